@@ -0,0 +1,126 @@
+package gocapnweb
+
+import (
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxCloseReasonBytes is the longest close reason RFC 6455 permits: a
+// control frame payload is limited to 125 bytes, two of which hold the code.
+const maxCloseReasonBytes = 123
+
+// AbortInfo describes an abort received from the client, translated into
+// the WebSocket close frame that should end the connection.
+type AbortInfo struct {
+	// CloseCode is the WebSocket close status to send.
+	CloseCode int
+	// Reason is the close reason, at most 123 bytes of UTF-8.
+	Reason string
+	// Err is the error the session's pending operations are rejected
+	// with: the client's ["error", type, message] if it sent one,
+	// otherwise an RpcError with code "Aborted".
+	Err RpcError
+}
+
+// newAbortInfo interprets the payload of an abort message. An object of the
+// form {"code": N, "reason": "..."} selects the close code, provided N is a
+// code an endpoint may send; otherwise 1011 (Internal Error) is used.
+func newAbortInfo(errorData interface{}) AbortInfo {
+	info := AbortInfo{CloseCode: websocket.CloseInternalServerErr}
+
+	switch v := errorData.(type) {
+	case string:
+		info.Reason = v
+	case map[string]interface{}:
+		if code, ok := v["code"].(float64); ok && isSendableCloseCode(int(code)) {
+			info.CloseCode = int(code)
+		}
+		if reason, ok := v["reason"].(string); ok {
+			info.Reason = reason
+		} else if message, ok := v["message"].(string); ok {
+			info.Reason = message
+		}
+	case []interface{}:
+		// ["error", type, message]
+		if len(v) >= 3 && v[0] == "error" {
+			if message, ok := v[2].(string); ok {
+				info.Reason = message
+			}
+		}
+	}
+
+	info.Err = RpcError{Code: "Aborted", Message: info.Reason}
+	if errArray, ok := errorData.([]interface{}); ok && len(errArray) >= 2 && errArray[0] == "error" {
+		if rpcErr, ok := (Evaluator{}).EvaluateError(errArray).(RpcError); ok && rpcErr.Code != "" {
+			info.Err = rpcErr
+		}
+	}
+
+	info.Reason = truncateUTF8(info.Reason, maxCloseReasonBytes)
+	return info
+}
+
+// CloseMessage returns the close frame payload for the abort.
+func (a AbortInfo) CloseMessage() []byte {
+	return websocket.FormatCloseMessage(a.CloseCode, a.Reason)
+}
+
+// isSendableCloseCode reports whether code may appear in a close frame.
+// 1005, 1006 and 1015 are reserved for reporting and 1004 is unassigned.
+func isSendableCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// abortSession ends a session the client aborted. Calls in progress are
+// cancelled, calls to the client, awaits of its promises and later pulls
+// are rejected with the abort's error, every export is released, and the
+// OnError and OnClose hooks are run. Transports close the connection once
+// the abort has been handled.
+func (s *RpcSession) abortSession(sessionData *SessionData, info AbortInfo) {
+	sessionData.setAbort(info)
+	sessionData.cancelCalls(info.Err)
+	sessionData.abandonCallbacks(info.Err)
+	sessionData.abandonPromises(info.Err)
+
+	sessionData.mu.Lock()
+	sessionData.PendingOperations = make(map[int]Operation)
+	sessionData.Subscriptions = make(map[int]<-chan interface{})
+	sessionData.indexCalls()
+	sessionData.mu.Unlock()
+	sessionData.resetResults()
+
+	s.reportError(sessionData, info.Err)
+	s.endSession(sessionData)
+}
+
+// setAbort records that the client aborted the session.
+func (sd *SessionData) setAbort(info AbortInfo) {
+	sd.abort.Store(&info)
+}
+
+// Abort returns the abort received from the client, or nil if the session
+// has not been aborted. It takes no lock.
+func (sd *SessionData) Abort() *AbortInfo {
+	return sd.abort.Load()
+}
@@ -0,0 +1,103 @@
+package gocapnweb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNewAbortInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		code    int
+		reason  string
+		errCode string
+	}{
+		{"reason", `{"reason":"test"}`, websocket.CloseInternalServerErr, "test", "Aborted"},
+		{"code and reason", `{"code":4000,"reason":"done"}`, 4000, "done", "Aborted"},
+		{"normal closure", `{"code":1000,"reason":"bye"}`, websocket.CloseNormalClosure, "bye", "Aborted"},
+		{"message", `{"code":1008,"message":"policy"}`, websocket.ClosePolicyViolation, "policy", "Aborted"},
+		{"reserved code", `{"code":1006,"reason":"x"}`, websocket.CloseInternalServerErr, "x", "Aborted"},
+		{"unassigned code", `{"code":1004}`, websocket.CloseInternalServerErr, "", "Aborted"},
+		{"code out of range", `{"code":5000}`, websocket.CloseInternalServerErr, "", "Aborted"},
+		{"string", `"gave up"`, websocket.CloseInternalServerErr, "gave up", "Aborted"},
+		{"error expression", `["error","RangeError","out of range"]`, websocket.CloseInternalServerErr, "out of range", "RangeError"},
+		{"other", `42`, websocket.CloseInternalServerErr, "", "Aborted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := decodeJSON([]byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := newAbortInfo(payload)
+			if info.CloseCode != tt.code || info.Reason != tt.reason || info.Err.Code != tt.errCode {
+				t.Errorf("newAbortInfo(%s) = %d %q %s; want %d %q %s", tt.payload, info.CloseCode, info.Reason, info.Err.Code, tt.code, tt.reason, tt.errCode)
+			}
+		})
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{"short", "abort", "abort"},
+		{"exact", strings.Repeat("a", 123), strings.Repeat("a", 123)},
+		{"ascii", strings.Repeat("a", 200), strings.Repeat("a", 123)},
+		// 41 three-byte runes fill 123 bytes exactly
+		{"runes at the limit", strings.Repeat("€", 50), strings.Repeat("€", 41)},
+		// 122 bytes of ASCII and a rune that would end at byte 124
+		{"rune across the limit", strings.Repeat("a", 122) + "€", strings.Repeat("a", 122)},
+		{"four-byte rune", strings.Repeat("a", 121) + "😀", strings.Repeat("a", 121)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateUTF8(tt.s, maxCloseReasonBytes)
+			if got != tt.want || !utf8.ValidString(got) || len(got) > maxCloseReasonBytes {
+				t.Errorf("truncateUTF8 = %q (%d bytes), want %q", got, len(got), tt.want)
+			}
+		})
+	}
+
+	info := newAbortInfo(map[string]interface{}{"reason": strings.Repeat("é", 100)})
+	if len(info.CloseMessage()) > 125 {
+		t.Errorf("close frame payload is %d bytes, over the 125 allowed", len(info.CloseMessage()))
+	}
+}
+
+func TestAbortClosesConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		code    int
+		reason  string
+	}{
+		{"reason", `["abort",{"reason":"test"}]`, websocket.CloseInternalServerErr, "test"},
+		{"mapped code", `["abort",{"code":4001,"reason":"shutting down"}]`, 4001, "shutting down"},
+		{"long reason", `["abort",{"reason":"` + strings.Repeat("ü", 80) + `"}]`, websocket.CloseInternalServerErr, strings.Repeat("ü", 61)},
+	}
+	server := endpointServer(t, testTarget())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialEndpoint(t, server, nil)
+			sendMessages(t, conn, tt.message)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var err error
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tt.code || closeErr.Text != tt.reason {
+				t.Errorf("connection ended with %v, want close %d %q", err, tt.code, tt.reason)
+			}
+		})
+	}
+}
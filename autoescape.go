@@ -0,0 +1,262 @@
+package gocapnweb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Go types with an escape of their own, time.Time, *big.Int and []byte, are
+// sent as that escape wherever they appear in a result, including struct
+// fields, which encoding/json would encode differently, and so are the
+// escape types themselves. Escapes are only ever sent for values of these
+// types: an array a result holds, such as []string{"undefined"}, is sent as
+// the array however it reads. Typed argument helpers, such as TypedMethod,
+// bind those escapes back into the Go types.
+
+// escapeTypeInfo describes what a Go type may hold, for deciding whether
+// its values need converting.
+type escapeTypeInfo struct {
+	// escapes is set if the type holds a type with an escape of its own,
+	// such as a time.Time or []byte field, or an escape type such as Date.
+	escapes bool
+	// interfaces is set if the type holds interface values, which may
+	// hold any type.
+	interfaces bool
+	// marshalers is set if the type holds a type that implements
+	// CapnWebMarshaler.
+	marshalers bool
+	// unmarshalers is set if the type holds a type that implements
+	// CapnWebUnmarshaler.
+	unmarshalers bool
+	// floats is set if the type holds floats, which may be NaN or infinite.
+	floats bool
+}
+
+var escapeTypeInfos sync.Map // reflect.Type -> escapeTypeInfo
+
+// typeEscapeInfo returns what values of type t may hold.
+func typeEscapeInfo(t reflect.Type) escapeTypeInfo {
+	if info, ok := escapeTypeInfos.Load(t); ok {
+		return info.(escapeTypeInfo)
+	}
+	var info escapeTypeInfo
+	inspectEscapeType(t, &info, make(map[reflect.Type]bool))
+	escapeTypeInfos.Store(t, info)
+	return info
+}
+
+// inspectEscapeType records what the values of t may hold in info.
+func inspectEscapeType(t reflect.Type, info *escapeTypeInfo, visiting map[reflect.Type]bool) {
+	if t.Implements(capnWebMarshalerType) || reflect.PointerTo(t).Implements(capnWebMarshalerType) {
+		info.marshalers = true
+	}
+	if reflect.PointerTo(t).Implements(capnWebUnmarshalerType) {
+		info.unmarshalers = true
+	}
+	if t == timeType || t == bigIntType || isByteSlice(t) || isEscapeType(t) {
+		info.escapes = true
+		return
+	}
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		info.floats = true
+	case reflect.Interface:
+		info.interfaces = true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		inspectEscapeType(t.Elem(), info, visiting)
+	case reflect.Struct:
+		if t.Implements(jsonMarshalerType) {
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i); field.IsExported() || field.Anonymous {
+				inspectEscapeType(field.Type, info, visiting)
+			}
+		}
+	}
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	bigIntType        = reflect.TypeOf((*big.Int)(nil))
+)
+
+// isEscapeType reports whether t is one of the escape types, which are kept
+// in normalized values as they are.
+func isEscapeType(t reflect.Type) bool {
+	switch t {
+	case reflect.TypeOf(Date{}), reflect.TypeOf(BigInt{}), reflect.TypeOf(Undefined{}), reflect.TypeOf(Bytes(nil)), reflect.TypeOf(Float(0)):
+		return true
+	}
+	return false
+}
+
+// isByteSlice reports whether t is a byte slice that encoding/json would
+// encode as a base64 string, rather than one such as json.RawMessage that
+// encodes itself.
+func isByteSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 && !t.Implements(jsonMarshalerType)
+}
+
+// escapeGoType is the leafEscape of Go types with an escape of their own
+// and of the escape types. A nil byte slice or *big.Int is sent as null, as
+// encoding/json sends it.
+func escapeGoType(value reflect.Value) (interface{}, bool, error) {
+	switch {
+	case isEscapeType(value.Type()) && value.CanInterface():
+		return value.Interface(), true, nil
+	case value.Type() == timeType && value.CanInterface():
+		return Date{value.Interface().(time.Time)}, true, nil
+	case value.Type() == bigIntType && value.CanInterface():
+		if value.IsNil() {
+			return nil, true, nil
+		}
+		return BigInt{value.Interface().(*big.Int)}, true, nil
+	case isByteSlice(value.Type()):
+		if value.IsNil() {
+			return nil, true, nil
+		}
+		return Bytes(value.Bytes()), true, nil
+	}
+	return nil, false, nil
+}
+
+// bindEscapedArg rewrites the escapes in an encoded argument that would be
+// decoded into a Go type with an escape of its own, so that encoding/json
+// decodes them into target: ["date", ms] for a time.Time becomes the RFC
+// 3339 time it stands for, and ["bytes", "base64"] for a []byte the base64
+// string. Other arguments are returned as they are.
+func bindEscapedArg(arg json.RawMessage, target reflect.Type) json.RawMessage {
+	if !typeEscapeInfo(target).escapes {
+		return arg
+	}
+	value, err := decodeJSON(arg)
+	if err != nil {
+		return arg
+	}
+	bound, err := json.Marshal(bindEscapes(value, target))
+	if err != nil {
+		return arg
+	}
+	return bound
+}
+
+// bindEscapes rewrites the escapes in a decoded value that target holds as
+// Go types with escapes of their own; see bindEscapedArg. value is
+// modified in place.
+func bindEscapes(value interface{}, target reflect.Type) interface{} {
+	if isEscapeType(target) {
+		return value
+	}
+	for target.Kind() == reflect.Pointer {
+		target = target.Elem()
+	}
+	if target == timeType || isByteSlice(target) {
+		if escape, ok := value.([]interface{}); ok {
+			switch revived, _ := reviveEscape(escape); v := revived.(type) {
+			case Date:
+				return v.Time.Format(time.RFC3339Nano)
+			case Bytes:
+				return base64.StdEncoding.EncodeToString(v)
+			}
+		}
+		return value
+	}
+
+	switch target.Kind() {
+	case reflect.Slice, reflect.Array:
+		if elems, ok := value.([]interface{}); ok {
+			for i, elem := range elems {
+				elems[i] = bindEscapes(elem, target.Elem())
+			}
+		}
+	case reflect.Map:
+		if fields, ok := value.(map[string]interface{}); ok {
+			for key, val := range fields {
+				fields[key] = bindEscapes(val, target.Elem())
+			}
+		}
+	case reflect.Struct:
+		if fields, ok := value.(map[string]interface{}); ok {
+			for key, val := range fields {
+				if fieldType, ok := jsonFieldType(target, key); ok {
+					fields[key] = bindEscapes(val, fieldType)
+				}
+			}
+		}
+	}
+	return value
+}
+
+// jsonFieldType returns the type of the field of struct type t that
+// encoding/json decodes the object key name into.
+func jsonFieldType(t reflect.Type, name string) (reflect.Type, bool) {
+	index, ok := jsonFieldIndex(t, name)
+	if !ok {
+		return nil, false
+	}
+	for _, i := range index[:len(index)-1] {
+		t = t.Field(i).Type
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+	}
+	return t.Field(index[len(index)-1]).Type, true
+}
+
+// jsonFieldIndex returns the index sequence of the field of struct type t
+// that encoding/json decodes the object key name into, preferring an exact
+// match of its name to a case-insensitive one as encoding/json does.
+func jsonFieldIndex(t reflect.Type, name string) ([]int, bool) {
+	var folded []int
+	var find func(t reflect.Type, index []int) []int
+	find = func(t reflect.Type, index []int) []int {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tagName, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if tagName == "-" && opts == "" {
+				continue
+			}
+			fieldIndex := append(index[:len(index):len(index)], i)
+			if field.Anonymous && tagName == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					if found := find(embedded, fieldIndex); found != nil {
+						return found
+					}
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if tagName == "" {
+				tagName = field.Name
+			}
+			if tagName == name {
+				return fieldIndex
+			}
+			if folded == nil && strings.EqualFold(tagName, name) {
+				folded = fieldIndex
+			}
+		}
+		return nil
+	}
+	if exact := find(t, nil); exact != nil {
+		return exact, true
+	}
+	return folded, folded != nil
+}
@@ -0,0 +1,95 @@
+//go:build integration
+
+package gocapnweb
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// letsEncryptStaging is the Let's Encrypt staging directory, whose
+// certificates are untrusted but which is not rate limited like production.
+const letsEncryptStaging = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// TestWithAutoTLS provisions a certificate from the Let's Encrypt staging
+// environment. It needs a host reachable from the internet on ports 80 and
+// 443, whose DNS name is given by CAPNWEB_ACME_DOMAIN:
+//
+//	CAPNWEB_ACME_DOMAIN=rpc.example.com go test -tags integration -run TestWithAutoTLS .
+func TestWithAutoTLS(t *testing.T) {
+	domain := os.Getenv("CAPNWEB_ACME_DOMAIN")
+	if domain == "" {
+		t.Skip("CAPNWEB_ACME_DOMAIN is not set")
+	}
+	cacheDir := t.TempDir()
+
+	e := SetupEchoServer(WithAutoTLS(domain, cacheDir))
+	e.AutoTLSManager.Client = &acme.Client{DirectoryURL: letsEncryptStaging}
+	target := NewBaseRpcTarget()
+	target.Method("ping", func(args json.RawMessage) (interface{}, error) {
+		return "pong", nil
+	})
+	SetupRpcEndpoint(e, "/api", target)
+	go func() {
+		if err := e.StartAutoTLS(":443"); err != nil && err != http.ErrServerClosed {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	t.Cleanup(func() { e.Close() })
+
+	// Staging certificates are not trusted, so the chain is not verified;
+	// the certificate is checked against domain below
+	client := &http.Client{
+		Timeout: 2 * time.Minute,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: domain, InsecureSkipVerify: true},
+		},
+	}
+	var resp *http.Response
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		var err error
+		resp, err = client.Post("https://"+domain+"/api", "text/plain",
+			strings.NewReader(`["push",["pipeline",0,["ping"],[]]]`+"\n"+`["pull",1]`))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no certificate was provisioned: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+	defer resp.Body.Close()
+
+	leaf := resp.TLS.PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("certificate does not cover %s: %v", domain, err)
+	}
+	if !strings.Contains(leaf.Issuer.String(), "STAGING") {
+		t.Errorf("certificate was not issued by the staging environment: %s", leaf.Issuer)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(body)); got != `["resolve",1,"pong"]` {
+		t.Errorf("batch response = %s", got)
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("no certificate was cached")
+	}
+}
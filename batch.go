@@ -0,0 +1,292 @@
+package gocapnweb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+)
+
+// ErrPullBeforePush rejects a pull, in an HTTP batch, of an export whose
+// push comes after the pull in the batch.
+var ErrPullBeforePush = RpcError{Code: "PullBeforePush"}
+
+// handleBatch handles the messages of an HTTP batch request and returns the
+// frames of its response. The messages are handled in two passes: first the
+// pushes, and a hello opening the session, in the order they were sent, so
+// every push is registered before any pull executes; then every other
+// message, in the order it was sent, so pulls execute in order and releases
+// take effect after the pulls that precede them. A pull of a push sent after
+// it is rejected with ErrPullBeforePush, and one that names an import no
+// push in the batch created fails with ExportNotFound. An abort stops the
+// batch.
+func (s *RpcSession) handleBatch(sessionData *SessionData, messages []string) []string {
+	var responses []string
+
+	// pushIDs holds the export ID of each push, by its index in messages
+	pushIDs := make(map[int]int)
+	for i, message := range messages {
+		if !isRegistration(message) {
+			continue
+		}
+		sessionData.mu.RLock()
+		nextExportID := sessionData.NextExportID
+		sessionData.mu.RUnlock()
+
+		frames, ok := s.handleBatchMessage(sessionData, message)
+		responses = append(responses, frames...)
+
+		sessionData.mu.RLock()
+		if sessionData.NextExportID > nextExportID {
+			pushIDs[i] = sessionData.NextExportID - 1
+		}
+		sessionData.mu.RUnlock()
+		if !ok {
+			return responses
+		}
+	}
+
+	// Each message sees the pushes sent after it as not yet pushed
+	laterPushes := make(map[int]bool, len(pushIDs))
+	for _, exportID := range pushIDs {
+		laterPushes[exportID] = true
+	}
+	defer sessionData.setLaterPushes(nil)
+	for i, message := range messages {
+		if exportID, ok := pushIDs[i]; ok {
+			delete(laterPushes, exportID)
+		}
+		if isRegistration(message) {
+			continue
+		}
+		sessionData.setLaterPushes(laterPushes)
+		frames, ok := s.handleBatchMessage(sessionData, message)
+		responses = append(responses, frames...)
+		if !ok {
+			return responses
+		}
+	}
+	return responses
+}
+
+// handleBatchMessage handles one message of an HTTP batch, returning its
+// frames and whether the batch should go on: an aborted session processes
+// no further messages.
+func (s *RpcSession) handleBatchMessage(sessionData *SessionData, message string) ([]string, bool) {
+	frames, err := s.HandleMessageFrames(sessionData, message)
+	if err != nil {
+		log.Printf("Error processing HTTP message: %v", err)
+		s.reportError(sessionData, err)
+		return nil, true
+	}
+	return frames, sessionData.Abort() == nil
+}
+
+// setLaterPushes records the exports whose pushes come after the batch
+// message being handled; nil clears them. Only handleBatch modifies the
+// map, between the messages it handles.
+func (sd *SessionData) setLaterPushes(exportIDs map[int]bool) {
+	if exportIDs == nil {
+		sd.laterPushes.Store(nil)
+		return
+	}
+	sd.laterPushes.Store(&exportIDs)
+}
+
+// pushedLater reports whether the push of exportID comes after the batch
+// message being handled. It takes no lock.
+func (sd *SessionData) pushedLater(exportID int) bool {
+	laterPushes := sd.laterPushes.Load()
+	return laterPushes != nil && (*laterPushes)[exportID]
+}
+
+// isRegistration reports whether message is a push or a hello, which an
+// HTTP batch handles before its other messages.
+func isRegistration(message string) bool {
+	messageType := peekMessageType([]byte(message))
+	return messageType == "push" || messageType == "hello"
+}
+
+// peekMessageType returns the type of message, reading no further into it
+// than its type, or "" if it does not start with one.
+func peekMessageType(message []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return ""
+	}
+	messageType, _ := decoder.Token()
+	kind, _ := messageType.(string)
+	return kind
+}
+
+// errBatchMessageTooLong is reported for a message of a JSON-array batch
+// body that is far beyond the session's MaxMessageBytes, which is not read
+// in full.
+var errBatchMessageTooLong = errors.New("batch message too long")
+
+// errInvalidBatch is reported for a JSON-array batch body that is not a
+// well-formed array.
+var errInvalidBatch = errors.New("invalid batch body")
+
+// batchReader reads the messages of an HTTP batch request body, one at a
+// time, in the manner of a bufio.Scanner. The body is either one message per
+// line or, if it opens with "[[" or "[]", a single JSON array of messages.
+type batchReader struct {
+	scanner *bufio.Scanner
+
+	decoder *json.Decoder
+	counter *countingReader
+	limit   int64
+	opened  bool
+
+	message string
+	err     error
+}
+
+// newBatchReader returns a batchReader for body. Messages may be up to
+// maxMessageBytes long, which a message must not exceed by much to be read;
+// zero or a negative value sets no limit.
+func newBatchReader(body io.Reader, maxMessageBytes int64) *batchReader {
+	buffered := bufio.NewReader(body)
+	if isArrayBatch(buffered) {
+		counter := &countingReader{r: buffered}
+		return &batchReader{decoder: json.NewDecoder(counter), counter: counter, limit: maxMessageBytes}
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	if maxMessageBytes > 0 {
+		// Allow lines up to the limit through so HandleMessage can reject
+		// them; anything longer fails the scan outright.
+		scanner.Buffer(nil, int(maxMessageBytes)+1)
+	}
+	return &batchReader{scanner: scanner}
+}
+
+// isArrayBatch reports whether a batch body is a JSON array of messages:
+// an array whose first element is itself an array, or an empty array.
+// Messages are arrays that open with a string, so a body of one message per
+// line never starts this way.
+func isArrayBatch(body *bufio.Reader) bool {
+	opened := false
+	for n := 1; ; n++ {
+		peeked, err := body.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch c := peeked[n-1]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '[' && !opened:
+			opened = true
+		default:
+			return opened && (c == '[' || c == ']')
+		}
+	}
+}
+
+// IsArray reports whether the body is a JSON array of messages, to be
+// answered with a JSON array.
+func (b *batchReader) IsArray() bool {
+	return b.decoder != nil
+}
+
+// Next reads the next message, which Message then returns. It returns false
+// at the end of the body or on an error, which Err then returns. Blank
+// lines of a line-delimited body are skipped.
+func (b *batchReader) Next() bool {
+	if b.err != nil {
+		return false
+	}
+	if b.scanner != nil {
+		for b.scanner.Scan() {
+			if line := strings.TrimSpace(b.scanner.Text()); line != "" {
+				b.message = line
+				return true
+			}
+		}
+		b.err = b.scanner.Err()
+		return false
+	}
+
+	if !b.opened {
+		b.opened = true
+		if _, err := b.decoder.Token(); err != nil {
+			b.err = b.decodeErr(err)
+			return false
+		}
+	}
+	if !b.decoder.More() {
+		// The closing bracket must end the body
+		if _, err := b.decoder.Token(); err != nil {
+			b.err = b.decodeErr(err)
+		} else if _, err := b.decoder.Token(); err != io.EOF {
+			b.err = errInvalidBatch
+		}
+		return false
+	}
+	b.counter.mark = b.decoder.InputOffset()
+	b.counter.max = b.readLimit()
+	var message json.RawMessage
+	if err := b.decoder.Decode(&message); err != nil {
+		b.err = b.decodeErr(err)
+		return false
+	}
+	b.message = string(message)
+	return true
+}
+
+// Message returns the message read by the last call to Next.
+func (b *batchReader) Message() string {
+	return b.message
+}
+
+// Err returns the error that stopped Next, if any: bufio.ErrTooLong or
+// errBatchMessageTooLong for a message far beyond the limit, errInvalidBatch
+// for a malformed JSON-array body, or an error reading the body.
+func (b *batchReader) Err() error {
+	return b.err
+}
+
+// readLimit returns how far past the start of a message of a JSON-array
+// body the decoder may read. It reads ahead of the message, so this is
+// well beyond the limit; messages that fit it but not the limit are left
+// for HandleMessage to reject.
+func (b *batchReader) readLimit() int64 {
+	if b.limit <= 0 {
+		return 0
+	}
+	return 2*b.limit + 64<<10
+}
+
+// decodeErr returns the error to report for an error from the decoder.
+func (b *batchReader) decodeErr(err error) error {
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, errBatchMessageTooLong):
+		return errBatchMessageTooLong
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errInvalidBatch
+	}
+	return err
+}
+
+// countingReader counts the bytes read through it and fails once more than
+// max have been read past mark. A max of zero sets no limit.
+type countingReader struct {
+	r    io.Reader
+	read int64
+	mark int64
+	max  int64
+}
+
+// Read implements io.Reader.
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.max > 0 && c.read-c.mark > c.max {
+		return 0, errBatchMessageTooLong
+	}
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,114 @@
+package gocapnweb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHandleBatchOrdering(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name: "pull after push",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["a"]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,"a"]`},
+		},
+		{
+			name: "pull before push",
+			messages: []string{
+				`["pull",1]`,
+				`["push",["pipeline",0,["echo"],["a"]]]`,
+			},
+			want: []string{`["reject",1,["error","PullBeforePush","pull of export 1 precedes its push"]]`},
+		},
+		{
+			name: "pull between pushes",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["a"]]]`,
+				`["pull",1,2]`,
+				`["push",["pipeline",0,["echo"],["b"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{
+				`["resolve",1,"a"]`,
+				`["reject",2,["error","PullBeforePush","pull of export 2 precedes its push"]]`,
+				`["resolve",2,"b"]`,
+			},
+		},
+		{
+			name: "pushes referring to earlier pushes",
+			messages: []string{
+				`["push",["pipeline",0,["user"],["u_1"]]]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",1,["id"]]]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",2,"u_1"]`},
+		},
+		{
+			name: "pullAll before push",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["a"]]]`,
+				`["pullAll"]`,
+				`["push",["pipeline",0,["echo"],["b"]]]`,
+				`["pullAll"]`,
+			},
+			want: []string{`["resolve",1,"a"]`, `["resolve",2,"b"]`},
+		},
+		{
+			name: "pull of no push",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["a"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["reject",2,["error","ExportNotFound","Export ID not found"]]`},
+		},
+		{
+			name: "release before pull",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["a"]]]`,
+				`["pull",1]`,
+				`["release",1,1]`,
+				`["pull",1]`,
+			},
+			want: []string{
+				`["resolve",1,"a"]`,
+				`["reject",1,["error","ExportNotFound","Export ID not found"]]`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			session := newTestSession(target)
+			got := session.handleBatch(NewSessionData(target), tt.messages)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleBatchClearsLaterPushes(t *testing.T) {
+	target := testTarget()
+	session := newTestSession(target)
+	sessionData := NewSessionData(target)
+	session.handleBatch(sessionData, []string{
+		`["pull",1]`,
+		`["push",["pipeline",0,["echo"],["a"]]]`,
+	})
+
+	// Once the batch is over, the push it registered can be pulled
+	frames, err := session.HandleMessageFrames(sessionData, `["pull",1]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`["resolve",1,"a"]`}; !reflect.DeepEqual(frames, want) {
+		t.Errorf("got %v, want %v", frames, want)
+	}
+}
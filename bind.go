@@ -0,0 +1,302 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// BindArgs decodes the positional arguments of a call into the values
+// targets point to, in order, for handlers registered with Method:
+//
+//	var handle string
+//	var limit int
+//	var tags []string
+//	// Binds getFeed("alice"), getFeed("alice", 20) and getFeed("alice", 20, "go", "rpc")
+//	err := gocapnweb.BindArgs(args, &handle, gocapnweb.Optional(&limit, 10), gocapnweb.Variadic(&tags))
+//	if err != nil {
+//		return nil, err
+//	}
+//
+// The arguments are decoded as TypedMethod decodes them: a single target
+// may also be bound from the bare argument rather than a one-element array,
+// and escapes bind to time.Time, []byte and CapnWebUnmarshaler targets.
+// Targets wrapped with Optional may follow the others, and one wrapped with
+// Variadic may come last. Arguments of the wrong number or types are
+// reported with an ArgumentError naming the argument and the type expected.
+// As with json.Unmarshal, a target that is not a non-nil pointer is an
+// error.
+func BindArgs(args json.RawMessage, targets ...interface{}) error {
+	values := make([]reflect.Value, len(targets))
+	decoder := typedArgDecoder{params: make([]reflect.Type, len(targets))}
+	for i, target := range targets {
+		var err error
+		switch target := target.(type) {
+		case optionalArg:
+			values[i], err = bindTarget("bind args", i, target.target)
+			decoder.defaults = append(decoder.defaults, target.def)
+		case variadicArg:
+			if i != len(targets)-1 {
+				return fmt.Errorf("bind args: variadic target %d must be the last", i+1)
+			}
+			values[i], err = bindTarget("bind args", i, target.target)
+			decoder.variadic = true
+		default:
+			if len(decoder.defaults) > 0 {
+				return fmt.Errorf("bind args: target %d follows an optional target", i+1)
+			}
+			values[i], err = bindTarget("bind args", i, target)
+		}
+		if err != nil {
+			return err
+		}
+		decoder.params[i] = values[i].Type()
+	}
+
+	in, err := decoder.decode(args)
+	if err != nil {
+		return err
+	}
+	setBound(values, in, decoder.variadic)
+	return nil
+}
+
+// Optional marks a BindArgs target as an optional argument: if the call
+// omits it, or passes undefined, target is set to def.
+func Optional[T any](target *T, def T) interface{} {
+	return optionalArg{target: target, def: reflect.ValueOf(&def).Elem()}
+}
+
+// Variadic marks the last BindArgs target as taking the rest of the call's
+// arguments, as a variadic parameter does; target is set to nil if there
+// are none.
+func Variadic[T any](target *[]T) interface{} {
+	return variadicArg{target: target}
+}
+
+type optionalArg struct {
+	target interface{}
+	def    reflect.Value
+}
+
+type variadicArg struct {
+	target interface{}
+}
+
+// setBound sets each of values to the argument decoded for it. If variadic,
+// the last of values is a slice set to the arguments remaining.
+func setBound(values, in []reflect.Value, variadic bool) {
+	fixed := len(values)
+	if variadic {
+		fixed--
+	}
+	for i := 0; i < fixed; i++ {
+		values[i].Set(in[i])
+	}
+	if variadic {
+		rest := reflect.Zero(values[fixed].Type())
+		for _, arg := range in[fixed:] {
+			rest = reflect.Append(rest, arg)
+		}
+		values[fixed].Set(rest)
+	}
+}
+
+// BindStruct decodes the arguments of a call into the struct target points
+// to. The arguments may be an object, sent bare or as the sole element of
+// the argument array, whose keys name the struct's fields as encoding/json
+// would decode them, or positional arguments bound to the struct's exported
+// fields in the order they are declared:
+//
+//	var req struct {
+//		Handle string   `json:"handle"`
+//		Limit  int      `json:"limit" capnweb:"default=10"`
+//		Tags   []string `json:"tags" capnweb:"variadic"`
+//	}
+//	// Binds getFeed("alice"), getFeed("alice", 20, "go", "rpc") and
+//	// getFeed({handle: "alice", limit: 20})
+//	if err := gocapnweb.BindStruct(args, &req); err != nil {
+//		return nil, err
+//	}
+//
+// Fields tagged capnweb:"optional" may be omitted, as may those given a
+// default with capnweb:"default=value", which must come last in the tag.
+// The default is decoded as a JSON argument whatever the field's type, so
+// string defaults are quoted, as in capnweb:"default=\"none\"". An
+// omitted field is set to its default, or else to its zero value; a
+// default that does not decode is an error. Optional
+// fields must follow the others, and the last field may be tagged
+// capnweb:"variadic" to take the rest of the positional arguments as a
+// slice. Positional arguments of the wrong number or types are reported
+// with an ArgumentError naming the field they were bound to. A target that
+// is not a non-nil pointer to a struct, or a struct whose tags are invalid,
+// is an error.
+func BindStruct(args json.RawMessage, target interface{}) error {
+	value, err := bindTarget("bind struct", 0, target)
+	if err != nil {
+		return err
+	}
+	if value.Kind() != reflect.Struct {
+		return fmt.Errorf("bind struct: target must point to a struct, got %T", target)
+	}
+	fields, err := positionalFields(value.Type())
+	if err != nil {
+		return err
+	}
+
+	decoder := typedArgDecoder{
+		params: make([]reflect.Type, len(fields)),
+		names:  make([]string, len(fields)),
+	}
+	values := make([]reflect.Value, len(fields))
+	defaults := make([]reflect.Value, len(fields))
+	for i, field := range fields {
+		decoder.params[i] = field.Type
+		decoder.names[i] = field.name
+		values[i] = value.FieldByIndex(field.Index)
+		if field.optional {
+			if defaults[i], err = field.defaultValue(); err != nil {
+				return err
+			}
+			decoder.defaults = append(decoder.defaults, defaults[i])
+		}
+		decoder.variadic = field.variadic
+	}
+
+	if object, ok := bindObject(args); ok {
+		// Keys the object omits keep the defaults of their fields
+		for i, def := range defaults {
+			if def.IsValid() {
+				values[i].Set(def)
+			}
+		}
+		if err := unmarshalArg(object, value.Addr().Interface()); err != nil {
+			return RpcError{Code: "ArgumentError", Message: fmt.Sprintf("invalid arguments: %v", err), Cause: err}
+		}
+		return nil
+	}
+
+	in, err := decoder.decode(args)
+	if err != nil {
+		return err
+	}
+	setBound(values, in, decoder.variadic)
+	return nil
+}
+
+// bindTarget returns the value a binder's target at index i points to.
+func bindTarget(op string, i int, target interface{}) (reflect.Value, error) {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+		return reflect.Value{}, fmt.Errorf("%s: target %d must be a non-nil pointer, got %T", op, i+1, target)
+	}
+	return ptr.Elem(), nil
+}
+
+// bindObject returns the object BindStruct decodes its arguments from, if
+// they are an object or an array holding only one.
+func bindObject(args json.RawMessage) (json.RawMessage, bool) {
+	trimmed := bytes.TrimSpace(args)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return trimmed, true
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(trimmed, &raw); err != nil || len(raw) != 1 {
+		return nil, false
+	}
+	if element := bytes.TrimSpace(raw[0]); len(element) > 0 && element[0] == '{' {
+		return element, true
+	}
+	return nil, false
+}
+
+// positionalField is a struct field that BindStruct binds a positional
+// argument to, with the name it has in messages and the options of its
+// capnweb tag.
+type positionalField struct {
+	reflect.StructField
+	name       string
+	optional   bool
+	variadic   bool
+	def        string
+	hasDefault bool
+}
+
+// positionalFields returns the fields of struct type t that positional
+// arguments bind to: its exported fields other than those encoding/json
+// ignores, in the order they are declared.
+func positionalFields(t reflect.Type) ([]positionalField, error) {
+	var fields []positionalField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tagName, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tagName == "-" && opts == "" {
+			continue
+		}
+		if tagName == "" {
+			tagName = field.Name
+		}
+		positional := positionalField{StructField: field, name: tagName}
+		if err := positional.parseTag(); err != nil {
+			return nil, fmt.Errorf("bind struct %s: %w", t, err)
+		}
+
+		if len(fields) > 0 {
+			last := fields[len(fields)-1]
+			if last.variadic {
+				return nil, fmt.Errorf("bind struct %s: variadic field %s must be the last", t, last.Name)
+			}
+			if last.optional && !positional.optional && !positional.variadic {
+				return nil, fmt.Errorf("bind struct %s: field %s follows an optional field", t, field.Name)
+			}
+		}
+		fields = append(fields, positional)
+	}
+	return fields, nil
+}
+
+// parseTag sets the options of f from its capnweb tag.
+func (f *positionalField) parseTag() error {
+	tag := f.Tag.Get("capnweb")
+	for tag != "" {
+		// A default takes the rest of the tag, which may hold commas
+		if def, ok := strings.CutPrefix(tag, "default="); ok {
+			f.optional, f.def, f.hasDefault = true, def, true
+			break
+		}
+		var opt string
+		opt, tag, _ = strings.Cut(tag, ",")
+		switch opt {
+		case "optional":
+			f.optional = true
+		case "variadic":
+			if f.Type.Kind() != reflect.Slice {
+				return fmt.Errorf("variadic field %s must be a slice, got %s", f.Name, f.Type)
+			}
+			f.variadic = true
+		default:
+			return fmt.Errorf("field %s has unknown capnweb tag option %q", f.Name, opt)
+		}
+	}
+	if f.optional && f.variadic {
+		return fmt.Errorf("field %s cannot be both optional and variadic", f.Name)
+	}
+	return nil
+}
+
+// defaultValue returns the value an omitted optional field takes.
+func (f positionalField) defaultValue() (reflect.Value, error) {
+	value := reflect.New(f.Type).Elem()
+	if !f.hasDefault {
+		return value, nil
+	}
+	if err := unmarshalArg(json.RawMessage(f.def), value.Addr().Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("bind struct: invalid default for field %s: %w", f.Name, err)
+	}
+	return value, nil
+}
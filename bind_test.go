@@ -0,0 +1,182 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBindArgs(t *testing.T) {
+	tests := []struct {
+		args   string
+		handle string
+		limit  int
+		tags   []string
+		err    string
+	}{
+		{args: `["alice"]`, handle: "alice", limit: 10},
+		{args: `["alice",20]`, handle: "alice", limit: 20},
+		{args: `["alice",["undefined"]]`, handle: "alice", limit: 10},
+		{args: `["alice",20,"go","rpc"]`, handle: "alice", limit: 20, tags: []string{"go", "rpc"}},
+		{args: `[]`, err: "ArgumentError: expected at least 1 argument, got 0"},
+		{args: `[1]`, err: "ArgumentError: argument 1: expected string: json: cannot unmarshal number into Go value of type string"},
+		{args: `["alice","x"]`, err: "ArgumentError: argument 2: expected int: json: cannot unmarshal string into Go value of type int"},
+		{args: `["alice",20,"go",2]`, err: "ArgumentError: argument 4: expected string: json: cannot unmarshal number into Go value of type string"},
+		{args: `"alice"`, err: "ArgumentError: expected an array of arguments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			var handle string
+			var limit int
+			var tags []string
+			err := BindArgs(json.RawMessage(tt.args), &handle, Optional(&limit, 10), Variadic(&tags))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err || !errors.Is(err, RpcError{Code: "ArgumentError"}) {
+					t.Errorf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handle != tt.handle || limit != tt.limit || fmt.Sprint(tags) != fmt.Sprint(tt.tags) || (tags == nil) != (tt.tags == nil) {
+				t.Errorf("bound %q, %d, %#v, want %q, %d, %#v", handle, limit, tags, tt.handle, tt.limit, tt.tags)
+			}
+		})
+	}
+}
+
+func TestBindArgsBareArgument(t *testing.T) {
+	var handle string
+	if err := BindArgs(json.RawMessage(`"alice"`), &handle); err != nil || handle != "alice" {
+		t.Errorf("bound %q, %v", handle, err)
+	}
+}
+
+func TestBindArgsInvalidTargets(t *testing.T) {
+	var handle string
+	var limit int
+	var tags []string
+	tests := []struct {
+		name    string
+		targets []interface{}
+		err     string
+	}{
+		{"not a pointer", []interface{}{handle}, "bind args: target 1 must be a non-nil pointer, got string"},
+		{"required after optional", []interface{}{Optional(&limit, 1), &handle}, "bind args: target 2 follows an optional target"},
+		{"variadic not last", []interface{}{Variadic(&tags), &handle}, "bind args: variadic target 1 must be the last"},
+	}
+	for _, tt := range tests {
+		if err := BindArgs(json.RawMessage(`[]`), tt.targets...); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+// feedRequest is the BindStruct target of the binder tests.
+type feedRequest struct {
+	Handle string   `json:"handle"`
+	Limit  int      `json:"limit" capnweb:"default=10"`
+	Cursor string   `json:"cursor" capnweb:"optional"`
+	Tags   []string `json:"tags" capnweb:"variadic"`
+}
+
+func TestBindStruct(t *testing.T) {
+	tests := []struct {
+		args string
+		want feedRequest
+		err  string
+	}{
+		{args: `["alice"]`, want: feedRequest{Handle: "alice", Limit: 10}},
+		{args: `["alice",20,"c1","go","rpc"]`, want: feedRequest{Handle: "alice", Limit: 20, Cursor: "c1", Tags: []string{"go", "rpc"}}},
+		{args: `{"handle":"bob"}`, want: feedRequest{Handle: "bob", Limit: 10}},
+		{args: `[{"handle":"bob","limit":5,"tags":["go"]}]`, want: feedRequest{Handle: "bob", Limit: 5, Tags: []string{"go"}}},
+		{args: `[]`, err: "ArgumentError: expected at least 1 argument (handle, limit, cursor, tags), got 0"},
+		{args: `["alice","x"]`, err: "ArgumentError: argument 2 (limit): expected int: json: cannot unmarshal string into Go value of type int"},
+		{args: `{"handle":1}`, err: "ArgumentError: invalid arguments: json: cannot unmarshal number into Go struct field feedRequest.handle of type string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			var req feedRequest
+			err := BindStruct(json.RawMessage(tt.args), &req)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err || !errors.Is(err, RpcError{Code: "ArgumentError"}) {
+					t.Errorf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%#v", req) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("bound %#v, want %#v", req, tt.want)
+			}
+		})
+	}
+}
+
+// Structs whose capnweb tags BindStruct refuses.
+type (
+	requiredAfterOptional struct {
+		A int `capnweb:"optional"`
+		B int
+	}
+	variadicNotSlice struct {
+		A int `capnweb:"variadic"`
+	}
+	unknownTagOption struct {
+		A int `capnweb:"required"`
+	}
+)
+
+func TestBindStructInvalidTargets(t *testing.T) {
+	tests := []struct {
+		name   string
+		target interface{}
+		err    string
+	}{
+		{"not a struct", new(string), "bind struct: target must point to a struct, got *string"},
+		{"required after optional", &requiredAfterOptional{}, "bind struct gocapnweb.requiredAfterOptional: field B follows an optional field"},
+		{"variadic not a slice", &variadicNotSlice{}, "bind struct gocapnweb.variadicNotSlice: variadic field A must be a slice, got int"},
+		{"unknown option", &unknownTagOption{}, `bind struct gocapnweb.unknownTagOption: field A has unknown capnweb tag option "required"`},
+	}
+	for _, tt := range tests {
+		if err := BindStruct(json.RawMessage(`[]`), tt.target); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestBindStructDefaults(t *testing.T) {
+	var valid struct {
+		Sort  string            `json:"sort" capnweb:"default=\"recent\""`
+		Limit int               `json:"limit" capnweb:"default=10"`
+		Tags  []string          `json:"tags" capnweb:"default=[\"go\",\"rpc\"]"`
+		Meta  map[string]string `json:"meta" capnweb:"default={\"a\":\"b,c\"}"`
+	}
+	if err := BindStruct(json.RawMessage(`[]`), &valid); err != nil {
+		t.Fatal(err)
+	}
+	if valid.Sort != "recent" || valid.Limit != 10 || fmt.Sprint(valid.Tags) != "[go rpc]" || valid.Meta["a"] != "b,c" {
+		t.Errorf("bound %+v", valid)
+	}
+
+	tests := []struct {
+		name   string
+		target interface{}
+		err    string
+	}{
+		{"unquoted string", &struct {
+			Sort string `capnweb:"default=recent"`
+		}{}, "bind struct: invalid default for field Sort: invalid character 'r' looking for beginning of value"},
+		{"string for an int", &struct {
+			Limit int `capnweb:"default=\"10\""`
+		}{}, "bind struct: invalid default for field Limit: json: cannot unmarshal string into Go value of type int"},
+	}
+	for _, tt := range tests {
+		if err := BindStruct(json.RawMessage(`[]`), tt.target); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrCallbackUnsupported is returned when calling a client stub of a session
+// that has no persistent connection, such as an HTTP batch request.
+var ErrCallbackUnsupported = errors.New("session does not support calls to the client")
+
+// ErrClientStubUnbound is returned when a client stub is called with a
+// context that does not belong to a call in the stub's session.
+var ErrClientStubUnbound = errors.New("client stub is not bound to a session")
+
+// ErrCallbackAbandoned is returned by calls to the client, and awaits of its
+// promises, that were still waiting for an answer when the session ended.
+var ErrCallbackAbandoned = errors.New("session ended before the client answered")
+
+// ClientStub is a function or object the client passed as an argument,
+// serialized as ["export", id]. Handlers decode it from their arguments like
+// any other value and call back into the client with Call.
+//
+// A stub decoded from arguments is bound to its session the first time it is
+// called with the context of a ContextHandler, and may be called again after
+// the handler returns, until the session ends.
+type ClientStub struct {
+	importID    int
+	session     *RpcSession
+	sessionData *SessionData
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *ClientStub) UnmarshalJSON(data []byte) error {
+	var ref []interface{}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return fmt.Errorf("client stub must be [\"export\", id]: %w", err)
+	}
+	if len(ref) != 2 || ref[0] != "export" {
+		return fmt.Errorf("client stub must be [\"export\", id]")
+	}
+	id, ok := ref[1].(float64)
+	if !ok {
+		return fmt.Errorf("client stub ID must be a number")
+	}
+	c.importID = int(id)
+	return nil
+}
+
+// ID returns the export ID the client assigned to the stub.
+func (c *ClientStub) ID() int {
+	return c.importID
+}
+
+// bind attaches the stub to the session of the call ctx belongs to.
+func (c *ClientStub) bind(ctx context.Context) error {
+	if c.sessionData != nil {
+		return nil
+	}
+	call, ok := ctx.Value(callSessionKey{}).(callSession)
+	if !ok {
+		return ErrClientStubUnbound
+	}
+	c.session = call.session
+	c.sessionData = call.sessionData
+	return nil
+}
+
+// Call calls method on the stub with args and waits for the client's answer.
+// A function passed by the client is called with an empty method name. A
+// rejection from the client is returned as an RpcError.
+func (c *ClientStub) Call(ctx context.Context, method string, args ...interface{}) (json.RawMessage, error) {
+	if err := c.bind(ctx); err != nil {
+		return nil, err
+	}
+	return c.session.callClient(ctx, c.sessionData, c.importID, method, args)
+}
+
+// Release tells the client the server no longer needs the stub. It should be
+// called once a handler that kept a stub is done with it; stubs that are not
+// released are freed by the client when the session ends. Releasing the
+// client's main interface does nothing.
+func (c *ClientStub) Release(ctx context.Context) error {
+	if err := c.bind(ctx); err != nil {
+		return err
+	}
+	return c.sessionData.releaseImport(c.importID)
+}
+
+// releaseImport drops the server's references to the client's export
+// importID and tells the client. Releasing the client's main interface, or
+// an import the server holds no reference to, does nothing.
+func (sd *SessionData) releaseImport(importID int) error {
+	if importID == MainExportID {
+		return nil
+	}
+	sd.mu.Lock()
+	refcount := sd.imports[importID]
+	delete(sd.imports, importID)
+	sd.mu.Unlock()
+	if refcount == 0 {
+		return nil
+	}
+	return sd.sendToClient([]interface{}{"release", importID, refcount})
+}
+
+// callSession identifies the session a call's context belongs to.
+type callSession struct {
+	session     *RpcSession
+	sessionData *SessionData
+}
+
+type callSessionKey struct{}
+
+// callbackResult is the client's answer to a call made by the server.
+type callbackResult struct {
+	value json.RawMessage
+	err   error
+}
+
+// callClient pushes a call on the client's export importID, pulls it and
+// waits for the client to resolve or reject it.
+func (s *RpcSession) callClient(ctx context.Context, sessionData *SessionData, importID int, method string, args []interface{}) (json.RawMessage, error) {
+	if !sessionData.canSendFrames() {
+		return nil, ErrCallbackUnsupported
+	}
+
+	encodedArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		normalizedArg, err := s.normalizeResult(sessionData, arg)
+		if err != nil {
+			return nil, err
+		}
+		encodedArgs[i] = wireValue(normalizedArg)
+	}
+	path := []interface{}{}
+	if method != "" {
+		path = append(path, method)
+	}
+
+	callID, answer := sessionData.startCallback()
+	defer sessionData.cancelCallback(callID)
+
+	push := []interface{}{"push", []interface{}{"pipeline", importID, path, encodedArgs}}
+	if err := sessionData.sendToClient(push); err != nil {
+		return nil, err
+	}
+	if err := sessionData.sendToClient([]interface{}{"pull", callID}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-answer:
+		// The server holds no further interest in the call's result
+		sessionData.sendToClient([]interface{}{"release", callID, 1})
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sendToClient encodes frame and delivers it through the session's frame
+// sender.
+func (sd *SessionData) sendToClient(frame []interface{}) error {
+	sd.outboxMu.Lock()
+	send := sd.sendFrame
+	sd.outboxMu.Unlock()
+	if send == nil {
+		return ErrCallbackUnsupported
+	}
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return send(encoded)
+}
+
+// startCallback allocates the import ID of a call to the client and returns
+// the channel its answer is delivered on.
+func (sd *SessionData) startCallback() (int, <-chan callbackResult) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.callbacks == nil {
+		sd.callbacks = make(map[int]chan callbackResult)
+	}
+	callID := sd.allocateCallbackID()
+	answer := make(chan callbackResult, 1)
+	sd.callbacks[callID] = answer
+	return callID, answer
+}
+
+// cancelCallback stops waiting for the answer to a call to the client.
+func (sd *SessionData) cancelCallback(callID int) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	delete(sd.callbacks, callID)
+}
+
+// settleCallback delivers the client's answer to a call made by the server.
+// It reports whether a call was waiting for it.
+func (sd *SessionData) settleCallback(callID int, result callbackResult) bool {
+	sd.mu.Lock()
+	answer, exists := sd.callbacks[callID]
+	delete(sd.callbacks, callID)
+	sd.mu.Unlock()
+	if !exists {
+		return false
+	}
+	answer <- result
+	return true
+}
+
+// abandonCallbacks fails the calls to the client still waiting for an
+// answer with err. It is called when the session ends.
+func (sd *SessionData) abandonCallbacks(err error) {
+	sd.mu.Lock()
+	callbacks := sd.callbacks
+	sd.callbacks = nil
+	sd.mu.Unlock()
+	for _, answer := range callbacks {
+		answer <- callbackResult{err: err}
+	}
+}
+
+// addImportRefs records a reference to each client export and promise in
+// value. It must be called with sd.mu held.
+func (sd *SessionData) addImportRefs(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 2 && (v[0] == "export" || v[0] == "promise") {
+			if id, ok := v[1].(float64); ok && int(id) != MainExportID {
+				if sd.imports == nil {
+					sd.imports = make(map[int]int)
+				}
+				sd.imports[int(id)]++
+				if v[0] == "promise" {
+					sd.promiseSettlement(int(id))
+				}
+				return
+			}
+		}
+		for _, elem := range v {
+			sd.addImportRefs(elem)
+		}
+	case map[string]interface{}:
+		for _, val := range v {
+			sd.addImportRefs(val)
+		}
+	}
+}
+
+// handleAnswer settles a call to the client, or a promise the client passed,
+// with a ["resolve", id, value] or ["reject", id, error] message. It reports
+// whether msg was such an answer to a call or promise that was waiting for
+// it.
+func (s *RpcSession) handleAnswer(sessionData *SessionData, msg []interface{}) bool {
+	if len(msg) < 3 {
+		return false
+	}
+	kind, _ := msg[0].(string)
+	callIDFloat, ok := msg[1].(float64)
+	if !ok {
+		return false
+	}
+
+	var result callbackResult
+	switch kind {
+	case "resolve":
+		value, err := Evaluator{Escapes: s.opts.Escapes}.Evaluate(msg[2])
+		if err == nil {
+			result.value, err = json.Marshal(value)
+		}
+		result.err = err
+	case "reject":
+		result.err = Evaluator{}.EvaluateError(msg[2])
+	default:
+		return false
+	}
+	if sessionData.settleCallback(int(callIDFloat), result) {
+		return true
+	}
+	return sessionData.settlePromise(int(callIDFloat), result)
+}
+
+// answerMessage reports whether message is a resolve or reject sent by the
+// client, and settles the call it answers. Connections whose messages are
+// handled one at a time route answers through it as they are read, so a
+// handler waiting on the client does not block the answer it waits for.
+func (s *RpcSession) answerMessage(sessionData *SessionData, message []byte) bool {
+	msg, err := decodeMessage(message)
+	if err != nil || len(msg) == 0 {
+		return false
+	}
+	if kind, _ := msg[0].(string); kind != "resolve" && kind != "reject" {
+		return false
+	}
+	s.handleAnswer(sessionData, msg)
+	return true
+}
@@ -0,0 +1,197 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ErrNotCapability rejects a call pushed on a value that is not a
+// capability, such as the data returned by an earlier call. It is a
+// TypeError, as calling a value that is not a function is in JavaScript.
+var ErrNotCapability = RpcError{Code: "TypeError"}
+
+// exportStub is a capability in a method's result: an RpcTarget the handler
+// returned, which the client calls through its export ID. It is sent as
+// ["export", id].
+type exportStub struct {
+	id int
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e exportStub) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{"export", e.id})
+}
+
+// exportCapabilities replaces the RpcTargets in a method's result, at the
+// top level or within maps and slices, with stubs for new exports. Maps and
+// slices are copied rather than modified when they contain a target.
+func (sd *SessionData) exportCapabilities(value interface{}) interface{} {
+	exported, _ := sd.exportCapabilitiesIn(value)
+	return exported
+}
+
+func (sd *SessionData) exportCapabilitiesIn(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case exportStub:
+		return v, false
+	case RpcTarget:
+		return sd.exportCapability(v), true
+	case map[string]interface{}:
+		var exported map[string]interface{}
+		for key, val := range v {
+			replaced, changed := sd.exportCapabilitiesIn(val)
+			if !changed {
+				continue
+			}
+			if exported == nil {
+				exported = make(map[string]interface{}, len(v))
+				for k, original := range v {
+					exported[k] = original
+				}
+			}
+			exported[key] = replaced
+		}
+		if exported == nil {
+			return v, false
+		}
+		return exported, true
+	case []interface{}:
+		var exported []interface{}
+		for i, elem := range v {
+			replaced, changed := sd.exportCapabilitiesIn(elem)
+			if !changed {
+				continue
+			}
+			if exported == nil {
+				exported = append([]interface{}(nil), v...)
+			}
+			exported[i] = replaced
+		}
+		if exported == nil {
+			return v, false
+		}
+		return exported, true
+	default:
+		return value, false
+	}
+}
+
+// exportCapability assigns target a new, negative export ID, referenced
+// once by the client it is sent to. A target that implements Disposer is
+// disposed of when the export is released.
+func (sd *SessionData) exportCapability(target RpcTarget) exportStub {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	exportID := sd.allocateCapabilityID()
+	entry := sd.exportEntry(exportID)
+	entry.refcount++
+	entry.target = target
+	if disposer, ok := target.(Disposer); ok {
+		entry.disposers = append(entry.disposers, disposer.Dispose)
+	}
+	return exportStub{id: exportID}
+}
+
+// addCapabilityRefs records another reference held by the client to each
+// capability within a normalized value that is being sent to it again.
+func (sd *SessionData) addCapabilityRefs(value interface{}) {
+	switch v := value.(type) {
+	case exportStub:
+		sd.mu.Lock()
+		if _, exists := sd.exports[v.id]; exists {
+			sd.addExportRef(v.id)
+		}
+		sd.mu.Unlock()
+	case map[string]interface{}:
+		for _, val := range v {
+			sd.addCapabilityRefs(val)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			sd.addCapabilityRefs(elem)
+		}
+	}
+}
+
+// capability returns the target exported as exportID, if any.
+func (sd *SessionData) capability(exportID int) (RpcTarget, bool) {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	entry, exists := sd.exports[exportID]
+	if !exists || entry.target == nil {
+		return nil, false
+	}
+	return entry.target, true
+}
+
+// importRef returns a pipeline reference to the earlier export a call was
+// pushed on, or nil if it was pushed on the main target.
+func (op Operation) importRef(exportID int) interface{} {
+	if op.ImportID <= MainExportID || op.ImportID >= exportID {
+		return nil
+	}
+	return []interface{}{"pipeline", float64(op.ImportID)}
+}
+
+// operationTarget returns the target and method of a pushed call. A call
+// pushed on a capability the client holds, or on an earlier call whose
+// result (at the call's path) is a capability, is made on that capability's
+// target. A call pushed on anything else, such as the data an earlier call
+// returned, fails with ErrNotCapability rather than reaching the session's
+// target.
+func (s *RpcSession) operationTarget(sessionData *SessionData, exportID int, operation Operation) (RpcTarget, string, error) {
+	if operation.ImportID == MainExportID {
+		return sessionData.Target, pathMethod(operation), nil
+	}
+	if len(operation.Path) == 0 {
+		return nil, "", notCapability(operation.ImportID, nil)
+	}
+	prefix := operation.Path[:len(operation.Path)-1]
+	method, ok := operation.Path[len(operation.Path)-1].(string)
+	if !ok {
+		return nil, "", notCapability(operation.ImportID, operation.Path)
+	}
+
+	if operation.ImportID < MainExportID {
+		target, exists := sessionData.capability(operation.ImportID)
+		if !exists {
+			return nil, "", RpcError{Code: "ExportNotFound", Message: fmt.Sprintf("capability %d does not exist or has been released", operation.ImportID)}
+		}
+		if len(prefix) > 0 {
+			return nil, "", fmt.Errorf("cannot read properties of capability %d", operation.ImportID)
+		}
+		return target, method, nil
+	}
+	if operation.importRef(exportID) == nil {
+		return nil, "", fmt.Errorf("call on import %d, which has not been pushed", operation.ImportID)
+	}
+
+	value, err := s.resolvePipelineReferences(sessionData, exportID, []interface{}{"pipeline", float64(operation.ImportID), prefix})
+	if err != nil {
+		return nil, "", err
+	}
+	stub, ok := value.(exportStub)
+	if !ok {
+		return nil, "", notCapability(operation.ImportID, prefix)
+	}
+	target, exists := sessionData.capability(stub.id)
+	if !exists {
+		return nil, "", RpcError{Code: "ExportNotFound", Message: fmt.Sprintf("capability %d has been released", stub.id)}
+	}
+	return target, method, nil
+}
+
+// notCapability returns the error a call fails with when the value at path
+// of import importID, which it is made on, is not a capability.
+func notCapability(importID int, path []interface{}) error {
+	if path == nil {
+		path = []interface{}{}
+	}
+	encodedPath, _ := json.Marshal(path)
+	return RpcError{
+		Code:    ErrNotCapability.Code,
+		Message: fmt.Sprintf("the value at path %s of import %d is not a capability", encodedPath, importID),
+		Details: map[string]interface{}{"importId": importID},
+	}
+}
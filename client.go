@@ -0,0 +1,641 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClientClosed is returned by calls, and awaits of promises, made on a
+// client that has been closed.
+var ErrClientClosed = errors.New("client is closed")
+
+// ClientTransport carries the messages of a client session to a server and
+// back. RpcClient calls Send from one goroutine at a time, in the order the
+// server must read the messages, and Receive from a single goroutine.
+type ClientTransport interface {
+	// Send delivers a message to the server.
+	Send(message []byte) error
+
+	// Receive waits for the next message from the server. It returns an
+	// error once the session can receive no more messages.
+	Receive() ([]byte, error)
+
+	// Close ends the session.
+	Close() error
+}
+
+// ReconnectingTransport is a ClientTransport that opens a new connection
+// when its connection is lost. Its Receive then returns a
+// SessionBrokenError, and its Send refuses messages with ErrConnectionLost
+// from the time the connection is lost until Resume is called, so that no
+// message meant for the lost session reaches the new one.
+type ReconnectingTransport interface {
+	ClientTransport
+
+	// Resume lets Send deliver messages on the new connection.
+	Resume()
+}
+
+// SessionBrokenError is returned by the Receive of a ReconnectingTransport
+// whose connection was lost, once a new connection is open. The client
+// starts a new session on it, and rejects the calls in flight in the lost
+// one with the error, which matches ErrConnectionLost.
+type SessionBrokenError struct {
+	// Err is why the connection was lost.
+	Err error
+}
+
+// Error implements error.
+func (e *SessionBrokenError) Error() string {
+	return fmt.Sprintf("session broken: %v", e.Err)
+}
+
+// Unwrap returns why the connection was lost.
+func (e *SessionBrokenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrConnectionLost.
+func (e *SessionBrokenError) Is(target error) bool {
+	return target == ErrConnectionLost
+}
+
+// ClientOptions configures an RpcClient.
+type ClientOptions struct {
+	// Header is sent with the request that opens the session, for example
+	// to authenticate it.
+	Header http.Header
+
+	// Dialer opens WebSocket connections. Defaults to
+	// websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// KeepAlive is how often the client pings the server over WebSocket.
+	// Defaults to DefaultClientKeepAlive; zero disables pings.
+	KeepAlive time.Duration
+
+	// Reconnect opens a new WebSocket connection when the connection is
+	// lost, carrying a new session.
+	Reconnect bool
+
+	// ReconnectDelay is how long the client waits before its first
+	// attempt to reconnect. It doubles after each failed attempt, up to
+	// MaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	// HTTPClient sends HTTP batch requests. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// BatchWindow is how long an HTTP batch collects messages, from the
+	// first, before it is sent. Defaults to DefaultBatchWindow.
+	BatchWindow time.Duration
+
+	// Broken is called, on a goroutine of its own, when the session is
+	// lost other than by Close: with the server's abort, or with the error
+	// that broke the connection. If the client reconnects, it is called
+	// once the new session has started, so that the application can
+	// re-create on it the promises and capabilities it held in the lost
+	// one, whose calls then fail with ErrConnectionLost. A client that
+	// sends HTTP batches calls it for each batch that fails or is
+	// aborted.
+	Broken func(err error)
+}
+
+// ClientOption configures an RpcClient.
+type ClientOption func(*ClientOptions)
+
+// WithClientHeader sets the headers sent with the request that opens the
+// session.
+func WithClientHeader(header http.Header) ClientOption {
+	return func(o *ClientOptions) {
+		o.Header = header
+	}
+}
+
+// WithClientDialer sets the dialer that opens WebSocket connections.
+func WithClientDialer(dialer *websocket.Dialer) ClientOption {
+	return func(o *ClientOptions) {
+		o.Dialer = dialer
+	}
+}
+
+// RpcClient is the client side of a Cap'n Web session: it calls methods on
+// the server's main interface, and on the results of earlier calls, through
+// stubs and promises. Calls are sent as soon as they are made and results
+// only fetched when awaited, so calls that depend on one another reach the
+// server together and are evaluated there without a round trip each, as
+// the TypeScript client pipelines them.
+type RpcClient struct {
+	transport ClientTransport
+	batch     *clientBatch
+	broken    func(err error)
+
+	// sendMu orders the messages sent to the server, which numbers pushes
+	// in the order it reads them
+	sendMu sync.Mutex
+
+	// ctx is the context of the calls the server makes on the client's
+	// exports, cancelled when the client's session ends
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu               sync.Mutex
+	generation       int
+	nextImportID     int
+	imports          map[int]*clientImport
+	lastExportID     int
+	exports          map[int]*clientExport
+	lastServerCallID int
+	serverCalls      map[int]*serverCall
+	err              error
+	done             chan struct{}
+}
+
+// clientImport is the result of a call the client pushed, which it
+// imports under the call's ID. done is closed once value or err is set.
+type clientImport struct {
+	pulled   bool
+	released bool
+	done     chan struct{}
+	value    interface{}
+	err      error
+}
+
+// Dial opens a session with the Cap'n Web server at rawURL and returns a
+// client for it. A ws:// or wss:// URL opens a WebSocket connection, which
+// is kept alive with pings and, with WithReconnect, replaced if it is lost.
+// An http:// or https:// URL sends calls in HTTP batch requests; see
+// NewBatchRpcClient.
+func Dial(ctx context.Context, rawURL string, opts ...ClientOption) (*RpcClient, error) {
+	options := ClientOptions{Dialer: websocket.DefaultDialer, KeepAlive: DefaultClientKeepAlive, HTTPClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		transport := &httpBatchTransport{url: rawURL, client: options.HTTPClient, header: options.Header}
+		return NewBatchRpcClient(transport, opts...), nil
+	case "ws", "wss":
+		transport, err := dialWebSocket(ctx, rawURL, options)
+		if err != nil {
+			return nil, err
+		}
+		return NewRpcClient(transport, opts...), nil
+	}
+	return nil, fmt.Errorf("unsupported server URL scheme %q", parsed.Scheme)
+}
+
+// NewRpcClient creates a client for the session transport carries and
+// starts reading the server's messages. Of opts, only Broken applies; the
+// others configure the transports Dial opens.
+func NewRpcClient(transport ClientTransport, opts ...ClientOption) *RpcClient {
+	var options ClientOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &RpcClient{
+		transport:    transport,
+		ctx:          ctx,
+		cancel:       cancel,
+		broken:       options.Broken,
+		nextImportID: 1,
+		imports:      make(map[int]*clientImport),
+		done:         make(chan struct{}),
+	}
+	go c.readMessages()
+	return c
+}
+
+// Main returns a stub for the server's main interface.
+func (c *RpcClient) Main() *RpcStub {
+	return &RpcStub{client: c, importID: MainExportID}
+}
+
+// Close ends the session. Promises that have not settled are rejected with
+// ErrClientClosed.
+func (c *RpcClient) Close() error {
+	c.fail(ErrClientClosed)
+	if c.batch != nil {
+		c.batch.close()
+		return nil
+	}
+	return c.transport.Close()
+}
+
+// Done returns a channel that is closed once the session has ended.
+func (c *RpcClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the session ended: ErrClientClosed after Close, the
+// server's abort as an RpcError, or the error that broke the transport. It
+// returns nil while the session is open.
+func (c *RpcClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// fail ends the session with err, rejecting the promises that have not
+// settled. Only the first error is kept; fail reports whether err was it.
+func (c *RpcClient) fail(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.err = err
+	for _, imp := range c.imports {
+		imp.settle(nil, err)
+	}
+	c.cancel()
+	close(c.done)
+	return true
+}
+
+// restart starts a new session on the new connection of a
+// ReconnectingTransport. The promises of the lost session are rejected
+// with broken, and the stubs and promises it handed out are of no further
+// use.
+func (c *RpcClient) restart(broken *SessionBrokenError) {
+	c.sendMu.Lock()
+	c.mu.Lock()
+	c.generation++
+	c.nextImportID = 1
+	for _, imp := range c.imports {
+		imp.settle(nil, broken)
+	}
+	c.imports = make(map[int]*clientImport)
+	c.lastExportID = 0
+	c.exports = nil
+	c.lastServerCallID = 0
+	c.serverCalls = nil
+	c.mu.Unlock()
+	if transport, ok := c.transport.(ReconnectingTransport); ok {
+		transport.Resume()
+	}
+	c.sendMu.Unlock()
+	c.notifyBroken(broken)
+}
+
+// notifyBroken calls the Broken function, if any, with err.
+func (c *RpcClient) notifyBroken(err error) {
+	if c.broken != nil {
+		go c.broken(err)
+	}
+}
+
+// staleStub returns the error for a use of a stub or promise of an earlier
+// session, which what describes.
+func (c *RpcClient) staleStub(what string) error {
+	if c.batch != nil {
+		return fmt.Errorf("%w: %s of an earlier batch", ErrBatchSent, what)
+	}
+	return fmt.Errorf("%w: %s of an earlier session", ErrConnectionLost, what)
+}
+
+// currentGeneration returns the number of sessions the client has
+// restarted.
+func (c *RpcClient) currentGeneration() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// send encodes frame and sends it to the server. It must be called with
+// c.sendMu held. A message that cannot be sent ends the session, since the
+// server's numbering of pushes can no longer be relied upon, unless the
+// connection was lost; the session is then restarted or ended once Receive
+// reports it.
+func (c *RpcClient) send(frame []interface{}) error {
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if c.batch != nil {
+		c.batch.add(encoded, c.flushBatch)
+		return nil
+	}
+	if err := c.transport.Send(encoded); err != nil {
+		if !errors.Is(err, ErrConnectionLost) {
+			c.fail(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// push sends a call of method on the object stub refers to with args and
+// returns a promise for its result.
+func (c *RpcClient) push(stub *RpcStub, method string, args []interface{}) *RpcPromise {
+	encodedArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		encoded, err := c.encodeValue(arg)
+		if err != nil {
+			return rejectedPromise(c, fmt.Errorf("failed to encode argument %d of %s: %w", i, method, err))
+		}
+		encodedArgs[i] = encoded
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return rejectedPromise(c, c.Err())
+	}
+	if stub.importID != MainExportID && stub.generation != c.generation {
+		c.mu.Unlock()
+		return rejectedPromise(c, c.staleStub(method+" called on a stub"))
+	}
+	callID := c.nextImportID
+	c.nextImportID++
+	generation := c.generation
+	imp := &clientImport{done: make(chan struct{})}
+	c.imports[callID] = imp
+	c.mu.Unlock()
+
+	path := append(append([]interface{}{}, stub.path...), method)
+	push := []interface{}{"push", []interface{}{"pipeline", stub.importID, path, encodedArgs}}
+	if err := c.send(push); err != nil {
+		// The server never read the push, so its ID is free again
+		c.mu.Lock()
+		if c.imports[callID] == imp {
+			delete(c.imports, callID)
+			c.nextImportID = callID
+		}
+		c.mu.Unlock()
+		return rejectedPromise(c, err)
+	}
+	return &RpcPromise{RpcStub: RpcStub{client: c, importID: callID, generation: generation}, imp: imp}
+}
+
+// pull asks the server for the result of the call callID of session
+// generation, unless it has been asked for already.
+func (c *RpcClient) pull(callID, generation int, imp *clientImport) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	if imp.pulled || imp.released || c.err != nil || generation != c.generation {
+		c.mu.Unlock()
+		return nil
+	}
+	imp.pulled = true
+	c.mu.Unlock()
+	if err := c.send([]interface{}{"pull", callID}); err != nil {
+		c.mu.Lock()
+		imp.pulled = false
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// release tells the server the client is done with the result of the call
+// callID of session generation.
+func (c *RpcClient) release(callID, generation int, imp *clientImport) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	if imp.released || c.err != nil || generation != c.generation {
+		c.mu.Unlock()
+		return nil
+	}
+	imp.released = true
+	delete(c.imports, callID)
+	imp.settle(nil, fmt.Errorf("import %d has been released", callID))
+	c.mu.Unlock()
+	return c.send([]interface{}{"release", callID, 1})
+}
+
+// readMessages handles the server's messages until the session ends.
+func (c *RpcClient) readMessages() {
+	for {
+		message, err := c.transport.Receive()
+		var broken *SessionBrokenError
+		if errors.As(err, &broken) {
+			c.restart(broken)
+			continue
+		}
+		if err != nil {
+			if c.fail(err) {
+				c.notifyBroken(err)
+			}
+			return
+		}
+		c.handleMessage(message)
+	}
+}
+
+// handleMessage handles a message from the server. Messages the client has
+// no use for, such as warnings, are ignored.
+func (c *RpcClient) handleMessage(message []byte) {
+	msg, err := decodeMessage(message)
+	if err != nil || len(msg) == 0 {
+		return
+	}
+	kind, _ := msg[0].(string)
+	switch kind {
+	case "resolve", "reject":
+		c.mu.Lock()
+		imports := c.imports
+		c.mu.Unlock()
+		c.settleAnswer(imports, msg)
+
+	case "abort":
+		var expr interface{}
+		if len(msg) >= 2 {
+			expr = msg[1]
+		}
+		abort := Evaluator{}.EvaluateError(expr)
+		if c.fail(abort) {
+			c.notifyBroken(abort)
+		}
+		c.transport.Close()
+
+	case "push":
+		c.handleServerPush(msg)
+
+	case "pull":
+		for _, operand := range msg[1:] {
+			if callID, ok := operand.(float64); ok {
+				c.handleServerPull(int(callID))
+			}
+		}
+
+	case "release":
+		if len(msg) >= 3 {
+			id, idOK := msg[1].(float64)
+			refcount, refcountOK := msg[2].(float64)
+			if idOK && refcountOK {
+				c.handleServerRelease(int(id), int(refcount))
+			}
+		}
+	}
+}
+
+// settleAnswer settles the call of imports that a ["resolve", id, value] or
+// ["reject", id, error] message answers. Answers to calls the client no
+// longer imports are ignored.
+func (c *RpcClient) settleAnswer(imports map[int]*clientImport, msg []interface{}) {
+	if len(msg) < 3 {
+		return
+	}
+	callID, ok := msg[1].(float64)
+	if !ok {
+		return
+	}
+	var value interface{}
+	var err error
+	if msg[0] == "reject" {
+		err = Evaluator{}.EvaluateError(msg[2])
+	} else {
+		value, err = Evaluator{}.Evaluate(msg[2])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if imp, exists := imports[int(callID)]; exists {
+		imp.settle(value, err)
+	}
+}
+
+// settle sets the result of the import, once. It must be called with the
+// client's mu held.
+func (imp *clientImport) settle(value interface{}, err error) {
+	select {
+	case <-imp.done:
+		return
+	default:
+	}
+	imp.value = value
+	imp.err = err
+	close(imp.done)
+}
+
+// RpcStub is a reference to an object on the server, on which methods are
+// called: the server's main interface, a capability the server returned,
+// or the eventual result of a call.
+type RpcStub struct {
+	client     *RpcClient
+	importID   int
+	path       []interface{}
+	generation int
+	err        error
+}
+
+// Call calls method on the object with args and returns a promise for its
+// result without waiting for it. Arguments are sent as results are, so they
+// may hold structs, escape types such as Date, and promises of earlier
+// calls, which the server resolves before making the call.
+func (s *RpcStub) Call(method string, args ...interface{}) *RpcPromise {
+	if s.err != nil {
+		return rejectedPromise(s.client, s.err)
+	}
+	return s.client.push(s, method, args)
+}
+
+// MarshalCapnWeb implements CapnWebMarshaler, so that a promise passed as
+// an argument is sent as a pipeline reference to its result.
+func (s RpcStub) MarshalCapnWeb() (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.importID <= MainExportID {
+		return nil, fmt.Errorf("only promises of calls can be passed as arguments")
+	}
+	if s.generation != s.client.currentGeneration() {
+		return nil, s.client.staleStub("promise passed as an argument")
+	}
+	if len(s.path) > 0 {
+		return wireExpression{"pipeline", s.importID, s.path}, nil
+	}
+	return wireExpression{"pipeline", s.importID}, nil
+}
+
+// RpcPromise is the eventual result of a call. It is also a stub for that
+// result: methods called on it are pipelined, sent to the server at once
+// and made there on the result when it is ready.
+type RpcPromise struct {
+	RpcStub
+	imp *clientImport
+}
+
+// rejectedPromise returns a promise rejected with err.
+func rejectedPromise(c *RpcClient, err error) *RpcPromise {
+	imp := &clientImport{done: make(chan struct{})}
+	imp.settle(nil, err)
+	return &RpcPromise{RpcStub: RpcStub{client: c, err: err}, imp: imp}
+}
+
+// Await fetches the result of the call and waits for it, returning it as
+// JSON in which capabilities are ["export", id]. A rejection is returned as
+// an RpcError, which errors.As finds with an RpcError or a *RpcError
+// target. Awaiting the promise again returns the same result without
+// asking the server again. See also the Await function.
+func (p *RpcPromise) Await(ctx context.Context) (json.RawMessage, error) {
+	value, err := p.await(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// await fetches the result of the call, waits for it and returns the value
+// at the promise's path within it.
+func (p *RpcPromise) await(ctx context.Context) (interface{}, error) {
+	if p.err == nil {
+		if err := p.client.pull(p.importID, p.generation, p.imp); err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case <-p.imp.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.imp.err != nil {
+		return nil, p.imp.err
+	}
+	return traverseResult(p.imp.value, p.path)
+}
+
+// Release tells the server the client is done with the result of the call,
+// which it may then discard. Calls pipelined on the promise, and on the
+// promises Get returns for parts of the same result, must have been made
+// before it is released. Results that are not released are discarded when
+// the session ends.
+func (p *RpcPromise) Release() error {
+	if p.err != nil {
+		return nil
+	}
+	return p.client.release(p.importID, p.generation, p.imp)
+}
+
+// wireExpression is an expression a client sends as it is, such as a
+// pipeline reference in its arguments.
+type wireExpression []interface{}
+
+// MarshalJSON implements json.Marshaler.
+func (w wireExpression) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}(w))
+}
@@ -0,0 +1,521 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestClient opens a client session with url, closed when the test
+// ends.
+func dialTestClient(t *testing.T, url string, opts ...ClientOption) *RpcClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := Dial(ctx, url, opts...)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// awaitAll awaits promises together, so that their calls may share an HTTP
+// batch, and returns their results as strings.
+func awaitAll(t *testing.T, promises ...*RpcPromise) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := make([]string, len(promises))
+	errs := make([]error, len(promises))
+	var wg sync.WaitGroup
+	for i, promise := range promises {
+		wg.Add(1)
+		go func(i int, promise *RpcPromise) {
+			defer wg.Done()
+			result, err := promise.Await(ctx)
+			results[i], errs[i] = string(result), err
+		}(i, promise)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("await %d: %v", i, err)
+		}
+	}
+	return results
+}
+
+// awaitJSON awaits promise and returns its result as a string.
+func awaitJSON(t *testing.T, promise *RpcPromise) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := promise.Await(ctx)
+	if err != nil {
+		t.Fatalf("await: %v", err)
+	}
+	return string(result)
+}
+
+func TestClientCall(t *testing.T) {
+	server := endpointServer(t, testTarget())
+	transports := map[string]string{
+		"websocket":  websocketURL(server, "/rpc"),
+		"http batch": server.URL + "/rpc",
+	}
+	for name, url := range transports {
+		t.Run(name, func(t *testing.T) {
+			client := dialTestClient(t, url)
+			main := client.Main()
+
+			if got, want := awaitJSON(t, main.Call("echo", "hi")), `"hi"`; got != want {
+				t.Errorf("echo = %s, want %s", got, want)
+			}
+
+			// A promise passed as an argument is resolved on the server
+			user := main.Call("user")
+			echoed := main.Call("echo", user.Get("tags"))
+			results := awaitAll(t, user, echoed)
+			if got, want := results[0], `{"id":"u_1","tags":["a","b"]}`; got != want {
+				t.Errorf("user = %s, want %s", got, want)
+			}
+			if got, want := results[1], `["a","b"]`; got != want {
+				t.Errorf("pipelined echo = %s, want %s", got, want)
+			}
+
+			// Awaiting again returns the same result
+			if got, want := awaitJSON(t, echoed), `["a","b"]`; got != want {
+				t.Errorf("second await = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestClientCallErrors(t *testing.T) {
+	server := endpointServer(t, testTarget())
+	transports := map[string]string{
+		"websocket":  websocketURL(server, "/rpc"),
+		"http batch": server.URL + "/rpc",
+	}
+	for name, url := range transports {
+		t.Run(name, func(t *testing.T) {
+			client := dialTestClient(t, url)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := client.Main().Call("missing").Await(ctx)
+			if !errors.Is(err, ErrMethodNotFound) {
+				t.Errorf("call of unknown method: %v, want MethodNotFound", err)
+			}
+
+			// The session goes on after a rejected call
+			if got, want := awaitJSON(t, client.Main().Call("echo", json.RawMessage(`{"a":1}`))), `{"a":1}`; got != want {
+				t.Errorf("echo = %s, want %s", got, want)
+			}
+
+			client.Close()
+			if _, err := client.Main().Call("echo", "x").Await(ctx); !errors.Is(err, ErrClientClosed) {
+				t.Errorf("call after Close: %v, want ErrClientClosed", err)
+			}
+		})
+	}
+}
+
+func TestClientBatchSent(t *testing.T) {
+	server := endpointServer(t, testTarget())
+	client := dialTestClient(t, server.URL+"/rpc")
+	main := client.Main()
+	unawaited := main.Call("user")
+	if got, want := awaitJSON(t, main.Call("echo", "hi")), `"hi"`; got != want {
+		t.Errorf("echo = %s, want %s", got, want)
+	}
+
+	// The batch of the user call has been sent without asking for its result
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := unawaited.Await(ctx); !errors.Is(err, ErrBatchSent) {
+		t.Errorf("await after the batch was sent: %v, want ErrBatchSent", err)
+	}
+	if got, want := awaitJSON(t, main.Call("echo", "again")), `"again"`; got != want {
+		t.Errorf("echo in the next batch = %s, want %s", got, want)
+	}
+}
+
+// countingTransport is an http.RoundTripper that counts the requests it
+// sends.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// directoryTarget returns a target whose directory method returns an
+// object holding a capability for each of names, with a name method.
+func directoryTarget(names ...string) *BaseRpcTarget {
+	target := testTarget()
+	target.Method("directory", func(json.RawMessage) (interface{}, error) {
+		directory := make(map[string]interface{})
+		for _, name := range names {
+			person := NewBaseRpcTarget()
+			person.Method("name", constantHandler(name))
+			directory[name] = person
+		}
+		return directory, nil
+	})
+	return target
+}
+
+func TestClientPipelining(t *testing.T) {
+	server := endpointServer(t, directoryTarget("alice", "bob"))
+
+	t.Run("http batch", func(t *testing.T) {
+		transport := &countingTransport{}
+		client := dialTestClient(t, server.URL+"/rpc", WithHTTPClient(&http.Client{Transport: transport}))
+
+		// The call on the capability in the unresolved result is sent in
+		// the same batch as the call that returns it
+		name := client.Main().Call("directory").Get("bob").Call("name")
+		if got, want := awaitJSON(t, name), `"bob"`; got != want {
+			t.Errorf("name = %s, want %s", got, want)
+		}
+		if got := transport.requests.Load(); got != 1 {
+			t.Errorf("sent %d requests, want 1", got)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		client := dialTestClient(t, websocketURL(server, "/rpc"))
+		directory := client.Main().Call("directory")
+		names := awaitAll(t, directory.Get("alice").Call("name"), directory.Get("bob").Call("name"))
+		if got, want := strings.Join(names, ","), `"alice","bob"`; got != want {
+			t.Errorf("names = %s, want %s", got, want)
+		}
+	})
+}
+
+func TestClientAwaitTyped(t *testing.T) {
+	type user struct {
+		ID   string   `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	server := endpointServer(t, directoryTarget("alice"))
+	client := dialTestClient(t, websocketURL(server, "/rpc"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got, err := Await[user](ctx, client.Main().Call("user"))
+	if err != nil {
+		t.Fatalf("Await: %v", err)
+	}
+	if got.ID != "u_1" || strings.Join(got.Tags, ",") != "a,b" {
+		t.Errorf("Await = %+v, want u_1 with tags a,b", got)
+	}
+
+	tags, err := Await[[]string](ctx, client.Main().Call("user").Get("tags"))
+	if err != nil || strings.Join(tags, ",") != "a,b" {
+		t.Errorf("Await of a path = %v, %v; want [a b]", tags, err)
+	}
+
+	// Capabilities in the result decode into stubs
+	directory, err := Await[map[string]*RpcStub](ctx, client.Main().Call("directory"))
+	if err != nil {
+		t.Fatalf("Await of capabilities: %v", err)
+	}
+	if name, err := Await[string](ctx, directory["alice"].Call("name")); err != nil || name != "alice" {
+		t.Errorf("name = %q, %v; want alice", name, err)
+	}
+
+	if _, err := Await[int](ctx, client.Main().Call("user")); err == nil {
+		t.Error("Await of an object into an int succeeded")
+	}
+}
+
+func TestClientAwaitRejected(t *testing.T) {
+	server := endpointServer(t, testTarget())
+	client := dialTestClient(t, websocketURL(server, "/rpc"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := Await[string](ctx, client.Main().Call("quota"))
+	var rpcErr *RpcError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Await error %v (%T) is not an *RpcError", err, err)
+	}
+	if rpcErr.Code != "QuotaExceeded" || rpcErr.Message != "slow down" || rpcErr.Details["limit"] != float64(10) {
+		t.Errorf("Await error = %+v, want QuotaExceeded: slow down with limit 10", rpcErr)
+	}
+
+	var value RpcError
+	if !errors.As(err, &value) || value.Code != "QuotaExceeded" {
+		t.Errorf("errors.As into an RpcError = %+v", value)
+	}
+	if !errors.Is(err, RpcError{Code: "QuotaExceeded"}) {
+		t.Errorf("errors.Is(%v, QuotaExceeded) = false", err)
+	}
+}
+
+// connRecorder is a WebSocket dialer that records the connections it opens.
+type connRecorder struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// dialer returns a dialer that records its connections in r.
+func (r *connRecorder) dialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				r.mu.Lock()
+				r.conns = append(r.conns, conn)
+				r.mu.Unlock()
+			}
+			return conn, err
+		},
+	}
+}
+
+// drop closes the last connection opened, without a close handshake.
+func (r *connRecorder) drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[len(r.conns)-1].Close()
+}
+
+// count returns the number of connections opened.
+func (r *connRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// hangingTarget returns a target whose hang method blocks until its call
+// is canceled, sending on started when it begins.
+func hangingTarget(started chan<- struct{}) *BaseRpcTarget {
+	target := testTarget()
+	target.MethodWithContext("hang", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	return target
+}
+
+func TestClientReconnect(t *testing.T) {
+	started := make(chan struct{}, 1)
+	server := endpointServer(t, hangingTarget(started))
+	recorder := &connRecorder{}
+	broken := make(chan error, 1)
+	client := dialTestClient(t, websocketURL(server, "/rpc"),
+		WithClientDialer(recorder.dialer()),
+		WithReconnect(10*time.Millisecond, 50*time.Millisecond),
+		WithBroken(func(err error) { broken <- err }),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pending := client.Main().Call("hang")
+	awaited := make(chan error, 1)
+	go func() {
+		_, err := pending.Await(ctx)
+		awaited <- err
+	}()
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("the hang call did not reach the server")
+	}
+	recorder.drop()
+
+	// The call in flight fails, and Broken is told, once the client has
+	// reconnected
+	select {
+	case err := <-awaited:
+		var brokenErr *SessionBrokenError
+		if !errors.Is(err, ErrConnectionLost) || !errors.As(err, &brokenErr) {
+			t.Errorf("pending call failed with %v, want a SessionBrokenError for ErrConnectionLost", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the pending call did not fail")
+	}
+	select {
+	case err := <-broken:
+		if !errors.Is(err, ErrConnectionLost) {
+			t.Errorf("Broken got %v, want ErrConnectionLost", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Broken was not called")
+	}
+	if got := recorder.count(); got != 2 {
+		t.Errorf("opened %d connections, want 2", got)
+	}
+
+	// New calls go over the new connection; promises of the lost session
+	// are of no further use
+	if got, want := awaitJSON(t, client.Main().Call("echo", "again")), `"again"`; got != want {
+		t.Errorf("echo after reconnecting = %s, want %s", got, want)
+	}
+	if _, err := pending.Call("anything").Await(ctx); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("call on a promise of the lost session: %v, want ErrConnectionLost", err)
+	}
+	if err := client.Err(); err != nil {
+		t.Errorf("Err = %v, want nil while the session is open", err)
+	}
+}
+
+func TestClientConnectionLost(t *testing.T) {
+	started := make(chan struct{}, 1)
+	server := endpointServer(t, hangingTarget(started))
+	recorder := &connRecorder{}
+	client := dialTestClient(t, websocketURL(server, "/rpc"), WithClientDialer(recorder.dialer()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pending := client.Main().Call("hang")
+	awaited := make(chan error, 1)
+	go func() {
+		_, err := pending.Await(ctx)
+		awaited <- err
+	}()
+	<-started
+	recorder.drop()
+
+	// Without reconnecting, the session ends
+	if err := <-awaited; !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("pending call failed with %v, want ErrConnectionLost", err)
+	}
+	select {
+	case <-client.Done():
+	case <-ctx.Done():
+		t.Fatal("the session did not end")
+	}
+	if err := client.Err(); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("Err = %v, want ErrConnectionLost", err)
+	}
+	if _, err := client.Main().Call("echo", "x").Await(ctx); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("call after the connection was lost: %v, want ErrConnectionLost", err)
+	}
+	if got := recorder.count(); got != 1 {
+		t.Errorf("opened %d connections, want 1", got)
+	}
+}
+
+// exportCount returns the number of callbacks the client has exported and
+// the server has not released.
+func (c *RpcClient) exportCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.exports)
+}
+
+// callbackServerTarget returns a target whose notify method calls the
+// callback in its first argument with the rest, releases it and returns
+// its answer, and whose greet method calls the greet method of the object
+// in its first argument, keeping it.
+func callbackServerTarget() *BaseRpcTarget {
+	target := testTarget()
+	target.MethodWithContext("notify", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var argArray []json.RawMessage
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, fmt.Errorf("notify expects a callback")
+		}
+		var callback ClientStub
+		if err := json.Unmarshal(argArray[0], &callback); err != nil {
+			return nil, err
+		}
+		rest := make([]interface{}, len(argArray)-1)
+		for i, arg := range argArray[1:] {
+			rest[i] = arg
+		}
+		answer, err := callback.Call(ctx, "", rest...)
+		if err != nil {
+			return nil, err
+		}
+		if err := callback.Release(ctx); err != nil {
+			return nil, err
+		}
+		return answer, nil
+	})
+	target.MethodWithContext("greet", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var greeters []*ClientStub
+		if err := json.Unmarshal(args, &greeters); err != nil || len(greeters) != 1 {
+			return nil, fmt.Errorf("greet expects a greeter")
+		}
+		return greeters[0].Call(ctx, "greet", "server")
+	})
+	return target
+}
+
+func TestClientCallbacks(t *testing.T) {
+	server := endpointServer(t, callbackServerTarget())
+	client := dialTestClient(t, websocketURL(server, "/rpc"))
+
+	var received []string
+	callback := func(args json.RawMessage) (interface{}, error) {
+		received = append(received, string(args))
+		return "pong", nil
+	}
+	if got, want := awaitJSON(t, client.Main().Call("notify", callback, "ping", 2)), `"pong"`; got != want {
+		t.Errorf("notify = %s, want %s", got, want)
+	}
+	if got, want := strings.Join(received, ","), `["ping",2]`; got != want {
+		t.Errorf("callback got %s, want %s", got, want)
+	}
+
+	// The server released the callback after calling it
+	if got := client.exportCount(); got != 0 {
+		t.Errorf("client holds %d exports after the server released its callback, want 0", got)
+	}
+
+	// An RpcTarget is called by method, and kept until the session ends
+	greeter := NewBaseRpcTarget()
+	greeter.Method("greet", func(args json.RawMessage) (interface{}, error) {
+		var names []string
+		if err := json.Unmarshal(args, &names); err != nil || len(names) != 1 {
+			return nil, fmt.Errorf("greet expects a name")
+		}
+		return "hello, " + names[0], nil
+	})
+	if got, want := awaitJSON(t, client.Main().Call("greet", greeter)), `"hello, server"`; got != want {
+		t.Errorf("greet = %s, want %s", got, want)
+	}
+	if got := client.exportCount(); got != 1 {
+		t.Errorf("client holds %d exports, want the greeter", got)
+	}
+
+	// A callback's rejection reaches the server's handler
+	failing := func(json.RawMessage) (interface{}, error) {
+		return nil, RpcError{Code: "Unavailable", Message: "not now"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Main().Call("notify", failing).Await(ctx); !errors.Is(err, RpcError{Code: "Unavailable"}) {
+		t.Errorf("notify with a failing callback: %v, want Unavailable", err)
+	}
+}
+
+func TestClientCallbacksOverBatch(t *testing.T) {
+	server := endpointServer(t, callbackServerTarget())
+	client := dialTestClient(t, server.URL+"/rpc")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	callback := func(json.RawMessage) (interface{}, error) { return nil, nil }
+	if _, err := client.Main().Call("notify", callback).Await(ctx); !errors.Is(err, errCallbacksNeedConnection) {
+		t.Errorf("callback over HTTP batch: %v, want errCallbacksNeedConnection", err)
+	}
+}
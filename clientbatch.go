@@ -0,0 +1,209 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrBatchSent is returned by awaits of promises whose HTTP batch was sent
+// without asking for their result, and by calls made on them after it was
+// sent.
+var ErrBatchSent = errors.New("batch already sent")
+
+// DefaultBatchWindow is how long an HTTP batch collects messages before it
+// is sent.
+const DefaultBatchWindow = 5 * time.Millisecond
+
+// WithBatchWindow sets how long an HTTP batch collects messages, from the
+// first, before it is sent.
+func WithBatchWindow(window time.Duration) ClientOption {
+	return func(o *ClientOptions) {
+		o.BatchWindow = window
+	}
+}
+
+// WithHTTPClient sets the HTTP client that sends HTTP batch requests.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(o *ClientOptions) {
+		o.HTTPClient = client
+	}
+}
+
+// BatchTransport carries client sessions that each consist of a single
+// batch of messages and the server's responses to them, such as HTTP batch
+// requests.
+type BatchTransport interface {
+	// RoundTrip sends the messages of a batch, in order, and returns the
+	// server's responses.
+	RoundTrip(ctx context.Context, messages [][]byte) ([][]byte, error)
+}
+
+// NewBatchRpcClient creates a client that sends its calls in batches, as
+// the TypeScript client's HTTP batch sessions do. The messages a client
+// sends within its batch window, starting with the first, are sent together
+// once it has passed, and the results are delivered to their promises when
+// the server responds. Each batch is a session of its own: a promise can
+// only be awaited, and called on or passed as an argument, within the
+// window of the batch its call was sent in. Awaiting it later fails with
+// ErrBatchSent. A batch that fails, or that the server aborts, rejects its
+// promises and leaves the client open for the next. Of opts, BatchWindow
+// and Broken apply.
+func NewBatchRpcClient(transport BatchTransport, opts ...ClientOption) *RpcClient {
+	options := ClientOptions{BatchWindow: DefaultBatchWindow}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RpcClient{
+		batch:        &clientBatch{transport: transport, window: options.BatchWindow, ctx: ctx, cancel: cancel},
+		ctx:          ctx,
+		cancel:       cancel,
+		broken:       options.Broken,
+		nextImportID: 1,
+		imports:      make(map[int]*clientImport),
+		done:         make(chan struct{}),
+	}
+}
+
+// clientBatch collects the messages of a client's next batch.
+type clientBatch struct {
+	transport BatchTransport
+	window    time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu       sync.Mutex
+	messages [][]byte
+	timer    *time.Timer
+}
+
+// add adds message to the batch, starting a timer that calls flush when the
+// batch window of its first message has passed.
+func (b *clientBatch) add(message []byte, flush func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.messages) == 0 {
+		b.timer = time.AfterFunc(b.window, flush)
+	}
+	b.messages = append(b.messages, message)
+}
+
+// take returns the messages of the batch and starts the next.
+func (b *clientBatch) take() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
+
+// close drops the batch and cancels the batches being sent.
+func (b *clientBatch) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.messages = nil
+	b.cancel()
+}
+
+// flushBatch sends the client's batch and settles its promises with the
+// server's responses. Promises of the batch that were not pulled in it are
+// rejected with ErrBatchSent; if the batch could not be sent, or the server
+// aborted it, all of them are rejected with the error.
+func (c *RpcClient) flushBatch() {
+	c.sendMu.Lock()
+	messages := c.batch.take()
+	c.mu.Lock()
+	imports := c.imports
+	ended := c.err
+	c.generation++
+	c.nextImportID = 1
+	c.imports = make(map[int]*clientImport)
+	c.mu.Unlock()
+	c.sendMu.Unlock()
+	if len(messages) == 0 || ended != nil {
+		return
+	}
+
+	responses, err := c.batch.transport.RoundTrip(c.batch.ctx, messages)
+	if err != nil && c.batch.ctx.Err() == nil {
+		c.notifyBroken(err)
+	}
+	for _, response := range responses {
+		msg, decodeErr := decodeMessage(response)
+		if decodeErr != nil || len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case "resolve", "reject":
+			c.settleAnswer(imports, msg)
+		case "abort":
+			var expr interface{}
+			if len(msg) >= 2 {
+				expr = msg[1]
+			}
+			err = Evaluator{}.EvaluateError(expr)
+			c.notifyBroken(err)
+		}
+	}
+
+	if err == nil {
+		err = fmt.Errorf("%w: promise was not awaited before its batch was sent", ErrBatchSent)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, imp := range imports {
+		imp.settle(nil, err)
+	}
+}
+
+// httpBatchTransport is a BatchTransport that sends each batch as an HTTP
+// batch request, one message per line.
+type httpBatchTransport struct {
+	url    string
+	client *http.Client
+	header http.Header
+}
+
+// RoundTrip implements BatchTransport.
+func (t *httpBatchTransport) RoundTrip(ctx context.Context, messages [][]byte) ([][]byte, error) {
+	body := bytes.Join(messages, []byte("\n"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", ContentTypeText)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("batch request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(text))
+	}
+
+	// Responses are lines or, from servers configured to send them so, a
+	// JSON array
+	var responses [][]byte
+	reader := newBatchReader(resp.Body, 0)
+	for reader.Next() {
+		responses = append(responses, []byte(reader.Message()))
+	}
+	if err := reader.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read batch response: %w", err)
+	}
+	return responses, nil
+}
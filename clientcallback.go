@@ -0,0 +1,256 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// errCallbacksNeedConnection is returned for calls passing callbacks over a
+// transport on which the server cannot call the client back.
+var errCallbacksNeedConnection = errors.New("callbacks can only be passed over a WebSocket session")
+
+// clientExport is a function or RpcTarget the client passed as an argument,
+// which the server calls through its export ID. refcount counts the
+// references the server holds.
+type clientExport struct {
+	target   RpcTarget
+	refcount int
+}
+
+// serverCall is a call the server pushed on one of the client's exports,
+// which the client makes when the server pulls it.
+type serverCall struct {
+	exportID int
+	path     []interface{}
+	args     interface{}
+	err      error
+}
+
+// callbackTarget is the RpcTarget of a function passed as an argument,
+// which the server calls with an empty method name.
+type callbackTarget struct {
+	handler ContextHandler
+}
+
+// DispatchContext implements ContextRpcTarget.
+func (t callbackTarget) DispatchContext(ctx context.Context, method string, args json.RawMessage) (interface{}, error) {
+	if method != "" {
+		return nil, fmt.Errorf("method %s not found on callback", method)
+	}
+	return t.handler(ctx, args)
+}
+
+// Dispatch implements RpcTarget.
+func (t callbackTarget) Dispatch(method string, args json.RawMessage) (interface{}, error) {
+	return t.DispatchContext(context.Background(), method, args)
+}
+
+// exportCallbacks replaces the functions and RpcTargets in an argument, at
+// the top level or within maps and slices, with ["export", id] references
+// to new exports, so that the server can call them. Functions must be
+// func(json.RawMessage) (interface{}, error) or ContextHandlers. Maps and
+// slices are copied rather than modified when they contain a callback.
+func (c *RpcClient) exportCallbacks(value interface{}) (interface{}, error) {
+	var target RpcTarget
+	switch v := value.(type) {
+	case func(json.RawMessage) (interface{}, error):
+		target = callbackTarget{handler: withoutContext(v)}
+	case ContextHandler:
+		target = callbackTarget{handler: v}
+	case RpcTarget:
+		target = v
+	case map[string]interface{}:
+		exported := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			elem, err := c.exportCallbacks(val)
+			if err != nil {
+				return nil, err
+			}
+			exported[key] = elem
+		}
+		return exported, nil
+	case []interface{}:
+		exported := make([]interface{}, len(v))
+		for i, elem := range v {
+			var err error
+			if exported[i], err = c.exportCallbacks(elem); err != nil {
+				return nil, err
+			}
+		}
+		return exported, nil
+	default:
+		return value, nil
+	}
+
+	if c.batch != nil {
+		return nil, errCallbacksNeedConnection
+	}
+	return wireExpression{"export", c.export(target)}, nil
+}
+
+// export assigns target a new, negative export ID, referenced once by the
+// server it is sent to.
+func (c *RpcClient) export(target RpcTarget) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.exports == nil {
+		c.exports = make(map[int]*clientExport)
+	}
+	c.lastExportID--
+	c.exports[c.lastExportID] = &clientExport{target: target, refcount: 1}
+	return c.lastExportID
+}
+
+// encodeValue converts a value the client sends, an argument or the result
+// of a call the server made, to a wire expression, exporting the callbacks
+// within it.
+func (c *RpcClient) encodeValue(value interface{}) (interface{}, error) {
+	value, err := c.exportCallbacks(value)
+	if err != nil {
+		return nil, err
+	}
+	d := Devaluator{}
+	if c.batch == nil {
+		d.Export = func(value interface{}) interface{} {
+			exported, _ := c.exportCallbacks(value)
+			return exported
+		}
+	}
+	return d.Devaluate(value)
+}
+
+// handleServerPush records a call the server pushed, ["push", ["pipeline",
+// exportId, path, args]]. The server numbers its pushes 1, 2, ... in each
+// session, as the client does.
+func (c *RpcClient) handleServerPush(msg []interface{}) {
+	call := &serverCall{}
+	var expr []interface{}
+	if len(msg) >= 2 {
+		expr, _ = msg[1].([]interface{})
+	}
+	exportID, ok := 0.0, false
+	if len(expr) >= 2 && expr[0] == "pipeline" {
+		exportID, ok = expr[1].(float64)
+	}
+	if !ok {
+		call.err = fmt.Errorf("unsupported push from server")
+	}
+	call.exportID = int(exportID)
+	if len(expr) >= 3 {
+		call.path, _ = expr[2].([]interface{})
+	}
+	if len(expr) >= 4 {
+		call.args = expr[3]
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.serverCalls == nil {
+		c.serverCalls = make(map[int]*serverCall)
+	}
+	c.lastServerCallID++
+	c.serverCalls[c.lastServerCallID] = call
+}
+
+// handleServerPull makes the call the server pushed as callID, on a
+// goroutine of its own so that the callback may call the server in turn,
+// and answers it with its result.
+func (c *RpcClient) handleServerPull(callID int) {
+	c.mu.Lock()
+	call, exists := c.serverCalls[callID]
+	generation := c.generation
+	var export *clientExport
+	if exists {
+		export = c.exports[call.exportID]
+	}
+	c.mu.Unlock()
+
+	go func() {
+		var result interface{}
+		var err error
+		switch {
+		case !exists:
+			err = fmt.Errorf("server pulled call %d, which it did not push", callID)
+		case call.err != nil:
+			err = call.err
+		case export == nil:
+			err = RpcError{Code: "ExportNotFound", Message: fmt.Sprintf("client export %d not found", call.exportID)}
+		default:
+			result, err = c.callExport(export.target, call)
+		}
+		c.answerServerCall(callID, generation, result, err)
+	}()
+}
+
+// callExport makes a call the server pushed on one of the client's
+// exports.
+func (c *RpcClient) callExport(target RpcTarget, call *serverCall) (interface{}, error) {
+	method := ""
+	switch len(call.path) {
+	case 0:
+	case 1:
+		name, ok := call.path[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid method name %v", call.path[0])
+		}
+		method = name
+	default:
+		return nil, fmt.Errorf("cannot read properties of client export %d", call.exportID)
+	}
+
+	args, err := Evaluator{}.EvaluateArguments(call.args)
+	if err != nil {
+		return nil, err
+	}
+	encodedArgs, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	if target, ok := target.(ContextRpcTarget); ok {
+		return target.DispatchContext(c.ctx, method, encodedArgs)
+	}
+	return target.Dispatch(method, encodedArgs)
+}
+
+// answerServerCall sends the result of a call the server made in session
+// generation, unless that session has been lost since.
+func (c *RpcClient) answerServerCall(callID, generation int, result interface{}, err error) {
+	var answer []interface{}
+	if err == nil {
+		var wire interface{}
+		if wire, err = c.encodeValue(result); err == nil {
+			answer = []interface{}{"resolve", callID, wire}
+		}
+	}
+	if err != nil {
+		answer = []interface{}{"reject", callID, Devaluator{}.DevaluateError(err, "Error")}
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.mu.Lock()
+	current := generation == c.generation && c.err == nil
+	c.mu.Unlock()
+	if current {
+		c.send(answer)
+	}
+}
+
+// handleServerRelease handles ["release", id, refcount]: the server no
+// longer needs a client export, or the result of a call it made.
+func (c *RpcClient) handleServerRelease(id, refcount int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id > 0 {
+		delete(c.serverCalls, id)
+		return
+	}
+	if export, exists := c.exports[id]; exists {
+		export.refcount -= refcount
+		if export.refcount <= 0 {
+			delete(c.exports, id)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Get returns a promise for the value at path within the promise's result,
+// whose elements are object keys, as strings, and array indices, as ints.
+// Like the promise itself, it can be called on and passed as an argument
+// without waiting for the result, and is sent to the server as a pipeline
+// reference into it; awaiting it fetches the whole result.
+func (p *RpcPromise) Get(path ...interface{}) *RpcPromise {
+	if p.err != nil {
+		return p
+	}
+	extended := append([]interface{}{}, p.path...)
+	for _, key := range path {
+		switch k := key.(type) {
+		case string:
+			extended = append(extended, k)
+		case int:
+			extended = append(extended, float64(k))
+		default:
+			return rejectedPromise(p.client, fmt.Errorf("invalid path key %v of type %T", key, key))
+		}
+	}
+	promise := *p
+	promise.path = extended
+	return &promise
+}
+
+// Await fetches the result of the call p stands for, waits for it and
+// decodes it into a T, as TypedMethod decodes arguments: escapes such as
+// ["date", ms] bind to time.Time and []byte as well as to their escape
+// types, types that implement CapnWebUnmarshaler decode themselves, and
+// capabilities bind to *RpcStub values, on which methods can be called. A
+// rejection is returned as RpcPromise.Await returns it.
+func Await[T any](ctx context.Context, p *RpcPromise) (T, error) {
+	var result T
+	value, err := p.await(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	// The result is decoded from its encoding, which leaves the value the
+	// promise holds as it is
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return result, err
+	}
+	decoded, err := decodeJSON(encoded)
+	if err != nil {
+		return result, err
+	}
+	decoded = p.client.importStubs(decoded, p.generation)
+	if err := unmarshalValue(decoded, reflect.ValueOf(&result).Elem()); err != nil {
+		return result, fmt.Errorf("failed to decode result into %T: %w", result, err)
+	}
+	return result, nil
+}
+
+// traverseResult returns the value at path within a result, as the server
+// traverses results for pipeline references.
+func traverseResult(value interface{}, path []interface{}) (interface{}, error) {
+	current := value
+	for _, key := range path {
+		switch k := key.(type) {
+		case string:
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot traverse string key on non-object")
+			}
+			current = obj[k]
+		case float64:
+			arr, ok := current.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot traverse numeric key on non-array")
+			}
+			idx := int(k)
+			if idx < 0 || idx >= len(arr) {
+				return nil, fmt.Errorf("array index out of bounds")
+			}
+			current = arr[idx]
+		}
+	}
+	return current, nil
+}
+
+// importStubs replaces the capabilities, ["export", id], in a decoded
+// result of session generation with stubs for them. value is modified in
+// place.
+func (c *RpcClient) importStubs(value interface{}, generation int) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 2 && v[0] == "export" {
+			if id, ok := v[1].(float64); ok {
+				return &RpcStub{client: c, importID: int(id), generation: generation}
+			}
+		}
+		for i, elem := range v {
+			v[i] = c.importStubs(elem, generation)
+		}
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = c.importStubs(val, generation)
+		}
+	}
+	return value
+}
+
+// UnmarshalCapnWeb implements CapnWebUnmarshaler, so that Await decodes the
+// capabilities in results into stubs.
+func (s *RpcStub) UnmarshalCapnWeb(value interface{}) error {
+	stub, ok := value.(*RpcStub)
+	if !ok {
+		return fmt.Errorf("cannot decode %s into a stub", jsonKind(value))
+	}
+	*s = *stub
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. A stub for a capability is encoded
+// as ["export", id], as the server sent it.
+func (s RpcStub) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{"export", s.importID})
+}
@@ -0,0 +1,239 @@
+package gocapnweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrConnectionLost is returned by calls, and awaits of promises, that were
+// in flight when the connection carrying their session was lost, and by
+// calls made while a new connection is being opened.
+var ErrConnectionLost = errors.New("connection lost")
+
+// Defaults of the client's WebSocket transport.
+const (
+	// DefaultClientKeepAlive is how often the client pings the server.
+	DefaultClientKeepAlive = 30 * time.Second
+
+	// DefaultReconnectDelay is how long the client waits before its first
+	// attempt to reconnect, doubling after each failed attempt.
+	DefaultReconnectDelay = 500 * time.Millisecond
+
+	// DefaultMaxReconnectDelay bounds the wait between attempts to
+	// reconnect.
+	DefaultMaxReconnectDelay = 30 * time.Second
+)
+
+// WithClientKeepAlive sets how often the client pings the server over
+// WebSocket. A connection on which nothing, pongs included, has been read
+// for twice the interval is considered lost. Zero disables pings.
+func WithClientKeepAlive(interval time.Duration) ClientOption {
+	return func(o *ClientOptions) {
+		o.KeepAlive = interval
+	}
+}
+
+// WithReconnect makes the client open a new WebSocket connection when its
+// connection is lost, waiting delay before the first attempt and doubling
+// the wait after each failed one, up to maxDelay. Zero values use
+// DefaultReconnectDelay and DefaultMaxReconnectDelay.
+func WithReconnect(delay, maxDelay time.Duration) ClientOption {
+	return func(o *ClientOptions) {
+		o.Reconnect = true
+		o.ReconnectDelay = delay
+		o.MaxReconnectDelay = maxDelay
+	}
+}
+
+// WithBroken sets a function called with the error that broke the session;
+// see ClientOptions.Broken.
+func WithBroken(broken func(err error)) ClientOption {
+	return func(o *ClientOptions) {
+		o.Broken = broken
+	}
+}
+
+// webSocketTransport is a ClientTransport over a WebSocket connection. It
+// pings the server to detect connections that were dropped without being
+// closed, and, if reconnecting, replaces a lost connection with a new one.
+type webSocketTransport struct {
+	url     string
+	options ClientOptions
+
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	accepting bool
+	closed    bool
+	closing   chan struct{}
+}
+
+// dialWebSocket opens a WebSocket connection to rawURL. A first connection
+// that fails is not retried.
+func dialWebSocket(ctx context.Context, rawURL string, options ClientOptions) (*webSocketTransport, error) {
+	t := &webSocketTransport{url: rawURL, options: options, closing: make(chan struct{})}
+	conn, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	t.accepting = true
+	return t, nil
+}
+
+// connect opens a connection and starts keeping it alive.
+func (t *webSocketTransport) connect(ctx context.Context) (*websocket.Conn, error) {
+	conn, _, err := t.options.Dialer.DialContext(ctx, t.url, t.options.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", t.url, err)
+	}
+	if interval := t.options.KeepAlive; interval > 0 {
+		conn.SetReadDeadline(time.Now().Add(2 * interval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * interval))
+		})
+		go t.keepAlive(conn, interval)
+	}
+	return conn, nil
+}
+
+// keepAlive pings the server over conn until it is closed.
+func (t *webSocketTransport) keepAlive(conn *websocket.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+			// The read that fails next reports the connection lost
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Send implements ClientTransport. Messages are refused with
+// ErrConnectionLost from the time the connection is lost until Resume is
+// called for its replacement.
+func (t *webSocketTransport) Send(message []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClientClosed
+	}
+	if !t.accepting {
+		return ErrConnectionLost
+	}
+	if err := t.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		t.accepting = false
+		t.conn.Close()
+		return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+	}
+	return nil
+}
+
+// Receive implements ClientTransport. If the connection is lost and the
+// transport reconnects, it returns a SessionBrokenError once a new
+// connection is open.
+func (t *webSocketTransport) Receive() ([]byte, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+
+	_, message, err := conn.ReadMessage()
+	if err == nil {
+		if interval := t.options.KeepAlive; interval > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * interval))
+		}
+		return message, nil
+	}
+
+	t.mu.Lock()
+	closed := t.closed
+	t.accepting = false
+	t.mu.Unlock()
+	conn.Close()
+	if closed {
+		return nil, ErrClientClosed
+	}
+	lost := fmt.Errorf("%w: %v", ErrConnectionLost, err)
+	if !t.options.Reconnect {
+		return nil, lost
+	}
+	if err := t.reconnect(); err != nil {
+		return nil, err
+	}
+	return nil, &SessionBrokenError{Err: lost}
+}
+
+// reconnect opens a new connection, backing off exponentially between
+// failed attempts, until it succeeds or the transport is closed. Messages
+// are refused until Resume is called.
+func (t *webSocketTransport) reconnect() error {
+	delay := t.options.ReconnectDelay
+	if delay <= 0 {
+		delay = DefaultReconnectDelay
+	}
+	maxDelay := t.options.MaxReconnectDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxReconnectDelay
+	}
+
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-t.closing:
+			timer.Stop()
+			return ErrClientClosed
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-t.closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		conn, err := t.connect(ctx)
+		cancel()
+		if err == nil {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.closed {
+				conn.Close()
+				return ErrClientClosed
+			}
+			t.conn = conn
+			return nil
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// Resume implements ReconnectingTransport.
+func (t *webSocketTransport) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.accepting = !t.closed
+}
+
+// Close implements ClientTransport.
+func (t *webSocketTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	t.accepting = false
+	close(t.closing)
+	return t.conn.Close()
+}
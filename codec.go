@@ -0,0 +1,125 @@
+package gocapnweb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// ArgCodecMetaKey is the key in a push message's metadata object naming the
+// codec its arguments are encoded with:
+//
+//	["push", ["pipeline", 0, ["ingest"], "<base64 arguments>"], {"argCodec": "msgpack"}]
+//
+// Encoded arguments are sent as a base64 string in place of the argument
+// array. Pushes without the key carry plain JSON arguments.
+const ArgCodecMetaKey = "argCodec"
+
+// ArgCodec decodes method arguments.
+type ArgCodec interface {
+	// Name identifies the codec in push message metadata.
+	Name() string
+
+	// DecodeArgs decodes encoded arguments into JSON-compatible values.
+	DecodeArgs(data []byte) (interface{}, error)
+}
+
+// ResultCodec encodes method results. Results travel inside JSON protocol
+// frames, so the encoding must be JSON.
+type ResultCodec interface {
+	EncodeResult(result interface{}) (json.RawMessage, error)
+}
+
+// Codec encodes and decodes the payloads of method calls. Arguments and
+// results may use different encodings; see MixedCodec.
+type Codec interface {
+	ArgCodec
+	ResultCodec
+}
+
+// JSONCodec encodes both arguments and results as JSON.
+type JSONCodec struct{}
+
+// Name implements ArgCodec.
+func (JSONCodec) Name() string { return "json" }
+
+// DecodeArgs implements ArgCodec.
+func (JSONCodec) DecodeArgs(data []byte) (interface{}, error) {
+	var args interface{}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// EncodeResult implements ResultCodec.
+func (JSONCodec) EncodeResult(result interface{}) (json.RawMessage, error) {
+	return json.Marshal(result)
+}
+
+// MessagePackArgCodec decodes MessagePack-encoded arguments. Binary values
+// are decoded as []byte, which handlers receive as base64 strings.
+type MessagePackArgCodec struct{}
+
+// Name implements ArgCodec.
+func (MessagePackArgCodec) Name() string { return "msgpack" }
+
+// DecodeArgs implements ArgCodec.
+func (MessagePackArgCodec) DecodeArgs(data []byte) (interface{}, error) {
+	return decodeMessagePack(data)
+}
+
+// MixedCodec combines independently chosen argument and result codecs.
+type MixedCodec struct {
+	Args    ArgCodec
+	Results ResultCodec
+}
+
+// NewMixedCodec returns a codec that decodes MessagePack arguments and
+// encodes JSON results, suited to binary inputs with human-readable output.
+func NewMixedCodec() MixedCodec {
+	return MixedCodec{Args: MessagePackArgCodec{}, Results: JSONCodec{}}
+}
+
+// Name implements ArgCodec.
+func (c MixedCodec) Name() string { return c.Args.Name() }
+
+// DecodeArgs implements ArgCodec.
+func (c MixedCodec) DecodeArgs(data []byte) (interface{}, error) {
+	return c.Args.DecodeArgs(data)
+}
+
+// EncodeResult implements ResultCodec.
+func (c MixedCodec) EncodeResult(result interface{}) (json.RawMessage, error) {
+	return c.Results.EncodeResult(result)
+}
+
+// decodePushArgs decodes the arguments of a push according to the codec
+// named in the message metadata. Arguments without a codec are returned
+// unchanged.
+func (s *RpcSession) decodePushArgs(args interface{}, metadata map[string]interface{}) (interface{}, error) {
+	name, _ := metadata[ArgCodecMetaKey].(string)
+	if name == "" || name == "json" {
+		return args, nil
+	}
+
+	codec := s.opts.Codec
+	if codec == nil || codec.Name() != name {
+		return nil, RpcError{Code: "ArgumentError", Message: fmt.Sprintf("unsupported argument codec: %s", name)}
+	}
+
+	encoded, ok := args.(string)
+	if !ok {
+		return nil, RpcError{Code: "ArgumentError", Message: name + " arguments must be a base64 string"}
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, RpcError{Code: "ArgumentError", Message: fmt.Sprintf("invalid base64 arguments: %v", err)}
+	}
+
+	decoded, err := codec.DecodeArgs(data)
+	if err != nil {
+		return nil, RpcError{Code: "ArgumentError", Message: fmt.Sprintf("invalid %s arguments: %v", name, err)}
+	}
+	return decoded, nil
+}
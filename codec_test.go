@@ -0,0 +1,152 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// sensorArgs is the MessagePack encoding of
+// ["probe-1", bin(01 02 ff), 3.5, -5, {"calibrated": true}].
+var sensorArgs = []byte{
+	0x95,
+	0xa7, 'p', 'r', 'o', 'b', 'e', '-', '1',
+	0xc4, 0x03, 0x01, 0x02, 0xff,
+	0xcb, 0x40, 0x0c, 0, 0, 0, 0, 0, 0,
+	0xfb,
+	0x81, 0xaa, 'c', 'a', 'l', 'i', 'b', 'r', 'a', 't', 'e', 'd', 0xc3,
+}
+
+// sensorReading is what the "ingest" method decodes its arguments into.
+type sensorReading struct {
+	ID         string
+	Raw        []byte
+	Value      float64
+	Offset     int
+	Calibrated bool
+}
+
+// codecTarget returns the test target with an "ingest" method that decodes
+// a sensor reading and returns it.
+func codecTarget() *BaseRpcTarget {
+	target := testTarget()
+	target.Method("ingest", func(args json.RawMessage) (interface{}, error) {
+		var (
+			reading sensorReading
+			options struct {
+				Calibrated bool `json:"calibrated"`
+			}
+		)
+		fields := []interface{}{&reading.ID, &reading.Raw, &reading.Value, &reading.Offset, &options}
+		if err := json.Unmarshal(args, &fields); err != nil {
+			return nil, err
+		}
+		reading.Calibrated = options.Calibrated
+		return reading, nil
+	})
+	return target
+}
+
+func TestMessagePackArgs(t *testing.T) {
+	target := codecTarget()
+	session := newTestSession(target, WithCodec(NewMixedCodec()))
+	encoded := base64.StdEncoding.EncodeToString(sensorArgs)
+
+	tests := []struct {
+		name  string
+		args  string
+		codec string
+		want  string
+	}{
+		{
+			name:  "msgpack",
+			args:  `"` + encoded + `"`,
+			codec: `{"argCodec":"msgpack"}`,
+			want:  `["resolve",1,{"Calibrated":true,"ID":"probe-1","Offset":-5,"Raw":["bytes","AQL/"],"Value":3.5}]`,
+		},
+		{
+			name: "json",
+			args: `["probe-1","AQL/",3.5,-5,{"calibrated":true}]`,
+			want: `["resolve",1,{"Calibrated":true,"ID":"probe-1","Offset":-5,"Raw":["bytes","AQL/"],"Value":3.5}]`,
+		},
+		{
+			name:  "unsupported codec",
+			args:  `"` + encoded + `"`,
+			codec: `{"argCodec":"cbor"}`,
+			want:  `["reject",1,["error","ArgumentError","unsupported argument codec: cbor"]]`,
+		},
+		{
+			name:  "not a string",
+			args:  `[1]`,
+			codec: `{"argCodec":"msgpack"}`,
+			want:  `["reject",1,["error","ArgumentError","msgpack arguments must be a base64 string"]]`,
+		},
+		{
+			name:  "truncated",
+			args:  `"` + base64.StdEncoding.EncodeToString(sensorArgs[:10]) + `"`,
+			codec: `{"argCodec":"msgpack"}`,
+			want:  `["reject",1,["error","ArgumentError","invalid msgpack arguments: msgpack: unexpected end of data"]]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			push := `["push",["pipeline",0,["ingest"],` + tt.args + `]]`
+			if tt.codec != "" {
+				push = `["push",["pipeline",0,["ingest"],` + tt.args + `],` + tt.codec + `]`
+			}
+			got := handleMessages(t, session, target, push, `["pull",1]`)
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+		})
+	}
+
+	// Without a codec, encoded arguments are refused
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["ingest"],"`+encoded+`"],{"argCodec":"msgpack"}]`, `["pull",1]`)
+	if want := `["reject",1,["error","ArgumentError","unsupported argument codec: msgpack"]]`; len(got) != 1 || got[0] != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestDecodeMessagePack(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    interface{}
+		wantErr string
+	}{
+		{"positive fixint", []byte{0x2a}, int64(42), ""},
+		{"negative fixint", []byte{0xff}, int64(-1), ""},
+		{"uint16", []byte{0xcd, 0x01, 0x00}, uint64(256), ""},
+		{"int32", []byte{0xd2, 0xff, 0xff, 0xff, 0xfe}, int64(-2), ""},
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0, 0}, 1.5, ""},
+		{"nil", []byte{0xc0}, nil, ""},
+		{"false", []byte{0xc2}, false, ""},
+		{"str8", append([]byte{0xd9, 0x03}, "abc"...), "abc", ""},
+		{"array16", []byte{0xdc, 0x00, 0x02, 0xc3, 0x01}, []interface{}{true, int64(1)}, ""},
+		{"integer map key", []byte{0x81, 0x07, 0xa1, 'x'}, map[string]interface{}{"7": "x"}, ""},
+		{"trailing bytes", []byte{0xc0, 0xc0}, nil, "msgpack: 1 trailing bytes"},
+		{"extension", []byte{0xd4, 0x01, 0x00}, nil, "msgpack: unsupported type 0xd4"},
+		{"long length", []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, nil, "msgpack: unexpected end of data"},
+		{"array map key", []byte{0x81, 0x90, 0xc0}, nil, "msgpack: unsupported map key type []interface {}"},
+		{"too deep", append(bytes.Repeat([]byte{0x91}, maxMessagePackDepth+1), 0xc0), nil, "msgpack: nesting too deep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeMessagePack(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("decodeMessagePack error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeMessagePack = %s, %v; want %v", fmt.Sprintf("%#v", got), err, tt.want)
+			}
+		})
+	}
+}
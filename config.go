@@ -0,0 +1,85 @@
+package gocapnweb
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds server settings that can be overridden from the environment.
+type Config struct {
+	// Port is the address the server listens on, e.g. ":8000".
+	// Read from CAPNWEB_PORT; a bare port number is accepted.
+	Port string
+	// StaticPath is the directory static files are served from.
+	// Read from CAPNWEB_STATIC_PATH.
+	StaticPath string
+	// PingInterval is how often WebSocket pings are sent; zero disables them.
+	// Read from CAPNWEB_PING_INTERVAL as a Go duration, e.g. "30s".
+	PingInterval time.Duration
+	// MaxConnections limits concurrent WebSocket connections; zero is
+	// unlimited. Read from CAPNWEB_MAX_CONNECTIONS.
+	MaxConnections int
+}
+
+// DefaultConfig returns the configuration used when no environment
+// variables are set.
+func DefaultConfig() *Config {
+	return &Config{
+		Port:       ":8000",
+		StaticPath: "/static",
+	}
+}
+
+// LoadConfig returns the default configuration with any CAPNWEB_*
+// environment variables applied. It fails if a variable holds a malformed
+// or negative value.
+func LoadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+
+	if port, ok := os.LookupEnv("CAPNWEB_PORT"); ok && port != "" {
+		if !strings.Contains(port, ":") {
+			port = ":" + port
+		}
+		cfg.Port = port
+	}
+
+	if staticPath, ok := os.LookupEnv("CAPNWEB_STATIC_PATH"); ok && staticPath != "" {
+		cfg.StaticPath = staticPath
+	}
+
+	if interval, ok := os.LookupEnv("CAPNWEB_PING_INTERVAL"); ok && interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CAPNWEB_PING_INTERVAL: %w", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid CAPNWEB_PING_INTERVAL: %s is negative", interval)
+		}
+		cfg.PingInterval = d
+	}
+
+	if maxConns, ok := os.LookupEnv("CAPNWEB_MAX_CONNECTIONS"); ok && maxConns != "" {
+		n, err := strconv.Atoi(maxConns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CAPNWEB_MAX_CONNECTIONS: %w", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid CAPNWEB_MAX_CONNECTIONS: %d is negative", n)
+		}
+		cfg.MaxConnections = n
+	}
+
+	return cfg, nil
+}
+
+// RpcEndpointOptions returns the endpoint options corresponding to the
+// configuration, for passing to SetupRpcEndpoint.
+func (c *Config) RpcEndpointOptions() []RpcEndpointOption {
+	return []RpcEndpointOption{
+		WithPingInterval(c.PingInterval),
+		WithMaxConnections(c.MaxConnections),
+	}
+}
@@ -0,0 +1,107 @@
+package gocapnweb
+
+import (
+	"testing"
+	"time"
+)
+
+// capnwebEnv lists the environment variables LoadConfig reads.
+var capnwebEnv = []string{"CAPNWEB_PORT", "CAPNWEB_STATIC_PATH", "CAPNWEB_PING_INTERVAL", "CAPNWEB_MAX_CONNECTIONS"}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want Config
+	}{
+		{
+			name: "defaults",
+			want: Config{Port: ":8000", StaticPath: "/static"},
+		},
+		{
+			name: "all set",
+			env: map[string]string{
+				"CAPNWEB_PORT":            "127.0.0.1:9000",
+				"CAPNWEB_STATIC_PATH":     "/srv/www",
+				"CAPNWEB_PING_INTERVAL":   "30s",
+				"CAPNWEB_MAX_CONNECTIONS": "100",
+			},
+			want: Config{Port: "127.0.0.1:9000", StaticPath: "/srv/www", PingInterval: 30 * time.Second, MaxConnections: 100},
+		},
+		{
+			name: "bare port",
+			env:  map[string]string{"CAPNWEB_PORT": "9000"},
+			want: Config{Port: ":9000", StaticPath: "/static"},
+		},
+		{
+			name: "empty values keep the defaults",
+			env:  map[string]string{"CAPNWEB_PORT": "", "CAPNWEB_STATIC_PATH": "", "CAPNWEB_PING_INTERVAL": ""},
+			want: Config{Port: ":8000", StaticPath: "/static"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range capnwebEnv {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if *cfg != tt.want {
+				t.Errorf("LoadConfig = %+v, want %+v", *cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{
+			name:    "malformed ping interval",
+			env:     map[string]string{"CAPNWEB_PING_INTERVAL": "30"},
+			wantErr: `invalid CAPNWEB_PING_INTERVAL: time: missing unit in duration "30"`,
+		},
+		{
+			name:    "negative ping interval",
+			env:     map[string]string{"CAPNWEB_PING_INTERVAL": "-5s"},
+			wantErr: "invalid CAPNWEB_PING_INTERVAL: -5s is negative",
+		},
+		{
+			name:    "malformed max connections",
+			env:     map[string]string{"CAPNWEB_MAX_CONNECTIONS": "ten"},
+			wantErr: `invalid CAPNWEB_MAX_CONNECTIONS: strconv.Atoi: parsing "ten": invalid syntax`,
+		},
+		{
+			name:    "negative max connections",
+			env:     map[string]string{"CAPNWEB_MAX_CONNECTIONS": "-1"},
+			wantErr: "invalid CAPNWEB_MAX_CONNECTIONS: -1 is negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range capnwebEnv {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := LoadConfig()
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("LoadConfig = %+v, %v; want error %q", cfg, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigRpcEndpointOptions(t *testing.T) {
+	cfg := &Config{PingInterval: 15 * time.Second, MaxConnections: 3}
+	options := defaultRpcEndpointOptions()
+	for _, opt := range cfg.RpcEndpointOptions() {
+		opt(&options)
+	}
+	if options.PingInterval != 15*time.Second || options.MaxConnections != 3 {
+		t.Errorf("options have ping interval %v and max connections %d, want 15s and 3", options.PingInterval, options.MaxConnections)
+	}
+}
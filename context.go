@@ -0,0 +1,120 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// ContextHandler is a method handler that receives the context of the call.
+// The context is cancelled when the WebSocket connection that made the call
+// closes, the HTTP request that carried it ends, the session is aborted or
+// the client releases the call's export, and when the session's pull
+// timeout passes. It carries the values of that request and the calling
+// session; see SessionFromContext and CallInfoFromContext.
+type ContextHandler = func(ctx context.Context, args json.RawMessage) (interface{}, error)
+
+// ContextRpcTarget is implemented by targets that accept the context of each
+// call. Sessions prefer DispatchContext over Dispatch when it is available.
+//
+// BaseRpcTarget implements ContextRpcTarget, so a type that embeds it and
+// overrides Dispatch should override DispatchContext as well.
+type ContextRpcTarget interface {
+	DispatchContext(ctx context.Context, method string, args json.RawMessage) (interface{}, error)
+}
+
+// SessionTarget is implemented by targets that need the state of the session
+// a call belongs to. RpcSession calls DispatchSession instead of Dispatch
+// when the target implements it. sessionData.Context is the context of the
+// session rather than of the call; targets that need the latter implement
+// SessionContextTarget.
+type SessionTarget interface {
+	DispatchSession(sessionData *SessionData, method string, args json.RawMessage) (interface{}, error)
+}
+
+// SessionContextTarget is implemented by session targets that accept the
+// context of each call, as ContextRpcTarget does. Sessions prefer
+// DispatchSessionContext over DispatchSession when it is available.
+type SessionContextTarget interface {
+	DispatchSessionContext(ctx context.Context, sessionData *SessionData, method string, args json.RawMessage) (interface{}, error)
+}
+
+// MethodWithContext registers a method handler that receives the context of
+// each call. Options annotate the method for introspection.
+func (t *BaseRpcTarget) MethodWithContext(name string, handler ContextHandler, opts ...MethodOption) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.methods[name] = handler
+	t.setMethodMeta(name, opts)
+}
+
+// withoutContext adapts a handler that takes no context.
+func withoutContext(handler func(json.RawMessage) (interface{}, error)) ContextHandler {
+	return func(_ context.Context, args json.RawMessage) (interface{}, error) {
+		return handler(args)
+	}
+}
+
+// SetContext sets the context passed to ContextRpcTarget targets by calls
+// made in the session.
+func (sd *SessionData) SetContext(ctx context.Context) {
+	sd.metaMu.Lock()
+	defer sd.metaMu.Unlock()
+	sd.ctx, sd.cancelCtx = context.WithCancelCause(ctx)
+}
+
+// cancelCalls cancels the context of calls made in the session, with err as
+// the cause.
+func (sd *SessionData) cancelCalls(err error) {
+	sd.metaMu.RLock()
+	cancel := sd.cancelCtx
+	sd.metaMu.RUnlock()
+	if cancel != nil {
+		cancel(err)
+	}
+}
+
+// Context returns the session's context, from which the context of each
+// call made in it is derived. It is context.Background if it has not been
+// set. Handlers are passed the context of their own call; see
+// ContextHandler and SessionContextTarget.
+func (sd *SessionData) Context() context.Context {
+	if sd == nil {
+		return context.Background()
+	}
+	sd.metaMu.RLock()
+	defer sd.metaMu.RUnlock()
+	if sd.ctx == nil {
+		return context.Background()
+	}
+	return sd.ctx
+}
+
+// SessionFromContext returns the session of the call a ContextHandler is
+// running for. Its Header method reports the headers of the request that
+// opened the session.
+func SessionFromContext(ctx context.Context) (*SessionData, bool) {
+	call, ok := ctx.Value(callSessionKey{}).(callSession)
+	if !ok {
+		return nil, false
+	}
+	return call.sessionData, true
+}
+
+// dispatchTarget calls method on target with ctx as the context of the
+// call, using the richest interface target implements:
+// SessionContextTarget, SessionTarget, ContextRpcTarget, then RpcTarget.
+// Calls dispatched concurrently each see their own context.
+func dispatchTarget(ctx context.Context, sessionData *SessionData, target RpcTarget, method string, args json.RawMessage) (interface{}, error) {
+	if sessionData != nil {
+		switch target := target.(type) {
+		case SessionContextTarget:
+			return target.DispatchSessionContext(ctx, sessionData, method, args)
+		case SessionTarget:
+			return target.DispatchSession(sessionData, method, args)
+		}
+	}
+	if contextTarget, ok := target.(ContextRpcTarget); ok {
+		return contextTarget.DispatchContext(ctx, method, args)
+	}
+	return target.Dispatch(method, args)
+}
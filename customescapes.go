@@ -0,0 +1,176 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// EscapeRegistry maps Go types to custom wire escapes, [tag, operand], such
+// as ["decimal", "12.50"] or ["uuid", "…"], so that domain types round-trip
+// through the RPC layer. Results holding a registered type, at any depth
+// and including struct fields, are sent with its escape, and the escape in
+// arguments is decoded into the type, which handlers receive in its own JSON
+// encoding. A session uses a registry set with WithEscapeRegistry.
+//
+// Clients must understand the escapes they are sent; the capnweb client
+// only knows its built-in ones.
+type EscapeRegistry struct {
+	byTag  map[string]*customEscapeType
+	byType map[reflect.Type]*customEscapeType
+	mu     sync.RWMutex
+}
+
+// customEscapeType is the encoding of a registered type.
+type customEscapeType struct {
+	tag    string
+	encode func(value interface{}) (interface{}, error)
+	decode func(operand interface{}) (interface{}, error)
+}
+
+// NewEscapeRegistry creates an empty EscapeRegistry.
+func NewEscapeRegistry() *EscapeRegistry {
+	return &EscapeRegistry{
+		byTag:  make(map[string]*customEscapeType),
+		byType: make(map[reflect.Type]*customEscapeType),
+	}
+}
+
+// RegisterEscape registers the escape [tag, operand] for values of type T.
+// encode returns the operand that carries a value, which must encode as
+// JSON; decode converts an operand sent by the client, as decoded JSON, back
+// into a value. Tags of the protocol's own expressions and escapes, and tags
+// or types already registered, are refused.
+func RegisterEscape[T any](r *EscapeRegistry, tag string, encode func(T) (interface{}, error), decode func(operand interface{}) (T, error)) error {
+	if reservedEscapeTag(tag) {
+		return fmt.Errorf("escape tag %q is reserved by the protocol", tag)
+	}
+	valueType := reflect.TypeOf((*T)(nil)).Elem()
+	if valueType.Kind() == reflect.Interface {
+		return fmt.Errorf("escape %q: cannot register interface type %s", tag, valueType)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.byTag[tag]; exists {
+		return fmt.Errorf("escape tag %q is already registered", tag)
+	}
+	if existing, exists := r.byType[valueType]; exists {
+		return fmt.Errorf("type %s is already registered as escape %q", valueType, existing.tag)
+	}
+	escape := &customEscapeType{
+		tag: tag,
+		encode: func(value interface{}) (interface{}, error) {
+			return encode(value.(T))
+		},
+		decode: func(operand interface{}) (interface{}, error) {
+			return decode(operand)
+		},
+	}
+	r.byTag[tag] = escape
+	r.byType[valueType] = escape
+	return nil
+}
+
+// reservedEscapeTag reports whether tag names one of the protocol's own
+// expressions or escapes.
+func reservedEscapeTag(tag string) bool {
+	switch tag {
+	case "", "pipeline", "remap", "import", "export", "promise", "error",
+		"date", "bigint", "bytes", "undefined", "nan", "inf", "-inf":
+		return true
+	}
+	return false
+}
+
+// empty reports whether no types are registered. A nil registry is empty.
+func (r *EscapeRegistry) empty() bool {
+	if r == nil {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.byType) == 0
+}
+
+// escapeValue is the leafEscape of registered types.
+func (r *EscapeRegistry) escapeValue(value reflect.Value) (interface{}, bool, error) {
+	if !value.CanInterface() {
+		return nil, false, nil
+	}
+	r.mu.RLock()
+	escape, exists := r.byType[value.Type()]
+	r.mu.RUnlock()
+	if !exists {
+		return nil, false, nil
+	}
+	operand, err := escape.encode(value.Interface())
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode %s escape: %w", escape.tag, err)
+	}
+	return customEscape{tag: escape.tag, value: value.Interface(), operand: operand}, true, nil
+}
+
+// revive decodes a [tag, operand] expression of a registered escape. It
+// reports whether tag is registered.
+func (r *EscapeRegistry) revive(expr []interface{}) (interface{}, bool, error) {
+	if r == nil || len(expr) != 2 {
+		return nil, false, nil
+	}
+	tag, _ := expr[0].(string)
+	r.mu.RLock()
+	escape, exists := r.byTag[tag]
+	r.mu.RUnlock()
+	if !exists {
+		return nil, false, nil
+	}
+	value, err := escape.decode(expr[1])
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid %s expression: %w", tag, err)
+	}
+	return value, true, nil
+}
+
+// customEscape is a value of a registered type within a normalized result.
+// It is sent as its escape; pipeline references into arguments use value.
+type customEscape struct {
+	tag     string
+	value   interface{}
+	operand interface{}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c customEscape) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{c.tag, c.operand})
+}
+
+// unwrapCustomEscapes returns value with each customEscape within it
+// replaced by the value it carries. value is not modified.
+func unwrapCustomEscapes(value interface{}) interface{} {
+	switch v := value.(type) {
+	case customEscape:
+		return v.value
+	case []interface{}:
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			elems[i] = unwrapCustomEscapes(elem)
+		}
+		return elems
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			fields[key] = unwrapCustomEscapes(val)
+		}
+		return fields
+	}
+	return value
+}
+
+// WithEscapeRegistry sets the custom escapes the session encodes results
+// with and decodes arguments from.
+func WithEscapeRegistry(registry *EscapeRegistry) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.Escapes = registry
+	}
+}
@@ -0,0 +1,135 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// money is an amount in cents, sent as the escape ["decimal", "12.50"].
+type money struct {
+	Cents int64
+}
+
+// moneyEscapes returns a registry with the decimal escape for money.
+func moneyEscapes(t *testing.T) *EscapeRegistry {
+	t.Helper()
+	registry := NewEscapeRegistry()
+	err := RegisterEscape(registry, "decimal",
+		func(m money) (interface{}, error) {
+			return fmt.Sprintf("%d.%02d", m.Cents/100, m.Cents%100), nil
+		},
+		func(operand interface{}) (money, error) {
+			s, ok := operand.(string)
+			if !ok {
+				return money{}, fmt.Errorf("decimal operand must be a string")
+			}
+			var units, cents int64
+			if _, err := fmt.Sscanf(s, "%d.%02d", &units, &cents); err != nil {
+				return money{}, err
+			}
+			return money{Cents: units*100 + cents}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestCustomEscapeRoundTrip(t *testing.T) {
+	target := testTarget()
+	target.Method("price", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{
+			"item":    "tea",
+			"price":   money{Cents: 1250},
+			"history": []money{{Cents: 1100}, {Cents: 1200}},
+		}, nil
+	})
+	target.Method("double", func(args json.RawMessage) (interface{}, error) {
+		var amounts []money
+		if err := json.Unmarshal(args, &amounts); err != nil || len(amounts) != 1 {
+			return nil, fmt.Errorf("double expects an amount, got %s", args)
+		}
+		return money{Cents: amounts[0].Cents * 2}, nil
+	})
+	session := newTestSession(target, WithEscapeRegistry(moneyEscapes(t)))
+
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name:     "result",
+			messages: []string{`["push",["pipeline",0,["price"],[]]]`, `["pull",1]`},
+			want:     []string{`["resolve",1,{"history":[[["decimal","11.00"],["decimal","12.00"]]],"item":"tea","price":["decimal","12.50"]}]`},
+		},
+		{
+			name:     "argument",
+			messages: []string{`["push",["pipeline",0,["double"],[["decimal","3.25"]]]]`, `["pull",1]`},
+			want:     []string{`["resolve",1,["decimal","6.50"]]`},
+		},
+		{
+			name: "pipelined",
+			messages: []string{
+				`["push",["pipeline",0,["price"],[]]]`,
+				`["push",["pipeline",0,["double"],[["pipeline",1,["price"]]]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",2,["decimal","25.00"]]`},
+		},
+		{
+			name:     "unregistered tag",
+			messages: []string{`["push",["pipeline",0,["echo"],[["uuid","x"]]]]`, `["pull",1]`},
+			want:     []string{`["resolve",1,[["uuid","x"]]]`},
+		},
+		{
+			name:     "invalid operand",
+			messages: []string{`["push",["pipeline",0,["double"],[["decimal",12]]]]`, `["pull",1]`},
+			want:     []string{`["reject",1,["error","PipelineError","invalid decimal expression: decimal operand must be a string"]]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := handleMessages(t, session, target, tt.messages...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without the registry the escape is not decoded
+	got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["echo"],[["decimal","3.25"]]]]`, `["pull",1]`)
+	if want := `["resolve",1,[["decimal","3.25"]]]`; len(got) != 1 || got[0] != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestRegisterEscape(t *testing.T) {
+	registry := moneyEscapes(t)
+	encode := func(s fmt.Stringer) (interface{}, error) { return s.String(), nil }
+	decode := func(interface{}) (fmt.Stringer, error) { return nil, nil }
+	encodeMoney := func(money) (interface{}, error) { return nil, nil }
+	decodeMoney := func(interface{}) (money, error) { return money{}, nil }
+	encodeString := func(s string) (interface{}, error) { return s, nil }
+	decodeString := func(o interface{}) (string, error) { return fmt.Sprint(o), nil }
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{"reserved tag", RegisterEscape(registry, "date", encodeString, decodeString), `escape tag "date" is reserved by the protocol`},
+		{"empty tag", RegisterEscape(registry, "", encodeString, decodeString), `escape tag "" is reserved by the protocol`},
+		{"registered tag", RegisterEscape(registry, "decimal", encodeString, decodeString), `escape tag "decimal" is already registered`},
+		{"registered type", RegisterEscape(registry, "cents", encodeMoney, decodeMoney), `type gocapnweb.money is already registered as escape "decimal"`},
+		{"interface type", RegisterEscape(registry, "stringer", encode, decode), `escape "stringer": cannot register interface type fmt.Stringer`},
+		{"new tag", RegisterEscape(registry, "label", encodeString, decodeString), ""},
+	}
+	for _, tt := range tests {
+		if tt.wantErr == "" && tt.err != nil || tt.wantErr != "" && (tt.err == nil || tt.err.Error() != tt.wantErr) {
+			t.Errorf("%s: RegisterEscape = %v, want %q", tt.name, tt.err, tt.wantErr)
+		}
+	}
+}
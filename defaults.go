@@ -0,0 +1,130 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// MethodWithDefaults registers a method handler whose missing arguments are
+// filled in from defaults before the handler runs, so the handler always
+// receives the effective arguments of the call.
+//
+// For positional calls defaults is an array: arguments beyond those supplied
+// are taken from the matching positions of defaults, so defaults of
+// [null, 10] turn a call with the single argument "a" into ["a", 10]. For
+// named-parameter calls defaults is an object whose keys are deep-merged
+// into the argument object wherever they are missing. The defaults are
+// available from BaseRpcTarget.MethodDefaults.
+func (t *BaseRpcTarget) MethodWithDefaults(name string, defaults json.RawMessage, handler func(json.RawMessage) (interface{}, error)) error {
+	parsedDefaults, err := decodeJSONValue(defaults)
+	if err != nil {
+		return fmt.Errorf("invalid defaults for %s: %w", name, err)
+	}
+
+	t.Method(name, func(args json.RawMessage) (interface{}, error) {
+		effective, err := applyDefaults(args, parsedDefaults)
+		if err != nil {
+			return nil, err
+		}
+		return handler(effective)
+	})
+
+	t.mu.Lock()
+	t.defaults[name] = defaults
+	t.mu.Unlock()
+	return nil
+}
+
+// MethodDefaults returns the default arguments recorded for a method.
+func (t *BaseRpcTarget) MethodDefaults(name string) (json.RawMessage, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defaults, exists := t.defaults[name]
+	return defaults, exists
+}
+
+// decodeJSONValue decodes data into generic JSON values, keeping numbers
+// exact so they re-encode unchanged.
+func decodeJSONValue(data json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// applyDefaults returns args with defaults merged in.
+func applyDefaults(args json.RawMessage, defaults interface{}) (json.RawMessage, error) {
+	var value interface{}
+	if len(bytes.TrimSpace(args)) > 0 {
+		var err error
+		if value, err = decodeJSONValue(args); err != nil {
+			return nil, RpcError{Code: "ArgumentError", Message: fmt.Sprintf("invalid arguments: %v", err)}
+		}
+	}
+
+	merged, err := json.Marshal(mergeDefaults(value, defaults))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode arguments: %w", err)
+	}
+	return merged, nil
+}
+
+// mergeDefaults fills the gaps in value from defaults. Objects are merged key
+// by key, arrays are extended to the length of defaults, and a missing value
+// takes the default outright. Values that are present are never replaced.
+func mergeDefaults(value, defaults interface{}) interface{} {
+	if value == nil {
+		return defaults
+	}
+
+	switch d := defaults.(type) {
+	case map[string]interface{}:
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, def := range d {
+				if existing, ok := v[key]; ok {
+					v[key] = mergeDefaults(existing, def)
+				} else {
+					v[key] = def
+				}
+			}
+			return v
+		case []interface{}:
+			// Named parameters sent as the sole positional argument
+			if len(v) == 0 {
+				return []interface{}{d}
+			}
+			if len(v) == 1 {
+				v[0] = mergeDefaults(v[0], d)
+			}
+			return v
+		}
+
+	case []interface{}:
+		if v, ok := value.([]interface{}); ok {
+			for i, def := range d {
+				if i < len(v) {
+					v[i] = mergeObjectDefaults(v[i], def)
+				} else {
+					v = append(v, def)
+				}
+			}
+			return v
+		}
+	}
+	return value
+}
+
+// mergeObjectDefaults merges def into a supplied positional argument when
+// both are objects; any other supplied argument, including an explicit null,
+// is kept as sent.
+func mergeObjectDefaults(value, def interface{}) interface{} {
+	if _, ok := value.(map[string]interface{}); ok {
+		return mergeDefaults(value, def)
+	}
+	return value
+}
@@ -0,0 +1,83 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMethodWithDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults string
+		args     string
+		want     string
+	}{
+		{name: "missing positional", defaults: `[null,10]`, args: `["ada"]`, want: `["ada",10]`},
+		{name: "all positional supplied", defaults: `[null,10]`, args: `["ada",5]`, want: `["ada",5]`},
+		{name: "explicit null kept", defaults: `[null,10]`, args: `["ada",null]`, want: `["ada",null]`},
+		{name: "no arguments", defaults: `[null,10]`, args: ``, want: `[null,10]`},
+		{name: "exact numbers", defaults: `[null,12345678901234567890]`, args: `[1]`, want: `[1,12345678901234567890]`},
+		{
+			name:     "named parameters",
+			defaults: `{"limit":10,"filter":{"replies":false,"reposts":true}}`,
+			args:     `{"handle":"ada","filter":{"replies":true}}`,
+			want:     `{"filter":{"replies":true,"reposts":true},"handle":"ada","limit":10}`,
+		},
+		{
+			name:     "named parameters as sole argument",
+			defaults: `{"limit":10}`,
+			args:     `[{"handle":"ada"}]`,
+			want:     `[{"handle":"ada","limit":10}]`,
+		},
+		{name: "named parameters without arguments", defaults: `{"limit":10}`, args: `[]`, want: `[{"limit":10}]`},
+		{
+			name:     "object in a positional argument",
+			defaults: `["x",{"limit":10}]`,
+			args:     `["ada",{"cursor":"c"}]`,
+			want:     `["ada",{"cursor":"c","limit":10}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewBaseRpcTarget()
+			var received json.RawMessage
+			err := target.MethodWithDefaults("feed", json.RawMessage(tt.defaults), func(args json.RawMessage) (interface{}, error) {
+				received = args
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := target.Dispatch("feed", json.RawMessage(tt.args)); err != nil {
+				t.Fatalf("Dispatch: %v", err)
+			}
+			if string(received) != tt.want {
+				t.Errorf("handler received %s, want %s", received, tt.want)
+			}
+			if defaults, ok := target.MethodDefaults("feed"); !ok || string(defaults) != tt.defaults {
+				t.Errorf("MethodDefaults = %s, want %s", defaults, tt.defaults)
+			}
+		})
+	}
+}
+
+func TestMethodWithDefaultsErrors(t *testing.T) {
+	target := NewBaseRpcTarget()
+	if err := target.MethodWithDefaults("bad", json.RawMessage(`[1,`), nil); err == nil {
+		t.Error("MethodWithDefaults accepted invalid defaults")
+	}
+	if _, ok := target.MethodDefaults("bad"); ok {
+		t.Error("a method that failed to register has defaults")
+	}
+
+	if err := target.MethodWithDefaults("feed", json.RawMessage(`[null,10]`), func(args json.RawMessage) (interface{}, error) {
+		return args, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var rpcErr RpcError
+	if _, err := target.Dispatch("feed", json.RawMessage(`["ada"`)); !errors.As(err, &rpcErr) || rpcErr.Code != "ArgumentError" {
+		t.Errorf("invalid arguments gave %v, want an ArgumentError", err)
+	}
+}
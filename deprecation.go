@@ -0,0 +1,72 @@
+package gocapnweb
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Deprecation describes a method that is scheduled for removal.
+type Deprecation struct {
+	Method       string
+	DeprecatedAt time.Time
+	Sunset       time.Time
+	Replacement  string
+}
+
+// Message returns the human-readable warning sent to clients that call the
+// deprecated method.
+func (d Deprecation) Message() string {
+	sunset := d.Sunset.UTC().Format(time.DateOnly)
+	if d.Replacement == "" {
+		return fmt.Sprintf("Method '%s' is deprecated. Sunset: %s", d.Method, sunset)
+	}
+	return fmt.Sprintf("Use '%s' instead. Sunset: %s", d.Replacement, sunset)
+}
+
+// DeprecationProvider is implemented by targets that can report deprecated
+// methods. RpcSession consults it on every dispatch; calls to deprecated
+// methods are preceded by a ["warning", "Deprecated", message] frame.
+type DeprecationProvider interface {
+	MethodDeprecation(method string) (Deprecation, bool)
+}
+
+// DeprecateMethod marks a method as deprecated, to be removed after
+// sunsetDate. replacement names the method clients should use instead and
+// may be empty.
+func (t *BaseRpcTarget) DeprecateMethod(name string, sunsetDate time.Time, replacement string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deprecations[name] = Deprecation{
+		Method:       name,
+		DeprecatedAt: time.Now(),
+		Sunset:       sunsetDate,
+		Replacement:  replacement,
+	}
+}
+
+// MethodDeprecation implements DeprecationProvider.
+func (t *BaseRpcTarget) MethodDeprecation(method string) (Deprecation, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	deprecation, exists := t.deprecations[method]
+	return deprecation, exists
+}
+
+// setDeprecationHeaders adds the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers for the earliest sunset among the given deprecations.
+func setDeprecationHeaders(header http.Header, deprecations []Deprecation) {
+	if len(deprecations) == 0 {
+		return
+	}
+
+	earliest := deprecations[0]
+	for _, d := range deprecations[1:] {
+		if d.Sunset.Before(earliest.Sunset) {
+			earliest = d
+		}
+	}
+
+	header.Set("Deprecation", fmt.Sprintf("@%d", earliest.DeprecatedAt.Unix()))
+	header.Set("Sunset", earliest.Sunset.UTC().Format(http.TimeFormat))
+}
@@ -0,0 +1,81 @@
+package gocapnweb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deprecatedTarget returns the test target with echo deprecated in favour
+// of say, and fail deprecated without a replacement, sunsetting earlier.
+func deprecatedTarget() *BaseRpcTarget {
+	target := testTarget()
+	target.DeprecateMethod("echo", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), "say")
+	target.DeprecateMethod("fail", time.Date(2029, 6, 1, 0, 0, 0, 0, time.UTC), "")
+	return target
+}
+
+func TestDeprecationWarnings(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name:     "resolve",
+			messages: []string{`["push",["pipeline",0,["echo"],["x"]]]`, `["pull",1]`},
+			want:     []string{`["warning","Deprecated","Use 'say' instead. Sunset: 2030-01-01"]`, `["resolve",1,"x"]`},
+		},
+		{
+			name:     "reject",
+			messages: []string{`["push",["pipeline",0,["fail"],[]]]`, `["pull",1]`},
+			want: []string{
+				`["warning","Deprecated","Method 'fail' is deprecated. Sunset: 2029-06-01"]`,
+				`["reject",1,["error","MethodError","intentional failure"]]`,
+			},
+		},
+		{
+			name:     "repeated pull",
+			messages: []string{`["push",["pipeline",0,["echo"],["x"]]]`, `["pull",1]`, `["pull",1]`},
+			want:     []string{`["warning","Deprecated","Use 'say' instead. Sunset: 2030-01-01"]`, `["resolve",1,"x"]`, `["resolve",1,"x"]`},
+		},
+		{
+			name:     "other method",
+			messages: []string{`["push",["pipeline",0,["user"],[]]]`, `["pull",1]`},
+			want:     []string{`["resolve",1,{"id":"u_1","tags":[["a","b"]]}]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := deprecatedTarget()
+			got := handleMessages(t, newTestSession(target), target, tt.messages...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	server := endpointServer(t, deprecatedTarget())
+
+	// The headers name the earliest sunset of the methods called
+	resp, _ := postBatch(t, server, strings.Join([]string{
+		`["push",["pipeline",0,["echo"],["x"]]]`,
+		`["push",["pipeline",0,["fail"],[]]]`,
+		`["pull",1]`,
+		`["pull",2]`,
+	}, "\n"))
+	if got, want := resp.Header.Get("Sunset"), "Fri, 01 Jun 2029 00:00:00 GMT"; got != want {
+		t.Errorf("Sunset = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Deprecation"); !strings.HasPrefix(got, "@") {
+		t.Errorf("Deprecation = %q, want an @-prefixed timestamp", got)
+	}
+
+	resp, _ = postBatch(t, server, `["push",["pipeline",0,["user"],[]]]`+"\n"+`["pull",1]`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Sunset") != "" || resp.Header.Get("Deprecation") != "" {
+		t.Errorf("batch without deprecated calls has headers %v", resp.Header)
+	}
+}
@@ -0,0 +1,113 @@
+package gocapnweb
+
+import (
+	"errors"
+)
+
+// RpcError is an error with a machine-readable code that is reported to the
+// client as the error type of a reject message. Handlers may return an
+// RpcError, or wrap one with fmt.Errorf's %w verb, to control how a failure
+// is presented on the wire.
+//
+// An RpcError is sent as ["error", type, message, stack, details]. The type
+// is Type, or Code if Type is empty. Details is sent as the details object,
+// to which Code is added as "code" if it differs from the type, and Data as
+// "data" if it is set; these replace any details of the same names. An error
+// expression received with a string "code" in its details is read back the
+// same way, with its type as Type.
+type RpcError struct {
+	// Code identifies the kind of error, e.g. "MethodNotFound". It is what
+	// errors.Is matches.
+	Code string `json:"code"`
+	// Type is the error type sent to the client, e.g. "TypeError", if it
+	// should differ from Code.
+	Type string `json:"type,omitempty"`
+	// Message is a human-readable description of the error.
+	Message string `json:"message,omitempty"`
+	// Data carries optional structured data about the error, of any type
+	// the session can send as a result.
+	Data interface{} `json:"data,omitempty"`
+	// Details carries optional structured information about the error.
+	Details map[string]interface{} `json:"details,omitempty"`
+	// Stack is an optional stack trace sent to the client with the error.
+	Stack string `json:"stack,omitempty"`
+	// Cause is the underlying error, if any.
+	Cause error `json:"-"`
+}
+
+// Sentinel errors that can be matched with errors.Is.
+var (
+	ErrMethodNotFound = RpcError{Code: "MethodNotFound"}
+
+	// ErrInternal rejects a call whose handler panicked. Its details name
+	// the method; the panic and its stack are logged, or passed to the
+	// OnPanic hook, not sent.
+	ErrInternal = RpcError{Code: "InternalError"}
+)
+
+// NewRpcError creates an RpcError with the given code and message.
+func NewRpcError(code, message string) RpcError {
+	return RpcError{Code: code, Message: message}
+}
+
+// Error implements the error interface.
+func (e RpcError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// Is reports whether target is an RpcError with the same code, so that
+// errors.Is(err, ErrMethodNotFound) matches any MethodNotFound error.
+func (e RpcError) Is(target error) bool {
+	switch t := target.(type) {
+	case RpcError:
+		return t.Code == e.Code
+	case *RpcError:
+		return t != nil && t.Code == e.Code
+	}
+	return false
+}
+
+// As sets a *RpcError target to a copy of e, so that errors.As finds an
+// RpcError returned by value with a pointer target as well.
+func (e RpcError) As(target interface{}) bool {
+	if t, ok := target.(**RpcError); ok {
+		copied := e
+		*t = &copied
+		return true
+	}
+	return false
+}
+
+// Unwrap returns the underlying cause.
+func (e RpcError) Unwrap() error {
+	return e.Cause
+}
+
+// asRpcError finds the first RpcError in err's chain, whether it was returned
+// by value or by pointer.
+func asRpcError(err error) (RpcError, bool) {
+	var rpcErr RpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr, true
+	}
+	var rpcErrPtr *RpcError
+	if errors.As(err, &rpcErrPtr) && rpcErrPtr != nil {
+		return *rpcErrPtr, true
+	}
+	return RpcError{}, false
+}
+
+// asRejection returns the RpcError err is reported to the client as: the
+// RpcError in its chain, or one with code defaultType and err's message.
+func asRejection(err error, defaultType string) RpcError {
+	if rpcErr, ok := asRpcError(err); ok {
+		if rpcErr.Message == "" {
+			rpcErr.Message = err.Error()
+		}
+		return rpcErr
+	}
+	return RpcError{Code: defaultType, Message: err.Error(), Cause: err}
+}
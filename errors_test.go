@@ -0,0 +1,90 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRpcErrorMatching(t *testing.T) {
+	cause := fs.ErrNotExist
+	wrapped := fmt.Errorf("loading user: %w", RpcError{Code: "NotFound", Message: "no such user", Cause: cause})
+
+	if got, want := wrapped.Error(), "loading user: NotFound: no such user"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if got, want := ErrMethodNotFound.Error(), "MethodNotFound"; got != want {
+		t.Errorf("Error() without a message = %q, want %q", got, want)
+	}
+	if !errors.Is(wrapped, RpcError{Code: "NotFound"}) || !errors.Is(wrapped, &RpcError{Code: "NotFound"}) {
+		t.Error("errors.Is does not match the code through a wrapped RpcError")
+	}
+	if errors.Is(wrapped, ErrMethodNotFound) {
+		t.Error("errors.Is matches another code")
+	}
+	if !errors.Is(wrapped, cause) {
+		t.Error("errors.Is does not reach the cause of the RpcError")
+	}
+
+	var value RpcError
+	if !errors.As(wrapped, &value) || value.Message != "no such user" {
+		t.Errorf("errors.As into an RpcError = %+v", value)
+	}
+	var pointer *RpcError
+	if !errors.As(wrapped, &pointer) || pointer.Code != "NotFound" {
+		t.Errorf("errors.As into a *RpcError = %+v", pointer)
+	}
+}
+
+func TestWrappedErrorRejects(t *testing.T) {
+	target := testTarget()
+	target.Method("lookup", func(json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("user u_9: %w", ErrMethodNotFound)
+	})
+	target.Method("load", func(json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("loading: %w", RpcError{Code: "NotFound", Message: "no such user", Cause: fs.ErrNotExist})
+	})
+
+	// Middleware sees the error the handler returned, wrapping and all
+	var seen []error
+	target.UseMiddleware(func(method string, args json.RawMessage, next RpcHandler) (interface{}, error) {
+		result, err := next(args)
+		if err != nil {
+			seen = append(seen, err)
+		}
+		return result, err
+	})
+
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["lookup"],[]]]`,
+		`["push",["pipeline",0,["load"],[]]]`,
+		`["pull",1]`,
+		`["pull",2]`,
+	)
+	want := []string{
+		`["reject",1,["error","MethodNotFound","user u_9: MethodNotFound"]]`,
+		`["reject",2,["error","NotFound","no such user"]]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+	if len(seen) != 2 || !errors.Is(seen[0], ErrMethodNotFound) || !errors.Is(seen[1], fs.ErrNotExist) {
+		t.Errorf("middleware saw %v, want the wrapped errors", seen)
+	}
+
+	// The client's rejection matches the code the handler wrapped
+	server := endpointServer(t, target)
+	client := dialTestClient(t, websocketURL(server, "/rpc"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.Main().Call("lookup").Await(ctx)
+	var rpcErr *RpcError
+	if !errors.Is(err, ErrMethodNotFound) || !errors.As(err, &rpcErr) || rpcErr.Message != "user u_9: MethodNotFound" {
+		t.Errorf("client got %v, want MethodNotFound with the handler's message", err)
+	}
+}
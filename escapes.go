@@ -0,0 +1,379 @@
+package gocapnweb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Date is a point in time, sent on the wire as the ["date", msSinceEpoch]
+// escape that JavaScript clients evaluate to a Date. Handlers decode Date
+// arguments and may return either a Date or a time.Time, which is sent as a
+// Date wherever it appears in a result, including struct fields. Times are
+// sent with millisecond precision.
+type Date struct {
+	time.Time
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{"date", d.UnixMilli()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var escape []interface{}
+	if err := json.Unmarshal(data, &escape); err != nil {
+		return fmt.Errorf("date must be [\"date\", msSinceEpoch]: %w", err)
+	}
+	if len(escape) != 2 || escape[0] != "date" {
+		return fmt.Errorf("date must be [\"date\", msSinceEpoch]")
+	}
+	ms, ok := escape[1].(float64)
+	if !ok {
+		return fmt.Errorf("date must be [\"date\", msSinceEpoch]")
+	}
+	d.Time = time.UnixMilli(int64(ms)).UTC()
+	return nil
+}
+
+// BigInt is an arbitrary-precision integer, sent on the wire as the
+// ["bigint", "decimal"] escape that JavaScript clients evaluate to a bigint.
+// Handlers decode BigInt arguments, using IsInt64 and Int64 when the value
+// is known to be small, and may return either a BigInt or a *big.Int.
+type BigInt struct {
+	*big.Int
+}
+
+// MarshalJSON implements json.Marshaler. A BigInt with no value is encoded
+// as null.
+func (b BigInt) MarshalJSON() ([]byte, error) {
+	if b.Int == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal([]interface{}{"bigint", b.String()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *BigInt) UnmarshalJSON(data []byte) error {
+	var escape []interface{}
+	if err := json.Unmarshal(data, &escape); err != nil {
+		return fmt.Errorf("bigint must be [\"bigint\", \"decimal\"]: %w", err)
+	}
+	if len(escape) != 2 || escape[0] != "bigint" {
+		return fmt.Errorf("bigint must be [\"bigint\", \"decimal\"]")
+	}
+	digits, ok := escape[1].(string)
+	if !ok {
+		return fmt.Errorf("bigint must be [\"bigint\", \"decimal\"]")
+	}
+	n, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return fmt.Errorf("invalid bigint: %q", digits)
+	}
+	b.Int = n
+	return nil
+}
+
+// Undefined is JavaScript's undefined, sent on the wire as the ["undefined"]
+// escape to distinguish it from null. Handlers return Undefined{} for
+// undefined and detect undefined arguments with IsUndefined.
+type Undefined struct{}
+
+// MarshalJSON implements json.Marshaler.
+func (Undefined) MarshalJSON() ([]byte, error) {
+	return []byte(`["undefined"]`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (*Undefined) UnmarshalJSON(data []byte) error {
+	if !IsUndefined(json.RawMessage(data)) {
+		return fmt.Errorf("undefined must be [\"undefined\"]")
+	}
+	return nil
+}
+
+// IsUndefined reports whether value is undefined: Undefined, or the
+// ["undefined"] escape as raw JSON or as decoded into an interface{}.
+func IsUndefined(value interface{}) bool {
+	switch v := value.(type) {
+	case Undefined, *Undefined:
+		return true
+	case json.RawMessage:
+		var escape []interface{}
+		return json.Unmarshal(v, &escape) == nil && IsUndefined(escape)
+	case []interface{}:
+		return len(v) == 1 && v[0] == "undefined"
+	}
+	return false
+}
+
+// Bytes is binary data, sent on the wire as the ["bytes", "base64"] escape
+// that JavaScript clients evaluate to a Uint8Array. Handlers decode Bytes
+// arguments and may return either Bytes or a []byte, which is sent as bytes
+// wherever it appears, including struct fields.
+type Bytes []byte
+
+// MarshalJSON implements json.Marshaler.
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{"bytes", base64.StdEncoding.EncodeToString(b)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Padding is optional.
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var escape []interface{}
+	if err := json.Unmarshal(data, &escape); err != nil {
+		return fmt.Errorf("bytes must be [\"bytes\", \"base64\"]: %w", err)
+	}
+	if len(escape) != 2 || escape[0] != "bytes" {
+		return fmt.Errorf("bytes must be [\"bytes\", \"base64\"]")
+	}
+	encoded, ok := escape[1].(string)
+	if !ok {
+		return fmt.Errorf("bytes must be [\"bytes\", \"base64\"]")
+	}
+	decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return fmt.Errorf("invalid bytes: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// Float is a number that may be NaN or infinite, which JSON cannot express.
+// Those are sent on the wire as the ["nan"], ["inf"] and ["-inf"] escapes
+// that JavaScript clients evaluate to NaN, Infinity and -Infinity; other
+// values are sent as plain numbers. Results may hold non-finite float64
+// values, at any depth, and are sent with the escapes. Handlers decode Float
+// arguments to receive them.
+type Float float64
+
+// MarshalJSON implements json.Marshaler.
+func (f Float) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsNaN(v):
+		return []byte(`["nan"]`), nil
+	case math.IsInf(v, 1):
+		return []byte(`["inf"]`), nil
+	case math.IsInf(v, -1):
+		return []byte(`["-inf"]`), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts a number or one of
+// the escapes.
+func (f *Float) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("float must be a number, [\"nan\"], [\"inf\"] or [\"-inf\"]: %w", err)
+	}
+	if n, ok := value.(float64); ok {
+		*f = Float(n)
+		return nil
+	}
+	if escape, ok := value.([]interface{}); ok {
+		if special, ok := reviveEscape(escape); ok {
+			if n, ok := special.(Float); ok {
+				*f = n
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("float must be a number, [\"nan\"], [\"inf\"] or [\"-inf\"]")
+}
+
+// isFinite reports whether f can be encoded as a JSON number.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// escapeValue returns the escape type that carries value on the wire, if
+// value is a Go type that has one.
+func escapeValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return Date{v}, true
+	case *big.Int:
+		return BigInt{v}, true
+	case []byte:
+		return Bytes(v), true
+	}
+	return value, false
+}
+
+// leafEscape returns the escape that carries a value found by escapeWithin,
+// if it has one.
+type leafEscape func(value reflect.Value) (interface{}, bool, error)
+
+// escapeNonFinite is the leafEscape of non-finite floats.
+func escapeNonFinite(value reflect.Value) (interface{}, bool, error) {
+	switch value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if f := value.Float(); !isFinite(f) {
+			return Float(f), true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// escapeWithin returns value with each value within it that escape has an
+// escape for replaced by that escape, and the structs, maps and slices that
+// hold one converted into maps and []interface{}, named as encoding/json
+// names them. It reports whether value held any. It lets values that
+// encoding/json would encode differently, or refuse, be sent with their
+// escapes instead. Values reached through unexported embedded structs,
+// which cannot be used as they are, are always converted.
+func escapeWithin(value reflect.Value, escape leafEscape) (interface{}, bool, error) {
+	if !value.IsValid() {
+		return nil, false, nil
+	}
+	if escaped, ok, err := escape(value); ok || err != nil {
+		return escaped, ok, err
+	}
+
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			return escapeWithin(value.Elem(), escape)
+		}
+	case reflect.Slice, reflect.Array:
+		elems := make([]interface{}, value.Len())
+		escaped := false
+		for i := range elems {
+			elem, found, err := escapeWithin(value.Index(i), escape)
+			if err != nil {
+				return nil, false, err
+			}
+			elems[i] = elem
+			escaped = escaped || found
+		}
+		if escaped || !value.CanInterface() {
+			return elems, escaped, nil
+		}
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			break
+		}
+		fields := make(map[string]interface{}, value.Len())
+		escaped := false
+		iter := value.MapRange()
+		for iter.Next() {
+			field, found, err := escapeWithin(iter.Value(), escape)
+			if err != nil {
+				return nil, false, err
+			}
+			fields[iter.Key().String()] = field
+			escaped = escaped || found
+		}
+		if escaped || !value.CanInterface() {
+			return fields, escaped, nil
+		}
+	case reflect.Struct:
+		if isMarshaler(value) {
+			break
+		}
+		fields := make(map[string]interface{})
+		escaped, err := escapeStructFields(value, fields, escape)
+		if err != nil {
+			return nil, false, err
+		}
+		if escaped || !value.CanInterface() {
+			return fields, escaped, nil
+		}
+	}
+
+	if value.CanInterface() {
+		return value.Interface(), false, nil
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		return value.Bool(), false, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), false, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint(), false, nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, nil
+	case reflect.String:
+		return value.String(), false, nil
+	}
+	return nil, false, nil
+}
+
+// isMarshaler reports whether value encodes itself through json.Marshaler.
+func isMarshaler(value reflect.Value) bool {
+	if !value.CanInterface() {
+		return false
+	}
+	_, ok := value.Interface().(json.Marshaler)
+	return ok
+}
+
+// escapeStructFields adds the fields of a struct encoding/json would encode
+// to fields, through escapeWithin, and reports whether any held a value
+// escape has an escape for. The fields of untagged embedded structs are
+// promoted.
+func escapeStructFields(value reflect.Value, fields map[string]interface{}, escape leafEscape) (bool, error) {
+	escaped := false
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		fieldValue := value.Field(i)
+		if field.Anonymous && name == "" {
+			embedded := fieldValue
+			if embedded.Kind() == reflect.Pointer {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct && !isMarshaler(embedded) {
+				found, err := escapeStructFields(embedded, fields, escape)
+				if err != nil {
+					return false, err
+				}
+				escaped = escaped || found
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fieldValue) {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fieldEscape, found, err := escapeWithin(fieldValue, escape)
+		if err != nil {
+			return false, err
+		}
+		fields[name] = fieldEscape
+		escaped = escaped || found
+	}
+	return escaped, nil
+}
+
+// isEmptyValue reports whether encoding/json's omitempty option omits v.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package gocapnweb
+
+import (
+	"sync"
+)
+
+// DefaultEventBufferSize is the number of events buffered per subscriber of
+// a LocalEventBus before further events are dropped for that subscriber.
+const DefaultEventBufferSize = 64
+
+// EventBus distributes events between processes (or components of one
+// process) so that connections held by one server instance can be reached
+// from another.
+type EventBus interface {
+	// Publish delivers event to every current subscriber of topic.
+	Publish(topic string, event []byte) error
+	// Subscribe returns a channel of events published to topic and a
+	// function that ends the subscription and closes the channel.
+	Subscribe(topic string) (<-chan []byte, func())
+}
+
+// LocalEventBus is an in-memory EventBus for components within a single
+// process. Publishing never blocks: a subscriber whose buffer is full misses
+// the event.
+type LocalEventBus struct {
+	subscribers map[string]map[*localSubscriber]struct{}
+	mu          sync.RWMutex
+}
+
+type localSubscriber struct {
+	ch   chan []byte
+	once sync.Once
+}
+
+// NewLocalEventBus creates an empty LocalEventBus.
+func NewLocalEventBus() *LocalEventBus {
+	return &LocalEventBus{
+		subscribers: make(map[string]map[*localSubscriber]struct{}),
+	}
+}
+
+// Publish implements EventBus.
+func (b *LocalEventBus) Publish(topic string, event []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers[topic] {
+		select {
+		case sub.ch <- event:
+		default:
+			// Subscriber is not keeping up; drop rather than block the publisher
+		}
+	}
+	return nil
+}
+
+// Subscribe implements EventBus.
+func (b *LocalEventBus) Subscribe(topic string) (<-chan []byte, func()) {
+	sub := &localSubscriber{ch: make(chan []byte, DefaultEventBufferSize)}
+
+	b.mu.Lock()
+	if b.subscribers[topic] == nil {
+		b.subscribers[topic] = make(map[*localSubscriber]struct{})
+	}
+	b.subscribers[topic][sub] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		sub.once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers[topic], sub)
+			if len(b.subscribers[topic]) == 0 {
+				delete(b.subscribers, topic)
+			}
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+	return sub.ch, unsubscribe
+}
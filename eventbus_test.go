@@ -0,0 +1,85 @@
+package gocapnweb
+
+import (
+	"testing"
+	"time"
+)
+
+// chanWriter is a MessageWriter that delivers each message to a channel.
+type chanWriter chan []byte
+
+func (w chanWriter) WriteMessage(messageType int, data []byte) error {
+	w <- data
+	return nil
+}
+
+// testRegistriesShareBus attaches two registries to topic on buses a and b,
+// which must share events, and checks that an event published on a reaches
+// the connections of both registries.
+func testRegistriesShareBus(t *testing.T, a, b EventBus) {
+	t.Helper()
+	first, second := NewConnectionRegistry(), NewConnectionRegistry()
+	firstConn, secondConn := make(chanWriter, DefaultMessageQueueSize), make(chanWriter, DefaultMessageQueueSize)
+	firstQueue, secondQueue := NewMessageQueue(firstConn, 0), NewMessageQueue(secondConn, 0)
+	defer firstQueue.Close()
+	defer secondQueue.Close()
+	first.Register("first", firstQueue)
+	second.Register("second", secondQueue)
+
+	detachFirst := first.AttachEventBus(a, "notify")
+	defer detachFirst()
+	detachSecond := second.AttachEventBus(b, "notify")
+	defer detachSecond()
+
+	// Subscriptions may take effect asynchronously, so the event is
+	// published until it arrives
+	event := []byte(`["notify",1,"update"]`)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	received := map[string]bool{}
+	for len(received) < 2 {
+		select {
+		case <-ticker.C:
+			if err := a.Publish("notify", event); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+		case got := <-firstConn:
+			if string(got) != string(event) {
+				t.Fatalf("first connection received %s", got)
+			}
+			received["first"] = true
+		case got := <-secondConn:
+			if string(got) != string(event) {
+				t.Fatalf("second connection received %s", got)
+			}
+			received["second"] = true
+		case <-timeout:
+			t.Fatalf("event not received by every registry: %v", received)
+		}
+	}
+}
+
+func TestLocalEventBusSharedBetweenRegistries(t *testing.T) {
+	bus := NewLocalEventBus()
+	testRegistriesShareBus(t, bus, bus)
+}
+
+func TestLocalEventBusTopics(t *testing.T) {
+	bus := NewLocalEventBus()
+	events, unsubscribe := bus.Subscribe("a")
+	bus.Publish("b", []byte("other"))
+	bus.Publish("a", []byte("mine"))
+	if got := <-events; string(got) != "mine" {
+		t.Errorf("received %q, want %q", got, "mine")
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, open := <-events; open {
+		t.Error("channel still open after unsubscribing")
+	}
+	if err := bus.Publish("a", []byte("late")); err != nil {
+		t.Errorf("Publish after unsubscribe: %v", err)
+	}
+}
@@ -32,7 +32,7 @@ type UserServer struct {
 // NewUserServer creates a new UserServer instance with sample data.
 func NewUserServer() *UserServer {
 	server := &UserServer{
-		BaseRpcTarget: gocapnweb.NewBaseRpcTarget(),
+		BaseRpcTarget: gocapnweb.NewBaseRpcTarget(gocapnweb.WithServerName("batch-pipelining")),
 		users:         make(map[string]User),
 		profiles:      make(map[string]Profile),
 		notifications: make(map[string][]string),
@@ -41,10 +41,19 @@ func NewUserServer() *UserServer {
 	// Initialize sample data
 	server.initializeData()
 
-	// Register RPC methods
-	server.Method("authenticate", server.authenticate)
-	server.Method("getUserProfile", server.getUserProfile)
-	server.Method("getNotifications", server.getNotifications)
+	// Log every call with its duration and outcome
+	server.UseMiddleware(gocapnweb.LoggingMiddleware(nil))
+
+	// Register RPC methods, annotated for /rpc/__introspect
+	server.Method("authenticate", server.authenticate,
+		gocapnweb.WithDescription("Looks up the user signed in with a session token"),
+		gocapnweb.WithSignature([]string{"sessionToken string"}, "User"))
+	server.Method("getUserProfile", server.getUserProfile,
+		gocapnweb.WithDescription("Returns a user's profile"),
+		gocapnweb.WithSignature([]string{"userID string"}, "Profile"))
+	server.Method("getNotifications", server.getNotifications,
+		gocapnweb.WithDescription("Returns a user's notifications"),
+		gocapnweb.WithSignature([]string{"userID string"}, "[]string"))
 
 	return server
 }
@@ -154,26 +163,35 @@ func (s *UserServer) getNotifications(args json.RawMessage) (interface{}, error)
 }
 
 func main() {
-	// Default to serving static files from the examples/static directory
-	staticPath := "/static"
-	if len(os.Args) >= 2 {
-		staticPath = os.Args[1]
+	// Load configuration from CAPNWEB_* environment variables
+	cfg, err := gocapnweb.LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
 	}
 
-	port := ":8000"
+	// A command-line argument still overrides the static files directory
+	if len(os.Args) >= 2 {
+		cfg.StaticPath = os.Args[1]
+	}
 
-	// Create Echo server with middleware
-	e := gocapnweb.SetupEchoServer()
+	port := cfg.Port
+	staticPath := cfg.StaticPath
 
-	// Setup RPC endpoint
+	// Create the Echo server with the RPC and static file endpoints
 	server := NewUserServer()
-	gocapnweb.SetupRpcEndpoint(e, "/rpc", server)
+	e, err := gocapnweb.SetupAll(port, "/rpc", "/static", staticPath, server,
+		gocapnweb.WithEndpointOptions(cfg.RpcEndpointOptions()...))
+	if err != nil {
+		log.Fatal("Failed to set up server:", err)
+	}
 
-	// Setup static file endpoint
-	gocapnweb.SetupFileEndpoint(e, "/static", staticPath)
+	// Serve the same target over Server-Sent Events for clients that
+	// cannot open a WebSocket
+	gocapnweb.SetupSSEEndpoint(e, "/rpc/sse", server)
 
 	log.Printf("🚀 Batch Pipelining Go Server (Echo) starting on port %s", port)
 	log.Printf("🔌 HTTP Batch RPC endpoint: http://localhost%s/rpc", port)
+	log.Printf("📡 SSE RPC endpoint: http://localhost%s/rpc/sse", port)
 	log.Printf("🌐 Demo URL: http://localhost:3000 (available once you start the Svelte development server)")
 	log.Println()
 	log.Println("Sample data:")
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gocapnweb/testharness"
+)
+
+func TestPipelinedCalls(t *testing.T) {
+	server := NewUserServer()
+	client := testharness.NewInProcessClient(testharness.NewRpcSessionForTest(t, server), server)
+	pipeline := testharness.NewPipelineAssert(client)
+
+	// The profile and notifications calls use the ID of the user
+	// authenticate returns, before it has been pulled
+	user := pipeline.Push("authenticate", []string{"cookie-123"})
+	profile := pipeline.Push("getUserProfile", []interface{}{user.Ref("id")})
+	notifications := pipeline.Push("getNotifications", []interface{}{user.Ref("id")})
+
+	user.Pull().ExpectResolve(t, User{ID: "u_1", Name: "Ada Lovelace"})
+	profile.Pull().ExpectResolve(t, Profile{ID: "u_1", Bio: "Mathematician & first programmer"})
+	notifications.Pull().ExpectResolve(t, []string{"Welcome to jsrpc!", "You have 2 new followers"})
+}
+
+func TestPipelinedCallsOnFailedCall(t *testing.T) {
+	server := NewUserServer()
+	client := testharness.NewInProcessClient(testharness.NewRpcSessionForTest(t, server), server)
+	pipeline := testharness.NewPipelineAssert(client)
+
+	// A call whose argument refers to a failed call fails with it
+	user := pipeline.Push("authenticate", []string{"expired"})
+	profile := pipeline.Push("getUserProfile", []interface{}{user.Ref("id")})
+	profile.Pull().ExpectReject(t, "MethodError")
+	user.Pull().ExpectReject(t, "MethodError")
+
+	pipeline.Push("getNotifications", []string{"u_9"}).Pull().ExpectResolve(t, []string{})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,32 +15,6 @@ import (
 
 const blueskyAPIBase = "https://public.api.bsky.app/xrpc"
 
-// sanitizeJSON recursively removes or renames keys starting with "$" to avoid
-// conflicts with Cap'n Web RPC's special value handling
-func sanitizeJSON(data interface{}) interface{} {
-	switch v := data.(type) {
-	case map[string]interface{}:
-		result := make(map[string]interface{})
-		for key, val := range v {
-			// Rename keys starting with "$" to avoid Cap'n Web protocol conflicts
-			newKey := key
-			if len(key) > 0 && key[0] == '$' {
-				newKey = "_" + key[1:] // Replace $ with _ (e.g., $type -> _type)
-			}
-			result[newKey] = sanitizeJSON(val)
-		}
-		return result
-	case []interface{}:
-		result := make([]interface{}, len(v))
-		for i, item := range v {
-			result[i] = sanitizeJSON(item)
-		}
-		return result
-	default:
-		return v
-	}
-}
-
 // BlueskyProfile represents a Bluesky profile response
 type BlueskyProfile struct {
 	DID            string `json:"did"`
@@ -95,30 +70,23 @@ func NewBlueskyServer() *BlueskyServer {
 	}
 
 	// Register RPC methods
-	server.Method("getProfile", server.getProfile)
-	server.Method("getFeed", server.getFeed)
+	if err := server.TypedMethod("getProfile", server.getProfile); err != nil {
+		log.Fatalf("Failed to register getProfile: %v", err)
+	}
+	// getFeed's limit defaults to 10 when the caller omits it
+	if err := server.MethodWithDefaults("getFeed", json.RawMessage(`[null, 10]`), server.getFeed); err != nil {
+		log.Fatalf("Failed to register getFeed: %v", err)
+	}
 
 	return server
 }
 
-// getProfile fetches a Bluesky profile by handle
-func (s *BlueskyServer) getProfile(args json.RawMessage) (interface{}, error) {
-	// Extract handle from arguments
-	var handle string
-
-	// Try to parse as array first
-	var argArray []string
-	if err := json.Unmarshal(args, &argArray); err == nil && len(argArray) > 0 {
-		handle = argArray[0]
-	} else {
-		// Try to parse as string
-		if err := json.Unmarshal(args, &handle); err != nil {
-			return nil, fmt.Errorf("invalid arguments: expected handle")
-		}
-	}
-
+// getProfile fetches a Bluesky profile by handle. The API request is
+// abandoned if the client disconnects.
+func (s *BlueskyServer) getProfile(ctx context.Context, handle string) (BlueskyProfile, error) {
+	var profile BlueskyProfile
 	if handle == "" {
-		return nil, fmt.Errorf("handle is required")
+		return profile, fmt.Errorf("handle is required")
 	}
 
 	// Build API URL
@@ -127,26 +95,29 @@ func (s *BlueskyServer) getProfile(args json.RawMessage) (interface{}, error) {
 	log.Printf("Fetching profile for handle: %s", handle)
 
 	// Make API request
-	resp, err := s.httpClient.Get(apiURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch profile: %w", err)
+		return profile, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return profile, fmt.Errorf("failed to fetch profile: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+		return profile, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
 	}
 
 	// Parse response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return profile, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	var profile BlueskyProfile
 	if err := json.Unmarshal(body, &profile); err != nil {
-		return nil, fmt.Errorf("failed to parse profile: %w", err)
+		return profile, fmt.Errorf("failed to parse profile: %w", err)
 	}
 
 	log.Printf("Successfully fetched profile for %s (DID: %s)", profile.Handle, profile.DID)
@@ -171,12 +142,12 @@ func (s *BlueskyServer) getFeed(args json.RawMessage) (interface{}, error) {
 		return nil, fmt.Errorf("handle must be a string")
 	}
 
-	limit := 10
-	if len(argArray) > 1 {
-		if limitFloat, ok := argArray[1].(float64); ok {
-			limit = int(limitFloat)
-		}
+	// The limit is always present once defaults have been applied
+	limitFloat, ok := argArray[1].(float64)
+	if !ok {
+		return nil, fmt.Errorf("limit must be a number")
 	}
+	limit := int(limitFloat)
 
 	// Build API URL
 	apiURL := fmt.Sprintf("%s/app.bsky.feed.getAuthorFeed?actor=%s&limit=%d",
@@ -202,17 +173,15 @@ func (s *BlueskyServer) getFeed(args json.RawMessage) (interface{}, error) {
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Parse as generic JSON first, then sanitize to avoid $ key conflicts
+	// Parse as generic JSON; the session renames the $-prefixed keys of
+	// the records in the result
 	var rawResponse map[string]interface{}
 	if err := json.Unmarshal(body, &rawResponse); err != nil {
 		return nil, fmt.Errorf("failed to parse feed: %w", err)
 	}
 
-	// Sanitize the entire response
-	sanitized := sanitizeJSON(rawResponse).(map[string]interface{})
-
 	// Extract feed array
-	feedArray, ok := sanitized["feed"].([]interface{})
+	feedArray, ok := rawResponse["feed"].([]interface{})
 	if !ok {
 		return nil, fmt.Errorf("unexpected feed response format")
 	}
@@ -258,13 +227,12 @@ func (s *BlueskyServer) getFeed(args json.RawMessage) (interface{}, error) {
 	log.Printf("Successfully fetched %d posts for %s", len(posts), handle)
 
 	cursor := ""
-	if c, ok := sanitized["cursor"].(string); ok {
+	if c, ok := rawResponse["cursor"].(string); ok {
 		cursor = c
 	}
 
-	// Wrap the posts array in another array to escape it for Cap'n Web
 	result := map[string]interface{}{
-		"posts":  []interface{}{posts}, // Double-wrap: [[{...}]]
+		"posts":  posts,
 		"cursor": cursor,
 	}
 
@@ -285,23 +253,32 @@ func getIntOrZero(m map[string]interface{}, key string) int {
 }
 
 func main() {
-	// Default to serving static files from the examples/static directory
-	staticPath := "/static"
-	if len(os.Args) >= 2 {
-		staticPath = os.Args[1]
+	// Load configuration from CAPNWEB_* environment variables
+	cfg, err := gocapnweb.LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
 	}
 
-	port := ":8000"
+	// A command-line argument still overrides the static files directory
+	if len(os.Args) >= 2 {
+		cfg.StaticPath = os.Args[1]
+	}
 
-	// Create Echo server with middleware
-	e := gocapnweb.SetupEchoServer()
+	port := cfg.Port
+	staticPath := cfg.StaticPath
 
-	// Setup RPC endpoint
+	// Create the Echo server with the RPC and static file endpoints
 	server := NewBlueskyServer()
-	gocapnweb.SetupRpcEndpoint(e, "/rpc", server)
 
-	// Setup static file endpoint
-	gocapnweb.SetupFileEndpoint(e, "/static", staticPath)
+	// AT Protocol records carry $type keys; rename them to _type so
+	// clients do not mistake them for protocol values
+	endpointOptions := append(cfg.RpcEndpointOptions(),
+		gocapnweb.WithSessionOptions(gocapnweb.WithKeySanitizer(gocapnweb.SanitizeDollarPrefix)))
+	e, err := gocapnweb.SetupAll(port, "/rpc", "/static", staticPath, server,
+		gocapnweb.WithEndpointOptions(endpointOptions...))
+	if err != nil {
+		log.Fatal("Failed to set up server:", err)
+	}
 
 	log.Printf("🚀 Bluesky Feed Reader Go Server starting on port %s", port)
 	log.Printf("🔌 HTTP Batch RPC endpoint: http://localhost%s/rpc", port)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gocapnweb"
+	"github.com/gocapnweb/testharness"
+)
+
+// roundTripFunc is an http.RoundTripper that answers requests itself.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper.
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// fakeAPI answers the Bluesky API requests the server makes with canned
+// responses, so tests run without the network.
+func fakeAPI(req *http.Request) (*http.Response, error) {
+	body := `{"error":"NotFound"}`
+	status := http.StatusNotFound
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/app.bsky.actor.getProfile") && req.URL.Query().Get("actor") == "ada.bsky.social":
+		status = http.StatusOK
+		body = `{"did":"did:plc:ada","handle":"ada.bsky.social","displayName":"Ada","followersCount":3,"followsCount":2,"postsCount":1}`
+	case strings.HasSuffix(req.URL.Path, "/app.bsky.feed.getAuthorFeed") && req.URL.Query().Get("actor") == "ada.bsky.social":
+		status = http.StatusOK
+		body = `{"feed":[{"post":{"uri":"at://post/1","cid":"c1","indexedAt":"2024-01-01T00:00:00Z","likeCount":5,` +
+			`"author":{"did":"did:plc:ada","handle":"ada.bsky.social"},"record":{"$type":"app.bsky.feed.post","text":"hello"}}}],"cursor":"next"}`
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// wantFeed is the result of getFeed for the feed fakeAPI serves, without
+// the fields of posts that are not displayed.
+var wantFeed = map[string]interface{}{
+	"cursor": "next",
+	"posts": []interface{}{map[string]interface{}{
+		"uri":         "at://post/1",
+		"cid":         "c1",
+		"indexedAt":   "2024-01-01T00:00:00Z",
+		"replyCount":  0,
+		"repostCount": 0,
+		"likeCount":   5,
+		"author":      map[string]interface{}{"did": "did:plc:ada", "handle": "ada.bsky.social", "displayName": nil, "avatar": nil},
+		"record":      map[string]interface{}{"text": "hello"},
+	}},
+}
+
+func TestProfileAndFeed(t *testing.T) {
+	server := NewBlueskyServer()
+	server.httpClient = &http.Client{Transport: roundTripFunc(fakeAPI)}
+	client := testharness.NewInProcessClient(testharness.NewRpcSessionForTest(t, server), server)
+	pipeline := testharness.NewPipelineAssert(client)
+
+	// The feed is fetched for the handle of the profile, in one round trip
+	profile := pipeline.Push("getProfile", []string{"ada.bsky.social"})
+	feed := pipeline.Push("getFeed", []interface{}{profile.Ref("handle"), 1})
+	profile.Pull().ExpectResolve(t, BlueskyProfile{
+		DID:            "did:plc:ada",
+		Handle:         "ada.bsky.social",
+		DisplayName:    "Ada",
+		FollowersCount: 3,
+		FollowsCount:   2,
+		PostsCount:     1,
+	})
+	feed.Pull().ExpectResolve(t, wantFeed)
+
+	// The limit defaults to 10
+	pipeline.Push("getFeed", []string{"ada.bsky.social"}).Pull().ExpectResolve(t, wantFeed)
+}
+
+func TestProfileErrors(t *testing.T) {
+	server := NewBlueskyServer()
+	server.httpClient = &http.Client{Transport: roundTripFunc(fakeAPI)}
+	client := testharness.NewInProcessClient(testharness.NewRpcSessionForTest(t, server), server)
+	pipeline := testharness.NewPipelineAssert(client)
+
+	pipeline.Push("getProfile", []string{""}).Pull().ExpectReject(t, "MethodError")
+	pipeline.Push("getProfile", []string{"nobody.bsky.social"}).Pull().ExpectReject(t, "MethodError")
+	pipeline.Push("getProfile", []int{1}).Pull().ExpectReject(t, "ArgumentError")
+	pipeline.Push("getFeed", []interface{}{}).Pull().ExpectReject(t, "MethodError")
+}
+
+func TestProfileSchema(t *testing.T) {
+	data, err := gocapnweb.InferSchema(reflect.TypeOf(BlueskyProfile{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]struct {
+			Type string `json:"type"`
+		} `json:"properties"`
+		Required []string `json:"required"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	required := make(map[string]bool)
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	for _, name := range []string{"did", "handle", "followersCount"} {
+		if !required[name] {
+			t.Errorf("%s is optional, want required", name)
+		}
+	}
+	for _, name := range []string{"displayName", "description", "avatar", "banner"} {
+		if required[name] {
+			t.Errorf("%s is required, want optional", name)
+		}
+	}
+	if got := schema.Properties["handle"].Type; got != "string" {
+		t.Errorf("handle has type %q, want string", got)
+	}
+	if got := schema.Properties["postsCount"].Type; got != "integer" {
+		t.Errorf("postsCount has type %q, want integer", got)
+	}
+}
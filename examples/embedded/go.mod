@@ -0,0 +1,24 @@
+module github.com/gocapnweb/examples/embedded
+
+go 1.23.0
+
+toolchain go1.24.2
+
+replace github.com/gocapnweb => ../..
+
+require github.com/gocapnweb v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/labstack/echo/v4 v4.13.4 // indirect
+	github.com/labstack/gommon v0.4.2 // indirect
+	github.com/mattn/go-colorable v0.1.14 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasttemplate v1.2.2 // indirect
+	golang.org/x/crypto v0.38.0 // indirect
+	golang.org/x/net v0.40.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
+	golang.org/x/time v0.11.0 // indirect
+)
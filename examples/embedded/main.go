@@ -0,0 +1,64 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"log"
+
+	"github.com/gocapnweb"
+)
+
+// staticFiles holds the demo page, compiled into the binary so the server
+// runs without any files alongside it.
+//
+//go:embed static
+var staticFiles embed.FS
+
+// NewGreeterServer creates an RPC target with a single hello method.
+func NewGreeterServer() *gocapnweb.BaseRpcTarget {
+	server := gocapnweb.NewBaseRpcTarget()
+
+	server.Method("hello", func(args json.RawMessage) (interface{}, error) {
+		var argArray []string
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return "Hello, World!", nil
+		}
+		return "Hello, " + argArray[0] + "!", nil
+	})
+
+	return server
+}
+
+func main() {
+	// Load configuration from CAPNWEB_* environment variables
+	cfg, err := gocapnweb.LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
+	}
+
+	port := cfg.Port
+
+	// Serve the embedded static directory at /static
+	root, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		log.Fatal("Failed to open embedded files:", err)
+	}
+
+	// Create Echo server with middleware
+	e := gocapnweb.SetupEchoServer()
+
+	// Setup RPC endpoint
+	gocapnweb.SetupRpcEndpoint(e, "/api", NewGreeterServer(), cfg.RpcEndpointOptions()...)
+
+	// Setup embedded static file endpoint
+	gocapnweb.SetupFileEndpointFS(e, "/static", root)
+
+	log.Printf("🚀 Embedded Assets Go Server (Echo) starting on port %s", port)
+	log.Printf("🌐 Demo URL: http://localhost%s/static/", port)
+	log.Printf("🔌 HTTP Batch RPC endpoint: http://localhost%s/api", port)
+
+	if err := e.Start(port); err != nil {
+		log.Fatal("Failed to start server:", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gocapnweb"
+)
+
+// testFiles holds a static tree with a subdirectory, served like the
+// example's own files.
+//
+//go:embed testdata
+var testFiles embed.FS
+
+// startServer serves root at /static and the greeter at /api, as main does.
+func startServer(t *testing.T, root fs.FS) *httptest.Server {
+	t.Helper()
+	e := gocapnweb.SetupEchoServer()
+	gocapnweb.SetupRpcEndpoint(e, "/api", NewGreeterServer())
+	gocapnweb.SetupFileEndpointFS(e, "/static", root)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get requests path from server and returns the response and its body.
+func get(t *testing.T, server *httptest.Server, path string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestEmbeddedFiles(t *testing.T) {
+	root, err := fs.Sub(testFiles, "testdata/static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, root)
+
+	// contentType is the media type expected, if any; the system MIME
+	// tables can disagree on types such as JavaScript's
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{path: "/static/", status: http.StatusOK, contentType: "text/html", body: "<!DOCTYPE html>\n<title>index</title>\n"},
+		{path: "/static/index.html", status: http.StatusOK, contentType: "text/html", body: "<!DOCTYPE html>\n<title>index</title>\n"},
+		{path: "/static/css/site.css", status: http.StatusOK, contentType: "text/css", body: "body { margin: 0; }\n"},
+		{path: "/static/app.js", status: http.StatusOK, body: "export const ok = true;\n"},
+		{path: "/static/missing.js", status: http.StatusNotFound},
+		{path: "/static/css", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, body := get(t, server, tt.path)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if tt.contentType != "" {
+				mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+				if err != nil || mediaType != tt.contentType {
+					t.Errorf("Content-Type = %q, want %s", resp.Header.Get("Content-Type"), tt.contentType)
+				}
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	root, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, root)
+
+	// Every file the example embeds is served as it is
+	err = fs.WalkDir(root, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		want, err := fs.ReadFile(root, path)
+		if err != nil {
+			return err
+		}
+		resp, body := get(t, server, "/static/"+path)
+		if resp.StatusCode != http.StatusOK || body != string(want) {
+			t.Errorf("%s: status %d, %d bytes; want the embedded %d bytes", path, resp.StatusCode, len(body), len(want))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The page's script calls the greeter over the HTTP batch endpoint
+	resp, err := http.Post(server.URL+"/api", gocapnweb.ContentTypeText, strings.NewReader(
+		`["push",["pipeline",0,["hello"],["embed"]]]`+"\n"+`["pull",1]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got, want := strings.TrimSpace(string(body)), `["resolve",1,"Hello, embed!"]`; got != want {
+		t.Errorf("hello = %s, want %s", got, want)
+	}
+}
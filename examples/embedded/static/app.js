@@ -0,0 +1,25 @@
+// Calls the hello method over the HTTP batch endpoint: one push and one
+// pull in a single request.
+async function hello(name) {
+  const body = [
+    JSON.stringify(["push", ["pipeline", 0, ["hello"], [name]]]),
+    JSON.stringify(["pull", 1]),
+  ].join("\n");
+
+  const response = await fetch("/api", { method: "POST", body });
+  const [type, , value] = JSON.parse(await response.text());
+  if (type !== "resolve") {
+    throw new Error(value[2]);
+  }
+  return value;
+}
+
+document.getElementById("greet").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const result = document.getElementById("result");
+  try {
+    result.textContent = await hello(document.getElementById("name").value);
+  } catch (err) {
+    result.textContent = "Error: " + err.message;
+  }
+});
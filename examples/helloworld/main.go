@@ -16,11 +16,11 @@ type HelloServer struct {
 // NewHelloServer creates a new HelloServer instance.
 func NewHelloServer() *HelloServer {
 	server := &HelloServer{
-		BaseRpcTarget: gocapnweb.NewBaseRpcTarget(),
+		BaseRpcTarget: gocapnweb.NewBaseRpcTarget(gocapnweb.WithServerName("helloworld")),
 	}
 
-	// Register the hello method
-	server.Method("hello", func(args json.RawMessage) (interface{}, error) {
+	// hello greets the name it is given, or the world
+	hello := func(args json.RawMessage) (interface{}, error) {
 		// Parse arguments as array of strings
 		var argArray []string
 		if err := json.Unmarshal(args, &argArray); err != nil {
@@ -32,37 +32,52 @@ func NewHelloServer() *HelloServer {
 		}
 
 		return "Hello, " + argArray[0] + "!", nil
-	})
+	}
+
+	// Register the hello method, annotated for /api/__introspect
+	server.Method("hello", hello,
+		gocapnweb.WithDescription("Greets the given name, or the world"),
+		gocapnweb.WithSignature([]string{"name string (optional)"}, "string"))
 
 	return server
 }
 
 func main() {
-	// Default to serving static files from the examples/static directory
-	staticPath := "/static"
-	if len(os.Args) >= 2 {
-		staticPath = os.Args[1]
+	// Load configuration from CAPNWEB_* environment variables
+	cfg, err := gocapnweb.LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
 	}
 
-	port := ":8000"
+	// A command-line argument still overrides the static files directory
+	if len(os.Args) >= 2 {
+		cfg.StaticPath = os.Args[1]
+	}
 
-	// Create Echo server with middleware
-	e := gocapnweb.SetupEchoServer()
+	port := cfg.Port
+	staticPath := cfg.StaticPath
 
-	// Setup RPC endpoint
+	// Create the Echo server with the RPC and static file endpoints
 	server := NewHelloServer()
-	gocapnweb.SetupRpcEndpoint(e, "/api", server)
+	e, err := gocapnweb.SetupAll(port, "/api", "/static", staticPath, server,
+		gocapnweb.WithEndpointOptions(cfg.RpcEndpointOptions()...))
+	if err != nil {
+		log.Fatal("Failed to set up server:", err)
+	}
 
-	// Setup static file endpoint
-	gocapnweb.SetupFileEndpoint(e, "/static", staticPath)
+	// Serve the same target over Server-Sent Events for clients that
+	// cannot open a WebSocket
+	gocapnweb.SetupSSEEndpoint(e, "/api/sse", server)
 
 	log.Printf("🚀 Hello World Go Server (Echo) starting on port %s", port)
 	log.Printf("🔌 WebSocket RPC endpoint: ws://localhost%s/api", port)
+	log.Printf("📡 SSE RPC endpoint: http://localhost%s/api/sse", port)
 	log.Printf("🌐 Demo URL: http://localhost:3000 (available once you start the Svelte development server)")
 	log.Println()
 	log.Println("Try the demo:")
 	log.Printf("  curl -X POST http://localhost%s/api -d '[\"push\",[\"pipeline\",1,[\"hello\"],[\"World\"]]]'", port)
 	log.Printf("  curl -X POST http://localhost%s/api -d '[\"pull\",1]'", port)
+	log.Printf("  curl http://localhost%s/api/__introspect", port)
 
 	if err := e.Start(port); err != nil {
 		log.Fatal("Failed to start server:", err)
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gocapnweb/testharness"
+)
+
+func TestHello(t *testing.T) {
+	server := NewHelloServer()
+	client := testharness.NewInProcessClient(testharness.NewRpcSessionForTest(t, server), server)
+	pipeline := testharness.NewPipelineAssert(client)
+
+	pipeline.Push("hello", []string{"Ada"}).Pull().ExpectResolve(t, "Hello, Ada!")
+	pipeline.Push("hello", nil).Pull().ExpectResolve(t, "Hello, World!")
+
+	// The greeting of one call is the name of the next
+	first := pipeline.Push("hello", []string{"Ada"})
+	pipeline.Push("hello", []interface{}{first.Ref()}).Pull().ExpectResolve(t, "Hello, Hello, Ada!!")
+
+	pipeline.Push("goodbye", nil).Pull().ExpectReject(t, "MethodNotFound")
+	pipeline.Push("hello", []int{1}).Pull().ExpectReject(t, "MethodError")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
@@ -23,18 +24,21 @@ type SystemMetrics struct {
 	Timestamp  int64   `json:"timestamp"`
 }
 
-// MetricsServer implements real-time system metrics streaming using polling-based Server Push.
+// MetricsServer implements real-time system metrics streaming, pushing each
+// update to subscribers as a notify frame.
 type MetricsServer struct {
 	*gocapnweb.BaseRpcTarget
-	subscribers   map[string]*Subscription // subscriptionID -> subscription
-	mu            sync.RWMutex
-	metricsBuffer map[string][]SystemMetrics // buffered updates per subscription
+	subscribers map[string]*Subscription // subscriptionID -> subscription
+	mu          sync.RWMutex
+	done        chan struct{} // closed to stop the metrics generator
+	stopOnce    sync.Once
 }
 
 // Subscription represents an active metrics subscription
 type Subscription struct {
 	ID       string
-	LastPull int64 // timestamp of last data pull
+	ExportID int                  // export ID of the subscribe call; updates are sent on it
+	notify   gocapnweb.NotifyFunc // pushes to the subscriber's connection
 }
 
 // MetricsServerWrapper wraps BaseRpcTarget to add debugging
@@ -43,8 +47,14 @@ type MetricsServerWrapper struct {
 }
 
 func (w *MetricsServerWrapper) Dispatch(method string, args json.RawMessage) (interface{}, error) {
+	return w.DispatchContext(context.Background(), method, args)
+}
+
+// DispatchContext is what sessions call, since the embedded BaseRpcTarget
+// accepts a context; it must be overridden for the logging to take effect.
+func (w *MetricsServerWrapper) DispatchContext(ctx context.Context, method string, args json.RawMessage) (interface{}, error) {
 	log.Printf("=== DISPATCH: method=%s, args=%s ===", method, string(args))
-	result, err := w.MetricsServer.BaseRpcTarget.Dispatch(method, args)
+	result, err := w.MetricsServer.BaseRpcTarget.DispatchContext(ctx, method, args)
 	log.Printf("=== DISPATCH RESULT: method=%s, result=%+v, err=%v ===", method, result, err)
 	return result, err
 }
@@ -54,15 +64,14 @@ func NewMetricsServer() *MetricsServerWrapper {
 	server := &MetricsServer{
 		BaseRpcTarget: gocapnweb.NewBaseRpcTarget(),
 		subscribers:   make(map[string]*Subscription),
-		metricsBuffer: make(map[string][]SystemMetrics),
+		done:          make(chan struct{}),
 	}
 
 	wrapper := &MetricsServerWrapper{MetricsServer: server}
 
 	// Register RPC methods
-	server.Method("subscribeSystemMetrics", server.subscribeSystemMetrics)
+	server.MethodWithContext("subscribeSystemMetrics", server.subscribeSystemMetrics)
 	server.Method("unsubscribe", server.unsubscribe)
-	server.Method("pollMetricsUpdates", server.pollMetricsUpdates)
 
 	// Start background metrics generator
 	go server.generateSystemMetrics()
@@ -70,18 +79,30 @@ func NewMetricsServer() *MetricsServerWrapper {
 	return wrapper
 }
 
-func (s *MetricsServer) subscribeSystemMetrics(args json.RawMessage) (interface{}, error) {
+// subscribeSystemMetrics subscribes the calling connection to metrics
+// updates, which are pushed as ["notify", exportID, metrics] frames on the
+// export ID of this call.
+func (s *MetricsServer) subscribeSystemMetrics(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	call, ok := gocapnweb.CallInfoFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("subscriptions require an RPC session")
+	}
+	notify, ok := gocapnweb.NotifierFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("subscriptions require an RPC session")
+	}
+
 	// Create a unique subscription ID
 	subscriptionID := "system_metrics_" + generateID()
 
 	subscription := &Subscription{
 		ID:       subscriptionID,
-		LastPull: time.Now().Unix(),
+		ExportID: call.ExportID,
+		notify:   notify,
 	}
 
 	s.mu.Lock()
 	s.subscribers[subscriptionID] = subscription
-	s.metricsBuffer[subscriptionID] = make([]SystemMetrics, 0)
 	s.mu.Unlock()
 
 	log.Printf("Client subscribed to system metrics: %s", subscriptionID)
@@ -90,7 +111,6 @@ func (s *MetricsServer) subscribeSystemMetrics(args json.RawMessage) (interface{
 		"subscriptionId": subscriptionID,
 		"message":        "Subscribed to real-time system metrics",
 		"status":         "active",
-		"pollInterval":   1000, // milliseconds
 	}
 	log.Printf("subscribeSystemMetrics returning: %+v", response)
 	return response, nil
@@ -111,7 +131,6 @@ func (s *MetricsServer) unsubscribe(args json.RawMessage) (interface{}, error) {
 	s.mu.Lock()
 	if _, exists := s.subscribers[subscriptionID]; exists {
 		delete(s.subscribers, subscriptionID)
-		delete(s.metricsBuffer, subscriptionID)
 		s.mu.Unlock()
 
 		log.Printf("Client unsubscribed: %s", subscriptionID)
@@ -126,56 +145,6 @@ func (s *MetricsServer) unsubscribe(args json.RawMessage) (interface{}, error) {
 	return map[string]string{"error": "subscription not found"}, nil
 }
 
-func (s *MetricsServer) pollMetricsUpdates(args json.RawMessage) (interface{}, error) {
-	var argArray []string
-	if err := json.Unmarshal(args, &argArray); err != nil {
-		return nil, err
-	}
-
-	if len(argArray) == 0 {
-		return map[string]string{"error": "subscription ID required"}, nil
-	}
-
-	subscriptionID := argArray[0]
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Check if subscription exists
-	subscription, exists := s.subscribers[subscriptionID]
-	if !exists {
-		return map[string]string{"error": "subscription not found"}, nil
-	}
-
-	// Get buffered updates for this subscription
-	metricsUpdates := s.metricsBuffer[subscriptionID]
-	s.metricsBuffer[subscriptionID] = make([]SystemMetrics, 0) // Clear buffer
-
-	// Return only the latest metrics (not as an array) to avoid double-wrapping
-	var latestMetrics map[string]interface{}
-	if len(metricsUpdates) > 0 {
-		// Get the most recent metrics
-		latest := metricsUpdates[len(metricsUpdates)-1]
-		latestMetrics = map[string]interface{}{
-			"cpuPercent": latest.CPUPercent,
-			"diskUsage":  latest.DiskUsage,
-			"networkIO":  latest.NetworkIO,
-			"timestamp":  latest.Timestamp,
-		}
-	}
-
-	// Update last poll time
-	subscription.LastPull = time.Now().Unix()
-
-	return map[string]interface{}{
-		"subscriptionId": subscriptionID,
-		"latestMetrics":  latestMetrics,
-		"hasData":        latestMetrics != nil,
-		"updateCount":    len(metricsUpdates),
-		"timestamp":      time.Now().Unix(),
-	}, nil
-}
-
 // Background goroutine to collect real system metrics
 func (s *MetricsServer) generateSystemMetrics() {
 	ticker := time.NewTicker(1 * time.Second) // Update every second
@@ -183,30 +152,42 @@ func (s *MetricsServer) generateSystemMetrics() {
 
 	for {
 		select {
+		case <-s.done:
+			return
 		case <-ticker.C:
 			// Collect real system metrics using runtime/metrics
 			metrics := s.collectRealSystemMetrics()
 
-			// Buffer update for all metrics subscribers
-			s.bufferMetricsUpdate(metrics)
+			// Push the update to all metrics subscribers
+			s.publishMetricsUpdate(metrics)
 		}
 	}
 }
 
-// Helper function to buffer metrics updates for subscribers
-func (s *MetricsServer) bufferMetricsUpdate(update SystemMetrics) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Add to buffer for all subscribers
-	for subscriptionID := range s.subscribers {
-		// Add to buffer, keep only last 30 updates per subscription
-		buffer := s.metricsBuffer[subscriptionID]
-		buffer = append(buffer, update)
-		if len(buffer) > 30 {
-			buffer = buffer[len(buffer)-30:]
+// Close stops the background metrics generator.
+func (s *MetricsServer) Close() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// publishMetricsUpdate pushes an update to every subscriber, dropping
+// subscriptions whose connection has gone away.
+func (s *MetricsServer) publishMetricsUpdate(update SystemMetrics) {
+	s.mu.RLock()
+	subscriptions := make([]*Subscription, 0, len(s.subscribers))
+	for _, subscription := range s.subscribers {
+		subscriptions = append(subscriptions, subscription)
+	}
+	s.mu.RUnlock()
+
+	for _, subscription := range subscriptions {
+		if err := subscription.notify(subscription.ExportID, update); err != nil {
+			log.Printf("Dropping subscription %s: %v", subscription.ID, err)
+			s.mu.Lock()
+			delete(s.subscribers, subscription.ID)
+			s.mu.Unlock()
 		}
-		s.metricsBuffer[subscriptionID] = buffer
 	}
 }
 
@@ -273,23 +254,28 @@ func main() {
 	// Initialize random seed
 	rand.Seed(time.Now().UnixNano())
 
-	// Default to serving static files from the examples/static directory
-	staticPath := "/static"
-	if len(os.Args) >= 2 {
-		staticPath = os.Args[1]
+	// Load configuration from CAPNWEB_* environment variables
+	cfg, err := gocapnweb.LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
 	}
 
-	port := ":8000"
+	// A command-line argument still overrides the static files directory
+	if len(os.Args) >= 2 {
+		cfg.StaticPath = os.Args[1]
+	}
 
-	// Create Echo server with middleware
-	e := gocapnweb.SetupEchoServer()
+	port := cfg.Port
+	staticPath := cfg.StaticPath
 
-	// Setup RPC endpoint
+	// Create the Echo server with the RPC and static file endpoints
 	server := NewMetricsServer()
-	gocapnweb.SetupRpcEndpoint(e, "/api", server)
-
-	// Setup static file endpoint
-	gocapnweb.SetupFileEndpoint(e, "/static", staticPath)
+	defer server.Close()
+	e, err := gocapnweb.SetupAll(port, "/api", "/static", staticPath, server,
+		gocapnweb.WithEndpointOptions(cfg.RpcEndpointOptions()...))
+	if err != nil {
+		log.Fatal("Failed to set up server:", err)
+	}
 
 	log.Printf("🚀 System Metrics Go Server (Echo) starting on port %s", port)
 	log.Printf("📁 Static files served from: %s", staticPath)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gocapnweb"
+	"github.com/gocapnweb/testharness"
+)
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	server := NewMetricsServer()
+	session := testharness.NewRpcSessionForTest(t, server)
+	// Registered after the session, so the generator is stopped before the
+	// leak check runs
+	t.Cleanup(server.Close)
+
+	sessionData := gocapnweb.NewSessionData(server)
+	send := func(message string) []string {
+		t.Helper()
+		frames, err := session.HandleMessageFrames(sessionData, message)
+		if err != nil {
+			t.Fatalf("message %s: %v", message, err)
+		}
+		return frames
+	}
+
+	send(`["push",["pipeline",0,["subscribeSystemMetrics"],[]]]`)
+	frames := send(`["pull",1]`)
+	if len(frames) != 1 {
+		t.Fatalf("subscribe: got %d frames, want 1", len(frames))
+	}
+	var resolve []json.RawMessage
+	if err := json.Unmarshal([]byte(frames[0]), &resolve); err != nil || len(resolve) != 3 {
+		t.Fatalf("subscribe: unexpected frame %s", frames[0])
+	}
+	var subscribed struct {
+		SubscriptionID string `json:"subscriptionId"`
+	}
+	if err := json.Unmarshal(resolve[2], &subscribed); err != nil || !strings.HasPrefix(subscribed.SubscriptionID, "system_metrics_") {
+		t.Fatalf("subscribe: unexpected result %s", resolve[2])
+	}
+
+	args, _ := json.Marshal([]interface{}{"pipeline", 0, []string{"unsubscribe"}, []string{subscribed.SubscriptionID}})
+	send(`["push",` + string(args) + `]`)
+	frames = send(`["pull",2]`)
+	if len(frames) != 1 || !strings.Contains(frames[0], `"status":"inactive"`) {
+		t.Fatalf("unsubscribe: unexpected frames %v", frames)
+	}
+
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	if len(server.subscribers) != 0 {
+		t.Errorf("%d subscriptions remain after unsubscribing", len(server.subscribers))
+	}
+}
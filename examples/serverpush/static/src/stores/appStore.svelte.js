@@ -1,4 +1,4 @@
-import { newWebSocketRpcSession } from 'capnweb';
+import { openPushSession } from './pushSession.js';
 
 // Application state using Svelte 5 runes
 let isConnected = $state(false);
@@ -6,6 +6,7 @@ let connectionStatus = $state('disconnected');
 let connectionMessage = $state('🔄 Ready to connect...');
 let api = $state(null);
 let metricsSubscriptionId = $state(null);
+let metricsExportId = null;
 let isSubscribedToMetrics = $state(false);
 let systemMetrics = $state({
   cpuPercent: 0,
@@ -33,9 +34,6 @@ export const getCanConnect = () => canConnect;
 export const getCanSubscribe = () => canSubscribe;
 export const getCanUnsubscribe = () => canUnsubscribe;
 
-// Polling interval reference
-let metricsPollInterval = null;
-
 // Connection functions
 export async function connectToServer() {
   try {
@@ -43,11 +41,11 @@ export async function connectToServer() {
     connectionMessage = '🔄 Connecting to server...';
     
     // Connect to our Go server's WebSocket endpoint
-    const apiInstance = newWebSocketRpcSession("ws://127.0.0.1:8000/api");
+    const apiInstance = await openPushSession("ws://127.0.0.1:8000/api");
     
     // Test the connection by subscribing and immediately unsubscribing
-    const testResponse = await apiInstance.subscribeSystemMetrics();
-    await apiInstance.unsubscribe(testResponse.subscriptionId);
+    const { result: testResponse } = await apiInstance.call('subscribeSystemMetrics');
+    await apiInstance.call('unsubscribe', testResponse.subscriptionId);
     
     api = apiInstance;
     isConnected = true;
@@ -70,14 +68,15 @@ export async function subscribeToMetrics() {
   }
   
   try {
-    const response = await api.subscribeSystemMetrics();
+    const { exportId, result: response } = await api.call('subscribeSystemMetrics');
     metricsSubscriptionId = response.subscriptionId;
+    metricsExportId = exportId;
     isSubscribedToMetrics = true;
     
-    // Start polling for metrics updates
-    if (response.pollInterval) {
-      startMetricsPolling(response.pollInterval, api);
-    }
+    // The server pushes each update as a notify frame on the call's export ID
+    api.onNotify(exportId, (metrics) => {
+      systemMetrics = metrics;
+    });
     
     console.log('Subscribed to system metrics:', response);
     return response;
@@ -93,9 +92,10 @@ export async function unsubscribeFromMetrics() {
   }
   
   try {
-    await api.unsubscribe(metricsSubscriptionId);
-    stopMetricsPolling();
+    await api.call('unsubscribe', metricsSubscriptionId);
+    api.offNotify(metricsExportId);
     metricsSubscriptionId = null;
+    metricsExportId = null;
     isSubscribedToMetrics = false;
     
     console.log('Unsubscribed from metrics feed');
@@ -105,41 +105,7 @@ export async function unsubscribeFromMetrics() {
   }
 }
 
-function startMetricsPolling(intervalMs, apiInstance) {
-  console.log('Starting metrics polling every', intervalMs, 'ms');
-  
-  if (metricsPollInterval) {
-    clearInterval(metricsPollInterval);
-  }
-  
-  metricsPollInterval = setInterval(async () => {
-    if (!metricsSubscriptionId || !isConnected) {
-      stopMetricsPolling();
-      return;
-    }
-    
-    try {
-      const response = await apiInstance.pollMetricsUpdates(metricsSubscriptionId);
-      if (response.hasData && response.latestMetrics) {
-        systemMetrics = response.latestMetrics;
-        console.log(`Received metrics update (${response.updateCount} updates processed)`);
-      }
-    } catch (error) {
-      console.error('Error polling metrics updates:', error);
-      stopMetricsPolling();
-    }
-  }, intervalMs);
-}
-
-function stopMetricsPolling() {
-  if (metricsPollInterval) {
-    clearInterval(metricsPollInterval);
-    metricsPollInterval = null;
-    console.log('Stopped metrics polling');
-  }
-}
-
 // Cleanup function for when the app is destroyed
 export function cleanup() {
-  stopMetricsPolling();
+  api?.close();
 }
@@ -0,0 +1,84 @@
+// A minimal Cap'n Web client over WebSocket that also handles the server's
+// ["notify", exportId, value] frames, which capnweb's session does not know.
+//
+//   const session = await openPushSession("ws://127.0.0.1:8000/api");
+//   const { exportId, result } = await session.call("subscribeSystemMetrics");
+//   session.onNotify(exportId, (metrics) => { ... });
+
+// Results that are arrays arrive escaped as [[...]].
+function unescape(value) {
+  if (Array.isArray(value) && value.length === 1 && Array.isArray(value[0])) {
+    return value[0];
+  }
+  return value;
+}
+
+export function openPushSession(url) {
+  return new Promise((resolveOpen, rejectOpen) => {
+    const socket = new WebSocket(url);
+    const pending = new Map();   // exportId -> { resolve, reject }
+    const listeners = new Map(); // exportId -> callback
+    let nextExportId = 1;
+
+    function failAll(error) {
+      for (const { reject } of pending.values()) {
+        reject(error);
+      }
+      pending.clear();
+    }
+
+    socket.onmessage = (event) => {
+      const [type, exportId, value] = JSON.parse(event.data);
+      switch (type) {
+        case 'resolve': {
+          const call = pending.get(exportId);
+          pending.delete(exportId);
+          call?.resolve(unescape(value));
+          break;
+        }
+        case 'reject': {
+          const call = pending.get(exportId);
+          pending.delete(exportId);
+          call?.reject(new Error(value?.[2] ?? 'call rejected'));
+          break;
+        }
+        case 'notify':
+          listeners.get(exportId)?.(unescape(value));
+          break;
+      }
+    };
+
+    socket.onclose = () => failAll(new Error('connection closed'));
+    socket.onerror = () => rejectOpen(new Error(`failed to connect to ${url}`));
+
+    socket.onopen = () => resolveOpen({
+      // call pushes a method call and pulls its result. The export ID is
+      // returned with the result so notifications for it can be observed.
+      call(method, ...args) {
+        const exportId = nextExportId++;
+        socket.send(JSON.stringify(['push', ['pipeline', 0, [method], args]]));
+        socket.send(JSON.stringify(['pull', exportId]));
+        return new Promise((resolve, reject) => {
+          pending.set(exportId, {
+            resolve: (result) => resolve({ exportId, result }),
+            reject,
+          });
+        });
+      },
+
+      // onNotify registers a callback for values pushed on exportId.
+      onNotify(exportId, callback) {
+        listeners.set(exportId, callback);
+      },
+
+      // offNotify stops observing exportId.
+      offNotify(exportId) {
+        listeners.delete(exportId);
+      },
+
+      close() {
+        socket.close();
+      },
+    });
+  });
+}
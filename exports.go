@@ -0,0 +1,223 @@
+package gocapnweb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrExportReleased is the cause with which the context of a call is
+// cancelled once the client releases the call's export. Notifying a
+// released export fails with it.
+var ErrExportReleased = errors.New("export released by the client")
+
+// Disposer is implemented by method results that hold resources, such as
+// stateful capabilities. Dispose is called once the client releases the
+// export the result was returned for, or when the session ends.
+type Disposer interface {
+	Dispose()
+}
+
+// exportEntry is a row of the session's export table.
+type exportEntry struct {
+	// refcount is the number of references to the export held by the
+	// client: one for the push that created it, plus one for each time
+	// the export ID has since been sent to the client.
+	refcount  int
+	disposers []func()
+
+	// target is set for exports that are capabilities returned by a
+	// method rather than pushed calls.
+	target RpcTarget
+
+	// resolved is set once the export's result has been sent to the client
+	// without being pulled. pulled is set once the client has pulled the
+	// export. Both are read by pulls without holding mu.
+	resolved atomic.Bool
+	pulled   atomic.Bool
+
+	// dispatched is set once the export's call has been dispatched; see
+	// awaitDispatchTurn.
+	dispatched bool
+
+	// chain is the length of the longest chain of pushes, each referring
+	// to the result of the one before, that ends at the export; see
+	// checkChain.
+	chain int
+
+	// rejected is set for pushes that were refused without being held as
+	// pending operations, such as those beyond MaxPendingOperations.
+	// Pulls of the export, and references to it, fail with it.
+	rejected error
+
+	// cancels cancel the contexts of the calls made for the export, which
+	// stay live after the calls return for the subscriptions and streams
+	// they started, until the export is released.
+	cancels []context.CancelCauseFunc
+}
+
+// addExportRef records a reference to exportID held by the client. It must
+// be called with sd.mu held.
+func (sd *SessionData) addExportRef(exportID int) {
+	sd.exportEntry(exportID).refcount++
+}
+
+// rejectedPush returns the error exportID was refused with, if it is a push
+// that was rejected without being held as a pending operation.
+func (sd *SessionData) rejectedPush(exportID int) error {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	if entry, exists := sd.exports[exportID]; exists {
+		return entry.rejected
+	}
+	return nil
+}
+
+// exportEntry returns the export table row for exportID, adding it if
+// needed. It must be called with sd.mu held.
+func (sd *SessionData) exportEntry(exportID int) *exportEntry {
+	if sd.exports == nil {
+		sd.exports = make(map[int]*exportEntry)
+	}
+	entry, exists := sd.exports[exportID]
+	if !exists {
+		entry = &exportEntry{}
+		sd.exports[exportID] = entry
+		sd.entries.Store(exportID, entry)
+	}
+	return entry
+}
+
+// loadExportEntry returns the export table row for exportID without
+// locking, for pulls.
+func (sd *SessionData) loadExportEntry(exportID int) (*exportEntry, bool) {
+	entry, exists := sd.entries.Load(exportID)
+	if !exists {
+		return nil, false
+	}
+	return entry.(*exportEntry), true
+}
+
+// setExports replaces the export table with exports, which may be nil. It
+// must be called with sd.mu held.
+func (sd *SessionData) setExports(exports map[int]*exportEntry) {
+	sd.exports = exports
+	sd.entries.Clear()
+	for exportID, entry := range exports {
+		sd.entries.Store(exportID, entry)
+	}
+}
+
+// markPulled records that the client has pulled an export and reports
+// whether it had pulled it before. It takes no lock, so that pulls of
+// computed results do not contend with each other.
+func (sd *SessionData) markPulled(exportID int) bool {
+	entry, exists := sd.loadExportEntry(exportID)
+	if !exists {
+		return false
+	}
+	return entry.pulled.Swap(true)
+}
+
+// ExportRefcount returns the number of references the client holds to
+// exportID; it is zero for exports that have been released or never
+// existed.
+func (sd *SessionData) ExportRefcount(exportID int) int {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	if entry, exists := sd.exports[exportID]; exists {
+		return entry.refcount
+	}
+	return 0
+}
+
+// OnRelease registers fn to be called once exportID is released by the
+// client or, failing that, when the session ends.
+func (sd *SessionData) OnRelease(exportID int, fn func()) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	entry := sd.exportEntry(exportID)
+	entry.disposers = append(entry.disposers, fn)
+}
+
+// releaseExport drops refcount of the client's references to exportID. Once
+// none remain, the export's operation, result and subscription are freed
+// and its disposers are called. It reports whether the export was freed.
+func (sd *SessionData) releaseExport(exportID, refcount int) bool {
+	sd.mu.Lock()
+	entry, exists := sd.exports[exportID]
+	if !exists {
+		sd.mu.Unlock()
+		return false
+	}
+	entry.refcount -= refcount
+	if entry.refcount > 0 {
+		sd.mu.Unlock()
+		return false
+	}
+	delete(sd.exports, exportID)
+	sd.entries.Delete(exportID)
+	delete(sd.PendingOperations, exportID)
+	delete(sd.Subscriptions, exportID)
+	sd.mu.Unlock()
+
+	sd.deleteResult(exportID)
+	for _, cancel := range entry.cancels {
+		cancel(ErrExportReleased)
+	}
+	for _, dispose := range entry.disposers {
+		dispose()
+	}
+	return true
+}
+
+// trackCall returns a context for a call made for exportID that is
+// cancelled once the client releases the export. Calls for exports the
+// client holds no reference to get ctx as it is.
+func (sd *SessionData) trackCall(ctx context.Context, exportID int) context.Context {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	entry, exists := sd.exports[exportID]
+	if !exists {
+		return ctx
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	entry.cancels = append(entry.cancels, cancel)
+	return ctx
+}
+
+// cancelReleasedCalls cancels the calls made for exportID if releasing
+// refcount references would free the export. It lets a release cancel a
+// call that holds up the handling of the release itself.
+func (sd *SessionData) cancelReleasedCalls(exportID, refcount int) {
+	sd.mu.Lock()
+	entry, exists := sd.exports[exportID]
+	if !exists || refcount < entry.refcount {
+		sd.mu.Unlock()
+		return
+	}
+	cancels := entry.cancels
+	sd.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel(ErrExportReleased)
+	}
+}
+
+// disposeAll calls the disposers of every export that has not been
+// released, and fails the calls to the client and awaits of its promises
+// still waiting for an answer. It is called when the session ends.
+func (sd *SessionData) disposeAll() {
+	sd.abandonCallbacks(ErrCallbackAbandoned)
+	sd.abandonPromises(ErrCallbackAbandoned)
+
+	sd.mu.Lock()
+	exports := sd.exports
+	sd.setExports(nil)
+	sd.mu.Unlock()
+
+	for _, entry := range exports {
+		for _, dispose := range entry.disposers {
+			dispose()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// FallbackHandler handles a call to a method that is not registered, and is
+// passed the name of the method called.
+type FallbackHandler func(ctx context.Context, method string, args json.RawMessage) (interface{}, error)
+
+// Fallback registers handler to be called for calls to methods that are
+// neither registered on t nor reached through a mounted target, in place of
+// failing them with MethodNotFound. It suits proxies and APIs whose methods
+// are only known at runtime, and errors richer than MethodNotFound:
+//
+//	server.Fallback(func(ctx context.Context, method string, args json.RawMessage) (interface{}, error) {
+//		return nil, gocapnweb.RpcError{
+//			Code:    gocapnweb.ErrMethodNotFound.Code,
+//			Message: "method not found: " + method,
+//			Details: map[string]interface{}{"suggestions": server.SimilarMethods(method)},
+//		}
+//	})
+//
+// Calls handled by the fallback pass through t's middleware, under the name
+// of the method called. Registering a fallback replaces any registered
+// before; a nil handler removes it.
+func (t *BaseRpcTarget) Fallback(handler FallbackHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fallback = handler
+}
+
+// fallbackHandler returns a handler that calls t's fallback for method. It
+// must be called with t.mu held.
+func (t *BaseRpcTarget) fallbackHandler(method string) (ContextHandler, bool) {
+	fallback := t.fallback
+	if fallback == nil {
+		return nil, false
+	}
+	return func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		return fallback(ctx, method, args)
+	}, true
+}
+
+// SimilarMethods returns the names of the registered methods that name may
+// be a misspelling of, closest first: those within an edit distance of a
+// third of its length, and at least one.
+func (t *BaseRpcTarget) SimilarMethods(name string) []string {
+	limit := max(len(name)/3, 1)
+	distances := make(map[string]int)
+	var similar []string
+	for _, method := range t.MethodNames() {
+		if method == IntrospectMethod || method == DiscoverMethod {
+			continue
+		}
+		if d := editDistance(name, method); d <= limit {
+			distances[method] = d
+			similar = append(similar, method)
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return distances[similar[i]] < distances[similar[j]]
+	})
+	return similar
+}
+
+// editDistance returns the Levenshtein distance between a and b, counting
+// bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
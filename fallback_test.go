@@ -0,0 +1,93 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFallbackPrecedence(t *testing.T) {
+	users := NewBaseRpcTarget()
+	users.Method("get", constantHandler("mounted"))
+	target := NewBaseRpcTarget()
+	target.Method("hello", constantHandler("registered"))
+	target.Method("users.admin", constantHandler("registered"))
+	target.Mount("users", users)
+	target.Fallback(func(ctx context.Context, method string, args json.RawMessage) (interface{}, error) {
+		return "fallback " + method, nil
+	})
+
+	tests := []struct {
+		method string
+		want   interface{}
+		err    error
+	}{
+		{method: "hello", want: "registered"},
+		// Registered methods come before mounted targets
+		{method: "users.admin", want: "registered"},
+		{method: "users.get", want: "mounted"},
+		// A call that reaches a mounted target is answered by it
+		{method: "users.missing", err: ErrMethodNotFound},
+		{method: "missing", want: "fallback missing"},
+		{method: "other.get", want: "fallback other.get"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			got, err := target.Dispatch(tt.method, nil)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("got %v, %v, want %v", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	target.Fallback(nil)
+	if _, err := target.Dispatch("missing", nil); !errors.Is(err, ErrMethodNotFound) {
+		t.Errorf("with the fallback removed: got %v, want MethodNotFound", err)
+	}
+}
+
+func TestFallbackPassesThroughMiddleware(t *testing.T) {
+	target := NewBaseRpcTarget()
+	var called []string
+	target.UseMiddleware(func(method string, args json.RawMessage, next RpcHandler) (interface{}, error) {
+		called = append(called, method)
+		return next(args)
+	})
+	target.Fallback(func(ctx context.Context, method string, args json.RawMessage) (interface{}, error) {
+		return nil, nil
+	})
+	target.Dispatch("missing", nil)
+	if fmt.Sprint(called) != "[missing]" {
+		t.Errorf("middleware called for %v, want [missing]", called)
+	}
+}
+
+func TestSimilarMethods(t *testing.T) {
+	target := NewBaseRpcTarget()
+	for _, method := range []string{"getProfile", "getProfiles", "getFeed", "hello"} {
+		target.Method(method, constantHandler(nil))
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"getProfil", []string{"getProfile", "getProfiles"}},
+		{"getFed", []string{"getFeed"}},
+		{"helo", []string{"hello"}},
+		{"introspect", nil},
+		{"x", nil},
+	}
+	for _, tt := range tests {
+		if got := target.SimilarMethods(tt.name); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("SimilarMethods(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package gocapnweb
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
@@ -107,6 +109,73 @@ func SetupFileEndpoint(e *echo.Echo, urlPath string, fsRoot string) {
 	e.GET(pathPattern, fileHandler)
 }
 
+// SetupFileEndpointFS sets up a static file server endpoint using Echo that
+// serves files from fsys, such as an embed.FS. Use fs.Sub to serve a
+// subdirectory of an embedded tree:
+//
+//	//go:embed static
+//	var staticFiles embed.FS
+//
+//	root, _ := fs.Sub(staticFiles, "static")
+//	gocapnweb.SetupFileEndpointFS(e, "/static", root)
+func SetupFileEndpointFS(e *echo.Echo, urlPath string, fsys fs.FS) {
+	// Clean the URL path to ensure it ends with a slash for proper matching
+	if !strings.HasSuffix(urlPath, "/") {
+		urlPath += "/"
+	}
+
+	fileHandler := func(c echo.Context) error {
+		// Remove the base path prefix and leading slash from the file path
+		filePath := c.Request().URL.Path
+		basePath := strings.TrimSuffix(urlPath, "/")
+		filePath = strings.TrimPrefix(filePath, basePath)
+		filePath = strings.TrimPrefix(filePath, "/")
+
+		// Default to index.html for directory requests
+		if filePath == "" || strings.HasSuffix(filePath, "/") {
+			filePath = path.Join(filePath, "index.html")
+		}
+
+		// fs.FS paths are unrooted and may not contain ".." elements, which
+		// keeps requests inside fsys
+		if !fs.ValidPath(filePath) {
+			return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+		}
+
+		fileInfo, err := fs.Stat(fsys, filePath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return echo.NewHTTPError(http.StatusNotFound, "File not found")
+			}
+			log.Printf("Error accessing file: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
+
+		if !fileInfo.Mode().IsRegular() {
+			return echo.NewHTTPError(http.StatusNotFound, "Not a file")
+		}
+
+		file, err := fsys.Open(filePath)
+		if err != nil {
+			log.Printf("Error opening file: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read file")
+		}
+		defer file.Close()
+
+		c.Response().Header().Set("Content-Type", getContentType(path.Ext(filePath)))
+		c.Response().Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+
+		if _, err := io.Copy(c.Response(), file); err != nil {
+			log.Printf("Error writing file to response: %v", err)
+			return err
+		}
+
+		return nil
+	}
+
+	e.GET(urlPath+"*", fileHandler)
+}
+
 // getContentType returns the MIME type for a given file extension.
 func getContentType(ext string) string {
 	// First try the standard mime package
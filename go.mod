@@ -7,6 +7,8 @@ toolchain go1.24.2
 require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/labstack/echo/v4 v4.13.4
+	golang.org/x/crypto v0.38.0
+	golang.org/x/time v0.11.0
 )
 
 require (
@@ -15,9 +17,7 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
-	golang.org/x/time v0.11.0 // indirect
 )
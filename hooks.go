@@ -0,0 +1,105 @@
+package gocapnweb
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WithOnOpen registers fn to be called when a session opens: before its
+// WebSocket connection is upgraded or its event stream starts, and before
+// the messages of an HTTP batch or the call of a long poll are handled. The
+// session's Header method reports the headers of the request opening it.
+//
+// If fn returns an error, the session is refused: the request is answered
+// with 401 Unauthorized if the error is ErrUnauthorized and with 403
+// Forbidden otherwise, and OnClose is not called for it.
+func WithOnOpen(fn func(sessionData *SessionData) error) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.OnOpen = fn
+	}
+}
+
+// WithOnError registers fn to be called when a session fails: when the
+// client aborts it, when a message cannot be handled or its response cannot
+// be sent, and when its WebSocket connection closes unexpectedly. The session
+// goes on after a message that cannot be handled. For an abort, fn receives
+// the error pending operations were rejected with.
+func WithOnError(fn func(sessionData *SessionData, err error)) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.OnError = fn
+	}
+}
+
+// WithOnClose registers fn to be called once when a session ends: when its
+// WebSocket connection or event stream closes, its HTTP batch or long poll
+// has been answered, or the client aborts it.
+func WithOnClose(fn func(sessionData *SessionData)) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.OnClose = fn
+	}
+}
+
+// WithOnPanic registers fn to be called when a handler panics, in place of
+// logging the panic and its stack to the session's logger. The call is
+// rejected with ErrInternal either way. fn receives the method called, the
+// value the handler panicked with and the stack of the panicking goroutine,
+// and is called on that goroutine.
+func WithOnPanic(fn func(sessionData *SessionData, method string, recovered interface{}, stack []byte)) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.OnPanic = fn
+	}
+}
+
+// endSession disposes of the session's exports and runs the OnClose hook.
+// Only the first call for a session has any effect.
+func (s *RpcSession) endSession(sessionData *SessionData) {
+	sessionData.mu.Lock()
+	ended := sessionData.ended
+	sessionData.ended = true
+	sessionData.mu.Unlock()
+	if ended {
+		return
+	}
+
+	sessionData.disposeAll()
+	if s.opts.OnClose != nil {
+		s.opts.OnClose(sessionData)
+	}
+}
+
+// openSession runs the OnOpen hook for a session, returning the HTTP error
+// that refuses it if the hook fails.
+func (s *RpcSession) openSession(sessionData *SessionData) error {
+	if s.opts.OnOpen == nil {
+		return nil
+	}
+	err := s.opts.OnOpen(sessionData)
+	if err == nil {
+		return nil
+	}
+	s.logf("Session refused: %v", err)
+	status := http.StatusForbidden
+	if errors.Is(err, ErrUnauthorized) {
+		status = http.StatusUnauthorized
+	}
+	return echo.NewHTTPError(status, err.Error())
+}
+
+// reportError passes an error a session failed with to the OnError hook.
+func (s *RpcSession) reportError(sessionData *SessionData, err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(sessionData, err)
+	}
+}
+
+// panicked reports a panic in the handler of method to the OnPanic hook, or
+// logs it if there is none.
+func (s *RpcSession) panicked(sessionData *SessionData, method string, recovered interface{}, stack []byte) {
+	if s.opts.OnPanic != nil {
+		s.opts.OnPanic(sessionData, method, recovered, stack)
+		return
+	}
+	s.logf("Panic in %s: %v\n%s", method, recovered, stack)
+}
@@ -0,0 +1,57 @@
+package gocapnweb
+
+import "context"
+
+// Each side of a session numbers the entries of its export table, and the
+// other side refers to them by the same IDs in its import table:
+//
+//   - ID 0 is the main interface of each side. The client's import 0 is the
+//     session's target, and the server's import 0 is the main interface the
+//     client offers, if any; see ClientMain. Neither is ever released.
+//   - Positive IDs are allocated by the importing side, in the order it
+//     pushes: the client's pushes are the server's exports 1, 2, ..., and
+//     the server's calls to the client are its imports 1, 2, ....
+//   - Negative IDs are allocated by the exporting side, for capabilities it
+//     sends unprompted: targets returned by methods are the server's
+//     exports -1, -2, ..., and the functions and objects the client passes
+//     as arguments are its own negative exports, sent as ["export", id].
+//
+// Positive and negative IDs therefore never collide within a table, and the
+// two tables never need to agree on a counter.
+
+// MainExportID is the ID of each side's main interface: the session's
+// target for the client, and the client's main interface for the server.
+const MainExportID = 0
+
+// allocatePushID assigns the export ID of the client's next push. It must be
+// called with sd.mu held.
+func (sd *SessionData) allocatePushID() int {
+	exportID := sd.NextExportID
+	sd.NextExportID++
+	return exportID
+}
+
+// allocateCapabilityID assigns the export ID of a capability the server
+// sends to the client. It must be called with sd.mu held.
+func (sd *SessionData) allocateCapabilityID() int {
+	sd.lastCapabilityID--
+	return sd.lastCapabilityID
+}
+
+// allocateCallbackID assigns the import ID of the server's next call to the
+// client. It must be called with sd.mu held.
+func (sd *SessionData) allocateCallbackID() int {
+	sd.lastCallbackID++
+	return sd.lastCallbackID
+}
+
+// ClientMain returns a stub for the main interface the client offered when
+// it opened the session, bound to the session of the call ctx belongs to.
+// Calling it fails with the client's rejection if the client offers none.
+func ClientMain(ctx context.Context) (*ClientStub, error) {
+	stub := &ClientStub{importID: MainExportID}
+	if err := stub.bind(ctx); err != nil {
+		return nil, err
+	}
+	return stub, nil
+}
@@ -0,0 +1,191 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// IntrospectMethod is the name of the built-in method that describes a
+// BaseRpcTarget's methods.
+const IntrospectMethod = "__introspect"
+
+// DiscoverMethod is another name for the built-in __introspect method, for
+// tooling that discovers APIs under the rpc.discover convention.
+const DiscoverMethod = "rpc.discover"
+
+// IntrospectionVersion is the version of the Introspection format.
+const IntrospectionVersion = "1"
+
+// Introspection describes the methods a server exposes. It is the result of
+// the built-in __introspect method. Schemas holds the JSON Schema of the
+// arguments of methods registered with one, and Deprecations the methods
+// marked with DeprecateMethod.
+type Introspection struct {
+	Methods      []string                   `json:"methods"`
+	Version      string                     `json:"version"`
+	ServerName   string                     `json:"serverName,omitempty"`
+	Metadata     map[string]MethodMeta      `json:"metadata,omitempty"`
+	Schemas      map[string]json.RawMessage `json:"schemas,omitempty"`
+	Deprecations map[string]DeprecationInfo `json:"deprecations,omitempty"`
+}
+
+// DeprecationInfo describes a deprecated method for introspection.
+type DeprecationInfo struct {
+	Sunset      time.Time `json:"sunset"`
+	Replacement string    `json:"replacement,omitempty"`
+	Message     string    `json:"message"`
+}
+
+// MethodMeta documents a method for introspection.
+type MethodMeta struct {
+	Description string   `json:"description,omitempty"`
+	Params      []string `json:"params,omitempty"`
+	Returns     string   `json:"returns,omitempty"`
+}
+
+// MethodOption annotates a method when it is registered.
+type MethodOption func(*MethodMeta)
+
+// WithDescription describes what a method does.
+func WithDescription(description string) MethodOption {
+	return func(m *MethodMeta) {
+		m.Description = description
+	}
+}
+
+// WithSignature documents a method's parameters and result, e.g.
+// WithSignature([]string{"name string"}, "string").
+func WithSignature(params []string, returns string) MethodOption {
+	return func(m *MethodMeta) {
+		m.Params = params
+		m.Returns = returns
+	}
+}
+
+// BaseRpcTargetOption configures a BaseRpcTarget.
+type BaseRpcTargetOption func(*BaseRpcTarget)
+
+// WithoutIntrospection stops the target from registering the built-in
+// __introspect and rpc.discover methods.
+func WithoutIntrospection() BaseRpcTargetOption {
+	return func(t *BaseRpcTarget) {
+		t.introspection = false
+	}
+}
+
+// WithServerName sets the server name reported by __introspect.
+func WithServerName(name string) BaseRpcTargetOption {
+	return func(t *BaseRpcTarget) {
+		t.serverName = name
+	}
+}
+
+// setMethodMeta records the metadata of a method registered with opts. It
+// must be called with t.mu held.
+func (t *BaseRpcTarget) setMethodMeta(name string, opts []MethodOption) {
+	if len(opts) == 0 {
+		delete(t.methodMeta, name)
+		return
+	}
+	var meta MethodMeta
+	for _, opt := range opts {
+		opt(&meta)
+	}
+	t.methodMeta[name] = meta
+}
+
+// MethodMetadata returns the metadata a method was registered with.
+func (t *BaseRpcTarget) MethodMetadata(name string) (MethodMeta, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	meta, exists := t.methodMeta[name]
+	return meta, exists
+}
+
+// Introspect describes the target's methods, other than the built-in
+// introspection methods themselves, with the metadata they were registered
+// with, their argument schemas and their deprecations, including those of
+// mounted BaseRpcTargets.
+func (t *BaseRpcTarget) Introspect() Introspection {
+	t.mu.RLock()
+
+	introspection := Introspection{
+		Methods:    make([]string, 0, len(t.methods)),
+		Version:    IntrospectionVersion,
+		ServerName: t.serverName,
+	}
+	for name := range t.methods {
+		if name == IntrospectMethod || name == DiscoverMethod {
+			continue
+		}
+		introspection.Methods = append(introspection.Methods, name)
+		if meta, exists := t.methodMeta[name]; exists {
+			if introspection.Metadata == nil {
+				introspection.Metadata = make(map[string]MethodMeta)
+			}
+			introspection.Metadata[name] = meta
+		}
+		if schema, exists := t.schemas[name]; exists {
+			if introspection.Schemas == nil {
+				introspection.Schemas = make(map[string]json.RawMessage)
+			}
+			introspection.Schemas[name] = schema
+		}
+		if deprecation, exists := t.deprecations[name]; exists {
+			if introspection.Deprecations == nil {
+				introspection.Deprecations = make(map[string]DeprecationInfo)
+			}
+			introspection.Deprecations[name] = DeprecationInfo{
+				Sunset:      deprecation.Sunset,
+				Replacement: deprecation.Replacement,
+				Message:     deprecation.Message(),
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	t.introspectMounts(&introspection)
+	sort.Strings(introspection.Methods)
+	return introspection
+}
+
+// registerIntrospection registers the built-in __introspect and
+// rpc.discover methods.
+func (t *BaseRpcTarget) registerIntrospection() {
+	introspect := func(json.RawMessage) (interface{}, error) {
+		return t.Introspect(), nil
+	}
+	for _, name := range []string{IntrospectMethod, DiscoverMethod} {
+		t.Method(name, introspect, WithDescription("Describes the methods the server exposes"), WithSignature(nil, "Introspection"))
+	}
+}
+
+// serveIntrospection answers GET requests for the endpoint's __introspect
+// route by calling the method, so that middleware such as AuthMiddleware
+// applies to it as it does to RPC calls.
+func serveIntrospection(session *RpcSession, target RpcTarget) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sessionData := NewSessionData(target)
+		sessionData.SetHeaders(c.Request().Header)
+		sessionData.SetContext(c.Request().Context())
+
+		result, err := session.dispatch(sessionData, 0, IntrospectMethod, json.RawMessage("[]"))
+		if err != nil {
+			var rpcErr RpcError
+			switch {
+			case errors.As(err, &rpcErr) && rpcErr.Code == ErrMethodNotFound.Code:
+				return echo.NewHTTPError(http.StatusNotFound, "introspection is disabled")
+			case errors.As(err, &rpcErr) && rpcErr.Code == ErrUnauthorized.Code:
+				return echo.NewHTTPError(http.StatusUnauthorized, rpcErr.Message)
+			default:
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,136 @@
+package gocapnweb
+
+import "fmt"
+
+// Default bounds on the expressions a client may push. A message within
+// MaxMessageBytes can still nest expressions deeply enough, or fan them out
+// widely enough, to make evaluating them costly, so pushes are also checked
+// against these.
+const (
+	DefaultMaxExpressionDepth = 64
+	DefaultMaxExpressionNodes = 100000
+	DefaultMaxPipelineChain   = 256
+
+	// DefaultMaxPendingOperations bounds the pushes a session holds
+	// without having resolved them, so that a client that pushes without
+	// pulling cannot grow it without end.
+	DefaultMaxPendingOperations = 10000
+)
+
+// ErrLimitExceeded rejects a push that exceeds one of the session's
+// expression limits, or that arrives while the session holds its limit of
+// pending operations. Its details name the limit ("depth", "nodes", "chain"
+// or "pending") and its maximum.
+var ErrLimitExceeded = RpcError{Code: "LimitExceeded"}
+
+// WithMaxExpressionDepth sets how deeply the arrays and objects of a pushed
+// expression may nest. Zero or a negative value disables the check.
+func WithMaxExpressionDepth(n int) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.MaxExpressionDepth = n
+	}
+}
+
+// WithMaxExpressionNodes sets how many values, counting every array, object
+// and scalar within it, a pushed expression may hold. Zero or a negative
+// value disables the check.
+func WithMaxExpressionNodes(n int) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.MaxExpressionNodes = n
+	}
+}
+
+// WithMaxPipelineChain sets how long a chain of pushes, each referring to
+// the result of the one before, may grow. Zero or a negative value disables
+// the check.
+func WithMaxPipelineChain(n int) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.MaxPipelineChain = n
+	}
+}
+
+// WithMaxPendingOperations sets how many of the client's pushes a session
+// may hold without having resolved or released them. Pushes are held from
+// when they arrive until they are pulled and resolve, or, if they fail,
+// until the client releases them. Zero or a negative value disables the
+// check.
+func WithMaxPendingOperations(n int) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.MaxPendingOperations = n
+	}
+}
+
+// limitExceeded returns the error for a push that exceeds a limit.
+func limitExceeded(limit string, max int) error {
+	return RpcError{
+		Code:    ErrLimitExceeded.Code,
+		Message: fmt.Sprintf("push exceeds the %s limit of %d", limit, max),
+		Details: map[string]interface{}{"limit": limit, "max": max},
+	}
+}
+
+// checkExpression checks a pushed expression against the session's depth
+// and node limits. It stops walking the expression as soon as either is
+// exceeded, so its own recursion is bounded by the depth limit.
+func (s *RpcSession) checkExpression(value interface{}) error {
+	maxDepth, maxNodes := s.opts.MaxExpressionDepth, s.opts.MaxExpressionNodes
+	nodes := 0
+	var walk func(value interface{}, depth int) error
+	walk = func(value interface{}, depth int) error {
+		if maxDepth > 0 && depth > maxDepth {
+			return limitExceeded("depth", maxDepth)
+		}
+		nodes++
+		if maxNodes > 0 && nodes > maxNodes {
+			return limitExceeded("nodes", maxNodes)
+		}
+		switch v := value.(type) {
+		case []interface{}:
+			for _, elem := range v {
+				if err := walk(elem, depth+1); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			for _, val := range v {
+				if err := walk(val, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(value, 1)
+}
+
+// checkChain records the length of the chain of pushes ending at exportID,
+// one more than the longest chain among the earlier pushes its operation
+// refers to, and checks it against the session's chain limit. It must be
+// called with sd.mu held.
+func (s *RpcSession) checkChain(sd *SessionData, exportID int, operation Operation) error {
+	refs, err := operation.dependencies(exportID)
+	if err != nil {
+		return nil
+	}
+	chain := 1
+	forEachPipelineRef(refs, func(importID int) {
+		if entry, exists := sd.exports[importID]; exists && importID > MainExportID && importID < exportID {
+			chain = max(chain, entry.chain+1)
+		}
+	})
+	sd.exportEntry(exportID).chain = chain
+	if limit := s.opts.MaxPipelineChain; limit > 0 && chain > limit {
+		return limitExceeded("chain", limit)
+	}
+	return nil
+}
+
+// checkPending checks that the session holds fewer pending operations than
+// its limit, so that another push can be taken. It must be called with sd.mu
+// held.
+func (s *RpcSession) checkPending(sd *SessionData) error {
+	if limit := s.opts.MaxPendingOperations; limit > 0 && len(sd.PendingOperations) >= limit {
+		return limitExceeded("pending", limit)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Long-poll hold durations.
+const (
+	DefaultLongPollTimeout = 30 * time.Second
+	MaxLongPollTimeout     = 5 * time.Minute
+)
+
+// SetupLongPollEndpoint registers a GET endpoint that performs a single call
+// in one HTTP round trip, for clients behind proxies that interfere with
+// WebSockets and streaming responses:
+//
+//	GET path?method=hello&args=["World"]&timeout=5s
+//
+// The request is held open until the call completes or the timeout (default
+// 30s, at most 5m) elapses. The response body is the call's resolve or reject
+// frame; if the timeout elapses first the endpoint responds with 504 Gateway
+// Timeout.
+func SetupLongPollEndpoint(e *echo.Echo, path string, target RpcTarget, opts ...RpcSessionOption) {
+	session := NewRpcSession(target, opts...)
+
+	e.GET(path, func(c echo.Context) error {
+		method := c.QueryParam("method")
+		if method == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "method is required")
+		}
+
+		args := json.RawMessage("[]")
+		if rawArgs := c.QueryParam("args"); rawArgs != "" {
+			var argArray []interface{}
+			if err := json.Unmarshal([]byte(rawArgs), &argArray); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "args must be a JSON array")
+			}
+			args = json.RawMessage(rawArgs)
+		}
+
+		timeout := DefaultLongPollTimeout
+		if rawTimeout := c.QueryParam("timeout"); rawTimeout != "" {
+			d, err := time.ParseDuration(rawTimeout)
+			if err != nil || d <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid timeout")
+			}
+			timeout = min(d, MaxLongPollTimeout)
+		}
+
+		pushBytes, err := json.Marshal([]interface{}{
+			"push", []interface{}{"pipeline", 0, []interface{}{method}, args},
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid call")
+		}
+
+		// The call's context ends with the request or the timeout
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+
+		sessionData := NewSessionData(target)
+		sessionData.SetHeaders(c.Request().Header)
+		sessionData.SetContext(ctx)
+		if err := session.openSession(sessionData); err != nil {
+			return err
+		}
+		defer session.endSession(sessionData)
+
+		type outcome struct {
+			frames []string
+			err    error
+		}
+		// Buffered so the call can finish after a timeout without blocking
+		done := make(chan outcome, 1)
+
+		go func() {
+			if _, err := session.HandleMessageFrames(sessionData, string(pushBytes)); err != nil {
+				done <- outcome{err: err}
+				return
+			}
+			frames, err := session.HandleMessageFrames(sessionData, `["pull",1]`)
+			done <- outcome{frames: frames, err: err}
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case result := <-done:
+			if result.err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, result.err.Error())
+			}
+			setDeprecationHeaders(c.Response().Header(), sessionData.Deprecations())
+			return c.Blob(http.StatusOK, ContentTypeNDJSON, []byte(strings.Join(result.frames, "\n")))
+		case <-timer.C:
+			return echo.NewHTTPError(http.StatusGatewayTimeout, "call did not complete within timeout")
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	})
+}
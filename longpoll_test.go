@@ -0,0 +1,119 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// longPollServer serves target's long-poll endpoint at /poll.
+func longPollServer(t *testing.T, target RpcTarget) *httptest.Server {
+	t.Helper()
+	e := echo.New()
+	SetupLongPollEndpoint(e, "/poll", target, WithLogger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// getLongPoll requests query from server's long-poll endpoint and returns
+// the response status and body.
+func getLongPoll(t *testing.T, server *httptest.Server, query string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/poll?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestLongPollHold(t *testing.T) {
+	target := testTarget()
+	target.Method("slow", func(json.RawMessage) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return "done", nil
+	})
+	server := longPollServer(t, target)
+
+	// The response is held until the result is ready, well within the timeout
+	start := time.Now()
+	status, body := getLongPoll(t, server, "method=slow&timeout=1s")
+	elapsed := time.Since(start)
+	if status != http.StatusOK || body != `["resolve",1,"done"]` {
+		t.Errorf("got %d %s, want 200 with the resolve frame", status, body)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("response took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestLongPollRoundTrip(t *testing.T) {
+	server := longPollServer(t, testTarget())
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   string
+	}{
+		{"resolve", `method=echo&args=["hi"]`, http.StatusOK, `["resolve",1,"hi"]`},
+		{"escaped result", `method=user`, http.StatusOK, `["resolve",1,{"id":"u_1","tags":[["a","b"]]}]`},
+		{"reject", `method=fail`, http.StatusOK, `["reject",1,["error","MethodError","intentional failure"]]`},
+		{"unknown method", `method=missing`, http.StatusOK, `["reject",1,["error","MethodNotFound","method not found: missing"]]`},
+		{"no method", ``, http.StatusBadRequest, `{"message":"method is required"}`},
+		{"args not an array", `method=echo&args={}`, http.StatusBadRequest, `{"message":"args must be a JSON array"}`},
+		{"invalid timeout", `method=echo&timeout=soon`, http.StatusBadRequest, `{"message":"invalid timeout"}`},
+		{"negative timeout", `method=echo&timeout=-1s`, http.StatusBadRequest, `{"message":"invalid timeout"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := getLongPoll(t, server, tt.query)
+			if status != tt.status || strings.TrimSpace(body) != tt.body {
+				t.Errorf("got %d %s, want %d %s", status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	target := testTarget()
+	cancelled := make(chan error, 1)
+	target.MethodWithContext("hang", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	server := longPollServer(t, target)
+
+	start := time.Now()
+	status, body := getLongPoll(t, server, "method=hang&timeout=100ms")
+	if status != http.StatusGatewayTimeout || strings.TrimSpace(body) != `{"message":"call did not complete within timeout"}` {
+		t.Errorf("got %d %s, want 504", status, body)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("response took %v, want about 100ms", elapsed)
+	}
+
+	// The call is cancelled once the endpoint gives up on it
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			t.Errorf("call ended with %v, want it cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the call was not cancelled")
+	}
+}
@@ -0,0 +1,235 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// CapnWebMarshaler is implemented by types that control how they are sent
+// on the wire. Wherever a value of such a type appears in a result,
+// including struct fields, MarshalCapnWeb is called in place of
+// encoding/json, and the value it returns is sent instead. That value is
+// converted like any result, so it may hold structs, escape types such as
+// Date, values of types registered in the session's EscapeRegistry, and
+// RpcTargets, which are sent as capabilities.
+type CapnWebMarshaler interface {
+	MarshalCapnWeb() (interface{}, error)
+}
+
+// CapnWebUnmarshaler is implemented by types that decode themselves from
+// the arguments clients send. TypedMethod and MethodTypedWithSchema call
+// UnmarshalCapnWeb in place of encoding/json for parameters and fields of
+// such a type, with the argument decoded as JSON: escapes such as
+// ["date", ms] are their escape types, integers beyond the precision of a
+// float64 are json.Numbers, and capabilities the client passes are
+// ["export", id] arrays, which a ClientStub decodes through encoding/json.
+type CapnWebUnmarshaler interface {
+	UnmarshalCapnWeb(value interface{}) error
+}
+
+var (
+	capnWebMarshalerType   = reflect.TypeOf((*CapnWebMarshaler)(nil)).Elem()
+	capnWebUnmarshalerType = reflect.TypeOf((*CapnWebUnmarshaler)(nil)).Elem()
+)
+
+// capnWebMarshaler returns the CapnWebMarshaler of a value found by
+// escapeWithin, through its address for methods with pointer receivers.
+func capnWebMarshaler(value reflect.Value) (CapnWebMarshaler, bool) {
+	if !value.CanInterface() {
+		return nil, false
+	}
+	if m, ok := value.Interface().(CapnWebMarshaler); ok {
+		return m, true
+	}
+	if value.CanAddr() {
+		m, ok := value.Addr().Interface().(CapnWebMarshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
+// marshalCapnWeb normalizes the value a CapnWebMarshaler sends in its
+// place. A nil pointer is sent as null, as encoding/json sends it.
+func (d Devaluator) marshalCapnWeb(m CapnWebMarshaler) (interface{}, error) {
+	if value := reflect.ValueOf(m); value.Kind() == reflect.Pointer && value.IsNil() {
+		return nil, nil
+	}
+	value, err := m.MarshalCapnWeb()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %T: %w", m, err)
+	}
+	if reflect.TypeOf(value) == reflect.TypeOf(m) {
+		return nil, fmt.Errorf("failed to marshal %T: MarshalCapnWeb returned a value of its own type", m)
+	}
+	if d.Export != nil {
+		value = d.Export(value)
+	}
+	return d.normalizeValue(value)
+}
+
+// unmarshalArg decodes an encoded argument into the value ptr points to.
+// Values within it whose types implement CapnWebUnmarshaler decode
+// themselves; the rest is decoded by encoding/json, with escapes bound as
+// by bindEscapedArg.
+func unmarshalArg(arg json.RawMessage, ptr interface{}) error {
+	target := reflect.ValueOf(ptr).Elem()
+	if !typeEscapeInfo(target.Type()).unmarshalers {
+		return json.Unmarshal(bindEscapedArg(arg, target.Type()), ptr)
+	}
+	value, err := decodeJSON(arg)
+	if err != nil {
+		return err
+	}
+	return unmarshalValue(value, target)
+}
+
+// unmarshalValue decodes a decoded argument into target, which must be
+// settable. value is modified in place.
+func unmarshalValue(value interface{}, target reflect.Value) error {
+	if u, ok := target.Addr().Interface().(CapnWebUnmarshaler); ok {
+		return u.UnmarshalCapnWeb(reviveArgumentEscapes(value))
+	}
+	targetType := target.Type()
+	if !typeEscapeInfo(targetType).unmarshalers {
+		encoded, err := json.Marshal(bindEscapes(value, targetType))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(encoded, target.Addr().Interface())
+	}
+
+	if value == nil {
+		// As encoding/json does, null leaves values other than pointers,
+		// slices and maps as they are
+		switch targetType.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map:
+			target.SetZero()
+		}
+		return nil
+	}
+	switch targetType.Kind() {
+	case reflect.Pointer:
+		if target.IsNil() {
+			target.Set(reflect.New(targetType.Elem()))
+		}
+		return unmarshalValue(value, target.Elem())
+
+	case reflect.Slice, reflect.Array:
+		elems, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("cannot decode %s into %s", jsonKind(value), targetType)
+		}
+		if targetType.Kind() == reflect.Slice {
+			target.Set(reflect.MakeSlice(targetType, len(elems), len(elems)))
+		} else {
+			target.SetZero()
+		}
+		for i, elem := range elems {
+			if i >= target.Len() {
+				break
+			}
+			if err := unmarshalValue(elem, target.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		fields, ok := value.(map[string]interface{})
+		if !ok || targetType.Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot decode %s into %s", jsonKind(value), targetType)
+		}
+		if target.IsNil() {
+			target.Set(reflect.MakeMapWithSize(targetType, len(fields)))
+		}
+		for key, val := range fields {
+			elem := reflect.New(targetType.Elem()).Elem()
+			if err := unmarshalValue(val, elem); err != nil {
+				return err
+			}
+			target.SetMapIndex(reflect.ValueOf(key).Convert(targetType.Key()), elem)
+		}
+
+	case reflect.Struct:
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot decode %s into %s", jsonKind(value), targetType)
+		}
+		for key, val := range fields {
+			index, ok := jsonFieldIndex(targetType, key)
+			if !ok {
+				continue
+			}
+			field, err := settableField(target, index)
+			if err != nil {
+				return err
+			}
+			if err := unmarshalValue(val, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// settableField returns the field of struct value at index, allocating the
+// embedded structs it is reached through as encoding/json does.
+func settableField(value reflect.Value, index []int) (reflect.Value, error) {
+	for i, fieldIndex := range index {
+		if i > 0 && value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				if !value.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded pointer to unexported struct %s", value.Type().Elem())
+				}
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			value = value.Elem()
+		}
+		value = value.Field(fieldIndex)
+	}
+	return value, nil
+}
+
+// jsonKind names the JSON type of a decoded value for error messages.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// reviveArgumentEscapes restores the escape types in an argument decoded
+// for a CapnWebUnmarshaler. Handlers receive their arguments as JSON, in
+// which the escapes the client sent are encoded as the arrays
+// ["date", number], ["bigint", string], ["bytes", string], ["undefined"],
+// ["nan"], ["inf"] and ["-inf"]. value is modified in place.
+func reviveArgumentEscapes(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = reviveArgumentEscapes(val)
+		}
+		return v
+	case []interface{}:
+		if revived, ok := reviveEscape(v); ok {
+			return revived
+		}
+		for i, elem := range v {
+			v[i] = reviveArgumentEscapes(elem)
+		}
+		return v
+	default:
+		return value
+	}
+}
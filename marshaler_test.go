@@ -0,0 +1,164 @@
+package gocapnweb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// coord is sent as the string "x,y" and decodes itself from it.
+type coord struct {
+	X, Y int
+}
+
+// MarshalCapnWeb implements CapnWebMarshaler.
+func (c coord) MarshalCapnWeb() (interface{}, error) {
+	if c.X < 0 {
+		return nil, errors.New("negative coordinate")
+	}
+	return fmt.Sprintf("%d,%d", c.X, c.Y), nil
+}
+
+// UnmarshalCapnWeb implements CapnWebUnmarshaler.
+func (c *coord) UnmarshalCapnWeb(value interface{}) error {
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("coordinate must be a string, got %v", value)
+	}
+	_, err := fmt.Sscanf(s, "%d,%d", &c.X, &c.Y)
+	return err
+}
+
+// stamped is sent as an object holding a Date, through a pointer receiver.
+type stamped struct {
+	at time.Time
+}
+
+// MarshalCapnWeb implements CapnWebMarshaler.
+func (s *stamped) MarshalCapnWeb() (interface{}, error) {
+	return map[string]interface{}{"at": s.at}, nil
+}
+
+// UnmarshalCapnWeb implements CapnWebUnmarshaler.
+func (s *stamped) UnmarshalCapnWeb(value interface{}) error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("stamp must be an object")
+	}
+	date, ok := fields["at"].(Date)
+	if !ok {
+		return fmt.Errorf("stamp must hold a date, got %T", fields["at"])
+	}
+	s.at = date.Time
+	return nil
+}
+
+// selfMarshaler returns a value of its own type from MarshalCapnWeb.
+type selfMarshaler struct{}
+
+// MarshalCapnWeb implements CapnWebMarshaler.
+func (s selfMarshaler) MarshalCapnWeb() (interface{}, error) {
+	return s, nil
+}
+
+func TestCapnWebMarshaler(t *testing.T) {
+	at := time.UnixMilli(1700000000000).UTC()
+	type route struct {
+		Name  string   `json:"name"`
+		Start coord    `json:"start"`
+		Stops []coord  `json:"stops"`
+		Stamp stamped  `json:"stamp"`
+		Next  *stamped `json:"next"`
+	}
+	target := testTarget()
+	results := map[string]interface{}{
+		"coord": coord{1, 2},
+		"route": &route{Name: "r", Start: coord{0, 0}, Stops: []coord{{1, 1}, {2, 3}}, Stamp: stamped{at}},
+		"bad":   []coord{{-1, 0}},
+		"self":  selfMarshaler{},
+	}
+	// A pointer receiver applies to fields of a result sent by pointer, which
+	// are addressable
+	for name, result := range results {
+		result := result
+		target.Method(name, constantHandler(result))
+	}
+
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"coord", `["resolve",1,"1,2"]`},
+		{"route", `["resolve",1,{"name":"r","next":null,"stamp":{"at":["date",1700000000000]},"start":"0,0","stops":[["1,1","2,3"]]}]`},
+		{"bad", `["reject",1,["error","SerializationError","failed to marshal gocapnweb.coord: negative coordinate"]]`},
+		{"self", `["reject",1,["error","SerializationError","failed to marshal gocapnweb.selfMarshaler: MarshalCapnWeb returned a value of its own type"]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["`+tt.method+`"],[]]]`, `["pull",1]`)
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapnWebUnmarshaler(t *testing.T) {
+	type trip struct {
+		From  coord    `json:"from"`
+		Via   []coord  `json:"via"`
+		Stamp *stamped `json:"stamp"`
+	}
+	target := NewBaseRpcTarget()
+	register := func(name string, fn interface{}) {
+		if err := target.TypedMethod(name, fn); err != nil {
+			t.Fatalf("TypedMethod(%s): %v", name, err)
+		}
+	}
+	register("sum", func(a, b coord) (int, error) { return a.X + a.Y + b.X + b.Y, nil })
+	register("trip", func(tr trip) (string, error) {
+		stamp := "none"
+		if tr.Stamp != nil {
+			stamp = tr.Stamp.at.Format(time.RFC3339)
+		}
+		return fmt.Sprintf("%v via %v at %s", tr.From, tr.Via, stamp), nil
+	})
+	if err := MethodTypedWithSchema(target, "origin", func(c coord) (bool, error) { return c == coord{}, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call string
+		want string
+	}{
+		{"parameters", `["sum"],["1,2","3,4"]`, `["resolve",1,10]`},
+		{
+			"fields",
+			`["trip"],[{"from":"0,0","via":[["1,1","2,2"]],"stamp":{"at":["date",1700000000000]}}]`,
+			`["resolve",1,"{0 0} via [{1 1} {2 2}] at 2023-11-14T22:13:20Z"]`,
+		},
+		{"null pointer field", `["trip"],[{"from":"5,5","stamp":null}]`, `["resolve",1,"{5 5} via [] at none"]`},
+		{"typed with schema", `["origin"],["0,0"]`, `["resolve",1,true]`},
+		{
+			"unmarshaler error",
+			`["sum"],["1,2",7]`,
+			`["reject",1,["error","ArgumentError","argument 2 of sum: expected gocapnweb.coord: coordinate must be a string, got 7",null,{"argument":2}]]`,
+		},
+		{
+			"escape type in an unmarshaler",
+			`["trip"],[{"from":"0,0","stamp":{"at":"yesterday"}}]`,
+			`["reject",1,["error","ArgumentError","argument 1 of trip: expected gocapnweb.trip: stamp must hold a date, got string",null,{"argument":1}]]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,`+tt.call+`]]`, `["pull",1]`)
+			if strings.Join(got, "\n") != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package gocapnweb
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultMessageQueueSize is the number of data messages a MessageQueue
+// buffers before SendData blocks.
+const DefaultMessageQueueSize = 64
+
+// ErrQueueClosed is returned when sending on a MessageQueue that has been
+// closed or whose connection has failed.
+var ErrQueueClosed = errors.New("message queue closed")
+
+// MessageWriter is the subset of *websocket.Conn used by MessageQueue.
+type MessageWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
+// MessageQueue serializes writes to a single WebSocket connection, which
+// does not support concurrent writers. It has two lanes: control messages
+// (pings and close frames) are always written before any queued data
+// messages (resolves, rejects), so a backlog of large responses cannot delay
+// keepalives or a close.
+type MessageQueue struct {
+	writer  MessageWriter
+	control chan queuedMessage
+	data    chan queuedMessage
+	stop    chan struct{}
+	done    chan struct{}
+
+	stopOnce sync.Once
+	mu       sync.Mutex
+	err      error
+}
+
+// NewMessageQueue creates a queue for writer and starts its writer goroutine.
+// size bounds the data lane; values less than one use DefaultMessageQueueSize.
+func NewMessageQueue(writer MessageWriter, size int) *MessageQueue {
+	if size < 1 {
+		size = DefaultMessageQueueSize
+	}
+
+	q := &MessageQueue{
+		writer:  writer,
+		control: make(chan queuedMessage, 8),
+		data:    make(chan queuedMessage, size),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// SendData queues a data message. It blocks while the data lane is full.
+func (q *MessageQueue) SendData(data []byte) error {
+	return q.enqueue(q.data, queuedMessage{messageType: websocket.TextMessage, data: data})
+}
+
+// SendControl queues a control message such as websocket.PingMessage or
+// websocket.CloseMessage ahead of any pending data messages. Nothing is
+// written after a close message.
+func (q *MessageQueue) SendControl(messageType int, data []byte) error {
+	return q.enqueue(q.control, queuedMessage{messageType: messageType, data: data})
+}
+
+// Close stops accepting messages, waits for those already queued to be
+// written, and returns the first write error encountered, if any.
+func (q *MessageQueue) Close() error {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+	<-q.done
+	return q.Err()
+}
+
+// Err returns the first write error encountered, if any.
+func (q *MessageQueue) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+func (q *MessageQueue) enqueue(lane chan queuedMessage, msg queuedMessage) error {
+	// Check for closure first so a send racing with Close is not accepted
+	// merely because the lane has room.
+	select {
+	case <-q.stop:
+		return ErrQueueClosed
+	case <-q.done:
+		return ErrQueueClosed
+	default:
+	}
+
+	select {
+	case lane <- msg:
+		return nil
+	case <-q.stop:
+		return ErrQueueClosed
+	case <-q.done:
+		return ErrQueueClosed
+	}
+}
+
+func (q *MessageQueue) run() {
+	defer close(q.done)
+
+	for {
+		// Control messages always take priority over data
+		select {
+		case msg := <-q.control:
+			if !q.write(msg) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case msg := <-q.control:
+			if !q.write(msg) {
+				return
+			}
+		case msg := <-q.data:
+			if !q.write(msg) {
+				return
+			}
+		case <-q.stop:
+			q.drain()
+			return
+		}
+	}
+}
+
+// drain writes any messages queued before Close, control messages first.
+func (q *MessageQueue) drain() {
+	for {
+		select {
+		case msg := <-q.control:
+			if !q.write(msg) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case msg := <-q.data:
+			if !q.write(msg) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// write sends a message and reports whether the writer should continue.
+func (q *MessageQueue) write(msg queuedMessage) bool {
+	if err := q.writer.WriteMessage(msg.messageType, msg.data); err != nil {
+		q.mu.Lock()
+		if q.err == nil {
+			q.err = err
+		}
+		q.mu.Unlock()
+		return false
+	}
+	return msg.messageType != websocket.CloseMessage
+}
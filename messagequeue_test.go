@@ -0,0 +1,145 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordingWriter is a MessageWriter that records what it writes. Its
+// first write blocks until release is closed, so that messages back up in
+// the queue behind it.
+type recordingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	fail    error
+
+	mu     sync.Mutex
+	writes []queuedMessage
+}
+
+func newRecordingWriter() *recordingWriter {
+	return &recordingWriter{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+// WriteMessage implements MessageWriter.
+func (w *recordingWriter) WriteMessage(messageType int, data []byte) error {
+	w.mu.Lock()
+	first := len(w.writes) == 0
+	w.writes = append(w.writes, queuedMessage{messageType: messageType, data: data})
+	w.mu.Unlock()
+	if first {
+		close(w.started)
+		<-w.release
+	}
+	return w.fail
+}
+
+// types returns the types of the messages written, in order.
+func (w *recordingWriter) types() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	types := make([]int, len(w.writes))
+	for i, msg := range w.writes {
+		types[i] = msg.messageType
+	}
+	return types
+}
+
+// fillQueue sends one data message, which the writer blocks on, and then n
+// more of size bytes, which fill the data lane of a queue of size n.
+func fillQueue(t *testing.T, q *MessageQueue, w *recordingWriter, n, size int) {
+	t.Helper()
+	if err := q.SendData([]byte(`["resolve",0,"first"]`)); err != nil {
+		t.Fatal(err)
+	}
+	<-w.started
+	payload := bytes.Repeat([]byte("x"), size)
+	for i := 0; i < n; i++ {
+		if err := q.SendData(payload); err != nil {
+			t.Fatalf("data message %d: %v", i, err)
+		}
+	}
+}
+
+func TestMessageQueueClosePriority(t *testing.T) {
+	const queued = 100
+	w := newRecordingWriter()
+	q := NewMessageQueue(w, queued)
+	fillQueue(t, q, w, queued, 64*1024)
+
+	// The close frame is queued behind a full data lane
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err := q.SendControl(websocket.CloseMessage, closeFrame); err != nil {
+		t.Fatal(err)
+	}
+	close(w.release)
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Only the message being written when the close was queued goes out
+	// before it, and nothing after it
+	types := w.types()
+	if len(types) != 2 || types[0] != websocket.TextMessage || types[1] != websocket.CloseMessage {
+		t.Errorf("wrote message types %v, want [text close]", types)
+	}
+	if err := q.SendData([]byte("late")); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("SendData after Close: %v, want ErrQueueClosed", err)
+	}
+}
+
+func TestMessageQueuePingPriority(t *testing.T) {
+	const queued = 10
+	w := newRecordingWriter()
+	q := NewMessageQueue(w, queued)
+	fillQueue(t, q, w, queued, 1024)
+	if err := q.SendControl(websocket.PingMessage, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(w.release)
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The ping jumps the queued data, which is all written after it
+	types := w.types()
+	if len(types) != queued+2 || types[1] != websocket.PingMessage {
+		t.Fatalf("wrote message types %v, want a ping second of %d", types, queued+2)
+	}
+	for i, typ := range types[2:] {
+		if typ != websocket.TextMessage {
+			t.Errorf("message %d has type %d, want text", i+2, typ)
+		}
+	}
+}
+
+func TestMessageQueueWriteError(t *testing.T) {
+	w := newRecordingWriter()
+	w.fail = errors.New("broken pipe")
+	close(w.release)
+	q := NewMessageQueue(w, 0)
+	if err := q.SendData([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The writer stops at the first error, which Close returns
+	select {
+	case <-q.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the writer did not stop")
+	}
+	if err := q.SendData([]byte("two")); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("SendData after a write error: %v, want ErrQueueClosed", err)
+	}
+	if err := q.Close(); err == nil || err.Error() != "broken pipe" {
+		t.Errorf("Close = %v, want the write error", err)
+	}
+	if got := len(w.types()); got != 1 {
+		t.Errorf("wrote %d messages, want 1", got)
+	}
+}
@@ -0,0 +1,132 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// RpcHandler handles a call with the given arguments.
+type RpcHandler func(args json.RawMessage) (interface{}, error)
+
+// RpcMiddleware wraps calls to a BaseRpcTarget's methods. It may inspect or
+// rewrite the arguments, short-circuit the call by returning without calling
+// next, or transform the result and error that next returns.
+type RpcMiddleware func(method string, args json.RawMessage, next RpcHandler) (interface{}, error)
+
+// ErrUnauthorized is returned by AuthMiddleware when a call's token is
+// missing or rejected.
+var ErrUnauthorized = RpcError{Code: "Unauthorized"}
+
+// AuthTokenKey is the argument key AuthMiddleware reads the caller's token
+// from.
+const AuthTokenKey = "$auth"
+
+// UseMiddleware adds mw to the middleware wrapping every method of the
+// target, including methods registered later. Middleware runs in the order
+// it was added: the first added is outermost and sees each call first.
+func (t *BaseRpcTarget) UseMiddleware(mw RpcMiddleware) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.middleware = append(t.middleware, mw)
+}
+
+// applyMiddleware wraps handler in the given middleware chain.
+func applyMiddleware(chain []RpcMiddleware, method string, handler RpcHandler) RpcHandler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		mw, next := chain[i], handler
+		handler = func(args json.RawMessage) (interface{}, error) {
+			return mw(method, args, next)
+		}
+	}
+	return handler
+}
+
+// ForMethods restricts mw to calls of the named methods; other calls pass
+// straight through.
+func ForMethods(mw RpcMiddleware, methods ...string) RpcMiddleware {
+	selected := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		selected[method] = true
+	}
+	return func(method string, args json.RawMessage, next RpcHandler) (interface{}, error) {
+		if !selected[method] {
+			return next(args)
+		}
+		return mw(method, args, next)
+	}
+}
+
+// AuthMiddleware rejects calls whose token is not accepted by
+// tokenValidator. The token is read from the "$auth" key of the argument
+// object, or of the first object in the positional argument array, and is
+// removed before the call reaches the handler:
+//
+//	["push", ["pipeline", 0, ["getProfile"], [{"$auth": "token-123", "id": "u_1"}]]]
+func AuthMiddleware(tokenValidator func(string) bool) RpcMiddleware {
+	return func(method string, args json.RawMessage, next RpcHandler) (interface{}, error) {
+		token, stripped, err := extractAuthToken(args)
+		if err != nil {
+			return nil, err
+		}
+		if token == "" || !tokenValidator(token) {
+			return nil, RpcError{Code: ErrUnauthorized.Code, Message: "unauthorized call to " + method}
+		}
+		return next(stripped)
+	}
+}
+
+// extractAuthToken returns the auth token carried by args and the arguments
+// without it.
+func extractAuthToken(args json.RawMessage) (string, json.RawMessage, error) {
+	var value interface{}
+	if err := json.Unmarshal(args, &value); err != nil {
+		return "", args, nil
+	}
+
+	envelope, ok := value.(map[string]interface{})
+	if !ok {
+		argArray, isArray := value.([]interface{})
+		if !isArray {
+			return "", args, nil
+		}
+		for _, arg := range argArray {
+			if obj, isObj := arg.(map[string]interface{}); isObj {
+				if _, has := obj[AuthTokenKey]; has {
+					envelope = obj
+					break
+				}
+			}
+		}
+		if envelope == nil {
+			return "", args, nil
+		}
+	}
+
+	token, _ := envelope[AuthTokenKey].(string)
+	delete(envelope, AuthTokenKey)
+
+	stripped, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, stripped, nil
+}
+
+// LoggingMiddleware logs the method, duration and error of every call to
+// logger, or to the standard logger if logger is nil.
+func LoggingMiddleware(logger *log.Logger) RpcMiddleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(method string, args json.RawMessage, next RpcHandler) (interface{}, error) {
+		start := time.Now()
+		result, err := next(args)
+		if err != nil {
+			logger.Printf("RPC %s failed after %v: %v", method, time.Since(start), err)
+		} else {
+			logger.Printf("RPC %s completed in %v", method, time.Since(start))
+		}
+		return result, err
+	}
+}
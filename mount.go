@@ -0,0 +1,107 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// Mount makes the methods of target callable on t under prefix, so a call
+// to "user.getProfile" is dispatched to the getProfile method of the target
+// mounted as "user". Methods registered on t itself take precedence, and
+// the target mounted under the longest matching prefix is chosen, so
+// mounted targets may have targets of their own mounted in turn. Calls
+// clients make on a path, such as api.user.getProfile(), are dispatched
+// under the path joined with dots.
+//
+// Calls to mounted targets pass through t's middleware and are reported by
+// __introspect under their full names if the target is a BaseRpcTarget.
+// Mounting a target under a prefix already in use replaces it.
+func (t *BaseRpcTarget) Mount(prefix string, target RpcTarget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mounts == nil {
+		t.mounts = make(map[string]RpcTarget)
+	}
+	t.mounts[prefix] = target
+}
+
+// mountedHandler returns a handler that calls the target mounted for
+// method. It must be called with t.mu held.
+func (t *BaseRpcTarget) mountedHandler(method string) (ContextHandler, bool) {
+	for i := strings.LastIndexByte(method, '.'); i >= 0; i = strings.LastIndexByte(method[:i], '.') {
+		target, exists := t.mounts[method[:i]]
+		if !exists {
+			continue
+		}
+		subMethod := method[i+1:]
+		return func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			return dispatchMounted(ctx, target, subMethod, args)
+		}, true
+	}
+	return nil, false
+}
+
+// dispatchMounted calls method on a mounted target, with the session of the
+// call if ctx carries one.
+func dispatchMounted(ctx context.Context, target RpcTarget, method string, args json.RawMessage) (interface{}, error) {
+	sessionData, _ := SessionFromContext(ctx)
+	return dispatchTarget(ctx, sessionData, target, method, args)
+}
+
+// introspectMounts adds the methods of the mounted targets that are
+// BaseRpcTargets to introspection, under their full names.
+func (t *BaseRpcTarget) introspectMounts(introspection *Introspection) {
+	t.mu.RLock()
+	mounts := make(map[string]*BaseRpcTarget, len(t.mounts))
+	for prefix, target := range t.mounts {
+		if base, ok := target.(*BaseRpcTarget); ok && base != t {
+			mounts[prefix] = base
+		}
+	}
+	t.mu.RUnlock()
+
+	for prefix, target := range mounts {
+		mounted := target.Introspect()
+		for _, name := range mounted.Methods {
+			fullName := prefix + "." + name
+			introspection.Methods = append(introspection.Methods, fullName)
+			if meta, exists := mounted.Metadata[name]; exists {
+				if introspection.Metadata == nil {
+					introspection.Metadata = make(map[string]MethodMeta)
+				}
+				introspection.Metadata[fullName] = meta
+			}
+			if schema, exists := mounted.Schemas[name]; exists {
+				if introspection.Schemas == nil {
+					introspection.Schemas = make(map[string]json.RawMessage)
+				}
+				introspection.Schemas[fullName] = schema
+			}
+			if deprecation, exists := mounted.Deprecations[name]; exists {
+				if introspection.Deprecations == nil {
+					introspection.Deprecations = make(map[string]DeprecationInfo)
+				}
+				introspection.Deprecations[fullName] = deprecation
+			}
+		}
+	}
+}
+
+// pathMethod returns the method a call pushed on the main target names: the
+// elements of its path joined with dots, which BaseRpcTarget dispatches to
+// its mounted targets.
+func pathMethod(operation Operation) string {
+	if len(operation.Path) < 2 {
+		return operation.Method
+	}
+	names := make([]string, len(operation.Path))
+	for i, element := range operation.Path {
+		name, ok := element.(string)
+		if !ok {
+			return operation.Method
+		}
+		names[i] = name
+	}
+	return strings.Join(names, ".")
+}
@@ -0,0 +1,93 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// mountedTarget returns a root target with a user target mounted under
+// "user", and an audit target mounted under "admin.audit" of an admin
+// target mounted under "admin".
+func mountedTarget() *BaseRpcTarget {
+	user := NewBaseRpcTarget()
+	user.Method("getProfile", func(args json.RawMessage) (interface{}, error) {
+		var ids []string
+		if err := json.Unmarshal(args, &ids); err != nil || len(ids) != 1 {
+			return nil, NewRpcError("ArgumentError", "getProfile takes an id")
+		}
+		return map[string]string{"id": ids[0]}, nil
+	})
+	user.MethodWithContext("session", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		_, ok := SessionFromContext(ctx)
+		return ok, nil
+	})
+	audit := NewBaseRpcTarget()
+	audit.Method("list", constantHandler([]string{"login"}))
+	admin := NewBaseRpcTarget()
+	admin.Method("ping", constantHandler("admin pong"))
+	admin.Mount("audit", audit)
+
+	root := testTarget()
+	root.Mount("user", user)
+	root.Mount("admin", admin)
+	return root
+}
+
+func TestMount(t *testing.T) {
+	tests := []struct {
+		name string
+		call string
+		want string
+	}{
+		{"dotted method", `["user.getProfile"],["u_1"]`, `["resolve",1,{"id":"u_1"}]`},
+		{"path", `["user","getProfile"],["u_2"]`, `["resolve",1,{"id":"u_2"}]`},
+		{"nested mount", `["admin","audit","list"],[]`, `["resolve",1,[["login"]]]`},
+		{"method of an outer mount", `["admin.ping"],[]`, `["resolve",1,"admin pong"]`},
+		{"session in context", `["user.session"],[]`, `["resolve",1,true]`},
+		{"root method", `["echo"],["root"]`, `["resolve",1,"root"]`},
+		{"error of a mounted method", `["user.getProfile"],[]`, `["reject",1,["error","ArgumentError","getProfile takes an id"]]`},
+		{"unknown mount path", `["billing.charge"],[]`, `["reject",1,["error","MethodNotFound","method not found: billing.charge"]]`},
+		{"unknown nested mount path", `["admin","billing","charge"],[]`, `["reject",1,["error","MethodNotFound","method not found: billing.charge"]]`},
+		{"unknown method of a mount", `["user","deleteProfile"],[]`, `["reject",1,["error","MethodNotFound","method not found: deleteProfile"]]`},
+	}
+	target := mountedTarget()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,`+tt.call+`]]`, `["pull",1]`)
+			if strings.Join(got, "\n") != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountMiddlewareAndIntrospection(t *testing.T) {
+	target := mountedTarget()
+	var called []string
+	target.UseMiddleware(func(method string, args json.RawMessage, next RpcHandler) (interface{}, error) {
+		called = append(called, method)
+		return next(args)
+	})
+	handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["user","getProfile"],["u_1"]]]`, `["pull",1]`)
+	if strings.Join(called, ",") != "user.getProfile" {
+		t.Errorf("middleware saw %v, want [user.getProfile]", called)
+	}
+
+	methods := target.Introspect().Methods
+	for _, name := range []string{"user.getProfile", "admin.ping", "admin.audit.list", "echo"} {
+		if !containsString(methods, name) {
+			t.Errorf("introspection lacks %s: %v", name, methods)
+		}
+	}
+
+	// Mounting under a prefix in use replaces the target
+	other := NewBaseRpcTarget()
+	other.Method("getProfile", constantHandler("replaced"))
+	target.Mount("user", other)
+	got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["user.getProfile"],[]]]`, `["pull",1]`)
+	if len(got) != 1 || got[0] != `["resolve",1,"replaced"]` {
+		t.Errorf("after replacing the mount: got %v", got)
+	}
+}
@@ -0,0 +1,135 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrNotifyUnsupported is returned when notifying a session that has no
+// persistent connection, such as an HTTP batch request.
+var ErrNotifyUnsupported = errors.New("session does not support notifications")
+
+// NotifyFunc sends ["notify", exportID, value] to one connection without a
+// pull from the client.
+type NotifyFunc func(exportID int, value interface{}) error
+
+// Notifier pushes values to the client of a session outside the normal
+// request/response flow. RpcSession implements Notifier.
+type Notifier interface {
+	Notify(sessionData *SessionData, exportID int, value interface{}) error
+}
+
+var _ Notifier = (*RpcSession)(nil)
+
+// Notify sends ["notify", exportID, value] to the client of sessionData. It
+// may be called from any goroutine; writes are serialized by the
+// connection's message queue. It fails with ErrNotifyUnsupported for
+// sessions without a WebSocket connection, and with ErrExportReleased once
+// the client has released exportID or the session has ended.
+func (s *RpcSession) Notify(sessionData *SessionData, exportID int, value interface{}) error {
+	frame, err := s.notifyFrame(exportID, value)
+	if err != nil {
+		return err
+	}
+
+	sessionData.outboxMu.Lock()
+	send := sessionData.sendFrame
+	sessionData.outboxMu.Unlock()
+	if send == nil {
+		return ErrNotifyUnsupported
+	}
+	if sessionData.ExportRefcount(exportID) == 0 {
+		return ErrExportReleased
+	}
+	return send(frame)
+}
+
+// notifyFrame encodes a notify frame, escaping array values as in a resolve.
+func (s *RpcSession) notifyFrame(exportID int, value interface{}) ([]byte, error) {
+	normalizedValue, err := s.normalizeResult(nil, value)
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := json.Marshal([]interface{}{"notify", exportID, wireValue(normalizedValue)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode notify frame: %w", err)
+	}
+	return frame, nil
+}
+
+// CallInfo identifies the call a handler is running for.
+type CallInfo struct {
+	// SessionID is the SessionData.ID of the calling session; for WebSocket
+	// connections it is also the connection's ID in the endpoint registry.
+	SessionID string
+
+	// ExportID is the export ID the client assigned to the call.
+	ExportID int
+}
+
+type callInfoKey struct{}
+type notifierKey struct{}
+
+// CallInfoFromContext returns the call a ContextHandler is running for.
+func CallInfoFromContext(ctx context.Context) (CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(CallInfo)
+	return info, ok
+}
+
+// NotifierFromContext returns a NotifyFunc for the connection that made the
+// call a ContextHandler is running for. It stays usable after the handler
+// returns, until the connection closes.
+func NotifierFromContext(ctx context.Context) (NotifyFunc, bool) {
+	notify, ok := ctx.Value(notifierKey{}).(NotifyFunc)
+	return notify, ok
+}
+
+// callContext returns the context of a call to exportID, carrying its
+// CallInfo, a NotifyFunc for the session and the session itself, to which
+// client stubs are bound.
+func (s *RpcSession) callContext(sessionData *SessionData, exportID int) context.Context {
+	ctx := context.WithValue(sessionData.Context(), callInfoKey{}, CallInfo{
+		SessionID: sessionData.ID,
+		ExportID:  exportID,
+	})
+	ctx = context.WithValue(ctx, callSessionKey{}, callSession{session: s, sessionData: sessionData})
+	return context.WithValue(ctx, notifierKey{}, NotifyFunc(func(exportID int, value interface{}) error {
+		return s.Notify(sessionData, exportID, value)
+	}))
+}
+
+// RpcEndpoint is the handle returned by SetupRpcEndpoint. It embeds the
+// endpoint's route group, so further routes can be added to it, and can push
+// notifications to the endpoint's WebSocket connections.
+type RpcEndpoint struct {
+	*echo.Group
+
+	session  *RpcSession
+	registry *ConnectionRegistry
+}
+
+// BroadcastNotify sends ["notify", exportID, value] to every connection in
+// the endpoint's registry and returns the number of connections it was
+// queued for.
+func (ep *RpcEndpoint) BroadcastNotify(exportID int, value interface{}) (int, error) {
+	frame, err := ep.session.notifyFrame(exportID, value)
+	if err != nil {
+		return 0, err
+	}
+	return ep.registry.Broadcast(frame), nil
+}
+
+// ConnNotify sends ["notify", exportID, value] to the connection whose
+// session ID is connID.
+func (ep *RpcEndpoint) ConnNotify(connID string, exportID int, value interface{}) error {
+	frame, err := ep.session.notifyFrame(exportID, value)
+	if err != nil {
+		return err
+	}
+	return ep.registry.Send(connID, frame)
+}
@@ -0,0 +1,109 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// watcher is what the "watch" method of notifyTarget hands to the test: the
+// NotifyFunc of the calling connection and the export ID of the call.
+type watcher struct {
+	notify   NotifyFunc
+	exportID int
+}
+
+// notifyTarget returns the test target with a "watch" method that sends a
+// watcher for each call to watchers.
+func notifyTarget(watchers chan<- watcher) *BaseRpcTarget {
+	target := testTarget()
+	target.MethodWithContext("watch", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		call, _ := CallInfoFromContext(ctx)
+		notify, ok := NotifierFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no notifier")
+		}
+		watchers <- watcher{notify: notify, exportID: call.ExportID}
+		return "watching", nil
+	})
+	return target
+}
+
+// awaitNotifyError calls notify until it fails, as it should once the
+// connection has handled a release or close, and returns the error.
+func awaitNotifyError(t *testing.T, w watcher) error {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := w.notify(w.exportID, "late"); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("notify kept succeeding")
+	return nil
+}
+
+func TestNotifyFunc(t *testing.T) {
+	watchers := make(chan watcher, 1)
+	server := endpointServer(t, notifyTarget(watchers))
+	conn := dialEndpoint(t, server, nil)
+	sendMessages(t, conn, `["push",["pipeline",0,["watch"],[]]]`, `["pull",1]`)
+	if got := readFrameWithPrefix(t, conn, `["resolve",1`); got != `["resolve",1,"watching"]` {
+		t.Fatalf("got %s", got)
+	}
+	w := <-watchers
+
+	// Pushes reach the subscribed connection without a pull
+	for _, value := range []interface{}{1, []string{"a", "b"}} {
+		if err := w.notify(w.exportID, value); err != nil {
+			t.Fatalf("notify: %v", err)
+		}
+	}
+	for _, want := range []string{`["notify",1,1]`, `["notify",1,[["a","b"]]]`} {
+		if got := readFrameWithPrefix(t, conn, `["notify"`); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	// Once the client releases the call, pushes to it stop
+	sendMessages(t, conn, `["release",1,1]`)
+	if err := awaitNotifyError(t, w); !errors.Is(err, ErrExportReleased) {
+		t.Errorf("notify after release = %v, want ErrExportReleased", err)
+	}
+
+	// The connection goes on
+	sendMessages(t, conn, `["push",["pipeline",0,["echo"],["after"]]]`, `["pull",2]`)
+	if got := readFrameWithPrefix(t, conn, `["resolve",2`); got != `["resolve",2,"after"]` {
+		t.Errorf("got %s after release", got)
+	}
+}
+
+func TestNotifyFuncAfterClose(t *testing.T) {
+	watchers := make(chan watcher, 1)
+	server := endpointServer(t, notifyTarget(watchers))
+	conn := dialEndpoint(t, server, nil)
+	sendMessages(t, conn, `["push",["pipeline",0,["watch"],[]]]`, `["pull",1]`)
+	readFrameWithPrefix(t, conn, `["resolve",1`)
+	w := <-watchers
+
+	conn.Close()
+	if err := awaitNotifyError(t, w); err == nil {
+		t.Error("notify succeeded after the connection closed")
+	}
+}
+
+func TestNotifyWithoutConnection(t *testing.T) {
+	watchers := make(chan watcher, 1)
+	target := notifyTarget(watchers)
+	got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["watch"],[]]]`, `["pull",1]`)
+	if len(got) != 1 || got[0] != `["resolve",1,"watching"]` {
+		t.Fatalf("got %v", got)
+	}
+	w := <-watchers
+	if err := w.notify(w.exportID, 1); !errors.Is(err, ErrNotifyUnsupported) {
+		t.Errorf("notify in a batch = %v, want ErrNotifyUnsupported", err)
+	}
+}
@@ -0,0 +1,87 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxSafeInteger is the largest integer below which every integer is exactly
+// representable as a float64, JavaScript's Number.MAX_SAFE_INTEGER.
+const maxSafeInteger = 1<<53 - 1
+
+// decodeJSON decodes data like json.Unmarshal into an interface{}, except
+// that integers too large to be represented exactly as a float64, such as
+// snowflake IDs or timestamps in nanoseconds, are kept as json.Number. They
+// are encoded again with all their digits, so arguments and results carry
+// them to handlers intact; other numbers are float64 as usual.
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return preciseNumbers(value), nil
+}
+
+// preciseNumbers converts the json.Numbers in a value decoded with UseNumber
+// to float64, other than integers a float64 would round. The value is
+// modified in place.
+func preciseNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if isLargeInteger(v) {
+			return v
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return v
+		}
+		return f
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = preciseNumbers(elem)
+		}
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = preciseNumbers(val)
+		}
+	}
+	return value
+}
+
+// isLargeInteger reports whether n is an integer literal beyond the range a
+// float64 represents exactly.
+func isLargeInteger(n json.Number) bool {
+	if strings.ContainsAny(string(n), ".eE") {
+		return false
+	}
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i > maxSafeInteger || i < -maxSafeInteger
+	}
+	// Integers beyond int64, including those that fit a uint64
+	return true
+}
+
+// decodeMessage decodes a protocol message, an array, with decodeJSON.
+func decodeMessage(data []byte) ([]interface{}, error) {
+	value, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	msg, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("message must be an array")
+	}
+	return msg, nil
+}
@@ -0,0 +1,128 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MethodNames returns the sorted names of all registered methods.
+func (t *BaseRpcTarget) MethodNames() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.methods))
+	for name := range t.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GenerateOpenAPISchema produces an OpenAPI 3.1 document describing the
+// methods of target. RPC methods are not individual HTTP paths, so each one
+// is described by an argument schema under components.schemas (named
+// "<method>Args") and listed, with its deprecation status, in the
+// x-rpc-methods extension. Methods registered without a schema accept any
+// arguments.
+func GenerateOpenAPISchema(target *BaseRpcTarget, title, version string) ([]byte, error) {
+	schemas := make(map[string]interface{})
+	methods := make([]map[string]interface{}, 0)
+
+	for _, name := range target.MethodNames() {
+		argsRef := "#/components/schemas/" + name + "Args"
+		if schema, exists := target.MethodSchema(name); exists {
+			schemas[name+"Args"] = schema
+		} else {
+			schemas[name+"Args"] = map[string]interface{}{}
+		}
+
+		method := map[string]interface{}{
+			"name": name,
+			"args": map[string]interface{}{"$ref": argsRef},
+		}
+		if deprecation, deprecated := target.MethodDeprecation(name); deprecated {
+			method["deprecated"] = true
+			method["sunset"] = deprecation.Sunset.UTC().Format(http.TimeFormat)
+			if deprecation.Replacement != "" {
+				method["replacement"] = deprecation.Replacement
+			}
+		}
+		methods = append(methods, method)
+	}
+
+	document := map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"paths": map[string]interface{}{},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+		"x-rpc-methods": methods,
+	}
+	return json.MarshalIndent(document, "", "  ")
+}
+
+// SetupOpenAPIEndpoint serves the OpenAPI document for target as JSON at
+// path. The document is regenerated on each request so that methods
+// registered after setup are included.
+func SetupOpenAPIEndpoint(e *echo.Echo, path string, target *BaseRpcTarget, title, version string) {
+	e.GET(path, func(c echo.Context) error {
+		schema, err := GenerateOpenAPISchema(target, title, version)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate schema")
+		}
+		return c.JSONBlob(http.StatusOK, schema)
+	})
+}
+
+// swaggerUIVersion is the swagger-ui-dist release loaded from the CDN.
+const swaggerUIVersion = "5.17.14"
+
+var swaggerUITemplate = template.Must(template.New("swagger-ui").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>API Documentation</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@{{.Version}}/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@{{.Version}}/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = function () {
+      window.ui = SwaggerUIBundle({
+        url: {{.SchemaURL}},
+        dom_id: "#swagger-ui",
+      });
+    };
+  </script>
+</body>
+</html>
+`))
+
+// SetupSwaggerUIEndpoint serves a Swagger UI page at path that loads the
+// OpenAPI document from schemaURL, typically the path passed to
+// SetupOpenAPIEndpoint. The Swagger UI assets are loaded from the unpkg CDN.
+func SetupSwaggerUIEndpoint(e *echo.Echo, path string, schemaURL string) {
+	var page strings.Builder
+	if err := swaggerUITemplate.Execute(&page, struct {
+		Version   string
+		SchemaURL string
+	}{swaggerUIVersion, schemaURL}); err != nil {
+		panic(err)
+	}
+	html := page.String()
+
+	e.GET(path, func(c echo.Context) error {
+		c.Response().Header().Set("X-Frame-Options", "SAMEORIGIN")
+		return c.HTML(http.StatusOK, html)
+	})
+}
@@ -0,0 +1,73 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSwaggerUIEndpoint(t *testing.T) {
+	target := testTarget()
+	e := echo.New()
+	SetupOpenAPIEndpoint(e, "/openapi.json", target, "Test API", "1.0.0")
+	SetupSwaggerUIEndpoint(e, "/docs", "/openapi.json")
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("GET /docs = %d %s, want 200 text/html", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if got := resp.Header.Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q, want SAMEORIGIN", got)
+	}
+	page := string(body)
+	for _, want := range []string{"swagger-ui-dist@" + swaggerUIVersion + "/swagger-ui-bundle.js", `url: "/openapi.json"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %s:\n%s", want, page)
+		}
+	}
+
+	// The schema the page loads lists the target's methods
+	resp, err = http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var document struct {
+		OpenAPI string `json:"openapi"`
+		Methods []struct {
+			Name string `json:"name"`
+		} `json:"x-rpc-methods"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, method := range document.Methods {
+		names = append(names, method.Name)
+	}
+	if document.OpenAPI != "3.1.0" || strings.Join(names, " ") != strings.Join(target.MethodNames(), " ") {
+		t.Errorf("schema = %+v, want the methods %v", document, target.MethodNames())
+	}
+}
+
+func TestSwaggerUISchemaURLEscaped(t *testing.T) {
+	e := echo.New()
+	SetupSwaggerUIEndpoint(e, "/docs", `/schema.json?x="</script><script>alert(1)</script>`)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if body := rec.Body.String(); strings.Contains(body, "<script>alert(1)") {
+		t.Errorf("schema URL is not escaped:\n%s", body)
+	}
+}
@@ -0,0 +1,147 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Calls the client makes through the same reference to a capability are
+// dispatched in the order it pushed them (E-order), even when a pull
+// evaluates them out of order or dispatches independent calls concurrently.
+// Before a call is dispatched, every call pushed earlier on the same callee
+// that has not yet been dispatched is evaluated first, or, if it is already
+// being evaluated, waited for until it is dispatched. Only the start of each
+// call is ordered; calls that have started may run concurrently.
+//
+// Argument references only ever refer to earlier pushes, so a call waits
+// only on calls pushed before it and the wait cannot form a cycle.
+
+// callee identifies the capability a pushed call is made on: the import it
+// was pushed on and the path to the capability within it. It is empty for
+// operations that are not method calls.
+func (op Operation) callee() string {
+	if !op.isCall() {
+		return ""
+	}
+	if len(op.Path) == 0 {
+		return fmt.Sprint(op.ImportID)
+	}
+	prefix, _ := json.Marshal(op.Path[:len(op.Path)-1])
+	return fmt.Sprintf("%d%s", op.ImportID, prefix)
+}
+
+// isCall reports whether op is a method call.
+func (op Operation) isCall() bool {
+	return op.Remap == nil && !op.Property && op.Err == nil && op.Method != ""
+}
+
+// queueCall adds the call pushed as exportID to the queue of its callee.
+// Pushes take increasing export IDs, so queues stay in push order. It must
+// be called with sd.mu held.
+func (sd *SessionData) queueCall(exportID int, operation Operation) {
+	callee := operation.callee()
+	if callee == "" {
+		return
+	}
+	if sd.callQueues == nil {
+		sd.callQueues = make(map[string][]int)
+	}
+	sd.callQueues[callee] = append(sd.callQueues[callee], exportID)
+}
+
+// indexCalls rebuilds the callee queues from the pending operations, after
+// they have been replaced. It must be called with sd.mu held.
+func (sd *SessionData) indexCalls() {
+	sd.callQueues = nil
+	exportIDs := make([]int, 0, len(sd.PendingOperations))
+	for exportID := range sd.PendingOperations {
+		exportIDs = append(exportIDs, exportID)
+	}
+	sort.Ints(exportIDs)
+	for _, exportID := range exportIDs {
+		sd.queueCall(exportID, sd.PendingOperations[exportID])
+	}
+}
+
+// awaitDispatchTurn returns once every call pushed before exportID on the
+// same callee has been dispatched, evaluating those nobody else is.
+func (s *RpcSession) awaitDispatchTurn(sessionData *SessionData, exportID int) {
+	for {
+		sessionData.mu.Lock()
+		earlier, running, changed := sessionData.earlierCall(exportID)
+		sessionData.mu.Unlock()
+
+		switch {
+		case earlier == 0:
+			return
+		case running:
+			<-changed
+		default:
+			// Its error, if any, is reported when it is pulled
+			s.evaluatePending(sessionData, earlier)
+		}
+	}
+}
+
+// earlierCall returns the first call pushed before exportID on the same
+// callee that has not been dispatched, or zero if there is none, whether it
+// is being evaluated, and a channel that is closed once a call is
+// dispatched or finishes. Calls that have been dispatched, released or
+// replaced are dropped from the front of the callee's queue as they are
+// found, so each is looked at once. It must be called with sd.mu held.
+func (sd *SessionData) earlierCall(exportID int) (int, bool, <-chan struct{}) {
+	operation, exists := sd.PendingOperations[exportID]
+	if !exists || !operation.isCall() {
+		return 0, false, nil
+	}
+	callee := operation.callee()
+	queue := sd.callQueues[callee]
+	for len(queue) > 0 && !sd.awaitsDispatch(queue[0]) {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(sd.callQueues, callee)
+	} else {
+		sd.callQueues[callee] = queue
+	}
+
+	if len(queue) == 0 || queue[0] >= exportID {
+		return 0, false, nil
+	}
+	earlier := queue[0]
+	if sd.dispatchSignal == nil {
+		sd.dispatchSignal = make(chan struct{})
+	}
+	_, running := sd.inflight[earlier]
+	return earlier, running, sd.dispatchSignal
+}
+
+// awaitsDispatch reports whether exportID is a pending call that has not
+// been dispatched. It must be called with sd.mu held.
+func (sd *SessionData) awaitsDispatch(exportID int) bool {
+	if operation, exists := sd.PendingOperations[exportID]; !exists || !operation.isCall() {
+		return false
+	}
+	entry, exists := sd.exports[exportID]
+	return exists && !entry.dispatched
+}
+
+// markDispatched records that the call for exportID is being dispatched.
+func (sd *SessionData) markDispatched(exportID int) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if entry, exists := sd.exports[exportID]; exists && !entry.dispatched {
+		entry.dispatched = true
+		sd.signalDispatch()
+	}
+}
+
+// signalDispatch wakes the calls waiting for their turn. It must be called
+// with sd.mu held.
+func (sd *SessionData) signalDispatch() {
+	if sd.dispatchSignal != nil {
+		close(sd.dispatchSignal)
+		sd.dispatchSignal = nil
+	}
+}
@@ -0,0 +1,153 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// orderTarget returns a target whose "record" method, also reachable on the
+// capability returned by "counter", appends its argument to the returned
+// log in the order calls are dispatched.
+func orderTarget() (*BaseRpcTarget, func() []string) {
+	var mu sync.Mutex
+	var log []string
+	record := func(prefix string) func(json.RawMessage) (interface{}, error) {
+		return func(args json.RawMessage) (interface{}, error) {
+			var argArray []string
+			if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) != 1 {
+				return nil, fmt.Errorf("record expects a string")
+			}
+			mu.Lock()
+			log = append(log, prefix+argArray[0])
+			mu.Unlock()
+			return argArray[0], nil
+		}
+	}
+	counter := NewBaseRpcTarget()
+	counter.Method("record", record("counter:"))
+	target := testTarget()
+	target.Method("record", record(""))
+	target.Method("counter", func(json.RawMessage) (interface{}, error) {
+		return counter, nil
+	})
+	return target, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), log...)
+	}
+}
+
+func TestCallOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name: "pulled in reverse",
+			messages: []string{
+				`["push",["pipeline",0,["record"],["a"]]]`,
+				`["push",["pipeline",0,["record"],["b"]]]`,
+				`["push",["pipeline",0,["record"],["c"]]]`,
+				`["pull",3]`,
+				`["pull",2]`,
+				`["pull",1]`,
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "released call is skipped",
+			messages: []string{
+				`["push",["pipeline",0,["record"],["a"]]]`,
+				`["push",["pipeline",0,["record"],["b"]]]`,
+				`["release",1,1]`,
+				`["pull",2]`,
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "calls on a capability",
+			messages: []string{
+				`["push",["pipeline",0,["counter"],[]]]`,
+				`["push",["pipeline",1,["record"],["a"]]]`,
+				`["push",["pipeline",0,["record"],["x"]]]`,
+				`["push",["pipeline",1,["record"],["b"]]]`,
+				`["pull",4]`,
+				`["pull",3]`,
+			},
+			// The main target's call is independent of the counter's
+			want: []string{"counter:a", "counter:b", "x"},
+		},
+		{
+			name: "property and failed pushes are not calls",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["push",["pipeline",1,["id"]]]`,
+				`["push",["pipeline",0,["record"],[["pipeline",9]]]]`,
+				`["push",["pipeline",0,["record"],["a"]]]`,
+				`["pull",4]`,
+			},
+			want: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, dispatched := orderTarget()
+			handleMessages(t, newTestSession(target), target, tt.messages...)
+			if got := dispatched(); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("dispatched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallOrderAfterReset(t *testing.T) {
+	target, dispatched := orderTarget()
+	session := newTestSession(target)
+	sessionData := NewSessionData(target)
+	send := func(messages ...string) {
+		for _, message := range messages {
+			if _, err := session.HandleMessageFrames(sessionData, message); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Calls queued before the session is reset do not hold up the export
+	// IDs reused after it
+	send(`["push",["pipeline",0,["record"],["a"]]]`, `["push",["pipeline",0,["record"],["b"]]]`)
+	session.OnOpen(sessionData)
+	send(`["push",["pipeline",0,["record"],["c"]]]`, `["push",["pipeline",0,["record"],["d"]]]`, `["pull",2]`)
+	if got := dispatched(); strings.Join(got, " ") != "c d" {
+		t.Errorf("dispatched %v, want [c d]", got)
+	}
+}
+
+// BenchmarkCallOrder measures pulling the last of n calls pushed on one
+// callee, which dispatches every call before it first.
+func BenchmarkCallOrder(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			target := NewBaseRpcTarget()
+			target.Method("noop", func(json.RawMessage) (interface{}, error) { return nil, nil })
+			session := newTestSession(target)
+			push := `["push",["pipeline",0,["noop"],[]]]`
+			pull := fmt.Sprintf(`["pull",%d]`, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sessionData := NewSessionData(target)
+				for j := 0; j < n; j++ {
+					if _, err := session.HandleMessageFrames(sessionData, push); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, err := session.HandleMessageFrames(sessionData, pull); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultMaxConcurrency is the default number of independent pipeline
+// operations a pull dispatches at once.
+const DefaultMaxConcurrency = 8
+
+// WithMaxConcurrency sets how many independent pending operations a pull may
+// dispatch at once. A value of 1 dispatches them one at a time, in the order
+// their results are first referenced.
+func WithMaxConcurrency(n int) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.MaxConcurrency = n
+	}
+}
+
+// exportPromise is the eventual result of a pending operation that is being
+// dispatched. done is closed once result and err are set.
+type exportPromise struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// evaluatePending dispatches the pending operation for exportID and returns
+// its normalized result. If the operation is already being dispatched, it
+// waits for that dispatch instead of starting another.
+func (s *RpcSession) evaluatePending(sessionData *SessionData, exportID int) (interface{}, error) {
+	sessionData.mu.Lock()
+	if promise, exists := sessionData.inflight[exportID]; exists {
+		sessionData.mu.Unlock()
+		<-promise.done
+		return promise.result, promise.err
+	}
+	operation, exists := sessionData.PendingOperations[exportID]
+	if !exists {
+		sessionData.mu.Unlock()
+		// The operation may have completed since the caller looked for it
+		if result, exists := sessionData.loadResult(exportID); exists {
+			return result, nil
+		}
+		if err := sessionData.rejectedPush(exportID); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("pipeline reference to non-existent export: %d", exportID)
+	}
+	promise := &exportPromise{done: make(chan struct{})}
+	if sessionData.inflight == nil {
+		sessionData.inflight = make(map[int]*exportPromise)
+	}
+	sessionData.inflight[exportID] = promise
+	sessionData.mu.Unlock()
+
+	promise.result, promise.err = s.executePending(sessionData, exportID, operation)
+
+	// A failed operation stays pending, with its error, so a later pull
+	// reports the error without evaluating the operation again
+	sessionData.mu.Lock()
+	delete(sessionData.inflight, exportID)
+	if promise.err == nil {
+		delete(sessionData.PendingOperations, exportID)
+	} else if _, exists := sessionData.PendingOperations[exportID]; exists {
+		promise.err = asRejection(promise.err, "PipelineError")
+		sessionData.PendingOperations[exportID] = Operation{Err: promise.err}
+	}
+	sessionData.signalDispatch()
+	sessionData.mu.Unlock()
+	close(promise.done)
+
+	return promise.result, promise.err
+}
+
+// executePending resolves the arguments of a pending operation, dispatches it
+// and caches its normalized result.
+func (s *RpcSession) executePending(sessionData *SessionData, exportID int, operation Operation) (interface{}, error) {
+	if operation.Err != nil {
+		return nil, operation.Err
+	}
+
+	if operation.Remap != nil {
+		result, err := s.executeRemap(sessionData, exportID, operation.Remap)
+		if err != nil {
+			return nil, asRejection(err, "RemapError")
+		}
+		normalizedResult, err := s.normalizeResult(sessionData, result)
+		if err != nil {
+			return nil, err
+		}
+		sessionData.storeResult(exportID, normalizedResult)
+		return normalizedResult, nil
+	}
+
+	if operation.Property {
+		return s.executeProperty(sessionData, exportID, operation)
+	}
+
+	if operation.Value != nil {
+		return s.executeValue(sessionData, exportID, operation)
+	}
+
+	target, method, err := s.operationTarget(sessionData, exportID, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recursively resolve arguments, other than literal ones
+	resolvedArgsBytes := operation.Args
+	if !operation.literalArgs {
+		args, err := decodeJSON(operation.Args)
+		if err != nil {
+			return nil, err
+		}
+		resolvedArgs, err := s.evaluator(sessionData, exportID).EvaluateArguments(args)
+		if err != nil {
+			return nil, err
+		}
+		if resolvedArgsBytes, err = json.Marshal(resolvedArgs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Execute the operation, converting a panic into an error so a
+	// failing dependency cannot take down the connection
+	result, err := s.dispatchRecover(sessionData, target, exportID, method, resolvedArgsBytes)
+	if err != nil {
+		return nil, asRejection(err, "MethodError")
+	}
+
+	// Normalize the result for pipeline traversal
+	normalizedResult, err := s.normalizeResult(sessionData, result)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the normalized result
+	sessionData.storeResult(exportID, normalizedResult)
+	return normalizedResult, nil
+}
+
+// executeProperty reads the property of an earlier result that a property
+// operation refers to and caches it as the operation's result.
+// Capabilities within the value are sent to the client again, so each
+// holds another reference to them.
+func (s *RpcSession) executeProperty(sessionData *SessionData, exportID int, operation Operation) (interface{}, error) {
+	value, err := s.pipelineValue(sessionData, operation.ImportID, operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	sessionData.addCapabilityRefs(value)
+	sessionData.storeResult(exportID, value)
+	return value, nil
+}
+
+// pullProperty evaluates a pulled property operation and returns its
+// resolve or reject frame.
+func (s *RpcSession) pullProperty(sessionData *SessionData, exportID int, operation Operation) []interface{} {
+	// Dispatch independent dependencies concurrently before resolving
+	if err := s.prefetchDependencies(sessionData, operation.importRef(exportID)); err != nil {
+		return s.createRpcErrorResponse(exportID, "PipelineError", err)
+	}
+
+	value, err := s.executeProperty(sessionData, exportID, operation)
+	if err != nil {
+		return s.rejectOperation(sessionData, exportID, "PipelineError", err)
+	}
+
+	// Clean up the operation
+	sessionData.mu.Lock()
+	delete(sessionData.PendingOperations, exportID)
+	sessionData.mu.Unlock()
+	return resolveFrame(exportID, value)
+}
+
+// executeValue evaluates the expression a value operation was pushed with
+// and caches the value as the operation's result. A pushed error rejects
+// the operation with that error.
+func (s *RpcSession) executeValue(sessionData *SessionData, exportID int, operation Operation) (interface{}, error) {
+	expr, err := decodeJSON(operation.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are kept as the client sent them, as are those of the results
+	// the expression refers to, so the value is stored as it would be sent
+	evaluator := s.evaluator(sessionData, exportID)
+	evaluator.Keys = SanitizeNone
+	value, err := evaluator.Evaluate(expr)
+	if err != nil {
+		return nil, err
+	}
+	if rpcErr, ok := value.(RpcError); ok {
+		return nil, rpcErr
+	}
+	normalized, err := Devaluator{Codec: s.opts.Codec, Escapes: s.opts.Escapes}.Normalize(value)
+	if err != nil {
+		return nil, err
+	}
+	sessionData.addCapabilityRefs(normalized)
+	sessionData.storeResult(exportID, normalized)
+	return normalized, nil
+}
+
+// pullValue evaluates a pulled value operation and returns its resolve or
+// reject frame.
+func (s *RpcSession) pullValue(sessionData *SessionData, exportID int, operation Operation) []interface{} {
+	// Dispatch independent dependencies concurrently before resolving
+	refs, _ := operation.dependencies(exportID)
+	if err := s.prefetchDependencies(sessionData, refs); err != nil {
+		return s.createRpcErrorResponse(exportID, "PipelineError", err)
+	}
+
+	value, err := s.executeValue(sessionData, exportID, operation)
+	if err != nil {
+		return s.rejectOperation(sessionData, exportID, "PipelineError", err)
+	}
+
+	// Clean up the operation
+	sessionData.mu.Lock()
+	delete(sessionData.PendingOperations, exportID)
+	sessionData.mu.Unlock()
+	return resolveFrame(exportID, value)
+}
+
+// prefetchDependencies dispatches the pending operations that value refers
+// to, directly or through other pending operations, before value itself is
+// resolved. Operations that do not depend on each other are dispatched
+// concurrently, at most MaxConcurrency at a time; each waits for the
+// operations it depends on and is skipped if one of them fails.
+func (s *RpcSession) prefetchDependencies(sessionData *SessionData, value interface{}) error {
+	if s.opts.MaxConcurrency <= 1 {
+		return nil
+	}
+
+	order, deps, err := pendingDependencies(sessionData, value)
+	if err != nil {
+		return err
+	}
+	if len(order) < 2 {
+		return nil
+	}
+
+	done := make(map[int]chan struct{}, len(order))
+	errs := make(map[int]error, len(order))
+	for _, exportID := range order {
+		done[exportID] = make(chan struct{})
+	}
+
+	// Operations are started in dependency order, so every operation an
+	// operation waits on already holds, or has released, a slot
+	slots := make(chan struct{}, s.opts.MaxConcurrency)
+	var errsMu sync.Mutex
+	for _, exportID := range order {
+		slots <- struct{}{}
+		go func(exportID int) {
+			defer func() { <-slots }()
+			defer close(done[exportID])
+
+			for _, dep := range deps[exportID] {
+				<-done[dep]
+				errsMu.Lock()
+				depErr := errs[dep]
+				errsMu.Unlock()
+				if depErr != nil {
+					errsMu.Lock()
+					errs[exportID] = depErr
+					errsMu.Unlock()
+					return
+				}
+			}
+
+			_, err := s.evaluatePending(sessionData, exportID)
+			errsMu.Lock()
+			errs[exportID] = err
+			errsMu.Unlock()
+		}(exportID)
+	}
+	for _, exportID := range order {
+		<-done[exportID]
+	}
+
+	// Report the error a sequential resolution would have reached first
+	for _, exportID := range order {
+		if err := errs[exportID]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingDependencies returns the pending operations value depends on in the
+// order a sequential resolution would dispatch them, together with the
+// pending operations each of them refers to directly.
+func pendingDependencies(sessionData *SessionData, value interface{}) ([]int, map[int][]int, error) {
+	sessionData.mu.RLock()
+	pending := make(map[int]Operation, len(sessionData.PendingOperations))
+	for exportID, operation := range sessionData.PendingOperations {
+		pending[exportID] = operation
+	}
+	sessionData.mu.RUnlock()
+
+	var order []int
+	deps := make(map[int][]int)
+	visiting := make(map[int]bool)
+	visited := make(map[int]bool)
+
+	var visit func(exportID int) error
+	visitRefs := func(value interface{}) ([]int, error) {
+		var direct []int
+		var err error
+		forEachPipelineRef(value, func(exportID int) {
+			if err != nil {
+				return
+			}
+			if _, exists := sessionData.loadResult(exportID); exists {
+				return
+			}
+			if _, exists := pending[exportID]; !exists {
+				return
+			}
+			direct = append(direct, exportID)
+			err = visit(exportID)
+		})
+		return direct, err
+	}
+	visit = func(exportID int) error {
+		if visited[exportID] {
+			return nil
+		}
+		if visiting[exportID] {
+			return pipelineCycle(exportID)
+		}
+		visiting[exportID] = true
+
+		refs, err := pending[exportID].dependencies(exportID)
+		if err != nil {
+			return err
+		}
+		if refs != nil {
+			direct, err := visitRefs(refs)
+			if err != nil {
+				return err
+			}
+			deps[exportID] = direct
+		}
+
+		visiting[exportID] = false
+		visited[exportID] = true
+		order = append(order, exportID)
+		return nil
+	}
+
+	if _, err := visitRefs(value); err != nil {
+		return nil, nil, err
+	}
+	return order, deps, nil
+}
+
+// ErrPipelineCycle rejects a pull whose pending operations refer to each
+// other in a cycle, which could never be resolved. Its details name an
+// export on the cycle.
+var ErrPipelineCycle = RpcError{Code: "PipelineCycle"}
+
+// pipelineCycle returns the error for a cycle through exportID.
+func pipelineCycle(exportID int) error {
+	return RpcError{
+		Code:    ErrPipelineCycle.Code,
+		Message: fmt.Sprintf("pipeline reference cycle through export %d", exportID),
+		Details: map[string]interface{}{"exportId": exportID},
+	}
+}
+
+// checkCycles checks that the pending operations the operation pushed as
+// exportID depends on do not refer to each other, or to it, in a cycle.
+// Pushes may only refer to earlier pushes, so a cycle cannot be pushed, but
+// resolving one would recurse without end, so pulls check for them first.
+func checkCycles(sessionData *SessionData, exportID int, operation Operation) error {
+	refs, err := operation.dependencies(exportID)
+	if err != nil || refs == nil {
+		return nil
+	}
+	if _, _, err := pendingDependencies(sessionData, refs); errors.Is(err, ErrPipelineCycle) {
+		return err
+	}
+	return nil
+}
+
+// dependencies returns the pipeline references through which the operation
+// pushed as exportID reads earlier results, for dependency analysis.
+// Operations that failed when pushed have none.
+func (op Operation) dependencies(exportID int) (interface{}, error) {
+	switch {
+	case op.Err != nil:
+		return nil, nil
+	case op.Remap != nil:
+		return op.Remap.dependencies(), nil
+	case op.Property:
+		return op.importRef(exportID), nil
+	case op.Value != nil:
+		return decodeJSON(op.Value)
+	case op.literalArgs:
+		// Literal arguments hold no references
+		return op.importRef(exportID), nil
+	}
+	args, err := decodeJSON(op.Args)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{args, op.importRef(exportID)}, nil
+}
+
+// forEachPipelineRef calls fn with the export ID of every pipeline reference
+// in value, including those in the arguments of the calls references make,
+// in the order resolvePipelineReferences visits them.
+func forEachPipelineRef(value interface{}, fn func(exportID int)) {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) >= 2 {
+			if pipelineStr, ok := v[0].(string); ok && pipelineStr == "pipeline" {
+				if refExportIDFloat, ok := v[1].(float64); ok {
+					fn(int(refExportIDFloat))
+					if len(v) >= 4 {
+						forEachPipelineRef(v[3], fn)
+					}
+					return
+				}
+			}
+		}
+		for _, elem := range v {
+			forEachPipelineRef(elem, fn)
+		}
+	case map[string]interface{}:
+		for _, val := range v {
+			forEachPipelineRef(val, fn)
+		}
+	}
+}
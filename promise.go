@@ -0,0 +1,129 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ClientPromise is a promise the client passed as an argument, serialized as
+// ["promise", id]. The client settles it later with a ["resolve", id, value]
+// or ["reject", id, error] message for its export id. Handlers decode it
+// from their arguments like any other value and wait for it with Await.
+//
+// Like a ClientStub, a promise is bound to its session the first time it is
+// awaited with the context of a ContextHandler.
+type ClientPromise struct {
+	importID    int
+	sessionData *SessionData
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *ClientPromise) UnmarshalJSON(data []byte) error {
+	var ref []interface{}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return fmt.Errorf("client promise must be [\"promise\", id]: %w", err)
+	}
+	if len(ref) != 2 || ref[0] != "promise" {
+		return fmt.Errorf("client promise must be [\"promise\", id]")
+	}
+	id, ok := ref[1].(float64)
+	if !ok {
+		return fmt.Errorf("client promise ID must be a number")
+	}
+	p.importID = int(id)
+	return nil
+}
+
+// ID returns the export ID the client assigned to the promise.
+func (p *ClientPromise) ID() int {
+	return p.importID
+}
+
+// Await waits for the client to settle the promise and returns the value it
+// resolved to. A rejection is returned as an RpcError. Once settled, the
+// promise is released; awaiting it again returns the same result.
+//
+// The client's answer is read like any other message, so on HTTP batch
+// requests it must come before the pull of the call that awaits it.
+func (p *ClientPromise) Await(ctx context.Context) (json.RawMessage, error) {
+	if p.sessionData == nil {
+		call, ok := ctx.Value(callSessionKey{}).(callSession)
+		if !ok {
+			return nil, ErrClientStubUnbound
+		}
+		p.sessionData = call.sessionData
+	}
+	sd := p.sessionData
+
+	sd.mu.Lock()
+	settlement := sd.promiseSettlement(p.importID)
+	sd.mu.Unlock()
+
+	select {
+	case <-settlement.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	sd.releaseImport(p.importID)
+	return settlement.result.value, settlement.result.err
+}
+
+// promiseSettlement is the eventual answer to a promise the client passed.
+// done is closed once result is set.
+type promiseSettlement struct {
+	done   chan struct{}
+	result callbackResult
+}
+
+// promiseSettlement returns the settlement of the client's promise
+// importID, adding it if needed. Answers may be read before the push that
+// passes the promise is handled, so either may add it. It must be called
+// with sd.mu held.
+func (sd *SessionData) promiseSettlement(importID int) *promiseSettlement {
+	if sd.promises == nil {
+		sd.promises = make(map[int]*promiseSettlement)
+	}
+	settlement, exists := sd.promises[importID]
+	if !exists {
+		settlement = &promiseSettlement{done: make(chan struct{})}
+		sd.promises[importID] = settlement
+	}
+	return settlement
+}
+
+// settlePromise settles the client's promise importID with the client's
+// answer. Promises are client exports, so only negative IDs name them. It
+// reports whether the answer settled a promise.
+func (sd *SessionData) settlePromise(importID int, result callbackResult) bool {
+	if importID >= MainExportID {
+		return false
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	settlement := sd.promiseSettlement(importID)
+	select {
+	case <-settlement.done:
+		// A promise is settled once; later answers are ignored
+		return false
+	default:
+	}
+	settlement.result = result
+	close(settlement.done)
+	return true
+}
+
+// abandonPromises settles the client's promises that are still unsettled
+// with err. It is called when the session ends.
+func (sd *SessionData) abandonPromises(err error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	for _, settlement := range sd.promises {
+		select {
+		case <-settlement.done:
+		default:
+			settlement.result = callbackResult{err: err}
+			close(settlement.done)
+		}
+	}
+}
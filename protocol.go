@@ -0,0 +1,72 @@
+package gocapnweb
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocols understood by the server.
+const (
+	// SubprotocolV1 selects the original protocol semantics: no capability
+	// announcement and no streaming results.
+	SubprotocolV1 = "capnweb-v1"
+
+	// SubprotocolV2 selects the current protocol, including capability
+	// announcements and streaming results.
+	SubprotocolV2 = "capnweb-v2"
+)
+
+// ProtocolMetaKey is the session metadata key holding the WebSocket
+// subprotocol selected for the connection.
+const ProtocolMetaKey = "protocol"
+
+// ProtocolNegotiator selects the WebSocket subprotocol of a connection from
+// those offered in its Sec-WebSocket-Protocol header.
+type ProtocolNegotiator struct {
+	// Supported lists the subprotocols the server speaks, oldest first.
+	Supported []string
+}
+
+// NewProtocolNegotiator creates a negotiator for the given subprotocols,
+// listed oldest first.
+func NewProtocolNegotiator(supported ...string) *ProtocolNegotiator {
+	return &ProtocolNegotiator{Supported: supported}
+}
+
+// DefaultProtocolNegotiator returns a negotiator supporting every
+// subprotocol known to this package.
+func DefaultProtocolNegotiator() *ProtocolNegotiator {
+	return NewProtocolNegotiator(SubprotocolV1, SubprotocolV2)
+}
+
+// Negotiate returns the newest supported subprotocol among those offered by
+// the client, or false if there is none in common.
+func (n *ProtocolNegotiator) Negotiate(offered []string) (string, bool) {
+	for i := len(n.Supported) - 1; i >= 0; i-- {
+		for _, protocol := range offered {
+			if protocol == n.Supported[i] {
+				return protocol, true
+			}
+		}
+	}
+	return "", false
+}
+
+// negotiateRequest selects the subprotocol for a WebSocket upgrade request.
+// It returns the response headers announcing the choice, or nil if the
+// client offered no supported subprotocol.
+func (n *ProtocolNegotiator) negotiateRequest(r *http.Request) (string, http.Header) {
+	protocol, ok := n.Negotiate(websocket.Subprotocols(r))
+	if !ok {
+		return "", nil
+	}
+	return protocol, http.Header{"Sec-Websocket-Protocol": {protocol}}
+}
+
+// isLegacyProtocol reports whether the session negotiated the v1
+// subprotocol. Sessions that negotiated nothing get current semantics.
+func (sd *SessionData) isLegacyProtocol() bool {
+	protocol, _ := sd.GetMeta(ProtocolMetaKey)
+	return protocol == SubprotocolV1
+}
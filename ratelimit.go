@@ -0,0 +1,55 @@
+package gocapnweb
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by Dispatch when a method's rate limit is
+// exceeded. The error's details carry the method name and, under
+// "retryAfterMs", how long the caller should wait before trying again.
+var ErrRateLimited = RpcError{Code: "RateLimited"}
+
+// SetMethodRateLimit limits calls to method to rps per second, allowing
+// bursts of up to burst calls. The limit applies across all sessions. A
+// non-positive rps removes the limit.
+func (t *BaseRpcTarget) SetMethodRateLimit(method string, rps int, burst int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rps <= 0 {
+		delete(t.limiters, method)
+		return
+	}
+	t.limiters[method] = rate.NewLimiter(rate.Limit(rps), burst)
+}
+
+// checkRateLimit consumes a token from limiter, or returns a RateLimited
+// error describing when one will next be available.
+func checkRateLimit(limiter *rate.Limiter, method string) error {
+	reservation := limiter.Reserve()
+	if !reservation.OK() {
+		return RpcError{
+			Code:    ErrRateLimited.Code,
+			Message: "rate limit exceeded for " + method,
+			Details: map[string]interface{}{"method": method},
+		}
+	}
+
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	// Give the token back; the call is rejected rather than delayed
+	reservation.Cancel()
+
+	return RpcError{
+		Code:    ErrRateLimited.Code,
+		Message: "rate limit exceeded for " + method,
+		Details: map[string]interface{}{
+			"method":       method,
+			"retryAfterMs": (delay + time.Millisecond - 1).Milliseconds(),
+		},
+	}
+}
@@ -0,0 +1,117 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMethodRateLimit(t *testing.T) {
+	target := testTarget()
+	target.SetMethodRateLimit("echo", 2, 2)
+
+	succeeded, limited := 0, 0
+	for i := 0; i < 5; i++ {
+		_, err := target.Dispatch("echo", []byte(`["x"]`))
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrRateLimited):
+			limited++
+		default:
+			t.Errorf("call %d: %v", i, err)
+		}
+	}
+	if succeeded != 2 || limited != 3 {
+		t.Errorf("%d calls succeeded and %d were rate limited, want 2 and 3", succeeded, limited)
+	}
+
+	// Other methods are not limited
+	for i := 0; i < 5; i++ {
+		if _, err := target.Dispatch("user", nil); err != nil {
+			t.Fatalf("unlimited method: %v", err)
+		}
+	}
+}
+
+func TestMethodRateLimitBurst(t *testing.T) {
+	for _, burst := range []int{1, 3, 10} {
+		target := testTarget()
+		target.SetMethodRateLimit("echo", 1, burst)
+		allowed := 0
+		for i := 0; i < burst+5; i++ {
+			if _, err := target.Dispatch("echo", []byte(`["x"]`)); err == nil {
+				allowed++
+			}
+		}
+		if allowed != burst {
+			t.Errorf("burst %d allowed %d rapid calls", burst, allowed)
+		}
+	}
+
+	// A burst of 0 admits no call, and nothing says when to retry
+	target := testTarget()
+	target.SetMethodRateLimit("echo", 10, 0)
+	var rpcErr RpcError
+	if _, err := target.Dispatch("echo", []byte(`["x"]`)); !errors.As(err, &rpcErr) || rpcErr.Code != "RateLimited" || rpcErr.Details["retryAfterMs"] != nil {
+		t.Errorf("call with a burst of 0 = %#v, want RateLimited without retryAfterMs", err)
+	}
+
+	// A non-positive rate removes the limit
+	target.SetMethodRateLimit("echo", 0, 0)
+	if _, err := target.Dispatch("echo", []byte(`["x"]`)); err != nil {
+		t.Errorf("call after removing the limit: %v", err)
+	}
+}
+
+func TestMethodRateLimitRefill(t *testing.T) {
+	target := testTarget()
+	target.SetMethodRateLimit("echo", 20, 1)
+	if _, err := target.Dispatch("echo", []byte(`["x"]`)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := target.Dispatch("echo", []byte(`["x"]`))
+	var rpcErr RpcError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != "RateLimited" {
+		t.Fatalf("second call = %v, want RateLimited", err)
+	}
+
+	// The token is due within 50ms and the call is allowed once it refills
+	retryAfter, ok := rpcErr.Details["retryAfterMs"].(int64)
+	if !ok || retryAfter <= 0 || retryAfter > 50 {
+		t.Fatalf("retryAfterMs = %v, want 1 to 50", rpcErr.Details["retryAfterMs"])
+	}
+	time.Sleep(time.Duration(retryAfter+10) * time.Millisecond)
+	if _, err := target.Dispatch("echo", []byte(`["x"]`)); err != nil {
+		t.Errorf("call after the refill: %v", err)
+	}
+}
+
+func TestMethodRateLimitReject(t *testing.T) {
+	target := testTarget()
+	target.SetMethodRateLimit("echo", 1, 1)
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["echo"],["a"]]]`,
+		`["push",["pipeline",0,["echo"],["b"]]]`,
+		`["pull",1]`,
+		`["pull",2]`,
+	)
+	if len(got) != 2 || got[0] != `["resolve",1,"a"]` {
+		t.Fatalf("got %v, want a resolve and a reject", got)
+	}
+
+	var frame []interface{}
+	if err := json.Unmarshal([]byte(got[1]), &frame); err != nil {
+		t.Fatal(err)
+	}
+	errorExpr, _ := frame[2].([]interface{})
+	if len(frame) != 3 || frame[0] != "reject" || frame[1] != 2.0 || len(errorExpr) != 5 {
+		t.Fatalf("got %s, want a reject of export 2 with details", got[1])
+	}
+	details, _ := errorExpr[4].(map[string]interface{})
+	retryAfter, _ := details["retryAfterMs"].(float64)
+	if errorExpr[1] != "RateLimited" || errorExpr[2] != "rate limit exceeded for echo" || details["method"] != "echo" || retryAfter <= 0 || retryAfter > 1000 {
+		t.Errorf("got %s, want RateLimited naming echo with retryAfterMs up to 1000", got[1])
+	}
+}
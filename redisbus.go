@@ -0,0 +1,251 @@
+package gocapnweb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisEventBus is an EventBus backed by Redis pub/sub, allowing several
+// server processes to share events. It speaks the Redis protocol directly
+// and needs no client library.
+type RedisEventBus struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Password, if set, is sent with AUTH on every new connection.
+	Password string
+	// DialTimeout bounds how long connecting to Redis may take.
+	DialTimeout time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+}
+
+// NewRedisEventBus creates a RedisEventBus for the server at addr.
+func NewRedisEventBus(addr string) *RedisEventBus {
+	return &RedisEventBus{
+		Addr:        addr,
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+// Publish implements EventBus.
+func (b *RedisEventBus) Publish(topic string, event []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn, reader, err := b.dial()
+		if err != nil {
+			return err
+		}
+		b.conn, b.reader = conn, reader
+	}
+
+	if _, err := b.roundTrip(b.conn, b.reader, "PUBLISH", []byte(topic), event); err != nil {
+		// Drop the connection so the next publish reconnects
+		b.conn.Close()
+		b.conn, b.reader = nil, nil
+		return fmt.Errorf("redis publish failed: %w", err)
+	}
+	return nil
+}
+
+// Subscribe implements EventBus. Each subscription uses its own connection,
+// as Redis requires. If the connection fails the channel is closed.
+func (b *RedisEventBus) Subscribe(topic string) (<-chan []byte, func()) {
+	events := make(chan []byte, DefaultEventBufferSize)
+	done := make(chan struct{})
+	var once sync.Once
+	var connMu sync.Mutex
+	var conn net.Conn
+
+	go func() {
+		defer close(events)
+
+		c, reader, err := b.dial()
+		if err != nil {
+			log.Printf("Redis subscribe to %s failed: %v", topic, err)
+			return
+		}
+
+		connMu.Lock()
+		select {
+		case <-done:
+			connMu.Unlock()
+			c.Close()
+			return
+		default:
+			conn = c
+		}
+		connMu.Unlock()
+		defer c.Close()
+
+		if err := writeRedisCommand(c, "SUBSCRIBE", []byte(topic)); err != nil {
+			log.Printf("Redis subscribe to %s failed: %v", topic, err)
+			return
+		}
+
+		for {
+			reply, err := readRedisValue(reader)
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					log.Printf("Redis subscription to %s ended: %v", topic, err)
+				}
+				return
+			}
+
+			// Messages arrive as ["message", channel, payload]
+			parts, ok := reply.([]interface{})
+			if !ok || len(parts) != 3 {
+				continue
+			}
+			if kind, ok := parts[0].([]byte); !ok || string(kind) != "message" {
+				continue
+			}
+			payload, ok := parts[2].([]byte)
+			if !ok {
+				continue
+			}
+
+			select {
+			case events <- payload:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	unsubscribe := func() {
+		once.Do(func() {
+			connMu.Lock()
+			close(done)
+			if conn != nil {
+				conn.Close()
+			}
+			connMu.Unlock()
+		})
+	}
+	return events, unsubscribe
+}
+
+// Close closes the connection used for publishing.
+func (b *RedisEventBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn, b.reader = nil, nil
+	return err
+}
+
+// dial connects to Redis and authenticates if a password is configured.
+func (b *RedisEventBus) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.Addr, b.DialTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+
+	if b.Password != "" {
+		if _, err := b.roundTrip(conn, reader, "AUTH", []byte(b.Password)); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	return conn, reader, nil
+}
+
+// roundTrip sends a command and reads its reply.
+func (b *RedisEventBus) roundTrip(conn net.Conn, reader *bufio.Reader, command string, args ...[]byte) (interface{}, error) {
+	if err := writeRedisCommand(conn, command, args...); err != nil {
+		return nil, err
+	}
+	return readRedisValue(reader)
+}
+
+// writeRedisCommand encodes a command as a RESP array of bulk strings.
+func writeRedisCommand(w io.Writer, command string, args ...[]byte) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)+1), 10)
+	buf = append(buf, '\r', '\n')
+	buf = appendRedisBulk(buf, []byte(command))
+	for _, arg := range args {
+		buf = appendRedisBulk(buf, arg)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendRedisBulk(buf, value []byte) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(value)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, value...)
+	return append(buf, '\r', '\n')
+}
+
+// readRedisValue decodes a single RESP value. Bulk strings are returned as
+// []byte, integers as int64, arrays as []interface{}, and error replies as
+// errors.
+func readRedisValue(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply: %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, errors.New(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRedisValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply type: %q", line[0])
+	}
+}
@@ -0,0 +1,83 @@
+//go:build integration
+
+package gocapnweb
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// redisAddr returns the Redis server the integration tests use, named by
+// CAPNWEB_REDIS_ADDR:
+//
+//	CAPNWEB_REDIS_ADDR=localhost:6379 go test -tags integration -run TestRedisEventBus .
+func redisAddr(t *testing.T) string {
+	addr := os.Getenv("CAPNWEB_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("CAPNWEB_REDIS_ADDR is not set")
+	}
+	return addr
+}
+
+// newTestRedisEventBus returns a RedisEventBus for the test server, closed
+// when the test ends.
+func newTestRedisEventBus(t *testing.T) *RedisEventBus {
+	bus := NewRedisEventBus(redisAddr(t))
+	bus.Password = os.Getenv("CAPNWEB_REDIS_PASSWORD")
+	t.Cleanup(func() { bus.Close() })
+	return bus
+}
+
+func TestRedisEventBusSharedBetweenRegistries(t *testing.T) {
+	// Separate buses stand for separate server processes
+	testRegistriesShareBus(t, newTestRedisEventBus(t), newTestRedisEventBus(t))
+}
+
+func TestRedisEventBusUnsubscribe(t *testing.T) {
+	bus := newTestRedisEventBus(t)
+	events, unsubscribe := bus.Subscribe("capnweb-test-unsubscribe")
+	unsubscribe()
+	unsubscribe()
+
+	select {
+	case _, open := <-events:
+		if open {
+			t.Error("received an event after unsubscribing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after unsubscribing")
+	}
+}
+
+func TestRedisEventBusReconnectsAfterClose(t *testing.T) {
+	bus := newTestRedisEventBus(t)
+	if err := bus.Publish("capnweb-test-reconnect", []byte("first")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := bus.Publish("capnweb-test-reconnect", []byte("second")); err != nil {
+		t.Errorf("Publish after Close: %v", err)
+	}
+}
+
+func TestRedisEventBusUnreachable(t *testing.T) {
+	redisAddr(t)
+	bus := NewRedisEventBus("127.0.0.1:1")
+	bus.DialTimeout = time.Second
+	if err := bus.Publish("capnweb-test", []byte("event")); err == nil {
+		t.Error("Publish to an unreachable server succeeded")
+	}
+	events, unsubscribe := bus.Subscribe("capnweb-test")
+	defer unsubscribe()
+	select {
+	case _, open := <-events:
+		if open {
+			t.Error("received an event from an unreachable server")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed when the server is unreachable")
+	}
+}
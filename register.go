@@ -0,0 +1,126 @@
+package gocapnweb
+
+import (
+	"fmt"
+	"reflect"
+	"unicode"
+)
+
+var baseRpcTargetType = reflect.TypeOf((*BaseRpcTarget)(nil))
+
+// RegisterStruct registers the exported methods of obj as method handlers,
+// as net/rpc does for its receivers. Each method of the form TypedMethod
+// accepts,
+//
+//	func (r *Receiver) Name([ctx context.Context,] p1 T1, ..., pn Tn) (R, error)
+//
+// is registered under its name in camelCase: GetProfile as getProfile and
+// URLFor as urlFor. Methods of other forms are skipped, as are those with
+// the name of a method of BaseRpcTarget, so obj may itself embed the target
+// it is registered on. As with net/rpc, methods with a pointer receiver are
+// only registered if obj is a pointer.
+//
+// RegisterStruct returns an error, having registered nothing, if obj has no
+// methods of the required form or if two of its methods have the same
+// camelCase name.
+func (t *BaseRpcTarget) RegisterStruct(obj interface{}) error {
+	value := reflect.ValueOf(obj)
+	if !value.IsValid() {
+		return fmt.Errorf("register struct: nil receiver")
+	}
+	handlers, err := reflectMethods("register struct", value, false)
+	if err != nil {
+		return err
+	}
+	if len(handlers) == 0 {
+		return fmt.Errorf("register struct %s: no exported methods of the form func(...) (result, error)", value.Type())
+	}
+	return t.registerTyped(handlers)
+}
+
+// RegisterInterface registers exactly the methods of interface T, as
+// implemented by impl, under their names in camelCase as RegisterStruct
+// does. Other methods of impl are not exposed, so T declares the RPC
+// surface in one place, and the compiler checks that impl implements it.
+//
+// RegisterInterface returns an error, having registered nothing, if T is
+// not an interface type, impl is nil, or any method of T is unexported or
+// not of the form TypedMethod accepts.
+func RegisterInterface[T any](t *BaseRpcTarget, impl T) error {
+	ifaceType := reflect.TypeOf((*T)(nil)).Elem()
+	if ifaceType.Kind() != reflect.Interface {
+		return fmt.Errorf("register interface: %s is not an interface type", ifaceType)
+	}
+	value := reflect.ValueOf(&impl).Elem()
+	if value.IsNil() {
+		return fmt.Errorf("register interface %s: nil implementation", ifaceType)
+	}
+	handlers, err := reflectMethods("register interface", value, true)
+	if err != nil {
+		return err
+	}
+	return t.registerTyped(handlers)
+}
+
+// reflectMethods returns the methods of value as TypedMethod handlers,
+// keyed by their names in camelCase. If strict, any method that cannot be
+// registered is an error; otherwise such methods, and methods of
+// BaseRpcTarget, are skipped.
+func reflectMethods(op string, value reflect.Value, strict bool) (map[string]interface{}, error) {
+	valueType := value.Type()
+	handlers := make(map[string]interface{})
+	goNames := make(map[string]string)
+	for i := 0; i < valueType.NumMethod(); i++ {
+		method := valueType.Method(i)
+		if !method.IsExported() {
+			if strict {
+				return nil, fmt.Errorf("%s %s: method %s is unexported", op, valueType, method.Name)
+			}
+			continue
+		}
+		if _, ok := baseRpcTargetType.MethodByName(method.Name); ok && !strict {
+			continue
+		}
+		fn := value.Method(i)
+		if err := checkTypedHandler(method.Name, fn.Type()); err != nil {
+			if strict {
+				return nil, fmt.Errorf("%s %s: %w", op, valueType, err)
+			}
+			continue
+		}
+		name := camelCase(method.Name)
+		if other, exists := goNames[name]; exists {
+			return nil, fmt.Errorf("%s %s: methods %s and %s are both named %s", op, valueType, other, method.Name, name)
+		}
+		goNames[name] = method.Name
+		handlers[name] = fn.Interface()
+	}
+	return handlers, nil
+}
+
+// registerTyped registers each of handlers with TypedMethod.
+func (t *BaseRpcTarget) registerTyped(handlers map[string]interface{}) error {
+	for name, handler := range handlers {
+		if err := t.TypedMethod(name, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// camelCase returns a Go method name with its leading capital, or leading
+// run of capitals that form an initialism, in lower case.
+func camelCase(name string) string {
+	runes := []rune(name)
+	for i, r := range runes {
+		if !unicode.IsUpper(r) {
+			break
+		}
+		// The last capital before a lower-case letter starts the next word
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(r)
+	}
+	return string(runes)
+}
@@ -0,0 +1,262 @@
+package gocapnweb
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// profiles is registered with RegisterStruct. Its methods cover each form
+// RegisterStruct registers or skips.
+type profiles struct {
+	prefix string
+}
+
+func (p *profiles) GetProfile(id string) (map[string]string, error) {
+	if id == "" {
+		return nil, errors.New("id is required")
+	}
+	return map[string]string{"id": p.prefix + id}, nil
+}
+
+func (p *profiles) URLFor(id string) (string, error) { return "/u/" + id, nil }
+
+func (p *profiles) Count(ctx context.Context) (int, error) {
+	if _, ok := SessionFromContext(ctx); !ok {
+		return 0, errors.New("no session in context")
+	}
+	return 2, nil
+}
+
+func (p profiles) Prefix() (string, error) { return p.prefix, nil }
+
+// Methods of other forms are skipped
+func (p *profiles) Reset()                  {}
+func (p *profiles) Lookup(id string) string { return id }
+func (p *profiles) hidden() (string, error) { return "", nil }
+
+// embeddedProfiles embeds the target it is registered on.
+type embeddedProfiles struct {
+	*BaseRpcTarget
+	profiles
+}
+
+// clash has two methods with the same camelCase name.
+type clash struct{}
+
+func (clash) URL() (string, error) { return "", nil }
+func (clash) Url() (string, error) { return "", nil }
+
+// noMethods has no methods of the required form.
+type noMethods struct{}
+
+func (noMethods) Close() {}
+
+func TestRegisterStruct(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  func(target *BaseRpcTarget) interface{}
+		want []string
+	}{
+		{"pointer", func(*BaseRpcTarget) interface{} { return &profiles{prefix: "p_"} }, []string{"count", "getProfile", "prefix", "urlFor"}},
+		{"value", func(*BaseRpcTarget) interface{} { return profiles{prefix: "p_"} }, []string{"prefix"}},
+		{
+			"embedding its target",
+			func(target *BaseRpcTarget) interface{} {
+				return &embeddedProfiles{BaseRpcTarget: target, profiles: profiles{prefix: "p_"}}
+			},
+			[]string{"count", "getProfile", "prefix", "urlFor"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewBaseRpcTarget()
+			before := target.MethodNames()
+			if err := target.RegisterStruct(tt.obj(target)); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, name := range target.MethodNames() {
+				if !containsString(before, name) {
+					got = append(got, name)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("registered %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	target := NewBaseRpcTarget()
+	if err := target.RegisterStruct(&profiles{prefix: "p_"}); err != nil {
+		t.Fatal(err)
+	}
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["getProfile"],["7"]]]`,
+		`["push",["pipeline",0,["urlFor"],["7"]]]`,
+		`["push",["pipeline",0,["count"],[]]]`,
+		`["push",["pipeline",0,["getProfile"],[""]]]`,
+		`["push",["pipeline",0,["lookup"],["7"]]]`,
+		`["pull",1]`, `["pull",2]`, `["pull",3]`, `["pull",4]`, `["pull",5]`,
+	)
+	want := []string{
+		`["resolve",1,{"id":"p_7"}]`,
+		`["resolve",2,"/u/7"]`,
+		`["resolve",3,2]`,
+		`["reject",4,["error","MethodError","id is required"]]`,
+		`["reject",5,["error","MethodNotFound","method not found: lookup"]]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestRegisterStructErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  interface{}
+		want string
+	}{
+		{"nil", nil, "register struct: nil receiver"},
+		{"no methods", noMethods{}, "register struct gocapnweb.noMethods: no exported methods of the form func(...) (result, error)"},
+		{"name clash", clash{}, "register struct gocapnweb.clash: methods URL and Url are both named url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewBaseRpcTarget()
+			before := len(target.MethodNames())
+			err := target.RegisterStruct(tt.obj)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+			if n := len(target.MethodNames()); n != before {
+				t.Errorf("%d methods registered after an error", n-before)
+			}
+		})
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	tests := map[string]string{
+		"GetProfile": "getProfile",
+		"URLFor":     "urlFor",
+		"URL":        "url",
+		"ID":         "id",
+		"X":          "x",
+		"HTTPServer": "httpServer",
+		"already":    "already",
+	}
+	for name, want := range tests {
+		if got := camelCase(name); got != want {
+			t.Errorf("camelCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// containsString reports whether names contains name.
+func containsString(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// profileService is the RPC surface of profiles registered with
+// RegisterInterface.
+type profileService interface {
+	GetProfile(id string) (map[string]string, error)
+	URLFor(id string) (string, error)
+}
+
+// badService has a method TypedMethod cannot register.
+type badService interface {
+	GetProfile(id string) (map[string]string, error)
+	Lookup(id string) string
+}
+
+// unexportedService has an unexported method.
+type unexportedService interface {
+	GetProfile(id string) (map[string]string, error)
+	hidden() (string, error)
+}
+
+func TestRegisterInterface(t *testing.T) {
+	target := NewBaseRpcTarget()
+	before := target.MethodNames()
+	if err := RegisterInterface[profileService](target, &profiles{prefix: "p_"}); err != nil {
+		t.Fatal(err)
+	}
+	var registered []string
+	for _, name := range target.MethodNames() {
+		if !containsString(before, name) {
+			registered = append(registered, name)
+		}
+	}
+	sort.Strings(registered)
+	if got, want := strings.Join(registered, ","), "getProfile,urlFor"; got != want {
+		t.Errorf("registered %s, want %s", got, want)
+	}
+
+	// Methods of the implementation outside the interface are not exposed
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["getProfile"],["7"]]]`,
+		`["push",["pipeline",0,["urlFor"],["7"]]]`,
+		`["push",["pipeline",0,["count"],[]]]`,
+		`["pull",1]`, `["pull",2]`, `["pull",3]`,
+	)
+	want := []string{
+		`["resolve",1,{"id":"p_7"}]`,
+		`["resolve",2,"/u/7"]`,
+		`["reject",3,["error","MethodNotFound","method not found: count"]]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestRegisterInterfaceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(*BaseRpcTarget) error
+		want     string
+	}{
+		{
+			"not an interface",
+			func(target *BaseRpcTarget) error { return RegisterInterface[*profiles](target, &profiles{}) },
+			"register interface: *gocapnweb.profiles is not an interface type",
+		},
+		{
+			"nil implementation",
+			func(target *BaseRpcTarget) error { return RegisterInterface[profileService](target, nil) },
+			"register interface gocapnweb.profileService: nil implementation",
+		},
+		{
+			"method of another form",
+			func(target *BaseRpcTarget) error { return RegisterInterface[badService](target, &profiles{}) },
+			"register interface gocapnweb.badService: typed method Lookup: handler must return (result, error)",
+		},
+		{
+			"unexported method",
+			func(target *BaseRpcTarget) error { return RegisterInterface[unexportedService](target, &profiles{}) },
+			"register interface gocapnweb.unexportedService: method hidden is unexported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewBaseRpcTarget()
+			before := len(target.MethodNames())
+			err := tt.register(target)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+			if n := len(target.MethodNames()); n != before {
+				t.Errorf("%d methods registered after an error", n-before)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package gocapnweb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// ConnectionRegistry tracks the live WebSocket connections of one or more
+// RPC endpoints so that messages can be sent to them outside of the normal
+// request/response flow.
+type ConnectionRegistry struct {
+	connections map[string]*MessageQueue
+	mu          sync.RWMutex
+}
+
+// NewConnectionRegistry creates an empty ConnectionRegistry.
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		connections: make(map[string]*MessageQueue),
+	}
+}
+
+// Register adds a connection's message queue under id.
+func (r *ConnectionRegistry) Register(id string, queue *MessageQueue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connections[id] = queue
+}
+
+// Unregister removes the connection with the given id.
+func (r *ConnectionRegistry) Unregister(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.connections, id)
+}
+
+// Len returns the number of registered connections.
+func (r *ConnectionRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.connections)
+}
+
+// IDs returns the identifiers of all registered connections.
+func (r *ConnectionRegistry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.connections))
+	for id := range r.connections {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Send queues message for the connection with the given id.
+func (r *ConnectionRegistry) Send(id string, message []byte) error {
+	r.mu.RLock()
+	queue, exists := r.connections[id]
+	r.mu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("connection not found: %s", id)
+	}
+	return queue.SendData(message)
+}
+
+// Broadcast queues message for every registered connection and returns the
+// number of connections it was queued for.
+func (r *ConnectionRegistry) Broadcast(message []byte) int {
+	r.mu.RLock()
+	queues := make([]*MessageQueue, 0, len(r.connections))
+	for _, queue := range r.connections {
+		queues = append(queues, queue)
+	}
+	r.mu.RUnlock()
+
+	delivered := 0
+	for _, queue := range queues {
+		if err := queue.SendData(message); err == nil {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// AttachEventBus subscribes to topic on bus and broadcasts every event
+// received to the registry's connections. This lets any process sharing the
+// bus reach connections held by this one. The returned function detaches the
+// registry from the bus.
+func (r *ConnectionRegistry) AttachEventBus(bus EventBus, topic string) func() {
+	events, unsubscribe := bus.Subscribe(topic)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for event := range events {
+			r.Broadcast(event)
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
+
+// newConnectionID returns a random identifier for a connection.
+func newConnectionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate connection ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,285 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Remap is a pushed ["remap", importId, path, captures, instructions]
+// expression, which the capnweb client sends for .map() on a promise. The
+// value at path of import importId is mapped by evaluating instructions once
+// for each of its elements, or once for the value itself if it is not an
+// array.
+//
+// Within instructions, import 0 is the element being mapped, captures are
+// numbered -1, -2, ... in order, and the result of each instruction is
+// numbered 1, 2, ... in order. The result of the last instruction is the
+// mapped value. Captures are ["import", id] references to the server's main
+// target (id 0) or to the results of earlier pushes.
+type Remap struct {
+	ImportID     int           `json:"importId"`
+	Path         []interface{} `json:"path"`
+	Captures     []interface{} `json:"captures"`
+	Instructions []interface{} `json:"instructions"`
+}
+
+// mainCapability stands for the session's target among the values of a
+// remap; its methods are the only ones a mapper can call.
+type mainCapability struct{}
+
+// parseRemap decodes the operands of a remap pushed as exportID. A remap may
+// only read the results of earlier pushes.
+func parseRemap(pushArray []interface{}, exportID int) (*Remap, error) {
+	if len(pushArray) < 5 {
+		return nil, fmt.Errorf("remap requires an import ID, path, captures and instructions")
+	}
+	importIDFloat, ok := pushArray[1].(float64)
+	if !ok {
+		return nil, fmt.Errorf("remap import ID must be a number")
+	}
+	remap := &Remap{ImportID: int(importIDFloat)}
+
+	if pushArray[2] != nil {
+		if remap.Path, ok = pushArray[2].([]interface{}); !ok {
+			return nil, fmt.Errorf("remap path must be an array")
+		}
+	}
+	if remap.Captures, ok = pushArray[3].([]interface{}); !ok {
+		return nil, fmt.Errorf("remap captures must be an array")
+	}
+	if remap.Instructions, ok = pushArray[4].([]interface{}); !ok {
+		return nil, fmt.Errorf("remap instructions must be an array")
+	}
+
+	if remap.ImportID < 0 || remap.ImportID >= exportID {
+		return nil, fmt.Errorf("remap of unknown import: %d", remap.ImportID)
+	}
+	for i, capture := range remap.Captures {
+		importID, err := captureImportID(capture)
+		if err != nil {
+			return nil, fmt.Errorf("remap capture %d: %w", i, err)
+		}
+		if importID < 0 || importID >= exportID {
+			return nil, fmt.Errorf("remap capture %d: unknown import: %d", i, importID)
+		}
+	}
+	return remap, nil
+}
+
+// captureImportID returns the import ID of an ["import", id] capture.
+func captureImportID(capture interface{}) (int, error) {
+	ref, ok := capture.([]interface{})
+	if !ok || len(ref) != 2 {
+		return 0, fmt.Errorf("capture must be [\"import\", id]")
+	}
+	kind, _ := ref[0].(string)
+	id, isNumber := ref[1].(float64)
+	switch {
+	case kind == "export":
+		return 0, fmt.Errorf("capturing client exports is not supported")
+	case kind != "import" || !isNumber:
+		return 0, fmt.Errorf("capture must be [\"import\", id]")
+	}
+	return int(id), nil
+}
+
+// dependencies returns pipeline references to the exports the remap reads,
+// for dependency analysis.
+func (r *Remap) dependencies() []interface{} {
+	refs := []interface{}{[]interface{}{"pipeline", float64(r.ImportID)}}
+	for _, capture := range r.Captures {
+		if id, err := captureImportID(capture); err == nil && id != 0 {
+			refs = append(refs, []interface{}{"pipeline", float64(id)})
+		}
+	}
+	return refs
+}
+
+// importValue returns the value of an export referenced by a remap: the
+// main target for import 0, otherwise the export's result.
+func (s *RpcSession) importValue(sessionData *SessionData, exportID, importID int) (interface{}, error) {
+	if importID == MainExportID {
+		return mainCapability{}, nil
+	}
+	return s.resolvePipelineReferences(sessionData, exportID, []interface{}{"pipeline", float64(importID)})
+}
+
+// executeRemap evaluates a remap pushed as exportID.
+func (s *RpcSession) executeRemap(sessionData *SessionData, exportID int, remap *Remap) (interface{}, error) {
+	input, err := s.importValue(sessionData, exportID, remap.ImportID)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := input.(mainCapability); ok && len(remap.Path) > 0 {
+		return nil, fmt.Errorf("remap cannot read properties of the main target")
+	}
+	if len(remap.Path) > 0 {
+		if input, err = s.traversePath(input, remap.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	captures := make([]interface{}, len(remap.Captures))
+	for i, capture := range remap.Captures {
+		importID, err := captureImportID(capture)
+		if err != nil {
+			return nil, err
+		}
+		if captures[i], err = s.importValue(sessionData, exportID, importID); err != nil {
+			return nil, err
+		}
+	}
+
+	elements, isArray := input.([]interface{})
+	if !isArray {
+		return s.mapValue(sessionData, exportID, remap, captures, input)
+	}
+	mapped := make([]interface{}, len(elements))
+	for i, element := range elements {
+		if mapped[i], err = s.mapValue(sessionData, exportID, remap, captures, element); err != nil {
+			return nil, err
+		}
+	}
+	return mapped, nil
+}
+
+// mapValue runs the remap's instructions on one input value.
+func (s *RpcSession) mapValue(sessionData *SessionData, exportID int, remap *Remap, captures []interface{}, input interface{}) (interface{}, error) {
+	results := make([]interface{}, 0, len(remap.Instructions))
+	lookup := func(id int) (interface{}, error) {
+		switch {
+		case id == 0:
+			return input, nil
+		case id < 0 && -id <= len(captures):
+			return captures[-id-1], nil
+		case id > 0 && id <= len(results):
+			return results[id-1], nil
+		}
+		return nil, fmt.Errorf("remap reference to unknown import: %d", id)
+	}
+
+	result := input
+	for _, instruction := range remap.Instructions {
+		value, err := s.evalRemapExpression(sessionData, exportID, lookup, instruction)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, value)
+		result = value
+	}
+	if _, ok := result.(mainCapability); ok {
+		return nil, fmt.Errorf("remap cannot return the main target")
+	}
+	return result, nil
+}
+
+// evalRemapExpression evaluates one expression of a mapper. Pipeline
+// expressions with arguments call a method of the main target; without
+// arguments they read a property of a value.
+func (s *RpcSession) evalRemapExpression(sessionData *SessionData, exportID int, lookup func(int) (interface{}, error), expr interface{}) (interface{}, error) {
+	switch v := expr.(type) {
+	case []interface{}:
+		if len(v) >= 2 {
+			if kind, ok := v[0].(string); ok && kind == "pipeline" {
+				if idFloat, ok := v[1].(float64); ok {
+					base, err := lookup(int(idFloat))
+					if err != nil {
+						return nil, err
+					}
+					var path []interface{}
+					if len(v) >= 3 && v[2] != nil {
+						if path, ok = v[2].([]interface{}); !ok {
+							return nil, fmt.Errorf("invalid remap path")
+						}
+					}
+					if len(v) >= 4 {
+						return s.callFromRemap(sessionData, exportID, lookup, base, path, v[3])
+					}
+					if _, ok := base.(mainCapability); ok {
+						if len(path) > 0 {
+							return nil, fmt.Errorf("remap cannot read properties of the main target")
+						}
+						return base, nil
+					}
+					return s.traversePath(base, path)
+				}
+			}
+		}
+
+		evaluated := make([]interface{}, len(v))
+		for i, elem := range v {
+			value, err := s.evalRemapExpression(sessionData, exportID, lookup, elem)
+			if err != nil {
+				return nil, err
+			}
+			evaluated[i] = value
+		}
+		return evaluated, nil
+
+	case map[string]interface{}:
+		evaluated := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			value, err := s.evalRemapExpression(sessionData, exportID, lookup, val)
+			if err != nil {
+				return nil, err
+			}
+			evaluated[key] = value
+		}
+		return evaluated, nil
+
+	default:
+		return expr, nil
+	}
+}
+
+// callFromRemap calls a method of the main target on behalf of a mapper.
+func (s *RpcSession) callFromRemap(sessionData *SessionData, exportID int, lookup func(int) (interface{}, error), base interface{}, path []interface{}, rawArgs interface{}) (interface{}, error) {
+	if _, ok := base.(mainCapability); !ok || len(path) != 1 {
+		return nil, fmt.Errorf("remap can only call methods of the main target")
+	}
+	method, ok := path[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("remap method name must be a string")
+	}
+
+	args, err := s.evalRemapExpression(sessionData, exportID, lookup, rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	argsBytes, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.dispatchRecover(sessionData, sessionData.Target, exportID, method, argsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return s.normalizeResult(sessionData, result)
+}
+
+// pullRemap evaluates a pulled remap and returns its resolve or reject frame.
+func (s *RpcSession) pullRemap(sessionData *SessionData, exportID int, remap *Remap) []interface{} {
+	// Dispatch independent dependencies concurrently before resolving
+	if err := s.prefetchDependencies(sessionData, remap.dependencies()); err != nil {
+		return s.createRpcErrorResponse(exportID, "PipelineError", err)
+	}
+
+	result, err := s.executeRemap(sessionData, exportID, remap)
+	if err != nil {
+		return s.rejectOperation(sessionData, exportID, "RemapError", err)
+	}
+
+	normalizedResult, err := s.normalizeResult(sessionData, result)
+	if err != nil {
+		return s.rejectOperation(sessionData, exportID, "SerializationError", err)
+	}
+
+	// Clean up the operation
+	sessionData.mu.Lock()
+	delete(sessionData.PendingOperations, exportID)
+	sessionData.mu.Unlock()
+	sessionData.storeResult(exportID, normalizedResult)
+
+	return resolveFrame(exportID, normalizedResult)
+}
@@ -0,0 +1,59 @@
+package gocapnweb
+
+// WithProactiveResolve makes sessions that can send unsolicited frames send
+// the result of each pushed call without waiting for it to be pulled.
+func WithProactiveResolve() RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.ProactiveResolve = true
+	}
+}
+
+// canSendFrames reports whether frames can be delivered to the session's
+// client outside of a response, through the writer set by SetFrameSender.
+func (sd *SessionData) canSendFrames() bool {
+	sd.outboxMu.Lock()
+	defer sd.outboxMu.Unlock()
+	return sd.sendFrame != nil
+}
+
+// resolvesProactively reports whether pushed calls in the session are
+// resolved without waiting for a pull.
+func (s *RpcSession) resolvesProactively(sessionData *SessionData) bool {
+	return s.opts.ProactiveResolve && sessionData.canSendFrames()
+}
+
+// resolveProactively evaluates a pushed call and returns its resolve or
+// reject frame, preceded by any frames emitted while evaluating it. Calls are
+// evaluated in the order they are pushed, so a call may reference the
+// results of those pushed before it.
+func (s *RpcSession) resolveProactively(sessionData *SessionData, exportID int) ([]string, error) {
+	response, err := s.pullExport(sessionData, exportID)
+	if err != nil {
+		return nil, err
+	}
+	// Each value of a subscription is still delivered by a pull
+	sessionData.mu.RLock()
+	_, subscribed := sessionData.Subscriptions[exportID]
+	sessionData.mu.RUnlock()
+	if !subscribed {
+		sessionData.markResolved(exportID)
+	}
+
+	frames := sessionData.takeFrames()
+	frames = append(frames, response)
+	return s.marshalFrames(frames)
+}
+
+// markResolved records that an export's result has been sent to the client.
+func (sd *SessionData) markResolved(exportID int) {
+	if entry, exists := sd.loadExportEntry(exportID); exists {
+		entry.resolved.Store(true)
+	}
+}
+
+// resolvedProactively reports whether an export's result has been sent to
+// the client without being pulled. It takes no lock.
+func (sd *SessionData) resolvedProactively(exportID int) bool {
+	entry, exists := sd.loadExportEntry(exportID)
+	return exists && entry.resolved.Load()
+}
@@ -0,0 +1,172 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RetryBudget is a token bucket limiting how many retries a session may
+// perform. Each retry consumes a token; tokens refill continuously at a fixed
+// rate up to the bucket's capacity. When a service is failing for every
+// session, the budget stops the sessions from multiplying load with retries.
+type RetryBudget struct {
+	capacity   float64
+	refillRate float64
+	tokens     float64
+	last       time.Time
+	mu         sync.Mutex
+}
+
+// NewRetryBudget creates a full budget holding capacity tokens, refilled at
+// refillPerSecond tokens per second.
+func NewRetryBudget(capacity int, refillPerSecond float64) *RetryBudget {
+	return &RetryBudget{
+		capacity:   float64(capacity),
+		refillRate: refillPerSecond,
+		tokens:     float64(capacity),
+		last:       time.Now(),
+	}
+}
+
+// Allow consumes a token and reports whether a retry may proceed.
+func (b *RetryBudget) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.refillRate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryBudget returns the session's retry budget, creating it with newBudget
+// if the session does not have one yet.
+func (sd *SessionData) retryBudget(newBudget func() *RetryBudget) *RetryBudget {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.RetryBudget == nil {
+		sd.RetryBudget = newBudget()
+	}
+	return sd.RetryBudget
+}
+
+// Default retry settings used by NewRetryTarget.
+const (
+	DefaultRetryBudgetCapacity   = 10
+	DefaultRetryBudgetRefillRate = 1.0
+)
+
+// RetryTarget wraps an RpcTarget and retries failed calls with exponential
+// backoff. When dispatched from an RpcSession, retries are drawn from the
+// session's RetryBudget; once it is exhausted the error is returned
+// immediately.
+type RetryTarget struct {
+	// Target receives the calls.
+	Target RpcTarget
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+	// Backoff is the delay before the first retry; it doubles each retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries. If zero, the delay keeps
+	// doubling.
+	MaxBackoff time.Duration
+	// Retryable decides whether an error is worth retrying. If nil, every
+	// error other than ErrMethodNotFound is retried.
+	Retryable func(error) bool
+	// BudgetCapacity and BudgetRefillRate configure the RetryBudget created
+	// for sessions that do not already have one.
+	BudgetCapacity   int
+	BudgetRefillRate float64
+}
+
+// NewRetryTarget creates a RetryTarget with the default budget settings.
+func NewRetryTarget(target RpcTarget, maxRetries int, backoff time.Duration) *RetryTarget {
+	return &RetryTarget{
+		Target:           target,
+		MaxRetries:       maxRetries,
+		Backoff:          backoff,
+		BudgetCapacity:   DefaultRetryBudgetCapacity,
+		BudgetRefillRate: DefaultRetryBudgetRefillRate,
+	}
+}
+
+// Dispatch implements RpcTarget. Calls made outside a session are retried
+// without a budget.
+func (t *RetryTarget) Dispatch(method string, args json.RawMessage) (interface{}, error) {
+	return t.dispatch(context.Background(), nil, method, args, nil)
+}
+
+// DispatchSession implements SessionTarget.
+func (t *RetryTarget) DispatchSession(sessionData *SessionData, method string, args json.RawMessage) (interface{}, error) {
+	return t.DispatchSessionContext(sessionData.Context(), sessionData, method, args)
+}
+
+// DispatchSessionContext implements SessionContextTarget.
+func (t *RetryTarget) DispatchSessionContext(ctx context.Context, sessionData *SessionData, method string, args json.RawMessage) (interface{}, error) {
+	budget := sessionData.retryBudget(func() *RetryBudget {
+		return NewRetryBudget(t.BudgetCapacity, t.BudgetRefillRate)
+	})
+	return t.dispatch(ctx, sessionData, method, args, budget)
+}
+
+func (t *RetryTarget) dispatch(ctx context.Context, sessionData *SessionData, method string, args json.RawMessage, budget *RetryBudget) (interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := dispatchTarget(ctx, sessionData, t.Target, method, args)
+		if err == nil || attempt >= t.MaxRetries || !t.retryable(err) {
+			return result, err
+		}
+		if budget != nil && !budget.Allow() {
+			return result, err
+		}
+
+		// Stop retrying once the caller has gone away
+		select {
+		case <-time.After(t.backoff(attempt)):
+		case <-ctx.Done():
+			return result, err
+		}
+	}
+}
+
+// backoff returns the delay before the retry that follows attempt, counting
+// the first attempt as 0.
+func (t *RetryTarget) backoff(attempt int) time.Duration {
+	delay := t.Backoff
+	for i := 0; i < attempt; i++ {
+		if t.MaxBackoff > 0 && delay >= t.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	if t.MaxBackoff > 0 && delay > t.MaxBackoff {
+		delay = t.MaxBackoff
+	}
+	return delay
+}
+
+func (t *RetryTarget) retryable(err error) bool {
+	if t.Retryable != nil {
+		return t.Retryable(err)
+	}
+	return !errors.Is(err, ErrMethodNotFound)
+}
+
+// MethodDeprecation implements DeprecationProvider by consulting the wrapped
+// target.
+func (t *RetryTarget) MethodDeprecation(method string) (Deprecation, bool) {
+	if provider, ok := t.Target.(DeprecationProvider); ok {
+		return provider.MethodDeprecation(method)
+	}
+	return Deprecation{}, false
+}
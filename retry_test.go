@@ -0,0 +1,178 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyTarget fails every call with err until it has failed failures times.
+type flakyTarget struct {
+	err      error
+	failures int32
+	calls    atomic.Int32
+}
+
+// Dispatch implements RpcTarget.
+func (t *flakyTarget) Dispatch(method string, args json.RawMessage) (interface{}, error) {
+	if t.calls.Add(1) <= t.failures {
+		return nil, t.err
+	}
+	return "ok", nil
+}
+
+func TestRetryTarget(t *testing.T) {
+	unavailable := NewRpcError("Unavailable", "try again")
+	tests := []struct {
+		name      string
+		err       error
+		failures  int32
+		retryable func(error) bool
+		want      error
+		calls     int32
+	}{
+		{name: "succeeds after retries", err: unavailable, failures: 2, calls: 3},
+		{name: "retries exhausted", err: unavailable, failures: 10, want: unavailable, calls: 4},
+		{name: "method not found", err: ErrMethodNotFound, failures: 10, want: ErrMethodNotFound, calls: 1},
+		{
+			name: "not retryable", err: unavailable, failures: 10, want: unavailable, calls: 1,
+			retryable: func(err error) bool { return !errors.Is(err, unavailable) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := &flakyTarget{err: tt.err, failures: tt.failures}
+			target := NewRetryTarget(flaky, 3, time.Millisecond)
+			target.Retryable = tt.retryable
+			result, err := target.Dispatch("call", nil)
+			if tt.want == nil && (err != nil || result != "ok") {
+				t.Errorf("Dispatch = %v, %v; want ok", result, err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Dispatch error = %v, want %v", err, tt.want)
+			}
+			if got := flaky.calls.Load(); got != tt.calls {
+				t.Errorf("target called %d times, want %d", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	target := &RetryTarget{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50, 50}
+	for attempt, delay := range want {
+		if got := target.backoff(attempt); got != delay*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, delay*time.Millisecond)
+		}
+	}
+	if got := target.backoff(1000); got != 50*time.Millisecond {
+		t.Errorf("backoff(1000) = %v, want the cap", got)
+	}
+
+	target.MaxBackoff = 0
+	if got := target.backoff(4); got != 160*time.Millisecond {
+		t.Errorf("uncapped backoff(4) = %v, want 160ms", got)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	flaky := &flakyTarget{err: NewRpcError("Unavailable", "down"), failures: 1000}
+	target := NewRetryTarget(flaky, 3, time.Millisecond)
+	target.BudgetCapacity = 5
+	target.BudgetRefillRate = 0
+	sessionData := NewSessionData(target)
+
+	// Five concurrent failing calls share the five retries of the budget
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := target.DispatchSession(sessionData, "call", nil); err == nil {
+				t.Error("failing call succeeded")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := flaky.calls.Load(); got != 10 {
+		t.Errorf("target called %d times, want 5 calls and 5 retries", got)
+	}
+
+	// With the budget exhausted, calls fail without waiting to retry
+	target.Backoff = time.Hour
+	start := time.Now()
+	if _, err := target.DispatchSession(sessionData, "call", nil); err == nil {
+		t.Error("failing call succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call with an exhausted budget took %v", elapsed)
+	}
+	if got := flaky.calls.Load(); got != 11 {
+		t.Errorf("target called %d times, want 11", got)
+	}
+
+	// Another session has its own budget
+	flaky.calls.Store(0)
+	target.Backoff = time.Millisecond
+	if _, err := target.DispatchSession(NewSessionData(target), "call", nil); err == nil {
+		t.Error("failing call succeeded")
+	}
+	if got := flaky.calls.Load(); got != 4 {
+		t.Errorf("target called %d times in a new session, want 4", got)
+	}
+}
+
+func TestRetryBudgetRefill(t *testing.T) {
+	budget := NewRetryBudget(2, 10)
+	if !budget.Allow() || !budget.Allow() || budget.Allow() {
+		t.Fatal("a budget of 2 did not allow exactly 2 retries")
+	}
+
+	// Tokens refill at the rate, but never beyond the capacity
+	budget.mu.Lock()
+	budget.last = budget.last.Add(-time.Hour)
+	budget.mu.Unlock()
+	allowed := 0
+	for budget.Allow() {
+		allowed++
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d retries after a long refill, want the capacity of 2", allowed)
+	}
+
+	budget.mu.Lock()
+	budget.last = budget.last.Add(-150 * time.Millisecond)
+	budget.mu.Unlock()
+	if !budget.Allow() || budget.Allow() {
+		t.Error("150ms at 10 tokens per second did not refill exactly 1 token")
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	flaky := &flakyTarget{err: NewRpcError("Unavailable", "down"), failures: 1000}
+	target := NewRetryTarget(flaky, 5, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := target.DispatchSessionContext(ctx, NewSessionData(target), "call", nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("cancelled call succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the call kept waiting to retry after it was cancelled")
+	}
+	if got := flaky.calls.Load(); got != 1 {
+		t.Errorf("target called %d times, want 1", got)
+	}
+}
@@ -4,10 +4,20 @@
 package gocapnweb
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // RpcTarget defines the interface that server implementations must satisfy.
@@ -21,112 +31,691 @@ type RpcTarget interface {
 // BaseRpcTarget provides a convenient base implementation of RpcTarget
 // with method registration capabilities.
 type BaseRpcTarget struct {
-	methods map[string]func(json.RawMessage) (interface{}, error)
-	mu      sync.RWMutex
+	methods      map[string]ContextHandler
+	deprecations map[string]Deprecation
+	schemas      map[string]json.RawMessage
+	limiters     map[string]*rate.Limiter
+	defaults     map[string]json.RawMessage
+	methodMeta   map[string]MethodMeta
+	mounts       map[string]RpcTarget
+	fallback     FallbackHandler
+	middleware   []RpcMiddleware
+	mu           sync.RWMutex
+
+	// introspection is whether the built-in __introspect method is
+	// registered; serverName is reported by it.
+	introspection bool
+	serverName    string
+}
+
+// NewBaseRpcTarget creates a new BaseRpcTarget instance. Unless
+// WithoutIntrospection is given, it has the built-in __introspect method.
+func NewBaseRpcTarget(opts ...BaseRpcTargetOption) *BaseRpcTarget {
+	t := &BaseRpcTarget{
+		methods:       make(map[string]ContextHandler),
+		deprecations:  make(map[string]Deprecation),
+		schemas:       make(map[string]json.RawMessage),
+		limiters:      make(map[string]*rate.Limiter),
+		defaults:      make(map[string]json.RawMessage),
+		methodMeta:    make(map[string]MethodMeta),
+		introspection: true,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.introspection {
+		t.registerIntrospection()
+	}
+	return t
+}
+
+// Method registers a method handler with the given name. Options annotate
+// the method for introspection.
+func (t *BaseRpcTarget) Method(name string, handler func(json.RawMessage) (interface{}, error), opts ...MethodOption) {
+	t.MethodWithContext(name, withoutContext(handler), opts...)
+}
+
+// SubscribeMethod registers a method whose handler returns a channel of
+// values. The first pull of a pushed call starts the subscription; that pull
+// and each subsequent pull of the same export ID blocks until the channel
+// delivers the next value, which is sent as a resolve. Once the channel is
+// closed, the next pull receives ["complete", exportId]. Sessions that
+// cannot send frames outside a response, such as HTTP batches, instead
+// receive every value as one array once the channel is closed. Any handler
+// that returns a <-chan interface{} or chan interface{} behaves the same.
+func (t *BaseRpcTarget) SubscribeMethod(name string, handler func(json.RawMessage) (<-chan interface{}, error)) {
+	t.Method(name, func(args json.RawMessage) (interface{}, error) {
+		ch, err := handler(args)
+		if err != nil {
+			return nil, err
+		}
+		return ch, nil
+	})
+}
+
+// BulkRegister registers all of the given method handlers while holding the
+// registration lock once, which is cheaper than calling Method for each entry
+// when a target exposes many methods. It returns the sorted names of any
+// methods whose existing handlers were replaced; as with Method, their
+// metadata is forgotten.
+func (t *BaseRpcTarget) BulkRegister(methods map[string]func(json.RawMessage) (interface{}, error)) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var overwritten []string
+	for name, handler := range methods {
+		if _, exists := t.methods[name]; exists {
+			overwritten = append(overwritten, name)
+		}
+		t.methods[name] = withoutContext(handler)
+		t.setMethodMeta(name, nil)
+	}
+	sort.Strings(overwritten)
+	return overwritten
+}
+
+// Unmethod unregisters the named method, forgetting its metadata, schema,
+// defaults, deprecation and rate limit, and reports whether it was
+// registered. Calls already dispatched to the method complete with its
+// handler; later calls fail with MethodNotFound, or go to the fallback.
+func (t *BaseRpcTarget) Unmethod(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, exists := t.methods[name]
+	t.forgetMethod(name)
+	return exists
 }
 
-// NewBaseRpcTarget creates a new BaseRpcTarget instance.
-func NewBaseRpcTarget() *BaseRpcTarget {
-	return &BaseRpcTarget{
-		methods: make(map[string]func(json.RawMessage) (interface{}, error)),
+// ReplaceMethods atomically replaces the methods registered on t with
+// methods, so that no call sees a mix of the old and new handlers: each is
+// dispatched either entirely before the swap or entirely after it, and
+// calls in flight complete with the handlers they were dispatched to. The
+// built-in __introspect and rpc.discover methods are kept unless methods
+// replaces them. Methods no longer registered are forgotten as by
+// Unmethod, and the metadata of those replaced is cleared, as when they are
+// registered again with Method. Entries with a nil handler are skipped, so
+// the methods they name are removed like any other left out of methods.
+// ReplaceMethods returns the sorted names of the methods removed.
+func (t *BaseRpcTarget) ReplaceMethods(methods map[string]func(json.RawMessage) (interface{}, error)) []string {
+	handlers := make(map[string]ContextHandler, len(methods))
+	for name, handler := range methods {
+		if handler != nil {
+			handlers[name] = withoutContext(handler)
+		}
 	}
+	return t.ReplaceMethodsWithContext(handlers)
 }
 
-// Method registers a method handler with the given name.
-func (t *BaseRpcTarget) Method(name string, handler func(json.RawMessage) (interface{}, error)) {
+// ReplaceMethodsWithContext is like ReplaceMethods, for handlers that
+// receive the context of each call, as registered with MethodWithContext.
+func (t *BaseRpcTarget) ReplaceMethodsWithContext(methods map[string]ContextHandler) []string {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.methods[name] = handler
+
+	var removed []string
+	for name := range t.methods {
+		if handler := methods[name]; handler != nil || name == IntrospectMethod || name == DiscoverMethod {
+			continue
+		}
+		removed = append(removed, name)
+		t.forgetMethod(name)
+	}
+	for name, handler := range methods {
+		if handler == nil {
+			continue
+		}
+		t.methods[name] = handler
+		delete(t.methodMeta, name)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// forgetMethod removes the named method and everything recorded about it.
+// It must be called with t.mu held.
+func (t *BaseRpcTarget) forgetMethod(name string) {
+	delete(t.methods, name)
+	delete(t.methodMeta, name)
+	delete(t.schemas, name)
+	delete(t.defaults, name)
+	delete(t.deprecations, name)
+	delete(t.limiters, name)
 }
 
 // Dispatch implements the RpcTarget interface.
 func (t *BaseRpcTarget) Dispatch(method string, args json.RawMessage) (interface{}, error) {
+	return t.DispatchContext(context.Background(), method, args)
+}
+
+// DispatchContext implements the ContextRpcTarget interface.
+func (t *BaseRpcTarget) DispatchContext(ctx context.Context, method string, args json.RawMessage) (interface{}, error) {
 	t.mu.RLock()
 	handler, exists := t.methods[method]
+	if !exists {
+		handler, exists = t.mountedHandler(method)
+	}
+	if !exists {
+		handler, exists = t.fallbackHandler(method)
+	}
+	limiter := t.limiters[method]
+	middleware := t.middleware
 	t.mu.RUnlock()
 
 	if !exists {
-		return nil, fmt.Errorf("method not found: %s", method)
+		return nil, RpcError{Code: ErrMethodNotFound.Code, Message: "method not found: " + method}
 	}
 
-	return handler(args)
+	if limiter != nil {
+		if err := checkRateLimit(limiter, method); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(middleware) == 0 {
+		return handler(ctx, args)
+	}
+	final := func(args json.RawMessage) (interface{}, error) {
+		return handler(ctx, args)
+	}
+	return applyMiddleware(middleware, method, final)(args)
 }
 
 // SessionData holds the state for each RPC session (WebSocket connection or HTTP batch).
 type SessionData struct {
-	PendingResults    map[int]interface{} `json:"pendingResults"`
-	PendingOperations map[int]Operation   `json:"pendingOperations"`
-	NextExportID      int                 `json:"nextExportId"`
-	Target            RpcTarget           `json:"-"`
-	mu                sync.RWMutex
+	ID                string                     `json:"id"`
+	PendingResults    map[int]interface{}        `json:"pendingResults"`
+	PendingOperations map[int]Operation          `json:"pendingOperations"`
+	Subscriptions     map[int]<-chan interface{} `json:"-"`
+	NextExportID      int                        `json:"nextExportId"`
+	Target            RpcTarget                  `json:"-"`
+	Metadata          map[string]string          `json:"metadata,omitempty"`
+	RetryBudget       *RetryBudget               `json:"-"`
+
+	// ExpiresAt is when a stored session may no longer be resumed; it is
+	// set by TTLSessionStore.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+
+	mu     sync.RWMutex
+	metaMu sync.RWMutex
+
+	// values holds the session values set by handlers; see SetValue. It
+	// is guarded by metaMu.
+	values map[string]interface{}
+
+	// results mirrors PendingResults so pulls of already-computed exports
+	// can be served without taking a lock. Writes to either go through
+	// storeResult/deleteResult, which hold resultsMu.
+	results   sync.Map
+	resultsMu sync.Mutex
+
+	// exports is the export table, tracking the client's references to
+	// each export. It is guarded by mu, and replaced with setExports.
+	// entries mirrors it for pulls, which look up their export without
+	// locking; it is written with mu held.
+	exports map[int]*exportEntry
+	entries sync.Map
+
+	// laterPushes holds, while an HTTP batch handles a message other than
+	// a push, the export IDs of the pushes sent after it; see handleBatch.
+	laterPushes atomic.Pointer[map[int]bool]
+
+	// lastCapabilityID is the export ID of the last capability returned
+	// by a method; see allocateCapabilityID. It is guarded by mu.
+	lastCapabilityID int
+
+	// storedCapabilities holds the export IDs of the capabilities of a
+	// session decoded by a SessionStore, whose targets were not encoded;
+	// see checkCapabilities. It is guarded by mu.
+	storedCapabilities []int
+
+	// imports counts the references the server holds to each function or
+	// object the client passed as an argument. callbacks holds the calls
+	// made on them that await an answer, by the import ID of the call,
+	// the last of which is lastCallbackID. All are guarded by mu.
+	imports        map[int]int
+	callbacks      map[int]chan callbackResult
+	lastCallbackID int
+
+	// promises holds the settlements of the promises the client passed,
+	// by their import ID. It is guarded by mu.
+	promises map[int]*promiseSettlement
+
+	// inflight holds the promises of pending operations being dispatched.
+	// It is guarded by mu.
+	inflight map[int]*exportPromise
+
+	// dispatchSignal is closed, and cleared, whenever a pending call is
+	// dispatched or finishes; see awaitDispatchTurn. It is guarded by mu.
+	dispatchSignal chan struct{}
+
+	// callQueues holds the export IDs of the pending calls on each callee,
+	// in push order; see earlierCall. It is guarded by mu.
+	callQueues map[string][]int
+
+	// abort is set once the session has been aborted by either side.
+	abort atomic.Pointer[AbortInfo]
+
+	// received is set once the first message has been handled.
+	received bool
+
+	// ended is set once the session has ended; see endSession. It is
+	// guarded by mu.
+	ended bool
+
+	// ctx is the context of calls made in the session; see SetContext.
+	// It is cancelled by cancelCtx when the session is aborted.
+	ctx       context.Context
+	cancelCtx context.CancelCauseFunc
+
+	// deprecations records deprecated methods dispatched by the session.
+	// outbox holds frames produced while handling a message that precede
+	// its response; sendFrame, if set, delivers them immediately instead.
+	deprecations []Deprecation
+	outbox       [][]interface{}
+	sendFrame    func([]byte) error
+	outboxMu     sync.Mutex
+}
+
+// loadResult returns the computed result for an export without locking.
+func (sd *SessionData) loadResult(exportID int) (interface{}, bool) {
+	return sd.results.Load(exportID)
+}
+
+// storeResult records the computed result for an export.
+func (sd *SessionData) storeResult(exportID int, result interface{}) {
+	sd.resultsMu.Lock()
+	defer sd.resultsMu.Unlock()
+	if sd.PendingResults == nil {
+		sd.PendingResults = make(map[int]interface{})
+	}
+	sd.PendingResults[exportID] = result
+	sd.results.Store(exportID, result)
+}
+
+// deleteResult discards the computed result for an export.
+func (sd *SessionData) deleteResult(exportID int) {
+	sd.resultsMu.Lock()
+	defer sd.resultsMu.Unlock()
+	delete(sd.PendingResults, exportID)
+	sd.results.Delete(exportID)
+}
+
+// resetResults discards all computed results.
+func (sd *SessionData) resetResults() {
+	sd.resultsMu.Lock()
+	defer sd.resultsMu.Unlock()
+	sd.PendingResults = make(map[int]interface{})
+	sd.results.Clear()
+}
+
+// headerMetaPrefix prefixes the metadata keys under which request headers are
+// stored.
+const headerMetaPrefix = "header:"
+
+// GetMeta returns the metadata value stored under key.
+func (sd *SessionData) GetMeta(key string) (string, bool) {
+	sd.metaMu.RLock()
+	defer sd.metaMu.RUnlock()
+	value, exists := sd.Metadata[key]
+	return value, exists
+}
+
+// SetMeta stores a metadata value for the session.
+func (sd *SessionData) SetMeta(key, value string) {
+	sd.metaMu.Lock()
+	defer sd.metaMu.Unlock()
+	if sd.Metadata == nil {
+		sd.Metadata = make(map[string]string)
+	}
+	sd.Metadata[key] = value
+}
+
+// SetHeaders records the headers of the HTTP request that opened the session
+// so they can be referenced by ["header", name] arguments.
+func (sd *SessionData) SetHeaders(header http.Header) {
+	for name, values := range header {
+		if len(values) > 0 {
+			sd.SetMeta(headerMetaPrefix+http.CanonicalHeaderKey(name), values[0])
+		}
+	}
+}
+
+// Header returns the value of a request header recorded with SetHeaders.
+func (sd *SessionData) Header(name string) (string, bool) {
+	return sd.GetMeta(headerMetaPrefix + http.CanonicalHeaderKey(name))
+}
+
+// markMessageReceived records that a message arrived and reports whether it
+// was the first.
+func (sd *SessionData) markMessageReceived() bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	first := !sd.received
+	sd.received = true
+	return first
+}
+
+// SetFrameSender installs a function that delivers frames to the client as
+// soon as they are produced, such as the chunks of a streaming result. Without
+// one, such frames are returned together with the response to the message
+// that produced them.
+func (sd *SessionData) SetFrameSender(send func(frame []byte) error) {
+	sd.outboxMu.Lock()
+	defer sd.outboxMu.Unlock()
+	sd.sendFrame = send
+}
+
+// emitFrame delivers a frame ahead of the response currently being built.
+func (sd *SessionData) emitFrame(frame []interface{}) error {
+	sd.outboxMu.Lock()
+	send := sd.sendFrame
+	if send == nil {
+		sd.outbox = append(sd.outbox, frame)
+		sd.outboxMu.Unlock()
+		return nil
+	}
+	sd.outboxMu.Unlock()
+
+	frameBytes, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return send(frameBytes)
+}
+
+// takeFrames returns and clears the frames waiting in the outbox.
+func (sd *SessionData) takeFrames() [][]interface{} {
+	sd.outboxMu.Lock()
+	defer sd.outboxMu.Unlock()
+	frames := sd.outbox
+	sd.outbox = nil
+	return frames
+}
+
+// addDeprecation records that a deprecated method was dispatched and emits
+// a warning frame for it.
+func (sd *SessionData) addDeprecation(deprecation Deprecation) {
+	sd.outboxMu.Lock()
+	sd.deprecations = append(sd.deprecations, deprecation)
+	sd.outboxMu.Unlock()
+	sd.emitFrame([]interface{}{"warning", "Deprecated", deprecation.Message()})
+}
+
+// Deprecations returns the deprecated methods dispatched by the session.
+func (sd *SessionData) Deprecations() []Deprecation {
+	sd.outboxMu.Lock()
+	defer sd.outboxMu.Unlock()
+	return append([]Deprecation(nil), sd.deprecations...)
 }
 
 // Operation represents a pending RPC operation.
 type Operation struct {
 	Method string          `json:"method"`
 	Args   json.RawMessage `json:"args"`
+
+	// ImportID and Path are the import the call was pushed on and the
+	// path of the method within it. Calls on the main target have an
+	// ImportID of zero.
+	ImportID int           `json:"importId,omitempty"`
+	Path     []interface{} `json:"path,omitempty"`
+
+	// Remap, if set, makes the operation a .map() over an earlier result
+	// instead of a method call.
+	Remap *Remap `json:"remap,omitempty"`
+
+	// Property, if set, makes the operation a read of the value at Path of
+	// import ImportID instead of a method call.
+	Property bool `json:"property,omitempty"`
+
+	// Value, if set, makes the operation the evaluation of a pushed
+	// expression, such as a literal value or an object holding pipeline
+	// references, instead of a method call.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Err, if set, rejects the operation when it is pulled; it records
+	// arguments that could not be decoded and invalid pushes. It is
+	// encoded as an error expression, or its message if it is not an
+	// RpcError.
+	Err error `json:"-"`
+
+	// literalArgs is set if Args hold nothing to evaluate, so that they are
+	// handed to the method as they are rather than decoded, evaluated and
+	// encoded again; see literalArgs.
+	literalArgs bool
 }
 
 // NewSessionData creates a new SessionData instance.
 func NewSessionData(target RpcTarget) *SessionData {
 	return &SessionData{
+		ID:                newConnectionID(),
 		PendingResults:    make(map[int]interface{}),
 		PendingOperations: make(map[int]Operation),
+		Subscriptions:     make(map[int]<-chan interface{}),
+		Metadata:          make(map[string]string),
 		NextExportID:      1,
 		Target:            target,
 	}
 }
 
+// DefaultMaxMessageBytes is the default upper bound on the size of a single
+// incoming RPC message.
+const DefaultMaxMessageBytes = 10 << 20
+
+// SessionOptions holds the configuration shared by every connection handled
+// by an RpcSession.
+type SessionOptions struct {
+	// Logger receives the session's diagnostic output. Defaults to the
+	// standard library's default logger.
+	Logger *log.Logger
+
+	// MaxMessageBytes is the largest message HandleMessage will parse.
+	// Larger messages are rejected before any JSON decoding takes place.
+	// Zero or a negative value disables the check.
+	MaxMessageBytes int64
+
+	// ProtocolVersions lists the protocol versions the session can speak,
+	// offered to clients that open with a hello message.
+	ProtocolVersions []string
+
+	// Codec decodes arguments sent with an argCodec in their push metadata
+	// and encodes method results. Defaults to JSONCodec.
+	Codec Codec
+
+	// KeySanitizer rewrites the object keys of method results, and the
+	// keys of pipeline paths into them; a reversible policy also restores
+	// the keys of call arguments. Defaults to EscapeDollarPrefix.
+	KeySanitizer SanitizeKeyPolicy
+
+	// ProactiveResolve makes sessions that can send unsolicited frames,
+	// such as WebSocket connections, evaluate each pushed call as soon as
+	// it arrives and send its resolve or reject without waiting for a
+	// pull. Pulls of those calls are then answered with no frame.
+	ProactiveResolve bool
+
+	// MaxConcurrency bounds how many independent pending operations a pull
+	// dispatches at once. Targets must be safe for concurrent use when it
+	// is greater than one. Defaults to DefaultMaxConcurrency.
+	MaxConcurrency int
+
+	// MaxExpressionDepth, MaxExpressionNodes and MaxPipelineChain bound
+	// the nesting and size of each pushed expression and the length of
+	// chains of pushes on earlier results. Pushes that exceed them are
+	// rejected with ErrLimitExceeded. Zero or a negative value disables a
+	// check.
+	MaxExpressionDepth int
+	MaxExpressionNodes int
+	MaxPipelineChain   int
+
+	// MaxPendingOperations bounds how many of the client's pushes a session
+	// holds without having resolved or released them. Further pushes are
+	// rejected with ErrLimitExceeded. Zero or a negative value disables the
+	// check.
+	MaxPendingOperations int
+
+	// Escapes holds the custom escapes of the session's results and
+	// arguments. See WithEscapeRegistry.
+	Escapes *EscapeRegistry
+
+	// PullTimeout bounds how long each handler called to resolve a pull
+	// may run. See WithPullTimeout.
+	PullTimeout time.Duration
+
+	// OnOpen, OnError and OnClose are called when a session opens, when
+	// it fails and once when it ends. See WithOnOpen, WithOnError and
+	// WithOnClose.
+	OnOpen  func(sessionData *SessionData) error
+	OnError func(sessionData *SessionData, err error)
+	OnClose func(sessionData *SessionData)
+
+	// OnPanic is called when a handler panics. See WithOnPanic.
+	OnPanic func(sessionData *SessionData, method string, recovered interface{}, stack []byte)
+}
+
+// defaultSessionOptions returns the options used when none are specified.
+func defaultSessionOptions() SessionOptions {
+	return SessionOptions{
+		Logger:           log.Default(),
+		MaxMessageBytes:  DefaultMaxMessageBytes,
+		ProtocolVersions: []string{ProtocolVersion},
+		Codec:            JSONCodec{},
+		KeySanitizer:     EscapeDollarPrefix,
+		MaxConcurrency:   DefaultMaxConcurrency,
+
+		MaxExpressionDepth: DefaultMaxExpressionDepth,
+		MaxExpressionNodes: DefaultMaxExpressionNodes,
+		MaxPipelineChain:   DefaultMaxPipelineChain,
+
+		MaxPendingOperations: DefaultMaxPendingOperations,
+	}
+}
+
+// RpcSessionOption configures an RpcSession.
+type RpcSessionOption func(*SessionOptions)
+
+// WithLogger routes the session's diagnostic output to the given logger.
+func WithLogger(logger *log.Logger) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.Logger = logger
+	}
+}
+
+// WithMaxMessageBytes sets the largest message the session will parse.
+func WithMaxMessageBytes(n int64) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.MaxMessageBytes = n
+	}
+}
+
+// WithProtocolVersions sets the protocol versions the session can speak.
+func WithProtocolVersions(versions ...string) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.ProtocolVersions = versions
+	}
+}
+
+// WithCodec sets the codec used for method arguments and results.
+func WithCodec(codec Codec) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.Codec = codec
+	}
+}
+
 // RpcSession handles the Cap'n Web RPC protocol for connections.
 type RpcSession struct {
 	target RpcTarget
+	opts   SessionOptions
 }
 
 // NewRpcSession creates a new RpcSession with the given target.
-func NewRpcSession(target RpcTarget) *RpcSession {
-	return &RpcSession{target: target}
+func NewRpcSession(target RpcTarget, opts ...RpcSessionOption) *RpcSession {
+	options := defaultSessionOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return newRpcSession(target, options)
+}
+
+// newRpcSession creates an RpcSession from an already-populated options struct.
+func newRpcSession(target RpcTarget, options SessionOptions) *RpcSession {
+	if options.Logger == nil {
+		options.Logger = log.Default()
+	}
+	return &RpcSession{target: target, opts: options}
+}
+
+// logf writes a diagnostic message to the session's logger.
+func (s *RpcSession) logf(format string, args ...interface{}) {
+	s.opts.Logger.Printf(format, args...)
 }
 
 // HandleMessage processes an incoming RPC message and returns the response.
-// Returns an empty string if no response should be sent.
+// Returns an empty string if no response should be sent. When a message
+// produces several frames they are separated by newlines; transports that
+// send frames individually should use HandleMessageFrames instead.
 func (s *RpcSession) HandleMessage(sessionData *SessionData, message string) (string, error) {
-	var msg []interface{}
-	if err := json.Unmarshal([]byte(message), &msg); err != nil {
-		return "", fmt.Errorf("invalid message format: %w", err)
+	frames, err := s.HandleMessageFrames(sessionData, message)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(frames, "\n"), nil
+}
+
+// HandleMessageFrames processes an incoming RPC message and returns the
+// protocol frames to send in response, in order. Returns nil if no response
+// should be sent.
+func (s *RpcSession) HandleMessageFrames(sessionData *SessionData, message string) ([]string, error) {
+	if limit := s.opts.MaxMessageBytes; limit > 0 && int64(len(message)) > limit {
+		return nil, fmt.Errorf("message too large: %d bytes exceeds limit of %d", len(message), limit)
+	}
+
+	msg, err := decodeMessage([]byte(message))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message format: %w", err)
 	}
 
 	if len(msg) == 0 {
-		return "", fmt.Errorf("empty message")
+		return nil, fmt.Errorf("empty message")
 	}
 
 	messageType, ok := msg[0].(string)
 	if !ok {
-		return "", fmt.Errorf("invalid message type")
+		return nil, fmt.Errorf("invalid message type")
 	}
 
+	first := sessionData.markMessageReceived()
+
 	switch messageType {
+	case "hello":
+		var helloData interface{}
+		if len(msg) >= 2 {
+			helloData = msg[1]
+		}
+		return s.marshalFrames(s.handleHello(sessionData, helloData, first))
+
 	case "push":
+		var pushData interface{}
+		var metadata map[string]interface{}
 		if len(msg) >= 2 {
-			s.handlePush(sessionData, msg[1])
+			pushData = msg[1]
+		}
+		if len(msg) >= 3 {
+			metadata, _ = msg[2].(map[string]interface{})
 		}
-		return "", nil // No response for push
+		exportID := s.handlePush(sessionData, pushData, metadata)
+		if s.resolvesProactively(sessionData) {
+			return s.resolveProactively(sessionData, exportID)
+		}
+		return nil, nil // No response for push
 
 	case "pull":
-		if len(msg) >= 2 {
-			if exportIDFloat, ok := msg[1].(float64); ok {
-				exportID := int(exportIDFloat)
-				response, err := s.handlePull(sessionData, exportID)
-				if err != nil {
-					return "", err
-				}
-				responseBytes, err := json.Marshal(response)
-				if err != nil {
-					return "", err
-				}
-				return string(responseBytes), nil
-			}
+		// ["pull", id, id, ...] pulls several exports at once
+		if exportIDs, ok := pullExportIDs(msg[1:]); ok {
+			return s.handlePulls(sessionData, exportIDs)
 		}
 
+	case "pullAll":
+		return s.handlePulls(sessionData, sessionData.unpulledExportIDs())
+
 	case "release":
 		if len(msg) >= 3 {
 			if exportIDFloat, ok := msg[1].(float64); ok {
@@ -135,173 +724,496 @@ func (s *RpcSession) HandleMessage(sessionData *SessionData, message string) (st
 				}
 			}
 		}
-		return "", nil // No response for release
+		return nil, nil // No response for release
 
 	case "abort":
 		if len(msg) >= 2 {
 			s.handleAbort(sessionData, msg[1])
 		}
-		return "", nil // No response for abort
+		return nil, nil // No response for abort
+
+	case "resolve", "reject":
+		s.handleAnswer(sessionData, msg)
+		return nil, nil // Answers to calls made by the server
+	}
+
+	return nil, nil
+}
+
+// handlePulls pulls each of exportIDs in turn and returns their frames in
+// order. Frames emitted while evaluating a pull precede its result.
+func (s *RpcSession) handlePulls(sessionData *SessionData, exportIDs []int) ([]string, error) {
+	var frames [][]interface{}
+	for _, exportID := range exportIDs {
+		response, err := s.handlePull(sessionData, exportID)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, sessionData.takeFrames()...)
+		if response != nil {
+			frames = append(frames, response)
+		}
+	}
+	if len(frames) == 0 {
+		return nil, nil
+	}
+	return s.marshalFrames(frames)
+}
+
+// pullExportIDs returns the export IDs of a pull message's operands, which
+// must all be numbers.
+func pullExportIDs(operands []interface{}) ([]int, bool) {
+	if len(operands) == 0 {
+		return nil, false
+	}
+	exportIDs := make([]int, len(operands))
+	for i, operand := range operands {
+		exportIDFloat, ok := operand.(float64)
+		if !ok {
+			return nil, false
+		}
+		exportIDs[i] = int(exportIDFloat)
+	}
+	return exportIDs, true
+}
+
+// unpulledExportIDs returns, in ascending order, the IDs of the client's
+// pushes that it has neither pulled nor released and that have not been
+// resolved proactively, leaving out those an HTTP batch sends after the
+// message being handled.
+func (sd *SessionData) unpulledExportIDs() []int {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	var exportIDs []int
+	for exportID, entry := range sd.exports {
+		if exportID > MainExportID && !entry.pulled.Load() && !entry.resolved.Load() && !sd.pushedLater(exportID) {
+			exportIDs = append(exportIDs, exportID)
+		}
 	}
+	sort.Ints(exportIDs)
+	return exportIDs
+}
 
-	return "", nil
+// marshalFrames encodes each frame as a JSON message.
+func (s *RpcSession) marshalFrames(frames [][]interface{}) ([]string, error) {
+	encoded := make([]string, 0, len(frames))
+	for _, frame := range frames {
+		frameBytes, err := json.Marshal(frame)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, string(frameBytes))
+	}
+	return encoded, nil
 }
 
 // OnOpen initializes a new session.
 func (s *RpcSession) OnOpen(sessionData *SessionData) {
-	log.Println("WebSocket connection opened")
+	s.logf("WebSocket connection opened")
+	sessionData.resetResults()
 	sessionData.mu.Lock()
 	defer sessionData.mu.Unlock()
 	sessionData.NextExportID = 1
-	sessionData.PendingResults = make(map[int]interface{})
 	sessionData.PendingOperations = make(map[int]Operation)
+	sessionData.Subscriptions = make(map[int]<-chan interface{})
+	sessionData.indexCalls()
 }
 
-// OnClose cleans up a session.
+// OnClose cleans up a session, disposing of the results of exports the
+// client has not released.
 func (s *RpcSession) OnClose(sessionData *SessionData) {
-	log.Println("WebSocket connection closed")
+	s.logf("WebSocket connection closed")
+	s.endSession(sessionData)
 }
 
-func (s *RpcSession) handlePush(sessionData *SessionData, pushData interface{}) {
-	pushArray, ok := pushData.([]interface{})
-	if !ok || len(pushArray) == 0 {
-		return
-	}
-
+// handlePush records a pushed call for evaluation when it is pulled and
+// returns its export ID. A push that cannot be evaluated is recorded as an
+// operation that rejects when pulled.
+func (s *RpcSession) handlePush(sessionData *SessionData, pushData interface{}, metadata map[string]interface{}) int {
 	sessionData.mu.Lock()
 	defer sessionData.mu.Unlock()
 
-	// Create a new export on the server side
-	exportID := sessionData.NextExportID
-	sessionData.NextExportID++
+	// The client numbers its imports 1, 2, ... in the order it sends
+	// pushes, so every push takes the next ID, even one that cannot be
+	// evaluated. The export is referenced by the client until released.
+	exportID := sessionData.allocatePushID()
+	sessionData.addExportRef(exportID)
+
+	// Pushes beyond the limit of pending operations are not held as
+	// operations, so they do not count towards it themselves
+	if err := s.checkPending(sessionData); err != nil {
+		sessionData.exportEntry(exportID).rejected = err
+		return exportID
+	}
 
-	if len(pushArray) >= 3 && pushArray[0] == "pipeline" {
-		if importIDFloat, ok := pushArray[1].(float64); ok {
-			_ = int(importIDFloat) // importID for future use
+	operation := s.parsePush(sessionData, exportID, pushData, metadata)
+	if operation.Err == nil {
+		operation.Err = s.checkChain(sessionData, exportID, operation)
+	}
+	sessionData.PendingOperations[exportID] = operation
+	sessionData.queueCall(exportID, operation)
+	return exportID
+}
+
+// parsePush decodes the expression pushed as exportID into the operation
+// that evaluates it. Pushes that cannot be evaluated become operations that
+// are rejected when pulled. It must be called with sessionData.mu held.
+func (s *RpcSession) parsePush(sessionData *SessionData, exportID int, pushData interface{}, metadata map[string]interface{}) Operation {
+	if pushData == nil {
+		return Operation{Err: invalidPush("push requires an expression")}
+	}
+	if err := s.checkExpression(pushData); err != nil {
+		return Operation{Err: err}
+	}
+	pushArray, isArray := pushData.([]interface{})
+
+	// A remap maps the elements of an earlier result when pulled
+	if isArray && len(pushArray) > 0 && pushArray[0] == "remap" {
+		remap, err := parseRemap(pushArray, exportID)
+		return Operation{Remap: remap, Err: err}
+	}
+
+	// Any other expression but a pipeline, such as a literal value or an
+	// object holding pipeline references, evaluates to a value
+	if !isArray || len(pushArray) == 0 || pushArray[0] != "pipeline" {
+		_, value, err := s.pushedValue(sessionData, exportID, resolveHeaderReferences(sessionData, pushData))
+		return Operation{Value: value, Err: err}
+	}
+
+	if len(pushArray) < 2 {
+		return Operation{Err: invalidPush("pipeline requires an import ID")}
+	}
+	if importIDFloat, ok := pushArray[1].(float64); ok {
+		importID := int(importIDFloat)
+		if importID >= exportID {
+			return Operation{Err: invalidPush(fmt.Sprintf("pipeline on import %d, which has not been pushed", importID))}
+		}
 
+		// A push without arguments on an earlier result reads a property
+		// of it, or the whole result if it has no path; on the main target
+		// or a capability it calls a method without arguments, as it
+		// always has
+		if len(pushArray) <= 3 && importID > MainExportID {
+			var path []interface{}
+			if len(pushArray) == 3 {
+				var ok bool
+				path, ok = pushArray[2].([]interface{})
+				if !ok && pushArray[2] != nil {
+					return Operation{Err: invalidPush("pipeline path must be an array")}
+				}
+			}
+			return Operation{ImportID: importID, Path: path, Property: true}
+		}
+
+		if len(pushArray) >= 3 {
 			if methodArray, ok := pushArray[2].([]interface{}); ok && len(methodArray) > 0 {
 				if method, ok := methodArray[0].(string); ok {
 					var args json.RawMessage
+					var argsErr error
+					literal := true
 					if len(pushArray) >= 4 {
-						argsBytes, _ := json.Marshal(pushArray[3])
-						args = argsBytes
+						argValue, err := s.decodePushArgs(pushArray[3], metadata)
+						if err == nil {
+							// Arguments decoded by a codec were not part
+							// of the pushed expression when it was checked
+							err = s.checkExpression(argValue)
+						}
+						if err != nil {
+							argsErr = err
+						} else {
+							var pushed interface{}
+							pushed, args, argsErr = s.pushedValue(sessionData, exportID, resolveHeaderArguments(sessionData, argValue))
+							literal = literalArgs(pushed, s.opts.KeySanitizer)
+						}
 					} else {
 						args = json.RawMessage("[]")
 					}
 
-					// Store the operation for lazy evaluation when pulled
-					sessionData.PendingOperations[exportID] = Operation{
-						Method: method,
-						Args:   args,
+					// The call is evaluated lazily, when pulled
+					return Operation{
+						Method:      method,
+						Args:        args,
+						ImportID:    importID,
+						Path:        methodArray,
+						Err:         argsErr,
+						literalArgs: literal,
 					}
 				}
 			}
 		}
 	}
+	return Operation{Err: invalidPush("unsupported push expression")}
+}
+
+// pushedValue prepares a value sent in a push, such as the arguments of a
+// call, for evaluation when the push is pulled, and returns it together with
+// its encoding. Its references may only refer to earlier pushes. value is
+// modified in place. It must be called with sessionData.mu held.
+func (s *RpcSession) pushedValue(sessionData *SessionData, exportID int, value interface{}) (interface{}, json.RawMessage, error) {
+	value = expandRefShorthand(value)
+	var err error
+	if forward := forwardReference(value, exportID); forward != 0 {
+		err = invalidPush(fmt.Sprintf("reference to import %d, which has not been pushed", forward))
+	}
+	sessionData.addImportRefs(value)
+	encoded, _ := json.Marshal(value)
+	return value, encoded, err
+}
+
+// literalArgs reports whether evaluating the arguments of a call would leave
+// them as they are, so that their encoding can be handed to the method
+// directly. Large arguments, such as uploads, then reach the method without
+// being decoded and encoded again when the call is pulled.
+func literalArgs(args interface{}, keys SanitizeKeyPolicy) bool {
+	// The argument array itself is not escaped; see EvaluateArguments
+	if elems, ok := args.([]interface{}); ok {
+		for _, elem := range elems {
+			if !isLiteral(elem, keys) {
+				return false
+			}
+		}
+		return true
+	}
+	return isLiteral(args, keys)
 }
 
-func (s *RpcSession) resolvePipelineReferences(sessionData *SessionData, value interface{}) (interface{}, error) {
+// isLiteral reports whether evaluating value would leave it as it is: it
+// holds no arrays, which are escaped array literals, escapes or
+// expressions, and no object keys that keys restores.
+func isLiteral(value interface{}, keys SanitizeKeyPolicy) bool {
 	switch v := value.(type) {
 	case []interface{}:
-		// Check if this is a pipeline reference: ["pipeline", exportId, ["path", ...]]
-		if len(v) >= 2 {
-			if pipelineStr, ok := v[0].(string); ok && pipelineStr == "pipeline" {
-				if refExportIDFloat, ok := v[1].(float64); ok {
-					refExportID := int(refExportIDFloat)
-
-					sessionData.mu.RLock()
-					// Check if result is already computed
-					if result, exists := sessionData.PendingResults[refExportID]; exists {
-						sessionData.mu.RUnlock()
-
-						// If there's a path, traverse it
-						if len(v) >= 3 {
-							if pathArray, ok := v[2].([]interface{}); ok {
-								return s.traversePath(result, pathArray)
-							}
-						}
-						return result, nil
-					}
-
-					// Check if we need to execute a pending operation
-					if operation, exists := sessionData.PendingOperations[refExportID]; exists {
-						sessionData.mu.RUnlock()
+		return false
+	case map[string]interface{}:
+		for key, val := range v {
+			if keys.restoreKey(key) != key || !isLiteral(val, keys) {
+				return false
+			}
+		}
+	}
+	return true
+}
 
-						// Recursively resolve arguments
-						var args interface{}
-						if err := json.Unmarshal(operation.Args, &args); err != nil {
-							return nil, err
-						}
-						resolvedArgs, err := s.resolvePipelineReferences(sessionData, args)
-						if err != nil {
-							return nil, err
-						}
+// forwardReference returns the first import ID at or after exportID that a
+// pipeline reference in value refers to, or zero if there is none. A push
+// may only refer to the results of earlier pushes.
+func forwardReference(value interface{}, exportID int) int {
+	forward := 0
+	forEachPipelineRef(value, func(importID int) {
+		if forward == 0 && importID >= exportID {
+			forward = importID
+		}
+	})
+	return forward
+}
 
-						resolvedArgsBytes, err := json.Marshal(resolvedArgs)
-						if err != nil {
-							return nil, err
-						}
+// invalidPush is the error a pull reports for a push that cannot be
+// evaluated.
+func invalidPush(message string) error {
+	return RpcError{Code: "InvalidPush", Message: message}
+}
 
-						// Execute the operation
-						result, err := sessionData.Target.Dispatch(operation.Method, resolvedArgsBytes)
-						if err != nil {
-							return nil, err
-						}
+// expandRefShorthand rewrites {"$ref": [exportId, "field", ...]} objects into
+// the equivalent ["pipeline", exportId, ["field", ...]] reference so that
+// hand-crafted requests can extract single fields from earlier results.
+// value is modified in place.
+func expandRefShorthand(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = expandRefShorthand(elem)
+		}
 
-						// Normalize the result for pipeline traversal
-						normalizedResult, err := s.normalizeResult(result)
-						if err != nil {
-							return nil, err
-						}
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].([]interface{}); ok && len(v) == 1 && len(ref) > 0 {
+			if exportID, ok := ref[0].(float64); ok {
+				path := make([]interface{}, len(ref)-1)
+				copy(path, ref[1:])
+				return []interface{}{"pipeline", exportID, path}
+			}
+		}
 
-						// Cache the normalized result
-						sessionData.mu.Lock()
-						sessionData.PendingResults[refExportID] = normalizedResult
-						delete(sessionData.PendingOperations, refExportID)
-						sessionData.mu.Unlock()
-
-						// If there's a path, traverse it
-						if len(v) >= 3 {
-							if pathArray, ok := v[2].([]interface{}); ok {
-								return s.traversePath(normalizedResult, pathArray)
-							}
-						}
-						return normalizedResult, nil
-					}
-					sessionData.mu.RUnlock()
+		for key, val := range v {
+			v[key] = expandRefShorthand(val)
+		}
+	}
+	return value
+}
 
-					return nil, fmt.Errorf("pipeline reference to non-existent export: %d", refExportID)
+// resolveHeaderReferences replaces the ["header", name] references in value,
+// an expression, with the value of the named request header captured when
+// the session was opened, or nil if the header was not present. Only
+// references in expression position are replaced; escaped array literals
+// and the paths of pipeline references are data the client sent, and are
+// left as they are. value is modified in place.
+func resolveHeaderReferences(sessionData *SessionData, value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 2 && v[0] == "header" {
+			if name, ok := v[1].(string); ok {
+				if headerValue, exists := sessionData.Header(name); exists {
+					return headerValue
 				}
+				return nil
 			}
 		}
 
-		// Not a pipeline reference, recursively resolve elements
-		resolved := make([]interface{}, len(v))
-		for i, elem := range v {
-			resolvedElem, err := s.resolvePipelineReferences(sessionData, elem)
-			if err != nil {
-				return nil, err
+		if len(v) == 1 {
+			if _, ok := v[0].([]interface{}); ok {
+				return value
 			}
-			resolved[i] = resolvedElem
 		}
-		return resolved, nil
+		if len(v) >= 2 && v[0] == "pipeline" {
+			if len(v) >= 4 {
+				v[3] = resolveHeaderArguments(sessionData, v[3])
+			}
+			return value
+		}
+
+		for i, elem := range v {
+			v[i] = resolveHeaderReferences(sessionData, elem)
+		}
 
 	case map[string]interface{}:
-		// Recursively resolve object values
-		resolved := make(map[string]interface{})
 		for key, val := range v {
-			resolvedVal, err := s.resolvePipelineReferences(sessionData, val)
-			if err != nil {
-				return nil, err
-			}
-			resolved[key] = resolvedVal
+			v[key] = resolveHeaderReferences(sessionData, val)
 		}
-		return resolved, nil
+	}
+	return value
+}
+
+// resolveHeaderArguments replaces the ["header", name] references in the
+// arguments of a call. The argument array is not escaped, so each argument
+// is an expression; arguments sent as a single object are one expression.
+// args is modified in place.
+func resolveHeaderArguments(sessionData *SessionData, args interface{}) interface{} {
+	if elems, ok := args.([]interface{}); ok {
+		for i, elem := range elems {
+			elems[i] = resolveHeaderReferences(sessionData, elem)
+		}
+		return elems
+	}
+	return resolveHeaderReferences(sessionData, args)
+}
+
+// resolvePipelineReferences evaluates value, an expression the client sent
+// in the push exportID, resolving its pipeline references against the
+// session's exports.
+func (s *RpcSession) resolvePipelineReferences(sessionData *SessionData, exportID int, value interface{}) (interface{}, error) {
+	return s.evaluator(sessionData, exportID).Evaluate(value)
+}
 
-	default:
-		// Primitive value, return as-is
-		return value, nil
+// pipelineValue returns the value at path of an export, dispatching its
+// pending operation, or waiting for the dispatch already executing it, if
+// its result has not been computed.
+func (s *RpcSession) pipelineValue(sessionData *SessionData, exportID int, path []interface{}) (interface{}, error) {
+	result, exists := sessionData.loadResult(exportID)
+	if !exists {
+		var err error
+		if result, err = s.evaluatePending(sessionData, exportID); err != nil {
+			return nil, err
+		}
+	}
+	if len(path) > 0 {
+		return s.traversePath(result, path)
 	}
+	return result, nil
+}
+
+// pipelineCall makes the call of a pipeline reference nested in the push
+// exportID, such as ["pipeline", 0, ["method"], args] within the arguments
+// of a call, and returns its normalized result. args is the argument
+// expression, or nil if there is none. The call is made for exportID, as a
+// remap's calls are.
+func (s *RpcSession) pipelineCall(sessionData *SessionData, exportID, importID int, path []interface{}, args interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("call on import %d requires a method", importID)
+	}
+	method, _ := path[len(path)-1].(string)
+	operation := Operation{Method: method, ImportID: importID, Path: path}
+	target, method, err := s.operationTarget(sessionData, exportID, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolvedArgs interface{} = []interface{}{}
+	if args != nil {
+		if resolvedArgs, err = s.evaluator(sessionData, exportID).EvaluateArguments(args); err != nil {
+			return nil, err
+		}
+	}
+	argsBytes, err := json.Marshal(resolvedArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.dispatchRecover(sessionData, target, exportID, method, argsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return s.normalizeResult(sessionData, result)
+}
+
+// dispatch invokes a method on the session's target, recording a warning if
+// the method has been deprecated.
+func (s *RpcSession) dispatch(sessionData *SessionData, exportID int, method string, args json.RawMessage) (interface{}, error) {
+	return s.dispatchOn(sessionData, sessionData.Target, exportID, method, args)
+}
+
+// dispatchOn calls method on target for the call to exportID. Capabilities
+// in the result are exported, and a result that implements Disposer is
+// disposed of when the export is released.
+func (s *RpcSession) dispatchOn(sessionData *SessionData, target RpcTarget, exportID int, method string, args json.RawMessage) (interface{}, error) {
+	// Calls on the same capability start in the order they were pushed
+	s.awaitDispatchTurn(sessionData, exportID)
+	sessionData.markDispatched(exportID)
+
+	if provider, ok := target.(DeprecationProvider); ok {
+		if deprecation, deprecated := provider.MethodDeprecation(method); deprecated {
+			sessionData.addDeprecation(deprecation)
+		}
+	}
+	result, err := s.dispatchCall(sessionData, target, exportID, method, args)
+	if err != nil {
+		return result, err
+	}
+	if _, isCapability := result.(RpcTarget); !isCapability {
+		if disposer, ok := result.(Disposer); ok {
+			sessionData.OnRelease(exportID, disposer.Dispose)
+		}
+	}
+	return sessionData.exportCapabilities(result), nil
+}
+
+// dispatchCall calls method on target with the context of the call to
+// exportID.
+func (s *RpcSession) dispatchCall(sessionData *SessionData, target RpcTarget, exportID int, method string, args json.RawMessage) (interface{}, error) {
+	ctx := sessionData.trackCall(s.callContext(sessionData, exportID), exportID)
+	return s.dispatchWithTimeout(ctx, sessionData, target, method, args)
+}
+
+// dispatchRecover calls dispatch, converting a panic in the handler into
+// ErrInternal so that only the call that panicked is rejected, whether it
+// was pulled or called to resolve a pipeline reference. The panic is
+// reported by panicked.
+//
+// Panics during pipeline resolution were once rejected with the code
+// PanicInResolution and the panic value in the details. They now share the
+// InternalError rejection of pulled calls, whose details name only the
+// method, so that panic values are not sent to clients.
+func (s *RpcSession) dispatchRecover(sessionData *SessionData, target RpcTarget, exportID int, method string, args json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.panicked(sessionData, method, r, debug.Stack())
+			result = nil
+			err = RpcError{
+				Code:    ErrInternal.Code,
+				Message: fmt.Sprintf("method %s failed with an internal error", method),
+				Details: map[string]interface{}{"method": method},
+			}
+		}
+	}()
+	return s.dispatchOn(sessionData, target, exportID, method, args)
 }
 
 func (s *RpcSession) traversePath(result interface{}, path []interface{}) (interface{}, error) {
@@ -310,7 +1222,8 @@ func (s *RpcSession) traversePath(result interface{}, path []interface{}) (inter
 		switch k := key.(type) {
 		case string:
 			if obj, ok := current.(map[string]interface{}); ok {
-				current = obj[k]
+				// Results are sanitized, so paths into them must be too
+				current = obj[s.opts.KeySanitizer.Key(k)]
 			} else {
 				return nil, fmt.Errorf("cannot traverse string key on non-object")
 			}
@@ -331,17 +1244,38 @@ func (s *RpcSession) traversePath(result interface{}, path []interface{}) (inter
 	return current, nil
 }
 
+// handlePull answers a pull with the export's resolve or reject frame, or
+// with no frame if the export was already resolved proactively. Pulls of
+// computed results take no lock, so that concurrent pulls do not contend.
 func (s *RpcSession) handlePull(sessionData *SessionData, exportID int) ([]interface{}, error) {
-	sessionData.mu.RLock()
-	// Check if we already have a cached result
-	if result, exists := sessionData.PendingResults[exportID]; exists {
-		sessionData.mu.RUnlock()
-
-		// Clean up
-		sessionData.mu.Lock()
-		delete(sessionData.PendingResults, exportID)
-		sessionData.mu.Unlock()
+	if abort := sessionData.Abort(); abort != nil {
+		return s.createRpcErrorResponse(exportID, "Aborted", abort.Err), nil
+	}
+	if sessionData.pushedLater(exportID) {
+		return s.createRpcErrorResponse(exportID, ErrPullBeforePush.Code, RpcError{
+			Code:    ErrPullBeforePush.Code,
+			Message: fmt.Sprintf("pull of export %d precedes its push", exportID),
+		}), nil
+	}
+	if sessionData.resolvedProactively(exportID) {
+		return nil, nil
+	}
+	if repeated := sessionData.markPulled(exportID); repeated {
+		// The client takes another reference to each capability in a
+		// result that is sent again
+		if result, exists := sessionData.loadResult(exportID); exists {
+			sessionData.addCapabilityRefs(result)
+		}
+	}
+	return s.pullExport(sessionData, exportID)
+}
 
+// pullExport evaluates an export and returns its resolve or reject frame.
+func (s *RpcSession) pullExport(sessionData *SessionData, exportID int) ([]interface{}, error) {
+	// Fast path: serve an already-computed result without locking
+	// Results are kept until the export is released, so pulling it again
+	// returns the same value
+	if result, exists := sessionData.loadResult(exportID); exists {
 		// Check if the stored result is an error
 		if errArray, ok := result.([]interface{}); ok && len(errArray) >= 2 {
 			if errType, ok := errArray[0].(string); ok && errType == "error" {
@@ -351,106 +1285,245 @@ func (s *RpcSession) handlePull(sessionData *SessionData, exportID int) ([]inter
 		}
 
 		// Send as resolve
-		// Arrays need to be wrapped in another array to escape them per Cap'n Web protocol
-		if _, ok := result.([]interface{}); ok {
-			return []interface{}{"resolve", exportID, []interface{}{result}}, nil
-		}
-		return []interface{}{"resolve", exportID, result}, nil
+		return resolveFrame(exportID, result), nil
+	}
+
+	sessionData.mu.RLock()
+	// Check if this export is an active subscription
+	if ch, exists := sessionData.Subscriptions[exportID]; exists {
+		sessionData.mu.RUnlock()
+		return s.pullSubscription(sessionData, exportID, ch), nil
 	}
 
 	// Check if we have a pending operation to execute
 	if operation, exists := sessionData.PendingOperations[exportID]; exists {
 		sessionData.mu.RUnlock()
 
-		// Resolve any pipeline references in the arguments
+		// Failed operations stay pending, so pulling them again reports the
+		// same error
+		if operation.Err != nil {
+			return s.createRpcErrorResponse(exportID, "ArgumentError", operation.Err), nil
+		}
+
+		if err := checkCycles(sessionData, exportID, operation); err != nil {
+			return s.rejectOperation(sessionData, exportID, "PipelineError", err), nil
+		}
+
+		if operation.Remap != nil {
+			return s.pullRemap(sessionData, exportID, operation.Remap), nil
+		}
+
+		if operation.Property {
+			return s.pullProperty(sessionData, exportID, operation), nil
+		}
+
+		if operation.Value != nil {
+			return s.pullValue(sessionData, exportID, operation), nil
+		}
+
+		// Resolve any pipeline references in the arguments; literal
+		// arguments are handed to the method as they were pushed
 		var args interface{}
-		if err := json.Unmarshal(operation.Args, &args); err != nil {
-			return s.createErrorResponse(exportID, "ArgumentError", err.Error()), nil
+		if !operation.literalArgs {
+			var err error
+			if args, err = decodeJSON(operation.Args); err != nil {
+				return s.rejectOperation(sessionData, exportID, "ArgumentError", err), nil
+			}
 		}
 
-		resolvedArgs, err := s.resolvePipelineReferences(sessionData, args)
-		if err != nil {
-			return s.createErrorResponse(exportID, "PipelineError", err.Error()), nil
+		// Dispatch independent dependencies concurrently before resolving
+		if err := s.prefetchDependencies(sessionData, []interface{}{args, operation.importRef(exportID)}); err != nil {
+			return s.createRpcErrorResponse(exportID, "PipelineError", err), nil
 		}
 
-		resolvedArgsBytes, err := json.Marshal(resolvedArgs)
+		target, method, err := s.operationTarget(sessionData, exportID, operation)
 		if err != nil {
-			return s.createErrorResponse(exportID, "SerializationError", err.Error()), nil
+			return s.createRpcErrorResponse(exportID, "PipelineError", err), nil
+		}
+
+		resolvedArgsBytes := operation.Args
+		if !operation.literalArgs {
+			resolvedArgs, err := s.evaluator(sessionData, exportID).EvaluateArguments(args)
+			if err != nil {
+				return s.createRpcErrorResponse(exportID, "PipelineError", err), nil
+			}
+			if resolvedArgsBytes, err = json.Marshal(resolvedArgs); err != nil {
+				return s.rejectOperation(sessionData, exportID, "SerializationError", err), nil
+			}
 		}
 
 		// Dispatch the method call to the target
-		result, err := sessionData.Target.Dispatch(operation.Method, resolvedArgsBytes)
+		result, err := s.dispatchRecover(sessionData, target, exportID, method, resolvedArgsBytes)
+		if err != nil {
+			return s.rejectOperation(sessionData, exportID, "MethodError", err), nil
+		}
 
 		// Clean up the operation
 		sessionData.mu.Lock()
 		delete(sessionData.PendingOperations, exportID)
 		sessionData.mu.Unlock()
 
-		if err != nil {
-			return s.createErrorResponse(exportID, "MethodError", err.Error()), nil
+		// Streaming results are delivered as a sequence of frames; v1
+		// clients receive the chunks as a single array instead
+		if stream, ok := result.(*StreamResult); ok {
+			if !sessionData.isLegacyProtocol() {
+				return s.pullStream(sessionData, exportID, stream), nil
+			}
+			result = stream.collect()
+		}
+
+		// Subscriptions stay open across pulls instead of being cached;
+		// sessions that cannot deliver frames outside a response, such as
+		// HTTP batches, receive the values as a single array instead
+		if ch, ok := subscriptionChannel(result); ok {
+			if !sessionData.canSendFrames() {
+				result = drainSubscription(sessionData.Context(), ch)
+			} else {
+				sessionData.mu.Lock()
+				sessionData.Subscriptions[exportID] = ch
+				sessionData.mu.Unlock()
+				return s.pullSubscription(sessionData, exportID, ch), nil
+			}
 		}
 
 		// Normalize the result to ensure it's JSON-compatible for pipeline traversal
-		normalizedResult, err := s.normalizeResult(result)
+		normalizedResult, err := s.normalizeResult(sessionData, result)
 		if err != nil {
-			return s.createErrorResponse(exportID, "SerializationError", err.Error()), nil
+			return s.rejectOperation(sessionData, exportID, "SerializationError", err), nil
 		}
 
 		// Store the normalized result for future reference
-		sessionData.mu.Lock()
-		sessionData.PendingResults[exportID] = normalizedResult
-		sessionData.mu.Unlock()
+		sessionData.storeResult(exportID, normalizedResult)
 
 		// Send as resolve
-		if _, ok := normalizedResult.([]interface{}); ok {
-			return []interface{}{"resolve", exportID, []interface{}{normalizedResult}}, nil
-		}
-		return []interface{}{"resolve", exportID, normalizedResult}, nil
+		return resolveFrame(exportID, normalizedResult), nil
 	}
 	sessionData.mu.RUnlock()
 
+	if err := sessionData.rejectedPush(exportID); err != nil {
+		return s.createRpcErrorResponse(exportID, "LimitExceeded", err), nil
+	}
+
 	// Export ID not found - send an error
 	return []interface{}{"reject", exportID, []interface{}{
 		"error", "ExportNotFound", "Export ID not found",
 	}}, nil
 }
 
+// rejectOperation replaces the pending operation of exportID with the error
+// it failed with, so that pulling the export again reports the same error
+// until the export is released, and returns the reject frame.
+func (s *RpcSession) rejectOperation(sessionData *SessionData, exportID int, defaultType string, err error) []interface{} {
+	rejection := asRejection(err, defaultType)
+	sessionData.mu.Lock()
+	if _, exists := sessionData.exports[exportID]; exists {
+		sessionData.PendingOperations[exportID] = Operation{Err: rejection}
+	} else {
+		delete(sessionData.PendingOperations, exportID)
+	}
+	sessionData.mu.Unlock()
+	return s.createRpcErrorResponse(exportID, defaultType, rejection)
+}
+
+// pullSubscription waits for the next value of a subscription and returns it
+// as a resolve, or returns a complete message once the channel is closed.
+func (s *RpcSession) pullSubscription(sessionData *SessionData, exportID int, ch <-chan interface{}) []interface{} {
+	value, ok := <-ch
+	if !ok {
+		sessionData.mu.Lock()
+		delete(sessionData.Subscriptions, exportID)
+		sessionData.mu.Unlock()
+		return []interface{}{"complete", exportID}
+	}
+
+	normalizedValue, err := s.normalizeResult(sessionData, value)
+	if err != nil {
+		return s.createErrorResponse(exportID, "SerializationError", err.Error())
+	}
+	return resolveFrame(exportID, normalizedValue)
+}
+
+// resolveFrame returns the resolve frame for a normalized result, with its
+// arrays escaped.
+func resolveFrame(exportID int, result interface{}) []interface{} {
+	return []interface{}{"resolve", exportID, wireValue(result)}
+}
+
 func (s *RpcSession) createErrorResponse(exportID int, errorType, message string) []interface{} {
-	return []interface{}{"reject", exportID, []interface{}{
-		"error", errorType, message,
-	}}
+	return []interface{}{"reject", exportID, errorExpression(errorType, message)}
+}
+
+// createRpcErrorResponse builds a reject for err. RpcErrors are reported
+// under their own code; anything else is reported as defaultType.
+func (s *RpcSession) createRpcErrorResponse(exportID int, defaultType string, err error) []interface{} {
+	return []interface{}{"reject", exportID, s.devaluator(nil).DevaluateError(err, defaultType)}
+}
+
+// releaseMessage cancels the calls running for an export that message, if
+// it is a release, is about to free. It is called as messages are read off
+// a connection, since the message loop that handles the release may be
+// held up by those calls; the loop still handles the release itself.
+func (s *RpcSession) releaseMessage(sessionData *SessionData, message []byte) {
+	if !bytes.HasPrefix(bytes.TrimSpace(message), []byte(`["release"`)) {
+		return
+	}
+	var msg []interface{}
+	if err := json.Unmarshal(message, &msg); err != nil || len(msg) < 3 {
+		return
+	}
+	exportID, ok := msg[1].(float64)
+	if !ok {
+		return
+	}
+	if refcount, ok := msg[2].(float64); ok && refcount > 0 && int(exportID) != MainExportID {
+		sessionData.cancelReleasedCalls(int(exportID), int(refcount))
+	}
 }
 
 func (s *RpcSession) handleRelease(sessionData *SessionData, exportID, refcount int) {
-	log.Printf("Released export %d with refcount %d", exportID, refcount)
+	s.logf("Released export %d with refcount %d", exportID, refcount)
+	// The main interface is never released
+	if refcount <= 0 || exportID == MainExportID {
+		return
+	}
+	sessionData.releaseExport(exportID, refcount)
 }
 
 func (s *RpcSession) handleAbort(sessionData *SessionData, errorData interface{}) {
 	errorBytes, _ := json.Marshal(errorData)
-	log.Printf("Abort received: %s", string(errorBytes))
+	s.logf("Abort received: %s", string(errorBytes))
+	s.abortSession(sessionData, newAbortInfo(errorData))
 }
 
-// normalizeResult ensures that Go structs are converted to map[string]interface{}
-// for proper pipeline traversal. This is necessary because Go structs need to be
-// JSON-marshaled and then unmarshaled to become navigable objects.
-func (s *RpcSession) normalizeResult(result interface{}) (interface{}, error) {
-	// If it's already a map[string]interface{} or basic type, return as-is
-	switch result.(type) {
-	case map[string]interface{}, []interface{}, string, float64, bool, nil:
-		return result, nil
-	}
+// normalizeResult converts a result to the normalized form in which it is
+// kept for pipeline traversal; see Devaluator.Normalize.
+func (s *RpcSession) normalizeResult(sessionData *SessionData, result interface{}) (interface{}, error) {
+	return s.devaluator(sessionData).Normalize(result)
+}
 
-	// For other types (like structs), marshal to JSON and unmarshal to interface{}
-	// This converts structs to map[string]interface{} which can be traversed
-	jsonBytes, err := json.Marshal(result)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal result: %w", err)
+// devaluator returns the Devaluator for the session's results. The
+// capabilities CapnWebMarshalers return are exported in sessionData; they
+// cannot be sent if it is nil.
+func (s *RpcSession) devaluator(sessionData *SessionData) Devaluator {
+	d := Devaluator{Codec: s.opts.Codec, Keys: s.opts.KeySanitizer, Escapes: s.opts.Escapes}
+	if sessionData != nil {
+		d.Export = sessionData.exportCapabilities
 	}
+	return d
+}
 
-	var normalized interface{}
-	if err := json.Unmarshal(jsonBytes, &normalized); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal result: %w", err)
+// evaluator returns the Evaluator for the expressions of the push exportID
+// sent in sessionData, whose pipeline references are resolved against the
+// session's exports. The calls they make are made for exportID.
+func (s *RpcSession) evaluator(sessionData *SessionData, exportID int) Evaluator {
+	return Evaluator{
+		Keys:    s.opts.KeySanitizer,
+		Escapes: s.opts.Escapes,
+		Pipeline: func(importID int, path []interface{}) (interface{}, error) {
+			return s.pipelineValue(sessionData, importID, path)
+		},
+		Call: func(importID int, path []interface{}, args interface{}) (interface{}, error) {
+			return s.pipelineCall(sessionData, exportID, importID, path, args)
+		},
 	}
-
-	return normalized, nil
 }
@@ -0,0 +1,247 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pullConcurrency is the number of goroutines BenchmarkPullResolved pulls
+// with.
+const pullConcurrency = 100
+
+// BenchmarkPullResolved measures pulls of an export whose result has already
+// been computed, made by pullConcurrency goroutines at once, and reports the
+// 99th percentile latency of a pull as p99-ns. The lock-free sub-benchmark
+// pulls through handlePull; mutex serves the same pulls from PendingResults
+// under the session's locks, as pulls did before results were mirrored in a
+// sync.Map and pull state kept in atomic flags, for comparison.
+func BenchmarkPullResolved(b *testing.B) {
+	pulls := []struct {
+		name string
+		pull func(session *RpcSession, sessionData *SessionData, exportID int) ([]interface{}, error)
+	}{
+		{"lock-free", (*RpcSession).handlePull},
+		{"mutex", pullResolvedLocked},
+	}
+	for _, p := range pulls {
+		b.Run(p.name, func(b *testing.B) {
+			target := benchTarget()
+			session := newTestSession(target)
+			sessionData := NewSessionData(target)
+			if _, err := session.HandleMessageFrames(sessionData, `["push",["pipeline",0,["hello"],["World"]]]`); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := session.handlePull(sessionData, 1); err != nil {
+				b.Fatal(err)
+			}
+			reportPullLatency(b, func() error {
+				_, err := p.pull(session, sessionData, 1)
+				return err
+			})
+		})
+	}
+}
+
+// pullResolvedLocked answers a pull of a computed result as handlePull did
+// with every check made under the session's locks: the pull is recorded
+// under the write lock and the result read under the read lock.
+func pullResolvedLocked(session *RpcSession, sessionData *SessionData, exportID int) ([]interface{}, error) {
+	sessionData.mu.Lock()
+	if entry, exists := sessionData.exports[exportID]; exists {
+		entry.pulled.Store(true)
+	}
+	sessionData.mu.Unlock()
+
+	sessionData.mu.RLock()
+	result, exists := sessionData.PendingResults[exportID]
+	sessionData.mu.RUnlock()
+	if !exists {
+		return session.pullExport(sessionData, exportID)
+	}
+	return resolveFrame(exportID, result), nil
+}
+
+// reportPullLatency calls pull from pullConcurrency goroutines at once and
+// reports the 99th percentile latency of a call as p99-ns.
+func reportPullLatency(b *testing.B, pull func() error) {
+	var mu sync.Mutex
+	var latencies []time.Duration
+	b.SetParallelism((pullConcurrency + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var local []time.Duration
+		for pb.Next() {
+			start := time.Now()
+			if err := pull(); err != nil {
+				b.Error(err)
+				return
+			}
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+	}
+}
+
+// benchRecord is a typical handler result: a struct holding escape types,
+// nested objects and arrays.
+type benchRecord struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Created  time.Time         `json:"created"`
+	Balance  *big.Int          `json:"balance"`
+	Tags     []string          `json:"tags"`
+	Scores   []float64         `json:"scores"`
+	Metadata map[string]string `json:"metadata"`
+	Children []benchRecord     `json:"children"`
+}
+
+func newBenchRecord(depth int) benchRecord {
+	record := benchRecord{
+		ID:       "u_1",
+		Name:     "Ada",
+		Created:  time.Unix(1700000000, 0),
+		Balance:  new(big.Int).Lsh(big.NewInt(1), 70),
+		Tags:     []string{"admin", "beta", "undefined"},
+		Scores:   []float64{1, 2.5, 3},
+		Metadata: map[string]string{"region": "eu", "$plan": "pro"},
+	}
+	if depth > 0 {
+		for i := 0; i < 3; i++ {
+			record.Children = append(record.Children, newBenchRecord(depth-1))
+		}
+	}
+	return record
+}
+
+// BenchmarkDevaluate measures converting handler results to wire
+// expressions.
+func BenchmarkDevaluate(b *testing.B) {
+	values := map[string]interface{}{
+		"string": "Hello, World!",
+		"map": map[string]interface{}{
+			"id": "u_1", "tags": []interface{}{"a", "b"}, "count": 3,
+		},
+		"struct": newBenchRecord(2),
+	}
+	for _, name := range []string{"string", "map", "struct"} {
+		value := values[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := (Devaluator{}).Devaluate(value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEvaluate measures converting client expressions to values.
+func BenchmarkEvaluate(b *testing.B) {
+	record, err := Devaluator{}.Devaluate(newBenchRecord(2))
+	if err != nil {
+		b.Fatal(err)
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		b.Fatal(err)
+	}
+	expressions := map[string]string{
+		"string": `"Hello, World!"`,
+		"args":   `[["date",1700000000000],[[1,2,3]],{"id":"u_1"}]`,
+		"struct": string(encoded),
+	}
+	for _, name := range []string{"string", "args", "struct"} {
+		var expr interface{}
+		if err := json.Unmarshal([]byte(expressions[name]), &expr); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := (Evaluator{}).Evaluate(expr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// bulkMethods returns n method handlers named method0, method1, ...
+func bulkMethods(n int) map[string]func(json.RawMessage) (interface{}, error) {
+	methods := make(map[string]func(json.RawMessage) (interface{}, error), n)
+	for i := 0; i < n; i++ {
+		methods[fmt.Sprintf("method%d", i)] = constantHandler(i)
+	}
+	return methods
+}
+
+// registerFunc registers methods on target.
+type registerFunc func(target *BaseRpcTarget, methods map[string]func(json.RawMessage) (interface{}, error))
+
+// bulkRegister registers methods with one BulkRegister call.
+func bulkRegister(target *BaseRpcTarget, methods map[string]func(json.RawMessage) (interface{}, error)) {
+	target.BulkRegister(methods)
+}
+
+// registerEach registers methods with a Method call each.
+func registerEach(target *BaseRpcTarget, methods map[string]func(json.RawMessage) (interface{}, error)) {
+	for name, handler := range methods {
+		target.Method(name, handler)
+	}
+}
+
+// BenchmarkRegister registers 100 methods on a target that other
+// goroutines are dispatching calls to, with one BulkRegister call and with
+// a Method call each.
+func BenchmarkRegister(b *testing.B) {
+	b.Run("BulkRegister", benchmarkRegister(bulkRegister))
+	b.Run("Method", benchmarkRegister(registerEach))
+}
+
+// benchmarkRegister returns a benchmark of register.
+func benchmarkRegister(register registerFunc) func(b *testing.B) {
+	return func(b *testing.B) {
+		methods := bulkMethods(100)
+		target := NewBaseRpcTarget(WithoutIntrospection())
+		target.Method("ping", constantHandler(true))
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						target.Dispatch("ping", nil)
+					}
+				}
+			}()
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			register(target, methods)
+		}
+		b.StopTimer()
+		close(stop)
+		wg.Wait()
+	}
+}
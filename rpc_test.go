@@ -0,0 +1,981 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTarget returns the target the protocol tests call.
+func testTarget() *BaseRpcTarget {
+	target := NewBaseRpcTarget()
+	target.Method("echo", func(args json.RawMessage) (interface{}, error) {
+		var argArray []interface{}
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, err
+		}
+		return argArray[0], nil
+	})
+	target.Method("user", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"id": "u_1", "tags": []string{"a", "b"}}, nil
+	})
+	target.Method("fail", func(json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("intentional failure")
+	})
+	target.Method("quota", func(json.RawMessage) (interface{}, error) {
+		return nil, RpcError{Code: "QuotaExceeded", Message: "slow down", Details: map[string]interface{}{"limit": 10}}
+	})
+	target.MethodWithContext("await", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var promises []*ClientPromise
+		if err := json.Unmarshal(args, &promises); err != nil || len(promises) != 1 {
+			return nil, fmt.Errorf("await expects a promise")
+		}
+		value, err := promises[0].Await(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(value), nil
+	})
+	return target
+}
+
+// newTestSession returns a session for target that discards its log.
+func newTestSession(target RpcTarget, opts ...RpcSessionOption) *RpcSession {
+	opts = append([]RpcSessionOption{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	return NewRpcSession(target, opts...)
+}
+
+// handleMessages sends messages to a new session of session in order and
+// returns every frame sent back.
+func handleMessages(t *testing.T, session *RpcSession, target RpcTarget, messages ...string) []string {
+	t.Helper()
+	sessionData := NewSessionData(target)
+	var frames []string
+	for _, message := range messages {
+		sent, err := session.HandleMessageFrames(sessionData, message)
+		if err != nil {
+			t.Fatalf("message %s: %v", message, err)
+		}
+		frames = append(frames, sent...)
+	}
+	return frames
+}
+
+func TestSessionMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name: "push and pull",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["hi"]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,"hi"]`},
+		},
+		{
+			name: "arrays are escaped",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,{"id":"u_1","tags":[["a","b"]]}]`},
+		},
+		{
+			name: "pipelined property",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",1,["id"]]]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",2,"u_1"]`},
+		},
+		{
+			name: "call on data",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["push",["pipeline",1,["echo"],["x"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["reject",2,["error","TypeError","the value at path [] of import 1 is not a capability",null,{"importId":1}]]`},
+		},
+		{
+			name: "pipelined call on data",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["push",["pipeline",1,["tags","echo"],["x"]]]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",2]]]]`,
+				`["pull",3]`,
+				`["pull",2]`,
+			},
+			want: []string{
+				`["reject",3,["error","TypeError","the value at path [\"tags\"] of import 1 is not a capability",null,{"importId":1}]]`,
+				`["reject",2,["error","TypeError","the value at path [\"tags\"] of import 1 is not a capability",null,{"importId":1}]]`,
+			},
+		},
+		{
+			name: "call on data after its pull",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",1,["id","echo"],["x"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{
+				`["resolve",1,{"id":"u_1","tags":[["a","b"]]}]`,
+				`["reject",2,["error","TypeError","the value at path [\"id\"] of import 1 is not a capability",null,{"importId":1}]]`,
+			},
+		},
+		{
+			name: "repeated pull",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],[1]]]`,
+				`["pull",1]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,1]`, `["resolve",1,1]`},
+		},
+		{
+			name: "release",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["x"]]]`,
+				`["pull",1]`,
+				`["release",1,1]`,
+				`["pull",1]`,
+			},
+			want: []string{
+				`["resolve",1,"x"]`,
+				`["reject",1,["error","ExportNotFound","Export ID not found"]]`,
+			},
+		},
+		{
+			name:     "pull of unknown export",
+			messages: []string{`["pull",7]`},
+			want:     []string{`["reject",7,["error","ExportNotFound","Export ID not found"]]`},
+		},
+		{
+			name: "handler error",
+			messages: []string{
+				`["push",["pipeline",0,["fail"],[]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","MethodError","intentional failure"]]`},
+		},
+		{
+			name: "RpcError",
+			messages: []string{
+				`["push",["pipeline",0,["quota"],[]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","QuotaExceeded","slow down",null,{"limit":10}]]`},
+		},
+		{
+			name: "unknown method",
+			messages: []string{
+				`["push",["pipeline",0,["missing"],[]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","MethodNotFound","method not found: missing"]]`},
+		},
+		{
+			name: "pipeline on unpushed import",
+			messages: []string{
+				`["push",["pipeline",5,["echo"],[]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","InvalidPush","pipeline on import 5, which has not been pushed"]]`},
+		},
+		{
+			name: "push without expression",
+			messages: []string{
+				`["push"]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","InvalidPush","push requires an expression"]]`},
+		},
+		{
+			name: "client resolves promise",
+			messages: []string{
+				`["push",["pipeline",0,["await"],[["promise",-1]]]]`,
+				`["resolve",-1,"settled"]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,"settled"]`},
+		},
+		{
+			name: "client rejects promise",
+			messages: []string{
+				`["push",["pipeline",0,["await"],[["promise",-1]]]]`,
+				`["reject",-1,["error","RangeError","no"]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","RangeError","no"]]`},
+		},
+		{
+			name: "abort rejects pending calls",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["x"]]]`,
+				`["abort",["error","Error","client gave up"]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","Error","client gave up"]]`},
+		},
+		{
+			name: "abort rejects later calls",
+			messages: []string{
+				`["abort",["error","Error","client gave up"]]`,
+				`["push",["pipeline",0,["echo"],["x"]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","Error","client gave up"]]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			got := handleMessages(t, newTestSession(target), target, tt.messages...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestNestedPipelineCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name: "call on the main target in a pushed object",
+			messages: []string{
+				`["push",{"a":1,"b":["pipeline",0,["user"],[]]}]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,{"a":1,"b":{"id":"u_1","tags":[["a","b"]]}}]`},
+		},
+		{
+			name: "call on the main target in arguments",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],[["pipeline",0,["user"],[]]]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,{"id":"u_1","tags":[["a","b"]]}]`},
+		},
+		{
+			name: "call on the main target without arguments",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],[["pipeline",0,["user"]]]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["resolve",1,{"id":"u_1","tags":[["a","b"]]}]`},
+		},
+		{
+			name: "call with references to earlier pushes",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",0,["echo"],[["pipeline",1,["id"]]]]]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",2,"u_1"]`},
+		},
+		{
+			name: "call on an earlier export",
+			messages: []string{
+				`["push",["pipeline",0,["account"],[]]]`,
+				`["push",{"name":["pipeline",1,["name"],[]]}]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",2,{"name":"alice"}]`},
+		},
+		{
+			name: "call on data",
+			messages: []string{
+				`["push",["pipeline",0,["user"],[]]]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",1,["id","echo"],[]]]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["reject",2,["error","TypeError","the value at path [\"id\"] of import 1 is not a capability",null,{"importId":1}]]`},
+		},
+		{
+			name: "reference to a later push in the arguments of a call",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],[["pipeline",0,["echo"],[["pipeline",2]]]]]]`,
+				`["pull",1]`,
+			},
+			want: []string{`["reject",1,["error","InvalidPush","reference to import 2, which has not been pushed"]]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			target.Method("account", func(json.RawMessage) (interface{}, error) {
+				account := NewBaseRpcTarget()
+				account.Method("name", constantHandler("alice"))
+				return account, nil
+			})
+			got := handleMessages(t, newTestSession(target), target, tt.messages...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestSessionInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		wantErr bool
+	}{
+		{"not JSON", `not json`, true},
+		{"unknown type", `["bogus"]`, false},
+		{"pull without ID", `["pull","x"]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			session := newTestSession(target)
+			sessionData := NewSessionData(target)
+			frames, err := session.HandleMessageFrames(sessionData, tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error: %v", err, tt.wantErr)
+			}
+			if len(frames) != 0 {
+				t.Errorf("frames = %q, want none", frames)
+			}
+
+			// The session goes on after a message it cannot handle
+			frames, err = session.HandleMessageFrames(sessionData, `["push",["pipeline",0,["echo"],[1]]]`)
+			if err == nil {
+				frames, err = session.HandleMessageFrames(sessionData, `["pull",1]`)
+			}
+			if err != nil || len(frames) != 1 || frames[0] != `["resolve",1,1]` {
+				t.Errorf("next call = %q, %v", frames, err)
+			}
+		})
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	const reject = `["reject",%d,["error","InternalError","method explode failed with an internal error",null,{"method":"explode"}]]`
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name: "pulled call",
+			messages: []string{
+				`["push",["pipeline",0,["explode"],[]]]`,
+				`["pull",1]`,
+			},
+			want: []string{fmt.Sprintf(reject, 1)},
+		},
+		{
+			name: "pipelined argument",
+			messages: []string{
+				`["push",["pipeline",0,["explode"],[]]]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",1]]]]`,
+				`["pull",2]`,
+			},
+			want: []string{fmt.Sprintf(reject, 2)},
+		},
+		{
+			name: "session goes on",
+			messages: []string{
+				`["push",["pipeline",0,["explode"],[]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",0,["echo"],["ok"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{fmt.Sprintf(reject, 1), `["resolve",2,"ok"]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			target.Method("explode", func(json.RawMessage) (interface{}, error) {
+				panic("boom")
+			})
+			var logged strings.Builder
+			session := NewRpcSession(target, WithLogger(log.New(&logged, "", 0)))
+			got := handleMessages(t, session, target, tt.messages...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+			if !strings.Contains(logged.String(), "Panic in explode: boom") || !strings.Contains(logged.String(), "goroutine") {
+				t.Errorf("panic and stack not logged: %q", logged.String())
+			}
+		})
+	}
+}
+
+func TestPanicInPipelineResolution(t *testing.T) {
+	target := testTarget()
+	target.Method("explode", func(json.RawMessage) (interface{}, error) {
+		panic("boom")
+	})
+	var method string
+	session := NewRpcSession(target, WithOnPanic(func(_ *SessionData, m string, _ interface{}, _ []byte) {
+		method = m
+	}))
+
+	// The panicking call is only resolved as a property reference nested in
+	// the arguments of the call that is pulled
+	got := handleMessages(t, session, target,
+		`["push",["pipeline",0,["explode"],[]]]`,
+		`["push",["pipeline",0,["echo"],[{"user":["pipeline",1,["id"]]}]]]`,
+		`["pull",2]`,
+	)
+	if len(got) != 1 {
+		t.Fatalf("got %v, want one reject", got)
+	}
+	var frame []interface{}
+	if err := json.Unmarshal([]byte(got[0]), &frame); err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"reject", 2.0, []interface{}{
+		"error", "InternalError", "method explode failed with an internal error", nil,
+		map[string]interface{}{"method": "explode"},
+	}}
+	if !reflect.DeepEqual(frame, want) {
+		t.Errorf("got %s, want %v", got[0], want)
+	}
+	if method != "explode" {
+		t.Errorf("OnPanic called for %q, want explode", method)
+	}
+}
+
+func TestWithOnPanic(t *testing.T) {
+	target := testTarget()
+	target.Method("explode", func(json.RawMessage) (interface{}, error) {
+		panic("boom")
+	})
+	var logged strings.Builder
+	var method string
+	var recovered interface{}
+	var stack []byte
+	session := NewRpcSession(target,
+		WithLogger(log.New(&logged, "", 0)),
+		WithOnPanic(func(sessionData *SessionData, m string, r interface{}, s []byte) {
+			method, recovered, stack = m, r, s
+		}))
+	got := handleMessages(t, session, target, `["push",["pipeline",0,["explode"],[]]]`, `["pull",1]`)
+	if len(got) != 1 || !strings.HasPrefix(got[0], `["reject",1,["error","InternalError"`) {
+		t.Errorf("got %v, want an InternalError reject", got)
+	}
+	if method != "explode" || recovered != "boom" || !strings.Contains(string(stack), "TestWithOnPanic") {
+		t.Errorf("OnPanic called with %q, %v and stack %q", method, recovered, stack)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("panic logged with an OnPanic hook: %q", logged.String())
+	}
+}
+
+func TestKeySanitizer(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []RpcSessionOption
+		messages []string
+		want     []string
+	}{
+		{
+			name: "default escapes results",
+			messages: []string{
+				`["push",["pipeline",0,["record"],[]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",1,["$type"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",1,{"$$type":"app.bsky.feed.post","text":"hi"}]`, `["resolve",2,"app.bsky.feed.post"]`},
+		},
+		{
+			name: "default unescapes arguments",
+			messages: []string{
+				`["push",["pipeline",0,["keys"],[{"$$ref":1,"$type":2,"plain":3}]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",0,["echo"],[{"$$ref":1,"plain":2}]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",1,[["$ref","$type","plain"]]]`, `["resolve",2,{"$$ref":1,"plain":2}]`},
+		},
+		{
+			name: "passing through",
+			opts: []RpcSessionOption{WithKeySanitizer(SanitizeNone)},
+			messages: []string{
+				`["push",["pipeline",0,["keys"],[{"$$ref":1,"$type":2}]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",0,["record"],[]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",1,[["$$ref","$type"]]]`, `["resolve",2,{"$type":"app.bsky.feed.post","text":"hi"}]`},
+		},
+		{
+			name: "renaming",
+			opts: []RpcSessionOption{WithKeySanitizer(SanitizeDollarPrefix)},
+			messages: []string{
+				`["push",["pipeline",0,["echo"],[{"$type":"post"}]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",1,["$type"]]]`,
+				`["pull",2]`,
+			},
+			want: []string{`["resolve",1,{"_type":"post"}]`, `["resolve",2,"post"]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			target.Method("record", constantHandler(map[string]interface{}{"$type": "app.bsky.feed.post", "text": "hi"}))
+			target.Method("keys", func(args json.RawMessage) (interface{}, error) {
+				var objects []map[string]interface{}
+				if err := json.Unmarshal(args, &objects); err != nil || len(objects) != 1 {
+					return nil, fmt.Errorf("keys expects an object")
+				}
+				keys := make([]string, 0, len(objects[0]))
+				for key := range objects[0] {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				return keys, nil
+			})
+			got := handleMessages(t, newTestSession(target, tt.opts...), target, tt.messages...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// waitingTarget is a SessionContextTarget whose "a.wait" and "b.wait"
+// methods block until the context of their call is cancelled. Other methods
+// are those registered.
+type waitingTarget struct {
+	*BaseRpcTarget
+	started chan int
+	causes  chan error
+}
+
+// DispatchSessionContext implements SessionContextTarget.
+func (t waitingTarget) DispatchSessionContext(ctx context.Context, sessionData *SessionData, method string, args json.RawMessage) (interface{}, error) {
+	if method != "a.wait" && method != "b.wait" {
+		return t.DispatchContext(ctx, method, args)
+	}
+	var id []int
+	if err := json.Unmarshal(args, &id); err != nil || len(id) != 1 {
+		return nil, fmt.Errorf("wait expects its export ID")
+	}
+	if info, _ := CallInfoFromContext(ctx); info.ExportID != id[0] {
+		t.causes <- fmt.Errorf("call %d saw the context of call %d", id[0], info.ExportID)
+		return nil, nil
+	}
+	t.started <- id[0]
+	<-ctx.Done()
+	t.causes <- fmt.Errorf("call %d: %w", id[0], context.Cause(ctx))
+	return nil, nil
+}
+
+// DispatchSession implements SessionTarget.
+func (t waitingTarget) DispatchSession(sessionData *SessionData, method string, args json.RawMessage) (interface{}, error) {
+	return t.DispatchSessionContext(sessionData.Context(), sessionData, method, args)
+}
+
+func TestConcurrentCallsHaveTheirOwnContexts(t *testing.T) {
+	target := waitingTarget{BaseRpcTarget: testTarget(), started: make(chan int, 2), causes: make(chan error, 2)}
+	session := newTestSession(target)
+	sessionData := NewSessionData(target)
+	sessionData.SetContext(context.Background())
+	// The pull of export 3 dispatches the calls it depends on concurrently,
+	// as they are made on different callees
+	for _, message := range []string{
+		`["push",["pipeline",0,["a","wait"],[1]]]`,
+		`["push",["pipeline",0,["b","wait"],[2]]]`,
+		`["push",["pipeline",0,["echo"],[[[["pipeline",1],["pipeline",2]]]]]]`,
+	} {
+		if _, err := session.HandleMessageFrames(sessionData, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pulled := make(chan struct{})
+	go func() {
+		defer close(pulled)
+		session.HandleMessageFrames(sessionData, `["pull",3]`)
+	}()
+	defer func() {
+		sessionData.cancelCalls(errors.New("test over"))
+		<-pulled
+	}()
+	for range 2 {
+		select {
+		case <-target.started:
+		case err := <-target.causes:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("calls did not run concurrently")
+		}
+	}
+
+	// Releasing each call's export cancels that call's context alone
+	for _, exportID := range []int{2, 1} {
+		session.releaseMessage(sessionData, []byte(fmt.Sprintf(`["release",%d,1]`, exportID)))
+		select {
+		case err := <-target.causes:
+			want := fmt.Sprintf("call %d: %v", exportID, ErrExportReleased)
+			if !errors.Is(err, ErrExportReleased) || err.Error() != want {
+				t.Errorf("releasing export %d ended %v, want %s", exportID, err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("releasing export %d did not cancel its call", exportID)
+		}
+	}
+}
+
+// constantHandler returns a handler that returns value.
+func constantHandler(value interface{}) func(json.RawMessage) (interface{}, error) {
+	return func(json.RawMessage) (interface{}, error) {
+		return value, nil
+	}
+}
+
+func TestReplaceMethods(t *testing.T) {
+	target := NewBaseRpcTarget()
+	target.Method("keep", constantHandler("old"))
+	target.Method("drop", constantHandler("old"))
+	target.Method("skip", constantHandler("old"))
+
+	removed := target.ReplaceMethods(map[string]func(json.RawMessage) (interface{}, error){
+		"keep":  constantHandler("new"),
+		"added": constantHandler("new"),
+		"skip":  nil,
+	})
+	if want := []string{"drop", "skip"}; fmt.Sprint(removed) != fmt.Sprint(want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	for _, method := range []string{"keep", "added"} {
+		if got, err := target.Dispatch(method, nil); got != "new" || err != nil {
+			t.Errorf("%s: got %v, %v", method, got, err)
+		}
+	}
+	for _, method := range []string{"drop", "skip"} {
+		if _, err := target.Dispatch(method, nil); !errors.Is(err, ErrMethodNotFound) {
+			t.Errorf("%s: got %v, want MethodNotFound", method, err)
+		}
+	}
+	if _, err := target.Dispatch(IntrospectMethod, nil); err != nil {
+		t.Errorf("%s removed: %v", IntrospectMethod, err)
+	}
+}
+
+func TestReplaceMethodsUnderConcurrentDispatch(t *testing.T) {
+	target := NewBaseRpcTarget()
+	generation := func(n int) map[string]ContextHandler {
+		return map[string]ContextHandler{
+			"shared": withoutContext(constantHandler(n)),
+			// Each generation also has a method of its own
+			fmt.Sprintf("only%d", n): withoutContext(constantHandler(n)),
+		}
+	}
+	target.ReplaceMethodsWithContext(generation(0))
+
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var callers sync.WaitGroup
+	for range 4 {
+		callers.Add(1)
+		go func() {
+			defer callers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// shared is in every generation, so the swap never
+				// leaves a moment without it
+				result, err := target.Dispatch("shared", nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				n := result.(int)
+				if _, err := target.Dispatch(fmt.Sprintf("only%d", n-1), nil); err == nil {
+					errs <- fmt.Errorf("generation %d was called after generation %d replaced it", n-1, n)
+					return
+				}
+			}
+		}()
+	}
+	for n := 1; n <= 200; n++ {
+		if removed := target.ReplaceMethodsWithContext(generation(n)); fmt.Sprint(removed) != fmt.Sprintf("[only%d]", n-1) {
+			t.Fatalf("generation %d removed %v", n, removed)
+		}
+	}
+	close(stop)
+	callers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReplaceMethodsLetsCallsInFlightFinish(t *testing.T) {
+	target := NewBaseRpcTarget()
+	entered, release := make(chan struct{}), make(chan struct{})
+	target.Method("slow", func(json.RawMessage) (interface{}, error) {
+		close(entered)
+		<-release
+		return "old", nil
+	})
+
+	done := make(chan interface{})
+	go func() {
+		result, _ := target.Dispatch("slow", nil)
+		done <- result
+	}()
+	<-entered
+	target.ReplaceMethods(map[string]func(json.RawMessage) (interface{}, error){"slow": constantHandler("new")})
+	close(release)
+
+	if got := <-done; got != "old" {
+		t.Errorf("call in flight returned %v, want old", got)
+	}
+	if got, _ := target.Dispatch("slow", nil); got != "new" {
+		t.Errorf("call after the swap returned %v, want new", got)
+	}
+}
+
+func TestExpandRefShorthand(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"shorthand", `{"$ref":[1,"id"]}`, `["pipeline",1,["id"]]`},
+		{"whole result", `{"$ref":[2]}`, `["pipeline",2,[]]`},
+		{"index", `{"$ref":[1,"tags",0]}`, `["pipeline",1,["tags",0]]`},
+		{"nested", `[{"user":{"$ref":[1,"id"]}}]`, `[{"user":["pipeline",1,["id"]]}]`},
+		{"escaped literal", `{"$$ref":[[1,"id"]]}`, `{"$$ref":[[1,"id"]]}`},
+		{"other keys", `{"$ref":[1,"id"],"x":1}`, `{"$ref":[1,"id"],"x":1}`},
+		{"non-numeric import", `{"$ref":["x","id"]}`, `{"$ref":["x","id"]}`},
+		{"empty", `{"$ref":[]}`, `{"$ref":[]}`},
+		{"not an array", `{"$ref":"1"}`, `{"$ref":"1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := decodeJSON([]byte(tt.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(expandRefShorthand(value))
+			if string(got) != tt.want {
+				t.Errorf("expandRefShorthand(%s) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefShorthand(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     string
+	}{
+		{
+			name: "field",
+			messages: []string{
+				`["push",["pipeline",0,["profile"],[]]]`,
+				`["push",["pipeline",0,["args"],[{"$ref":[1,"id"]}]]]`,
+				`["pull",2]`,
+			},
+			want: `["resolve",2,"[\"u_1\"]"]`,
+		},
+		{
+			name: "escaped literal",
+			messages: []string{
+				`["push",["pipeline",0,["profile"],[]]]`,
+				`["push",["pipeline",0,["args"],[{"$$ref":[[1,"id"]]}]]]`,
+				`["pull",2]`,
+			},
+			want: `["resolve",2,"[{\"$ref\":[1,\"id\"]}]"]`,
+		},
+		{
+			name: "reference to an unpushed import",
+			messages: []string{
+				`["push",["pipeline",0,["args"],[{"$ref":[7,"id"]}]]]`,
+				`["pull",1]`,
+			},
+			want: `["reject",1,["error","InvalidPush","reference to import 7, which has not been pushed"]]`,
+		},
+		{
+			name: "missing field",
+			messages: []string{
+				`["push",["pipeline",0,["profile"],[]]]`,
+				`["push",["pipeline",0,["args"],[{"$ref":[1,"email"]}]]]`,
+				`["pull",2]`,
+			},
+			want: `["resolve",2,"[null]"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget()
+			target.Method("profile", constantHandler(map[string]interface{}{"id": "u_1", "name": "Ada"}))
+			target.Method("args", func(args json.RawMessage) (interface{}, error) {
+				return string(args), nil
+			})
+			got := handleMessages(t, newTestSession(target), target, tt.messages...)
+			if strings.Join(got, "\n") != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	var dispatched atomic.Int32
+	target := testTarget()
+	target.Method("count", func(args json.RawMessage) (interface{}, error) {
+		dispatched.Add(1)
+		return len(args), nil
+	})
+	session := newTestSession(target, WithMaxMessageBytes(1024))
+	sessionData := NewSessionData(target)
+
+	large := `["push",["pipeline",0,["count"],["` + strings.Repeat("x", 2048) + `"]]]`
+	frames, err := session.HandleMessageFrames(sessionData, large)
+	if err == nil || !strings.Contains(err.Error(), "message too large: 2086 bytes exceeds limit of 1024") {
+		t.Errorf("2 KB message: frames %v, error %v; want message too large", frames, err)
+	}
+
+	// The message was refused without being read, so nothing was pushed
+	got, err := session.HandleMessageFrames(sessionData, `["pull",1]`)
+	if want := `["reject",1,["error","ExportNotFound","Export ID not found"]]`; err != nil || strings.Join(got, "\n") != want {
+		t.Errorf("pull after the refused message: %v, want %s", got, want)
+	}
+	if n := dispatched.Load(); n != 0 {
+		t.Errorf("dispatched %d calls for a refused message, want 0", n)
+	}
+
+	small := `["push",["pipeline",0,["count"],["` + strings.Repeat("x", 512) + `"]]]`
+	got = handleMessages(t, session, target, small, `["pull",1]`)
+	if want := `["resolve",1,516]`; strings.Join(got, "\n") != want {
+		t.Errorf("message under the limit: %v, want %s", got, want)
+	}
+}
+
+func TestBulkRegister(t *testing.T) {
+	target := NewBaseRpcTarget()
+	target.Method("method7", constantHandler("old"), WithDescription("replaced"))
+	target.Method("kept", constantHandler("kept"))
+
+	overwritten := target.BulkRegister(bulkMethods(100))
+	if got := strings.Join(overwritten, ","); got != "method7" {
+		t.Errorf("overwritten = %v, want [method7]", overwritten)
+	}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("method%d", i)
+		result, err := target.Dispatch(name, json.RawMessage(`[]`))
+		if err != nil || result != i {
+			t.Errorf("%s = %v, %v; want %d", name, result, err, i)
+		}
+	}
+	if result, err := target.Dispatch("kept", nil); err != nil || result != "kept" {
+		t.Errorf("kept = %v, %v; want the method registered before", result, err)
+	}
+
+	// The replaced method forgets its metadata, as it would with Method
+	if _, exists := target.MethodMetadata("method7"); exists {
+		t.Error("method7 kept the metadata of the handler it replaced")
+	}
+
+	if overwritten := target.BulkRegister(bulkMethods(3)); strings.Join(overwritten, ",") != "method0,method1,method2" {
+		t.Errorf("overwritten = %v, want sorted names", overwritten)
+	}
+	if overwritten := target.BulkRegister(nil); overwritten != nil {
+		t.Errorf("BulkRegister(nil) = %v", overwritten)
+	}
+}
+
+func TestBulkRegisterFasterThanMethod(t *testing.T) {
+	if testing.Short() {
+		t.Skip("benchmarks registration")
+	}
+	bulk := testing.Benchmark(benchmarkRegister(bulkRegister))
+	each := testing.Benchmark(benchmarkRegister(registerEach))
+	t.Logf("BulkRegister: %s; Method: %s", bulk, each)
+	if bulk.NsPerOp() >= each.NsPerOp() {
+		t.Errorf("BulkRegister took %d ns for 100 methods, Method %d ns", bulk.NsPerOp(), each.NsPerOp())
+	}
+}
+
+func TestSubscribeMethod(t *testing.T) {
+	newTarget := func() *BaseRpcTarget {
+		target := testTarget()
+		target.SubscribeMethod("count", func(args json.RawMessage) (<-chan interface{}, error) {
+			var n []int
+			if err := json.Unmarshal(args, &n); err != nil || len(n) != 1 {
+				return nil, fmt.Errorf("count expects a number")
+			}
+			ch := make(chan interface{}, n[0])
+			for i := 1; i <= n[0]; i++ {
+				ch <- i
+			}
+			close(ch)
+			return ch, nil
+		})
+		return target
+	}
+	messages := []string{
+		`["push",["pipeline",0,["count"],[3]]]`,
+		`["pull",1]`, `["pull",1]`, `["pull",1]`, `["pull",1]`,
+	}
+
+	t.Run("streaming", func(t *testing.T) {
+		target := newTarget()
+		session := newTestSession(target)
+		sessionData := NewSessionData(target)
+		sessionData.SetFrameSender(func([]byte) error { return nil })
+		var got []string
+		for _, message := range messages {
+			frames, err := session.HandleMessageFrames(sessionData, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, frames...)
+		}
+		want := []string{`["resolve",1,1]`, `["resolve",1,2]`, `["resolve",1,3]`, `["complete",1]`}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("got  %v\nwant %v", got, want)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		// Without a way to send frames later, the values arrive together
+		target := newTarget()
+		got := handleMessages(t, newTestSession(target), target, messages[:2]...)
+		if want := `["resolve",1,[[1,2,3]]]`; strings.Join(got, "\n") != want {
+			t.Errorf("got  %v\nwant %s", got, want)
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		target := newTarget()
+		got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["count"],["x"]]]`, `["pull",1]`)
+		if want := `["reject",1,["error","MethodError","count expects a number"]]`; strings.Join(got, "\n") != want {
+			t.Errorf("got  %v\nwant %s", got, want)
+		}
+	})
+}
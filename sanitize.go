@@ -0,0 +1,135 @@
+package gocapnweb
+
+import "strings"
+
+// SanitizeKeyPolicy rewrites the object keys of method results before they
+// are sent or traversed by pipeline references. Keys beginning with "$" can
+// be mistaken for the protocol's special values by clients, so results from
+// sources such as the AT Protocol, whose records carry "$type", usually need
+// them renamed.
+//
+// A policy may also be reversible, restoring the original keys of the
+// objects in call arguments.
+type SanitizeKeyPolicy struct {
+	transform func(key string) string
+	restore   func(key string) string
+}
+
+// Key sanitization policies.
+var (
+	// SanitizeNone leaves keys unchanged, for clients that neither escape
+	// nor unescape keys, such as the official JavaScript client.
+	SanitizeNone = SanitizeKeyPolicy{}
+
+	// SanitizeDollarPrefix replaces a leading "$" with "_", so "$type"
+	// becomes "_type".
+	SanitizeDollarPrefix = SanitizeKeyPolicy{transform: replaceDollarPrefix}
+
+	// EscapeDollarPrefix escapes keys beginning with "$" by doubling the
+	// "$", so "$type" is sent as "$$type", and unescapes "$$"-prefixed
+	// keys in call arguments, so a client sends a literal "$ref" key as
+	// "$$ref" without it being read as a reference. It is the default.
+	// Clients must unescape the keys of results themselves, which the
+	// official JavaScript client does not do.
+	EscapeDollarPrefix = SanitizeKeyPolicy{transform: escapeDollarPrefix, restore: unescapeDollarPrefix}
+)
+
+// SanitizeCustom returns a policy that rewrites every key with transform.
+func SanitizeCustom(transform func(key string) string) SanitizeKeyPolicy {
+	return SanitizeKeyPolicy{transform: transform}
+}
+
+// WithKeySanitizer sets how the keys of method results are rewritten.
+func WithKeySanitizer(policy SanitizeKeyPolicy) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.KeySanitizer = policy
+	}
+}
+
+// Key returns key as the policy rewrites it.
+func (p SanitizeKeyPolicy) Key(key string) string {
+	if p.transform == nil {
+		return key
+	}
+	return p.transform(key)
+}
+
+// Apply returns value with the keys of every object in it, at any depth,
+// rewritten. value is expected to be normalized JSON; it is not modified.
+func (p SanitizeKeyPolicy) Apply(value interface{}) interface{} {
+	if p.transform == nil {
+		return value
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		sanitized := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			sanitized[p.transform(key)] = p.Apply(val)
+		}
+		return sanitized
+	case []interface{}:
+		sanitized := make([]interface{}, len(v))
+		for i, elem := range v {
+			sanitized[i] = p.Apply(elem)
+		}
+		return sanitized
+	default:
+		return value
+	}
+}
+
+// Restore returns value, the arguments of a call, with the keys of every
+// object in it restored by a reversible policy. Other policies return value
+// unchanged. value is expected to be normalized JSON; it is not modified.
+func (p SanitizeKeyPolicy) Restore(value interface{}) interface{} {
+	if p.restore == nil {
+		return value
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		restored := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			restored[p.restore(key)] = p.Restore(val)
+		}
+		return restored
+	case []interface{}:
+		restored := make([]interface{}, len(v))
+		for i, elem := range v {
+			restored[i] = p.Restore(elem)
+		}
+		return restored
+	default:
+		return value
+	}
+}
+
+// restoreKey returns key as a reversible policy restores it.
+func (p SanitizeKeyPolicy) restoreKey(key string) string {
+	if p.restore == nil {
+		return key
+	}
+	return p.restore(key)
+}
+
+func escapeDollarPrefix(key string) string {
+	if strings.HasPrefix(key, "$") {
+		return "$" + key
+	}
+	return key
+}
+
+func unescapeDollarPrefix(key string) string {
+	if strings.HasPrefix(key, "$$") {
+		return key[1:]
+	}
+	return key
+}
+
+func replaceDollarPrefix(key string) string {
+	if rest, ok := strings.CutPrefix(key, "$"); ok {
+		return "_" + rest
+	}
+	return key
+}
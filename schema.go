@@ -0,0 +1,222 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage{})
+	byteSliceType = reflect.TypeOf([]byte{})
+)
+
+// InferSchema produces a JSON Schema describing the JSON encoding of values
+// of type t. Struct fields are named after their json tags; fields tagged
+// omitempty are optional and all others are required. Pointer fields are
+// nullable.
+func InferSchema(t reflect.Type) ([]byte, error) {
+	if t == nil {
+		return nil, fmt.Errorf("cannot infer schema for nil type")
+	}
+	schema, err := inferSchema(t, make(map[reflect.Type]bool))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(schema)
+}
+
+func inferSchema(t reflect.Type, visiting map[reflect.Type]bool) (map[string]interface{}, error) {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+	case rawJSONType:
+		return map[string]interface{}{}, nil
+	case byteSliceType:
+		return map[string]interface{}{"type": "string", "contentEncoding": "base64"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Interface:
+		// Any JSON value
+		return map[string]interface{}{}, nil
+
+	case reflect.Pointer:
+		elem, err := inferSchema(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return nullable(elem), nil
+
+	case reflect.Slice, reflect.Array:
+		items, err := inferSchema(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		schema := map[string]interface{}{"type": "array", "items": items}
+		if t.Kind() == reflect.Array {
+			schema["minItems"] = t.Len()
+			schema["maxItems"] = t.Len()
+		}
+		return schema, nil
+
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return nil, fmt.Errorf("unsupported map key type %s", t.Key())
+		}
+		values, err := inferSchema(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}, nil
+
+	case reflect.Struct:
+		if visiting[t] {
+			// Recursive type; describe the nested occurrence as any object
+			return map[string]interface{}{"type": "object"}, nil
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		properties := make(map[string]interface{})
+		required := []string{}
+		if err := inferStructFields(t, visiting, properties, &required); err != nil {
+			return nil, err
+		}
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+// inferStructFields adds the schema of each JSON-visible field of t,
+// flattening embedded structs as encoding/json does.
+func inferStructFields(t reflect.Type, visiting map[reflect.Type]bool, properties map[string]interface{}, required *[]string) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		omitempty := strings.Contains(","+opts+",", ",omitempty,") || strings.Contains(","+opts+",", ",omitzero,")
+
+		fieldType := field.Type
+		if field.Anonymous && name == "" {
+			embedded := fieldType
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if err := inferStructFields(embedded, visiting, properties, required); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fieldSchema, err := inferSchema(fieldType, visiting)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		properties[name] = fieldSchema
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+	return nil
+}
+
+// nullable extends a schema to also accept null.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	typ, ok := schema["type"].(string)
+	if !ok {
+		// Schemas without a single type (e.g. any value) already admit null
+		return schema
+	}
+	result := make(map[string]interface{}, len(schema))
+	for k, v := range schema {
+		result[k] = v
+	}
+	result["type"] = []string{typ, "null"}
+	return result
+}
+
+// MethodTypedWithSchema registers a method whose argument is decoded into a
+// value of type I and whose result is of type O. The JSON Schema of I is
+// inferred with InferSchema and recorded for the method, where it is
+// available from BaseRpcTarget.MethodSchema.
+//
+// The argument may be sent either directly as an object or as the sole
+// element of the positional argument array.
+func MethodTypedWithSchema[I, O any](t *BaseRpcTarget, name string, handler func(I) (O, error)) error {
+	schema, err := InferSchema(reflect.TypeOf((*I)(nil)).Elem())
+	if err != nil {
+		return fmt.Errorf("failed to infer schema for %s: %w", name, err)
+	}
+
+	t.Method(name, func(args json.RawMessage) (interface{}, error) {
+		var input I
+		if err := decodeSingleArg(args, &input); err != nil {
+			return nil, err
+		}
+		return handler(input)
+	})
+
+	t.mu.Lock()
+	t.schemas[name] = schema
+	t.mu.Unlock()
+	return nil
+}
+
+// MethodSchema returns the JSON Schema recorded for a method's argument.
+func (t *BaseRpcTarget) MethodSchema(name string) (json.RawMessage, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	schema, exists := t.schemas[name]
+	return schema, exists
+}
+
+// decodeSingleArg decodes args into v, accepting either a positional argument
+// array holding a single value or the bare value itself.
+func decodeSingleArg(args json.RawMessage, v interface{}) error {
+	var argArray []json.RawMessage
+	if err := json.Unmarshal(args, &argArray); err == nil {
+		if len(argArray) == 0 {
+			return NewRpcError("ArgumentError", "missing argument")
+		}
+		args = argArray[0]
+	}
+	if err := unmarshalArg(args, v); err != nil {
+		return RpcError{Code: "ArgumentError", Message: err.Error(), Cause: err}
+	}
+	return nil
+}
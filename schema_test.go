@@ -0,0 +1,151 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInferSchema(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type base struct {
+		ID string `json:"id"`
+	}
+	type node struct {
+		Name     string  `json:"name"`
+		Children []*node `json:"children,omitempty"`
+	}
+	type user struct {
+		base
+		Name     string          `json:"name"`
+		Nickname string          `json:"nickname,omitempty"`
+		Age      int             `json:"age"`
+		Score    float64         `json:"score"`
+		Admin    bool            `json:"admin"`
+		Manager  *string         `json:"manager"`
+		Tags     []string        `json:"tags"`
+		Labels   map[string]int  `json:"labels,omitempty"`
+		Home     address         `json:"home"`
+		Joined   time.Time       `json:"joined"`
+		Extra    json.RawMessage `json:"extra,omitempty"`
+		Secret   string          `json:"-"`
+		Untagged bool
+		internal int
+	}
+
+	tests := []struct {
+		name    string
+		typ     reflect.Type
+		want    string
+		wantErr string
+	}{
+		{name: "string", typ: reflect.TypeOf(""), want: `{"type":"string"}`},
+		{name: "pointer", typ: reflect.TypeOf((*int)(nil)), want: `{"type":["integer","null"]}`},
+		{name: "slice", typ: reflect.TypeOf([]bool{}), want: `{"items":{"type":"boolean"},"type":"array"}`},
+		{name: "array", typ: reflect.TypeOf([2]float32{}), want: `{"items":{"type":"number"},"maxItems":2,"minItems":2,"type":"array"}`},
+		{name: "bytes", typ: reflect.TypeOf([]byte{}), want: `{"contentEncoding":"base64","type":"string"}`},
+		{name: "map", typ: reflect.TypeOf(map[string]string{}), want: `{"additionalProperties":{"type":"string"},"type":"object"}`},
+		{
+			name: "struct",
+			typ:  reflect.TypeOf(user{}),
+			want: `{"properties":{` +
+				`"Untagged":{"type":"boolean"},` +
+				`"admin":{"type":"boolean"},` +
+				`"age":{"type":"integer"},` +
+				`"extra":{},` +
+				`"home":{"properties":{"city":{"type":"string"}},"required":["city"],"type":"object"},` +
+				`"id":{"type":"string"},` +
+				`"joined":{"format":"date-time","type":"string"},` +
+				`"labels":{"additionalProperties":{"type":"integer"},"type":"object"},` +
+				`"manager":{"type":["string","null"]},` +
+				`"name":{"type":"string"},` +
+				`"nickname":{"type":"string"},` +
+				`"score":{"type":"number"},` +
+				`"tags":{"items":{"type":"string"},"type":"array"}},` +
+				`"required":["id","name","age","score","admin","manager","tags","home","joined","Untagged"],` +
+				`"type":"object"}`,
+		},
+		{
+			name: "recursive struct",
+			typ:  reflect.TypeOf(node{}),
+			want: `{"properties":{` +
+				`"children":{"items":{"type":["object","null"]},"type":"array"},` +
+				`"name":{"type":"string"}},` +
+				`"required":["name"],"type":"object"}`,
+		},
+		{name: "nil", typ: nil, wantErr: "cannot infer schema for nil type"},
+		{name: "channel", typ: reflect.TypeOf(make(chan int)), wantErr: "unsupported type chan int"},
+		{name: "map key", typ: reflect.TypeOf(map[bool]int{}), wantErr: "unsupported map key type bool"},
+		{
+			name:    "field",
+			typ:     reflect.TypeOf(struct{ F func() }{}),
+			wantErr: "field F: unsupported type func()",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InferSchema(tt.typ)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("InferSchema error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InferSchema: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("InferSchema =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMethodTypedWithSchema(t *testing.T) {
+	type greeting struct {
+		Name     string `json:"name"`
+		Greeting string `json:"greeting,omitempty"`
+	}
+	target := NewBaseRpcTarget()
+	err := MethodTypedWithSchema(target, "greet", func(g greeting) (string, error) {
+		if g.Greeting == "" {
+			g.Greeting = "Hello"
+		}
+		return g.Greeting + ", " + g.Name + "!", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MethodTypedWithSchema(target, "bad", func(chan int) (int, error) { return 0, nil }); err == nil {
+		t.Error("MethodTypedWithSchema accepted an argument type without a schema")
+	}
+
+	schema, ok := target.MethodSchema("greet")
+	if want := `{"properties":{"greeting":{"type":"string"},"name":{"type":"string"}},"required":["name"],"type":"object"}`; !ok || string(schema) != want {
+		t.Errorf("MethodSchema = %s, want %s", schema, want)
+	}
+	if _, ok := target.MethodSchema("bad"); ok {
+		t.Error("a method that failed to register has a schema")
+	}
+
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["greet"],[{"name":"Ada"}]]]`,
+		`["push",["pipeline",0,["greet"],{"name":"Ada","greeting":"Hi"}]]`,
+		`["push",["pipeline",0,["greet"],[]]]`,
+		`["pull",1]`,
+		`["pull",2]`,
+		`["pull",3]`,
+	)
+	want := []string{
+		`["resolve",1,"Hello, Ada!"]`,
+		`["resolve",2,"Hi, Ada!"]`,
+		`["reject",3,["error","ArgumentError","missing argument"]]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
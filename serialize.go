@@ -0,0 +1,517 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Devaluator converts the values handlers return into wire expressions, in
+// two steps. Normalize turns a Go value into plain JSON data (maps, slices,
+// strings, numbers, booleans and nil) together with the escape types,
+// which is the form results are kept in for pipeline references to
+// traverse. Devaluate then escapes the arrays of a normalized value for the
+// wire.
+type Devaluator struct {
+	// Codec encodes values that are not already plain JSON data, such as
+	// structs. Defaults to JSONCodec.
+	Codec Codec
+
+	// Keys rewrites the object keys of normalized values.
+	Keys SanitizeKeyPolicy
+
+	// Escapes sends values of the types registered in it as their custom
+	// escapes. It may be nil.
+	Escapes *EscapeRegistry
+
+	// Export replaces the RpcTargets in the values CapnWebMarshalers
+	// return, at the top level or within maps and slices, with the
+	// capabilities sent for them. If it is nil, they are encoded like other
+	// values.
+	Export func(value interface{}) interface{}
+}
+
+// Devaluate converts value to a wire expression.
+func (d Devaluator) Devaluate(value interface{}) (interface{}, error) {
+	normalized, err := d.Normalize(value)
+	if err != nil {
+		return nil, err
+	}
+	return wireValue(normalized), nil
+}
+
+// Normalize converts value to plain JSON data and escape types, with its
+// object keys rewritten. Structs and other Go values are converted through
+// their encoding by Codec. value is not modified.
+func (d Devaluator) Normalize(value interface{}) (interface{}, error) {
+	normalized, err := d.normalizeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return d.Keys.Apply(normalized), nil
+}
+
+// normalizeValue converts a value to normalized JSON values, leaving its
+// keys as they are.
+func (d Devaluator) normalizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case exportStub, wireExpression, Date, BigInt, Undefined, Bytes, Float, customEscape, json.Number, string, bool, nil:
+		return value, nil
+	case float64:
+		if !isFinite(v) {
+			return Float(v), nil
+		}
+		return value, nil
+	case RpcError:
+		return d.normalizeError(v)
+	case *RpcError:
+		if v == nil {
+			return nil, nil
+		}
+		return d.normalizeError(*v)
+	case map[string]interface{}, []interface{}:
+		return d.normalizeElements(value)
+	}
+	// Values with an escape of their own are sent as that escape
+	if escaped, ok := escapeValue(value); ok {
+		return escaped, nil
+	}
+
+	// So are values of registered types, Go types with escapes of their own
+	// and non-finite floats, which are found by testing each float before
+	// the value is encoded, and CapnWebMarshalers send values of their
+	// choosing, wherever they are within it
+	if info := typeEscapeInfo(reflect.TypeOf(value)); info.escapes || info.interfaces || info.marshalers || info.floats || !d.Escapes.empty() {
+		escaped, ok, err := escapeWithin(reflect.ValueOf(value), d.escapeLeaf)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return d.normalizeElements(escaped)
+		}
+	}
+
+	// Other values, such as structs, are converted through their encoding
+	codec := d.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	encoded, err := codec.EncodeResult(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %w", err)
+	}
+	normalized, err := decodeJSON(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %w", err)
+	}
+	return normalized, nil
+}
+
+// escapeLeaf is the leafEscape of registered types, CapnWebMarshalers, Go
+// types with escapes of their own and non-finite floats.
+func (d Devaluator) escapeLeaf(value reflect.Value) (interface{}, bool, error) {
+	if !d.Escapes.empty() {
+		if escaped, ok, err := d.Escapes.escapeValue(value); ok || err != nil {
+			return escaped, ok, err
+		}
+	}
+	if m, ok := capnWebMarshaler(value); ok {
+		marshaled, err := d.marshalCapnWeb(m)
+		return marshaled, err == nil, err
+	}
+	if escaped, ok, err := escapeGoType(value); ok || err != nil {
+		return escaped, ok, err
+	}
+	return escapeNonFinite(value)
+}
+
+// normalizeElements normalizes the values within a map or slice, which may
+// hold structs, typed slices or values with escapes of their own.
+func (d Devaluator) normalizeElements(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			elem, err := d.normalizeElements(val)
+			if err != nil {
+				return nil, err
+			}
+			normalized[key] = elem
+		}
+		return normalized, nil
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, val := range v {
+			elem, err := d.normalizeElements(val)
+			if err != nil {
+				return nil, err
+			}
+			normalized[i] = elem
+		}
+		return normalized, nil
+	default:
+		return d.normalizeValue(value)
+	}
+}
+
+// DevaluateError converts err to an ["error", type, message, stack,
+// details] expression. RpcErrors are reported under their own type, with
+// their stack, data and details if they have any; anything else is reported
+// as defaultType. Data and details that cannot be normalized are left out.
+func (d Devaluator) DevaluateError(err error, defaultType string) []interface{} {
+	rpcErr := asRejection(err, defaultType)
+	normalized, normErr := d.normalizeError(rpcErr)
+	if normErr != nil {
+		rpcErr.Data, rpcErr.Details = nil, nil
+		normalized = rpcErr
+	}
+	return rpcErrorExpression(normalized)
+}
+
+// normalizeError normalizes the data and details of an RpcError, which is
+// kept in normalized values as it is and sent as an error expression.
+func (d Devaluator) normalizeError(rpcErr RpcError) (RpcError, error) {
+	if rpcErr.Data != nil {
+		data, err := d.Normalize(rpcErr.Data)
+		if err != nil {
+			return RpcError{}, err
+		}
+		rpcErr.Data = data
+	}
+	if len(rpcErr.Details) == 0 {
+		return rpcErr, nil
+	}
+	details, err := d.Normalize(rpcErr.Details)
+	if err != nil {
+		return RpcError{}, err
+	}
+	rpcErr.Details = details.(map[string]interface{})
+	return rpcErr, nil
+}
+
+// errorExpression returns the ["error", type, message] expression.
+func errorExpression(errorType, message string) []interface{} {
+	return []interface{}{"error", errorType, message}
+}
+
+// rpcErrorExpression returns the expression of an RpcError with normalized
+// data and details, mapped onto it as described for RpcError. The stack and
+// details are only sent if the error has them; an error with details but no
+// stack sends a null stack.
+func rpcErrorExpression(rpcErr RpcError) []interface{} {
+	errorType := rpcErr.Code
+	if rpcErr.Type != "" {
+		errorType = rpcErr.Type
+	}
+	details := rpcErr.Details
+	if errorType != rpcErr.Code || rpcErr.Data != nil {
+		details = make(map[string]interface{}, len(rpcErr.Details)+2)
+		for key, value := range rpcErr.Details {
+			details[key] = value
+		}
+		if errorType != rpcErr.Code {
+			details["code"] = rpcErr.Code
+		}
+		if rpcErr.Data != nil {
+			details["data"] = rpcErr.Data
+		}
+	}
+
+	expr := errorExpression(errorType, rpcErr.Message)
+	if rpcErr.Stack == "" && len(details) == 0 {
+		return expr
+	}
+	var stack interface{}
+	if rpcErr.Stack != "" {
+		stack = rpcErr.Stack
+	}
+	expr = append(expr, stack)
+	if len(details) > 0 {
+		expr = append(expr, wireValue(details))
+	}
+	return expr
+}
+
+// Evaluator converts wire expressions sent by the client into values. It
+// unescapes arrays, turns escapes such as ["date", ms] into their escape
+// types, restores object keys and evaluates pipeline references. Errors,
+// ["error", type, message, stack, details], become RpcErrors, which handlers
+// receive encoded as {"code", "type", "message", "data", "details", "stack"}
+// objects. Arrays
+// that are neither escaped nor a known expression are kept as they are, as
+// hand-written requests send them. Client exports, ["export", id], and
+// promises, ["promise", id], are left for handlers to decode as ClientStub
+// and ClientPromise.
+type Evaluator struct {
+	// Keys restores the object keys of values; see
+	// SanitizeKeyPolicy.Restore.
+	Keys SanitizeKeyPolicy
+
+	// Pipeline returns the value at path of the client's import importID.
+	// Evaluating a pipeline reference fails if it is nil. Its values are
+	// used as they are, without further evaluation.
+	Pipeline func(importID int, path []interface{}) (interface{}, error)
+
+	// Call makes the call of a pipeline reference that carries arguments,
+	// or is made on the main target, and returns its result, which is used
+	// as Pipeline's values are. args is the argument expression as sent, or
+	// nil if there is none. Evaluating such a reference fails if it is nil.
+	Call func(importID int, path []interface{}, args interface{}) (interface{}, error)
+
+	// Escapes decodes the custom escapes registered in it into their
+	// types. It may be nil.
+	Escapes *EscapeRegistry
+}
+
+// Evaluate converts expr to a value. expr is not modified.
+func (e Evaluator) Evaluate(expr interface{}) (interface{}, error) {
+	switch v := expr.(type) {
+	case []interface{}:
+		// An escaped array literal
+		if len(v) == 1 {
+			if elems, ok := v[0].([]interface{}); ok {
+				return e.evaluateElements(elems)
+			}
+		}
+
+		if kind, ok := firstString(v); ok {
+			switch kind {
+			case "pipeline":
+				if importIDFloat, ok := v[1].(float64); ok {
+					return e.evaluatePipeline(int(importIDFloat), v)
+				}
+			case "date", "bigint", "bytes", "undefined", "nan", "inf", "-inf":
+				if escaped, ok := reviveEscape(v); ok {
+					return escaped, nil
+				}
+				return nil, fmt.Errorf("invalid %s expression", kind)
+			case "error":
+				return e.evaluateError(v)
+			case "export", "promise":
+				return v, nil
+			}
+		}
+		if value, ok, err := e.Escapes.revive(v); ok {
+			return value, err
+		}
+		return e.evaluateElements(v)
+
+	case map[string]interface{}:
+		evaluated := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			value, err := e.Evaluate(val)
+			if err != nil {
+				return nil, err
+			}
+			evaluated[e.Keys.restoreKey(key)] = value
+		}
+		return evaluated, nil
+
+	default:
+		return expr, nil
+	}
+}
+
+// EvaluateArguments converts the arguments of a call to values. The
+// argument array is not itself escaped, so each argument is evaluated in
+// turn; arguments sent as a single object are evaluated as an expression.
+func (e Evaluator) EvaluateArguments(args interface{}) (interface{}, error) {
+	if elems, ok := args.([]interface{}); ok {
+		return e.evaluateElements(elems)
+	}
+	return e.Evaluate(args)
+}
+
+// evaluateElements evaluates each element of an array.
+func (e Evaluator) evaluateElements(elems []interface{}) ([]interface{}, error) {
+	evaluated := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		value, err := e.Evaluate(elem)
+		if err != nil {
+			return nil, err
+		}
+		evaluated[i] = value
+	}
+	return evaluated, nil
+}
+
+// evaluatePipeline evaluates a ["pipeline", importId, path, args]
+// reference. A reference with arguments, or on the main target, is a call;
+// any other reads the value at path.
+func (e Evaluator) evaluatePipeline(importID int, ref []interface{}) (interface{}, error) {
+	var path []interface{}
+	if len(ref) >= 3 {
+		path, _ = ref[2].([]interface{})
+	}
+	var value interface{}
+	var err error
+	switch {
+	case len(ref) >= 4 || importID == MainExportID:
+		if e.Call == nil {
+			return nil, fmt.Errorf("calls in pipeline references are not supported here")
+		}
+		var args interface{}
+		if len(ref) >= 4 {
+			args = ref[3]
+		}
+		value, err = e.Call(importID, path, args)
+	case e.Pipeline == nil:
+		return nil, fmt.Errorf("pipeline references are not supported here")
+	default:
+		value, err = e.Pipeline(importID, path)
+	}
+	if err != nil || e.Escapes.empty() {
+		return value, err
+	}
+	// Results hold registered types as their escapes
+	return unwrapCustomEscapes(value), nil
+}
+
+// EvaluateError converts an ["error", type, message, stack, details]
+// expression into an RpcError. Other values, and errors whose details
+// cannot be evaluated, are reported as an RpcError with code "Error".
+func (e Evaluator) EvaluateError(expr interface{}) error {
+	if errArray, ok := expr.([]interface{}); ok && len(errArray) >= 2 && errArray[0] == "error" {
+		if rpcErr, err := e.evaluateError(errArray); err == nil {
+			return rpcErr
+		}
+	}
+	encoded, _ := json.Marshal(expr)
+	return RpcError{Code: "Error", Message: string(encoded)}
+}
+
+// evaluateError converts an error expression into an RpcError. Only the
+// type is required; the message and stack must be strings, or null, and the
+// details an object.
+func (e Evaluator) evaluateError(expr []interface{}) (RpcError, error) {
+	var rpcErr RpcError
+	var ok bool
+	if rpcErr.Code, ok = expr[1].(string); !ok {
+		return RpcError{}, fmt.Errorf("invalid error expression")
+	}
+	if len(expr) >= 3 && expr[2] != nil {
+		if rpcErr.Message, ok = expr[2].(string); !ok {
+			return RpcError{}, fmt.Errorf("invalid error expression")
+		}
+	}
+	if len(expr) >= 4 && expr[3] != nil {
+		if rpcErr.Stack, ok = expr[3].(string); !ok {
+			return RpcError{}, fmt.Errorf("invalid error expression")
+		}
+	}
+	if len(expr) >= 5 && expr[4] != nil {
+		if _, ok := expr[4].(map[string]interface{}); !ok {
+			return RpcError{}, fmt.Errorf("invalid error expression")
+		}
+		details, err := e.Evaluate(expr[4])
+		if err != nil {
+			return RpcError{}, err
+		}
+		rpcErr.Details = details.(map[string]interface{})
+	}
+
+	// Reverse the mapping of Type, Code and Data onto the details
+	if code, ok := rpcErr.Details["code"].(string); ok {
+		rpcErr.Type, rpcErr.Code = rpcErr.Code, code
+		delete(rpcErr.Details, "code")
+	}
+	if data, ok := rpcErr.Details["data"]; ok {
+		rpcErr.Data = data
+		delete(rpcErr.Details, "data")
+	}
+	if len(rpcErr.Details) == 0 {
+		rpcErr.Details = nil
+	}
+	return rpcErr, nil
+}
+
+// firstString returns the first element of an expression of at least two
+// elements, or of a one-element escape such as ["undefined"], if it is a
+// string.
+func firstString(expr []interface{}) (string, bool) {
+	if len(expr) == 0 {
+		return "", false
+	}
+	kind, ok := expr[0].(string)
+	if !ok || (len(expr) < 2 && !isUnitEscape(kind)) {
+		return "", false
+	}
+	return kind, true
+}
+
+// isUnitEscape reports whether kind names an escape without operands.
+func isUnitEscape(kind string) bool {
+	switch kind {
+	case "undefined", "nan", "inf", "-inf":
+		return true
+	}
+	return false
+}
+
+// reviveEscape returns the escape type an array encodes, if any.
+func reviveEscape(array []interface{}) (interface{}, bool) {
+	if len(array) == 0 {
+		return nil, false
+	}
+	kind, _ := array[0].(string)
+	switch {
+	case kind == "undefined" && len(array) == 1:
+		return Undefined{}, true
+	case kind == "nan" && len(array) == 1:
+		return Float(math.NaN()), true
+	case kind == "inf" && len(array) == 1:
+		return Float(math.Inf(1)), true
+	case kind == "-inf" && len(array) == 1:
+		return Float(math.Inf(-1)), true
+	case len(array) != 2:
+		return nil, false
+	}
+
+	encoded, err := json.Marshal(array)
+	if err != nil {
+		return nil, false
+	}
+	switch kind {
+	case "date":
+		var d Date
+		if json.Unmarshal(encoded, &d) == nil {
+			return d, true
+		}
+	case "bigint":
+		var b BigInt
+		if json.Unmarshal(encoded, &b) == nil {
+			return b, true
+		}
+	case "bytes":
+		var b Bytes
+		if json.Unmarshal(encoded, &b) == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// wireValue returns a normalized value as a wire expression: every array, at
+// any depth, is escaped by wrapping it in another array so the client does
+// not evaluate it as an expression. The value is not modified.
+func wireValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			elems[i] = wireValue(elem)
+		}
+		return []interface{}{elems}
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			fields[key] = wireValue(val)
+		}
+		return fields
+	case RpcError:
+		return rpcErrorExpression(v)
+	default:
+		return value
+	}
+}
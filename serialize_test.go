@@ -0,0 +1,242 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// wireJSON devaluates value and returns its wire expression as JSON.
+func wireJSON(t *testing.T, value interface{}) string {
+	t.Helper()
+	expr, err := Devaluator{}.Devaluate(value)
+	if err != nil {
+		t.Fatalf("Devaluate(%#v): %v", value, err)
+	}
+	encoded, err := json.Marshal(expr)
+	if err != nil {
+		t.Fatalf("encoding %#v: %v", expr, err)
+	}
+	return string(encoded)
+}
+
+func TestDevaluateStringArraysAreNotEscapes(t *testing.T) {
+	type tagged struct {
+		Tags []string `json:"tags"`
+	}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"undefined", []string{"undefined"}, `[["undefined"]]`},
+		{"nan", []string{"nan"}, `[["nan"]]`},
+		{"inf", []string{"inf"}, `[["inf"]]`},
+		{"-inf", []string{"-inf"}, `[["-inf"]]`},
+		{"date", []interface{}{"date", 0}, `[["date",0]]`},
+		{"bigint", []string{"bigint", "1"}, `[["bigint","1"]]`},
+		{"bytes", []string{"bytes", "AA=="}, `[["bytes","AA=="]]`},
+		{"struct field", tagged{Tags: []string{"nan"}}, `{"tags":[["nan"]]}`},
+		{"nested", map[string]interface{}{"a": []string{"undefined"}}, `{"a":[["undefined"]]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wireJSON(t, tt.value)
+			if got != tt.want {
+				t.Fatalf("wire form = %s, want %s", got, tt.want)
+			}
+
+			var expr interface{}
+			if err := json.Unmarshal([]byte(got), &expr); err != nil {
+				t.Fatal(err)
+			}
+			evaluated, err := Evaluator{}.Evaluate(expr)
+			if err != nil {
+				t.Fatalf("Evaluate(%s): %v", got, err)
+			}
+			var want interface{}
+			encoded, _ := json.Marshal(tt.value)
+			json.Unmarshal(encoded, &want)
+			if !reflect.DeepEqual(evaluated, want) {
+				t.Fatalf("round trip = %#v, want %#v", evaluated, want)
+			}
+		})
+	}
+}
+
+func TestDevaluateEscapeTypes(t *testing.T) {
+	when := time.UnixMilli(1700000000000).UTC()
+	type record struct {
+		When    time.Time   `json:"when"`
+		Date    Date        `json:"date"`
+		Count   *big.Int    `json:"count"`
+		Big     BigInt      `json:"big"`
+		Data    []byte      `json:"data"`
+		Missing Undefined   `json:"missing"`
+		Any     interface{} `json:"any"`
+	}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"time", when, `["date",1700000000000]`},
+		{"undefined", Undefined{}, `["undefined"]`},
+		{"big.Int", big.NewInt(42), `["bigint","42"]`},
+		{"struct", record{
+			When:  when,
+			Date:  Date{when},
+			Count: big.NewInt(7),
+			Big:   BigInt{big.NewInt(8)},
+			Data:  []byte{1, 2},
+			Any:   Date{when},
+		}, `{"any":["date",1700000000000],"big":["bigint","8"],"count":["bigint","7"],"data":["bytes","AQI="],"date":["date",1700000000000],"missing":["undefined"],"when":["date",1700000000000]}`},
+		{"slice", []interface{}{Undefined{}, "x"}, `[[["undefined"],"x"]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wireJSON(t, tt.value); got != tt.want {
+				t.Fatalf("wire form = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevaluateNonFiniteFloats(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	type reading struct {
+		Value  float64   `json:"value"`
+		Series []float32 `json:"series"`
+	}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"nan", nan, `["nan"]`},
+		{"-inf", -inf, `["-inf"]`},
+		{"float32", float32(inf), `["inf"]`},
+		{"finite", 1.5, `1.5`},
+		{"slice", []float64{1, nan, -inf}, `[[1,["nan"],["-inf"]]]`},
+		{"struct", reading{Value: inf, Series: []float32{2, float32(nan)}}, `{"series":[[2,["nan"]]],"value":["inf"]}`},
+		{"finite struct", reading{Value: 2}, `{"series":null,"value":2}`},
+		{"Float", []Float{Float(nan), 3}, `[[["nan"],3]]`},
+		{"string inf", []string{"inf"}, `[["inf"]]`},
+		{"strings in struct", struct {
+			Names []string `json:"names"`
+		}{[]string{"nan", "-inf"}}, `{"names":[["nan","-inf"]]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wireJSON(t, tt.value); got != tt.want {
+				t.Fatalf("wire form = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevaluateError(t *testing.T) {
+	type quota struct {
+		Limit int `json:"limit"`
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+		// back is the RpcError the expression is evaluated back into
+		back RpcError
+	}{
+		{
+			name: "plain error",
+			err:  errors.New("boom"),
+			want: `["error","MethodError","boom"]`,
+			back: RpcError{Code: "MethodError", Message: "boom"},
+		},
+		{
+			name: "code",
+			err:  RpcError{Code: "QuotaExceeded", Message: "used up"},
+			want: `["error","QuotaExceeded","used up"]`,
+			back: RpcError{Code: "QuotaExceeded", Message: "used up"},
+		},
+		{
+			name: "type and code",
+			err:  RpcError{Type: "RangeError", Code: "QuotaExceeded", Message: "used up"},
+			want: `["error","RangeError","used up",null,{"code":"QuotaExceeded"}]`,
+			back: RpcError{Type: "RangeError", Code: "QuotaExceeded", Message: "used up"},
+		},
+		{
+			name: "type same as code",
+			err:  RpcError{Type: "TypeError", Code: "TypeError", Message: "bad"},
+			want: `["error","TypeError","bad"]`,
+			back: RpcError{Code: "TypeError", Message: "bad"},
+		},
+		{
+			name: "data",
+			err:  RpcError{Code: "QuotaExceeded", Data: quota{Limit: 1000}},
+			want: `["error","QuotaExceeded","QuotaExceeded",null,{"data":{"limit":1000}}]`,
+			back: RpcError{Code: "QuotaExceeded", Message: "QuotaExceeded", Data: map[string]interface{}{"limit": float64(1000)}},
+		},
+		{
+			name: "escaped data",
+			err:  RpcError{Code: "Retry", Message: "later", Data: []interface{}{time.UnixMilli(0).UTC()}},
+			want: `["error","Retry","later",null,{"data":[[["date",0]]]}]`,
+			back: RpcError{Code: "Retry", Message: "later", Data: []interface{}{Date{time.UnixMilli(0).UTC()}}},
+		},
+		{
+			name: "all fields",
+			err: RpcError{
+				Type: "RangeError", Code: "QuotaExceeded", Message: "used up", Stack: "at search",
+				Data: "daily", Details: map[string]interface{}{"limit": 1000},
+			},
+			want: `["error","RangeError","used up","at search",{"code":"QuotaExceeded","data":"daily","limit":1000}]`,
+			back: RpcError{
+				Type: "RangeError", Code: "QuotaExceeded", Message: "used up", Stack: "at search",
+				Data: "daily", Details: map[string]interface{}{"limit": float64(1000)},
+			},
+		},
+		{
+			name: "fields replace details",
+			err: RpcError{
+				Type: "RangeError", Code: "QuotaExceeded", Message: "used up",
+				Data: 1, Details: map[string]interface{}{"code": "other", "data": 2},
+			},
+			want: `["error","RangeError","used up",null,{"code":"QuotaExceeded","data":1}]`,
+			back: RpcError{Type: "RangeError", Code: "QuotaExceeded", Message: "used up", Data: float64(1)},
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("search: %w", RpcError{Type: "RangeError", Code: "QuotaExceeded"}),
+			want: `["error","RangeError","search: QuotaExceeded",null,{"code":"QuotaExceeded"}]`,
+			back: RpcError{Type: "RangeError", Code: "QuotaExceeded", Message: "search: QuotaExceeded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr := Devaluator{}.DevaluateError(tt.err, "MethodError")
+			encoded, err := json.Marshal(expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(encoded) != tt.want {
+				t.Errorf("DevaluateError = %s, want %s", encoded, tt.want)
+			}
+
+			var decoded interface{}
+			if err := json.Unmarshal(encoded, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			back, ok := Evaluator{}.EvaluateError(decoded).(RpcError)
+			if !ok || !reflect.DeepEqual(back, tt.back) {
+				t.Errorf("EvaluateError = %#v, want %#v", back, tt.back)
+			}
+			if !errors.Is(back, RpcError{Code: tt.back.Code}) {
+				t.Errorf("evaluated error does not match code %s", tt.back.Code)
+			}
+		})
+	}
+}
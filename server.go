@@ -2,13 +2,18 @@ package gocapnweb
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var upgrader = websocket.Upgrader{
@@ -17,93 +22,453 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// Content types supported for HTTP batch responses.
+const (
+	ContentTypeText   = "text/plain"
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeJSON   = "application/json"
+)
+
+// RpcEndpointOptions configures the endpoints registered by SetupRpcEndpoint.
+type RpcEndpointOptions struct {
+	// SessionOptions configures the RpcSession shared by the endpoint's
+	// connections. MaxMessageBytes is also applied as the WebSocket read limit
+	// and as the maximum line length of HTTP batch requests.
+	SessionOptions
+
+	// ResponseContentType is the content type of HTTP batch responses.
+	// ContentTypeText and ContentTypeNDJSON send one response per line;
+	// ContentTypeJSON sends the responses as the elements of a JSON array.
+	// Defaults to ContentTypeText.
+	ResponseContentType string
+
+	// PingInterval is how often WebSocket ping frames are sent to keep idle
+	// connections alive through proxies. Zero disables pings.
+	PingInterval time.Duration
+
+	// MaxConnections limits the number of concurrent WebSocket connections.
+	// Upgrades beyond the limit are refused with 503 Service Unavailable.
+	// Zero means unlimited.
+	MaxConnections int
+
+	// Registry has every WebSocket connection registered with it for the
+	// lifetime of the connection, keyed by SessionData.ID. If unset, the
+	// endpoint uses a registry of its own.
+	Registry *ConnectionRegistry
+
+	// ProtocolNegotiator selects the subprotocol of each WebSocket
+	// connection, recorded in the session metadata under ProtocolMetaKey.
+	// Defaults to DefaultProtocolNegotiator.
+	ProtocolNegotiator *ProtocolNegotiator
+
+	// SessionStore, if set, keeps the state of each WebSocket session when
+	// its connection closes, so that a client which reconnects and sends
+	// ["resume", token] as its first message, or right after its hello,
+	// continues the session. The token is sent to the client in a
+	// ["session", token] frame when the connection opens. Unless it is a
+	// *TTLSessionStore, the store is wrapped in one that expires sessions
+	// after SessionTTL.
+	SessionStore SessionStore
+
+	// SessionTTL is how long a closed session can be resumed. Defaults to
+	// DefaultSessionTTL.
+	SessionTTL time.Duration
+}
+
+// defaultRpcEndpointOptions returns the options used when none are specified.
+func defaultRpcEndpointOptions() RpcEndpointOptions {
+	return RpcEndpointOptions{
+		SessionOptions:      defaultSessionOptions(),
+		ResponseContentType: ContentTypeText,
+		ProtocolNegotiator:  DefaultProtocolNegotiator(),
+		SessionTTL:          DefaultSessionTTL,
+	}
+}
+
+// RpcEndpointOption configures an RPC endpoint.
+type RpcEndpointOption func(*RpcEndpointOptions)
+
+// WithSessionOptions applies session options to every connection handled by
+// the endpoint.
+func WithSessionOptions(opts ...RpcSessionOption) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		for _, opt := range opts {
+			opt(&o.SessionOptions)
+		}
+	}
+}
+
+// WithResponseContentType sets the content type of HTTP batch responses.
+func WithResponseContentType(contentType string) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.ResponseContentType = contentType
+	}
+}
+
+// WithPingInterval sets how often WebSocket ping frames are sent.
+func WithPingInterval(interval time.Duration) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.PingInterval = interval
+	}
+}
+
+// WithMaxConnections limits the number of concurrent WebSocket connections.
+func WithMaxConnections(n int) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.MaxConnections = n
+	}
+}
+
+// WithConnectionRegistry registers the endpoint's WebSocket connections
+// with registry.
+func WithConnectionRegistry(registry *ConnectionRegistry) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.Registry = registry
+	}
+}
+
+// WithProtocolNegotiator sets how WebSocket subprotocols are selected.
+func WithProtocolNegotiator(negotiator *ProtocolNegotiator) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.ProtocolNegotiator = negotiator
+	}
+}
+
+// WithSessionStore keeps the state of closed WebSocket sessions in store so
+// that clients can resume them.
+func WithSessionStore(store SessionStore) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.SessionStore = store
+	}
+}
+
+// WithSessionTTL sets how long a closed WebSocket session can be resumed.
+func WithSessionTTL(ttl time.Duration) RpcEndpointOption {
+	return func(o *RpcEndpointOptions) {
+		o.SessionTTL = ttl
+	}
+}
+
 // SetupRpcEndpoint sets up both WebSocket and HTTP POST endpoints for RPC using Echo.
-func SetupRpcEndpoint(e *echo.Echo, path string, target RpcTarget) {
-	session := NewRpcSession(target)
+// The returned RpcEndpoint embeds the route group for path, to which callers
+// may add further routes such as endpoint.GET("/version", ...), and can push
+// notifications to the endpoint's WebSocket connections.
+func SetupRpcEndpoint(e *echo.Echo, path string, target RpcTarget, opts ...RpcEndpointOption) *RpcEndpoint {
+	options := defaultRpcEndpointOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// Connections are always registered so the endpoint can notify them
+	if options.Registry == nil {
+		options.Registry = NewConnectionRegistry()
+	}
+
+	// Stored sessions expire so that abandoned ones are not kept forever
+	var sessionStore *TTLSessionStore
+	if options.SessionStore != nil {
+		var ok bool
+		if sessionStore, ok = options.SessionStore.(*TTLSessionStore); !ok {
+			sessionStore = NewTTLSessionStore(options.SessionStore, options.SessionTTL)
+			options.SessionStore = sessionStore
+		}
+	}
+
+	session := newRpcSession(target, options.SessionOptions)
+	var connections atomic.Int64
+	group := e.Group(path)
 
 	// Setup WebSocket endpoint
-	e.GET(path, func(c echo.Context) error {
-		conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	group.GET("", func(c echo.Context) error {
+		if options.MaxConnections > 0 {
+			if connections.Add(1) > int64(options.MaxConnections) {
+				connections.Add(-1)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many connections")
+			}
+			defer connections.Add(-1)
+		}
+
+		var protocol string
+		var responseHeader http.Header
+		if options.ProtocolNegotiator != nil {
+			protocol, responseHeader = options.ProtocolNegotiator.negotiateRequest(c.Request())
+		}
+
+		// Calls made on the connection are cancelled once it closes
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+
+		sessionData := NewSessionData(target)
+		sessionData.SetHeaders(c.Request().Header)
+		sessionData.SetContext(ctx)
+		if protocol != "" {
+			sessionData.SetMeta(ProtocolMetaKey, protocol)
+		}
+		// A refused session is answered before the upgrade
+		if err := session.openSession(sessionData); err != nil {
+			return err
+		}
+
+		conn, err := upgrader.Upgrade(c.Response(), c.Request(), responseHeader)
 		if err != nil {
 			log.Printf("WebSocket upgrade error: %v", err)
 			return err
 		}
 		defer conn.Close()
 
-		sessionData := NewSessionData(target)
+		if options.MaxMessageBytes > 0 {
+			conn.SetReadLimit(options.MaxMessageBytes)
+		}
+
+		// All writes to the connection go through the queue
+		queue := NewMessageQueue(conn, DefaultMessageQueueSize)
+		defer queue.Close()
+
+		if options.PingInterval > 0 {
+			stopPing := startPinger(queue, options.PingInterval)
+			defer stopPing()
+		}
+
+		sessionData.SetFrameSender(queue.SendData)
 		session.OnOpen(sessionData)
 		defer session.OnClose(sessionData)
 
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket error: %v", err)
+		options.Registry.Register(sessionData.ID, queue)
+		// A resumed session changes ID, so look it up when unregistering
+		defer func() { options.Registry.Unregister(sessionData.ID) }()
+
+		if sessionStore != nil {
+			if err := queue.SendData([]byte(sessionFrame(sessionData.ID))); err != nil {
+				log.Printf("Error writing WebSocket response: %v", err)
+				session.reportError(sessionData, err)
+				return nil
+			}
+			defer func() {
+				// An aborted session cannot be resumed
+				if sessionData.Abort() != nil {
+					return
+				}
+				saved := sessionData.snapshot()
+				if err := sessionStore.Save(saved.ID, saved); err != nil {
+					log.Printf("Error saving WebSocket session: %v", err)
+					saved.disposeAll()
+				}
+			}()
+		}
+
+		// Messages are read on their own goroutine so that a connection
+		// closing while a call is running cancels the call's context
+		messages := make(chan []byte)
+		go func() {
+			defer close(messages)
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+						log.Printf("WebSocket error: %v", err)
+						session.reportError(sessionData, err)
+					}
+					cancel()
+					return
+				}
+				// Answers to calls made on the client settle them here,
+				// as the call may be holding up the message loop
+				if session.answerMessage(sessionData, message) {
+					continue
+				}
+				// A release cancels the calls it abandons right away
+				session.releaseMessage(sessionData, message)
+				select {
+				case messages <- message:
+				case <-ctx.Done():
+					return
 				}
-				break
 			}
+		}()
 
-			response, err := session.HandleMessage(sessionData, string(message))
+		resumable := sessionStore != nil
+		for message := range messages {
+			// A ["resume", token] message continues a stored session if it
+			// is the first message, or follows the opening hello
+			if resumable {
+				if token, ok := parseResume(message); ok {
+					resumable = false
+					previousID := sessionData.ID
+					resumed, err := sessionStore.resume(token, sessionData)
+					if err != nil {
+						log.Printf("Error resuming WebSocket session: %v", err)
+					}
+					if resumed {
+						options.Registry.Unregister(previousID)
+						options.Registry.Register(sessionData.ID, queue)
+					}
+					if err := queue.SendData([]byte(sessionFrame(sessionData.ID))); err != nil {
+						log.Printf("Error writing WebSocket response: %v", err)
+						session.reportError(sessionData, err)
+						break
+					}
+					continue
+				}
+				resumable = peekMessageType(message) == "hello"
+			}
+
+			frames, err := session.HandleMessageFrames(sessionData, string(message))
 			if err != nil {
 				log.Printf("Error processing WebSocket message: %v", err)
+				session.reportError(sessionData, err)
 				continue
 			}
 
-			if response != "" {
-				if err := conn.WriteMessage(websocket.TextMessage, []byte(response)); err != nil {
-					log.Printf("Error writing WebSocket response: %v", err)
-					break
+			if err := sendFrames(queue, frames); err != nil {
+				log.Printf("Error writing WebSocket response: %v", err)
+				session.reportError(sessionData, err)
+				break
+			}
+
+			// An abort ends the session; close the socket with its reason
+			if abort := sessionData.Abort(); abort != nil {
+				if err := queue.SendControl(websocket.CloseMessage, abort.CloseMessage()); err != nil {
+					log.Printf("Error sending WebSocket close: %v", err)
 				}
+				break
 			}
 		}
 		return nil
 	})
 
 	// Setup HTTP POST endpoint for batch RPC
-	e.POST(path, func(c echo.Context) error {
+	group.POST("", func(c echo.Context) error {
 		// CORS headers are handled by Echo middleware
-		c.Response().Header().Set("Content-Type", "text/plain")
-
 		defer c.Request().Body.Close()
-		scanner := bufio.NewScanner(c.Request().Body)
+		batch := newBatchReader(c.Request().Body, options.MaxMessageBytes)
 
 		// Create a session data for this HTTP batch request
 		sessionData := NewSessionData(target)
-		var responses []string
+		sessionData.SetHeaders(c.Request().Header)
+		sessionData.SetContext(c.Request().Context())
+		if err := session.openSession(sessionData); err != nil {
+			return err
+		}
+		defer session.endSession(sessionData)
 
-		// Process each line as a separate RPC message
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" {
-				continue
+		// The whole body is read before any message is handled, so a
+		// malformed batch is refused without having been partly run
+		var messages []string
+		for batch.Next() {
+			messages = append(messages, batch.Message())
+		}
+		if err := batch.Err(); err != nil {
+			switch {
+			case errors.Is(err, bufio.ErrTooLong), errors.Is(err, errBatchMessageTooLong):
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Message too large")
+			case errors.Is(err, errInvalidBatch):
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid batch body")
 			}
+			log.Printf("Error reading HTTP body: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error reading request body")
+		}
+		responses := session.handleBatch(sessionData, messages)
 
-			response, err := session.HandleMessage(sessionData, line)
-			if err != nil {
-				log.Printf("Error processing HTTP message: %v", err)
-				continue
-			}
+		// A JSON array of messages is answered with a JSON array
+		contentType := options.ResponseContentType
+		if batch.IsArray() {
+			contentType = ContentTypeJSON
+		}
+		setDeprecationHeaders(c.Response().Header(), sessionData.Deprecations())
+		return c.Blob(http.StatusOK, contentType, formatBatchResponse(contentType, responses))
+	})
+
+	// Describe the target's methods for clients that do not speak the protocol
+	group.GET("/"+IntrospectMethod, serveIntrospection(session, target))
+
+	// OPTIONS endpoint is handled automatically by Echo CORS middleware
+
+	return &RpcEndpoint{Group: group, session: session, registry: options.Registry}
+}
 
-			if response != "" {
-				responses = append(responses, response)
+// startPinger queues a ping frame every interval until the returned
+// function is called.
+func startPinger(queue *MessageQueue, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := queue.SendControl(websocket.PingMessage, nil); err != nil {
+					return
+				}
 			}
 		}
+	}()
 
-		if err := scanner.Err(); err != nil {
-			log.Printf("Error reading HTTP body: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error reading request body")
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// sendFrames queues each frame as its own WebSocket text message.
+func sendFrames(queue *MessageQueue, frames []string) error {
+	for _, frame := range frames {
+		if err := queue.SendData([]byte(frame)); err != nil {
+			if writeErr := queue.Err(); writeErr != nil {
+				return writeErr
+			}
+			return err
 		}
+	}
+	return nil
+}
 
-		// Join responses with newlines
-		responseBody := strings.Join(responses, "\n")
-		return c.String(http.StatusOK, responseBody)
-	})
+// formatBatchResponse joins the response frames of an HTTP batch request
+// according to the response content type.
+func formatBatchResponse(contentType string, responses []string) []byte {
+	if contentType == ContentTypeJSON {
+		// Each response is already a JSON value, so they can be spliced
+		// into an array without re-encoding.
+		return []byte("[" + strings.Join(responses, ",") + "]")
+	}
+	// Join responses with newlines
+	return []byte(strings.Join(responses, "\n"))
+}
 
-	// OPTIONS endpoint is handled automatically by Echo CORS middleware
+// EchoServerOption configures the Echo server created by SetupEchoServer.
+type EchoServerOption func(*echo.Echo)
+
+// acmeChallengeAddr is where the HTTP-01 challenge server listens; ACME
+// requires port 80.
+const acmeChallengeAddr = ":80"
+
+// WithAutoTLS provisions and renews Let's Encrypt certificates for domain
+// automatically, caching them in cacheDir. It starts an HTTP-01 challenge
+// server on port 80 in the background; start the Echo server with
+// e.StartAutoTLS(":443") to serve HTTPS with the provisioned certificates.
+func WithAutoTLS(domain, cacheDir string) EchoServerOption {
+	return func(e *echo.Echo) {
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(domain)
+		e.AutoTLSManager.Cache = autocert.DirCache(cacheDir)
+
+		go func() {
+			// Requests other than ACME challenges are redirected to HTTPS
+			handler := e.AutoTLSManager.HTTPHandler(nil)
+			if err := http.ListenAndServe(acmeChallengeAddr, handler); err != nil {
+				log.Printf("ACME challenge server error: %v", err)
+			}
+		}()
+	}
 }
 
 // SetupEchoServer creates and configures an Echo server with common middleware.
-func SetupEchoServer() *echo.Echo {
+func SetupEchoServer(opts ...EchoServerOption) *echo.Echo {
 	e := echo.New()
 
 	// Add middleware
@@ -114,5 +479,9 @@ func SetupEchoServer() *echo.Echo {
 	// Hide Echo banner for cleaner output
 	e.HideBanner = true
 
+	for _, opt := range opts {
+		opt(e)
+	}
+
 	return e
 }
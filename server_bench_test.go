@@ -0,0 +1,223 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// The transport benchmarks serve benchTarget on an ephemeral port and report
+// their throughput as a calls/s metric. Compare several runs made on the
+// same otherwise idle machine, for example with benchstat.
+
+// benchClientCounts are the numbers of concurrent clients each transport
+// benchmark is run with.
+var benchClientCounts = []int{1, 10}
+
+// benchTarget returns the target the benchmarks call: hello returns a
+// greeting and inc returns its numeric argument plus one.
+func benchTarget() *BaseRpcTarget {
+	target := NewBaseRpcTarget()
+
+	target.Method("hello", func(args json.RawMessage) (interface{}, error) {
+		var argArray []string
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return "Hello, World!", nil
+		}
+		return "Hello, " + argArray[0] + "!", nil
+	})
+
+	target.Method("inc", func(args json.RawMessage) (interface{}, error) {
+		var argArray []float64
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, fmt.Errorf("inc expects a number")
+		}
+		return argArray[0] + 1, nil
+	})
+
+	return target
+}
+
+// BenchmarkHTTPBatch measures hello calls made as HTTP batch requests, one
+// push and pull per request.
+func BenchmarkHTTPBatch(b *testing.B) {
+	for _, clients := range benchClientCounts {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			server := startBenchServer(b)
+			httpClient := &http.Client{
+				Transport: &http.Transport{MaxIdleConnsPerHost: clients},
+			}
+			defer httpClient.CloseIdleConnections()
+
+			body := []byte(`["push",["pipeline",0,["hello"],["bench"]]]` + "\n" + `["pull",1]`)
+
+			runBenchClients(b, clients, func(int) func() error {
+				return func() error {
+					resp, err := httpClient.Post(server.URL+"/rpc", ContentTypeText, bytes.NewReader(body))
+					if err != nil {
+						return err
+					}
+					defer resp.Body.Close()
+
+					response, err := io.ReadAll(resp.Body)
+					if err != nil {
+						return err
+					}
+					return expectResolve(string(response))
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkWebSocket measures hello calls made over WebSocket connections,
+// one per client.
+func BenchmarkWebSocket(b *testing.B) {
+	for _, clients := range benchClientCounts {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			server := startBenchServer(b)
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + "/rpc"
+
+			conns := make([]*websocket.Conn, clients)
+			for i := range conns {
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					b.Fatalf("dial %s: %v", url, err)
+				}
+				defer conn.Close()
+				conns[i] = conn
+			}
+
+			push := []byte(`["push",["pipeline",0,["hello"],["bench"]]]`)
+
+			runBenchClients(b, clients, func(client int) func() error {
+				conn := conns[client]
+				exportID := 0
+				return func() error {
+					exportID++
+					if err := conn.WriteMessage(websocket.TextMessage, push); err != nil {
+						return err
+					}
+					pull := fmt.Sprintf(`["pull",%d]`, exportID)
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(pull)); err != nil {
+						return err
+					}
+					_, response, err := conn.ReadMessage()
+					if err != nil {
+						return err
+					}
+					return expectResolve(string(response))
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkPipelineResolution compares a direct call with a chain of five
+// calls, each taking the previous result as its argument, resolved by a
+// single pull. It runs in-process so that only resolution is measured.
+func BenchmarkPipelineResolution(b *testing.B) {
+	for _, depth := range []int{1, 5} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			target := benchTarget()
+			session := NewRpcSession(target, WithLogger(log.New(io.Discard, "", 0)))
+
+			messages := []string{`["push",["pipeline",0,["inc"],[0]]]`}
+			for i := 2; i <= depth; i++ {
+				messages = append(messages, fmt.Sprintf(`["push",["pipeline",0,["inc"],[["pipeline",%d,[]]]]]`, i-1))
+			}
+			messages = append(messages, fmt.Sprintf(`["pull",%d]`, depth))
+			want := fmt.Sprintf(`["resolve",%d,%d]`, depth, depth)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sessionData := NewSessionData(target)
+				var response string
+				for _, message := range messages {
+					var err error
+					if response, err = session.HandleMessage(sessionData, message); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if response != want {
+					b.Fatalf("got %s, want %s", response, want)
+				}
+			}
+			reportCallRate(b)
+		})
+	}
+}
+
+// startBenchServer serves benchTarget at /rpc on an ephemeral port until the
+// benchmark ends.
+func startBenchServer(b *testing.B) *httptest.Server {
+	b.Helper()
+
+	e := echo.New()
+	e.HideBanner = true
+	quiet := log.New(io.Discard, "", 0)
+	SetupRpcEndpoint(e, "/rpc", benchTarget(), WithSessionOptions(WithLogger(quiet)))
+
+	server := httptest.NewServer(e)
+	b.Cleanup(server.Close)
+	return server
+}
+
+// runBenchClients makes b.N calls shared between the given number of
+// concurrent clients. newClient is called once per client, before timing
+// starts, and returns the function making one call.
+func runBenchClients(b *testing.B, clients int, newClient func(client int) func() error) {
+	calls := make([]func() error, clients)
+	for i := range calls {
+		calls[i] = newClient(i)
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, call := range calls {
+		wg.Add(1)
+		go func(call func() error) {
+			defer wg.Done()
+			for next.Add(1) <= int64(b.N) {
+				if err := call(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(call)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	reportCallRate(b)
+}
+
+// reportCallRate reports the benchmark's throughput in calls per second.
+func reportCallRate(b *testing.B) {
+	if elapsed := b.Elapsed().Seconds(); elapsed > 0 {
+		b.ReportMetric(float64(b.N)/elapsed, "calls/s")
+	}
+}
+
+// expectResolve checks that a response is a resolve frame.
+func expectResolve(response string) error {
+	if !strings.HasPrefix(response, `["resolve",`) {
+		return fmt.Errorf("unexpected response: %s", response)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// endpointServer serves target's RPC endpoint at /rpc, configured by opts,
+// and returns the server. Its log is discarded unless opts set a logger.
+func endpointServer(t *testing.T, target RpcTarget, opts ...RpcEndpointOption) *httptest.Server {
+	t.Helper()
+	e := echo.New()
+	opts = append([]RpcEndpointOption{WithSessionOptions(WithLogger(log.New(io.Discard, "", 0)))}, opts...)
+	SetupRpcEndpoint(e, "/rpc", target, opts...)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// websocketURL returns the WebSocket URL of server's endpoint at path.
+func websocketURL(server *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + path
+}
+
+// dialEndpoint opens a WebSocket connection to server's endpoint at /rpc
+// with the given request headers.
+func dialEndpoint(t *testing.T, server *httptest.Server, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL(server, "/rpc"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHeaderReferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     string
+	}{
+		{
+			name:     "argument",
+			messages: []string{`["push",["pipeline",0,["echo"],[["header","Authorization"]]]]`, `["pull",1]`},
+			want:     `["resolve",1,"Bearer test-token"]`,
+		},
+		{
+			name:     "pushed object",
+			messages: []string{`["push",{"token":["header","authorization"]}]`, `["pull",1]`},
+			want:     `["resolve",1,{"token":"Bearer test-token"}]`,
+		},
+		{
+			name:     "argument of a nested call",
+			messages: []string{`["push",["pipeline",0,["echo"],[["pipeline",0,["echo"],[["header","Authorization"]]]]]]`, `["pull",1]`},
+			want:     `["resolve",1,"Bearer test-token"]`,
+		},
+		{
+			name:     "missing header",
+			messages: []string{`["push",["pipeline",0,["echo"],[["header","X-Missing"]]]]`, `["pull",1]`},
+			want:     `["resolve",1,null]`,
+		},
+		{
+			name:     "array literal",
+			messages: []string{`["push",["pipeline",0,["echo"],[[["header","Authorization"]]]]]`, `["pull",1]`},
+			want:     `["resolve",1,[["header","Authorization"]]]`,
+		},
+		{
+			name:     "element of an array literal",
+			messages: []string{`["push",["pipeline",0,["echo"],[[[["header","Authorization"],1]]]]]`, `["pull",1]`},
+			want:     `["resolve",1,[[[["header","Authorization"]],1]]]`,
+		},
+		{
+			name: "pipeline path",
+			messages: []string{
+				`["push",{"header":{"Authorization":"data"}}]`,
+				`["push",["pipeline",0,["echo"],[["pipeline",1,["header","Authorization"]]]]]`,
+				`["pull",2]`,
+			},
+			want: `["resolve",2,"data"]`,
+		},
+		{
+			name:     "pushed array literal",
+			messages: []string{`["push",[["header","Authorization"]]]`, `["pull",1]`},
+			want:     `["resolve",1,[["header","Authorization"]]]`,
+		},
+	}
+	server := endpointServer(t, testTarget())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialEndpoint(t, server, http.Header{"Authorization": {"Bearer test-token"}})
+			sendMessages(t, conn, tt.messages...)
+			if got := readFrameWithPrefix(t, conn, `["resolve",`); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointMaxMessageBytes(t *testing.T) {
+	server := endpointServer(t, testTarget(), WithSessionOptions(WithMaxMessageBytes(1024)))
+	large := `["push",["pipeline",0,["echo"],["` + strings.Repeat("x", 2048) + `"]]]`
+
+	t.Run("websocket", func(t *testing.T) {
+		conn := dialEndpoint(t, server, nil)
+		sendMessages(t, conn, large)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+			t.Errorf("connection ended with %v, want close 1009", err)
+		}
+	})
+
+	t.Run("http batch", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/rpc", ContentTypeText, strings.NewReader(large+"\n"+`["pull",1]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", resp.StatusCode)
+		}
+	})
+}
+
+// postBatch sends body to server's endpoint at /rpc as an HTTP batch and
+// returns the response and its body.
+func postBatch(t *testing.T, server *httptest.Server, body string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/rpc", ContentTypeText, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(respBody)
+}
+
+func TestEndpointRouteGroup(t *testing.T) {
+	e := echo.New()
+	endpoint := SetupRpcEndpoint(e, "/api", testTarget(), WithSessionOptions(WithLogger(log.New(io.Discard, "", 0))))
+	endpoint.GET("/version", func(c echo.Context) error {
+		return c.String(http.StatusOK, "1.2.3")
+	})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "1.2.3" {
+		t.Errorf("GET /api/version = %d %q, want 200 \"1.2.3\"", resp.StatusCode, body)
+	}
+
+	// The RPC endpoint is still served over HTTP and WebSocket
+	resp, err = http.Post(server.URL+"/api", ContentTypeText, strings.NewReader(`["push",["pipeline",0,["echo"],["hi"]]]`+"\n"+`["pull",1]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := strings.TrimSpace(string(body)); got != `["resolve",1,"hi"]` {
+		t.Errorf("HTTP batch = %q", got)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL(server, "/api"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	sendMessages(t, conn, `["push",["pipeline",0,["echo"],["ws"]]]`, `["pull",1]`)
+	if got := readFrameWithPrefix(t, conn, `["resolve",1`); got != `["resolve",1,"ws"]` {
+		t.Errorf("WebSocket frame = %q", got)
+	}
+}
+
+func TestBatchResponseContentType(t *testing.T) {
+	lines := strings.Join([]string{
+		`["push",["pipeline",0,["echo"],["a"]]]`,
+		`["push",["pipeline",0,["echo"],["b"]]]`,
+		`["pull",1]`,
+		`["pull",2]`,
+	}, "\n")
+	tests := []struct {
+		name        string
+		opts        []RpcEndpointOption
+		body        string
+		contentType string
+		want        string
+	}{
+		{"default", nil, lines, ContentTypeText, "[\"resolve\",1,\"a\"]\n[\"resolve\",2,\"b\"]"},
+		{"ndjson", []RpcEndpointOption{WithResponseContentType(ContentTypeNDJSON)}, lines, ContentTypeNDJSON, "[\"resolve\",1,\"a\"]\n[\"resolve\",2,\"b\"]"},
+		{"json", []RpcEndpointOption{WithResponseContentType(ContentTypeJSON)}, lines, ContentTypeJSON, `[["resolve",1,"a"],["resolve",2,"b"]]`},
+		{"json request", nil, "[" + strings.ReplaceAll(lines, "\n", ",") + "]", ContentTypeJSON, `[["resolve",1,"a"],["resolve",2,"b"]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := endpointServer(t, testTarget(), tt.opts...)
+			resp, body := postBatch(t, server, tt.body)
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.contentType)
+			}
+			if strings.TrimSpace(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+			if tt.contentType == ContentTypeJSON {
+				var responses []json.RawMessage
+				if err := json.Unmarshal([]byte(body), &responses); err != nil || len(responses) != 2 {
+					t.Errorf("body is not a JSON array of 2 responses: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscribeMethodOverWebSocket(t *testing.T) {
+	values := make(chan interface{})
+	target := testTarget()
+	target.SubscribeMethod("ticks", func(json.RawMessage) (<-chan interface{}, error) {
+		return values, nil
+	})
+	server := endpointServer(t, target)
+	conn := dialEndpoint(t, server, nil)
+
+	// Each pull waits for the next value
+	sendMessages(t, conn, `["push",["pipeline",0,["ticks"],[]]]`)
+	for i := 1; i <= 3; i++ {
+		sendMessages(t, conn, `["pull",1]`)
+		values <- i
+		if got, want := readFrameWithPrefix(t, conn, `["resolve",`), fmt.Sprintf(`["resolve",1,%d]`, i); got != want {
+			t.Errorf("pull %d: got %s, want %s", i, got, want)
+		}
+	}
+	sendMessages(t, conn, `["pull",1]`)
+	close(values)
+	if got, want := readFrameWithPrefix(t, conn, `["complete",`), `["complete",1]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
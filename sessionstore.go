@@ -0,0 +1,656 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSessionTTL is how long the state of a closed WebSocket session is
+// kept for the client to resume it.
+const DefaultSessionTTL = 5 * time.Minute
+
+// ErrSessionNotFound is returned by SessionStore.Load when no session is
+// stored under the requested ID.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore persists the state of WebSocket sessions between connections
+// so that a client which reconnects can resume its session. Stored sessions
+// carry their pending operations, computed results, next export ID and
+// metadata; their target, subscriptions and request headers are not kept.
+// Stores that encode sessions, such as FileSessionStore, encode them with
+// their MarshalJSON and UnmarshalJSON methods. The capabilities a session
+// holds cannot be encoded; see TTLSessionStore.
+type SessionStore interface {
+	Save(id string, data *SessionData) error
+	Load(id string) (*SessionData, error)
+	Delete(id string) error
+}
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory.
+type MemorySessionStore struct {
+	sessions map[string]*SessionData
+	mu       sync.RWMutex
+}
+
+// NewMemorySessionStore creates an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*SessionData),
+	}
+}
+
+// Save implements SessionStore.
+func (m *MemorySessionStore) Save(id string, data *SessionData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = data
+	return nil
+}
+
+// Load implements SessionStore.
+func (m *MemorySessionStore) Load(id string) (*SessionData, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, exists := m.sessions[id]
+	if !exists {
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+// Delete implements SessionStore.
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// FileSessionStore is a SessionStore that writes each session to a JSON
+// file in a directory, so sessions survive a restart of the server. A
+// session that holds capabilities survives only as long as the process
+// that stored it, which keeps the capabilities in memory.
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore creates a FileSessionStore that keeps its files in
+// dir, creating the directory if it does not exist.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+// path returns the file a session is stored in. Session IDs are generated
+// by the server, but a resume token comes from the client, so IDs that
+// could name another file are refused.
+func (f *FileSessionStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("invalid session ID: %q", id)
+	}
+	return filepath.Join(f.dir, id+".json"), nil
+}
+
+// Save implements SessionStore. The file is replaced atomically.
+func (f *FileSessionStore) Save(id string, data *SessionData) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(f.dir, id+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return nil
+}
+
+// Load implements SessionStore.
+func (f *FileSessionStore) Load(id string) (*SessionData, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	var data SessionData
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	return &data, nil
+}
+
+// Delete implements SessionStore.
+func (f *FileSessionStore) Delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// TTLSessionStore wraps a SessionStore so that sessions expire a fixed time
+// after they were saved. The expiry is stored with the session, so it holds
+// across restarts when the wrapped store is persistent. Expired sessions
+// are deleted when they are loaded and by Sweep, which Save also runs.
+//
+// The capabilities returned by a session's methods cannot be encoded, so
+// the store keeps the export table of each session it saves in memory, and
+// disposes of the exports when the session expires or is deleted rather
+// than when its connection closes. A session whose capabilities were not
+// kept, such as one read back from a FileSessionStore after a restart, is
+// not resumed.
+type TTLSessionStore struct {
+	store SessionStore
+	ttl   time.Duration
+
+	// saved holds the sessions saved through the store.
+	saved map[string]savedSession
+	mu    sync.Mutex
+}
+
+// savedSession is a session saved through a TTLSessionStore: its expiry,
+// and the snapshot holding its export table.
+type savedSession struct {
+	expiresAt time.Time
+	data      *SessionData
+}
+
+// NewTTLSessionStore wraps store so that its sessions expire ttl after they
+// are saved. A ttl of zero or less uses DefaultSessionTTL.
+func NewTTLSessionStore(store SessionStore, ttl time.Duration) *TTLSessionStore {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &TTLSessionStore{
+		store: store,
+		ttl:   ttl,
+		saved: make(map[string]savedSession),
+	}
+}
+
+// Save implements SessionStore.
+func (t *TTLSessionStore) Save(id string, data *SessionData) error {
+	t.Sweep()
+
+	expiresAt := time.Now().Add(t.ttl)
+	data.ExpiresAt = expiresAt
+	if err := t.store.Save(id, data); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	previous, replaced := t.saved[id]
+	t.saved[id] = savedSession{expiresAt: expiresAt, data: data}
+	t.mu.Unlock()
+	if replaced && previous.data != data {
+		previous.data.disposeAll()
+	}
+	return nil
+}
+
+// Load implements SessionStore.
+func (t *TTLSessionStore) Load(id string) (*SessionData, error) {
+	data, err := t.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if data.expired() {
+		if err := t.Delete(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+// Delete implements SessionStore. The session's exports are disposed of.
+func (t *TTLSessionStore) Delete(id string) error {
+	t.mu.Lock()
+	saved, exists := t.saved[id]
+	delete(t.saved, id)
+	t.mu.Unlock()
+	if exists {
+		saved.data.disposeAll()
+	}
+	return t.store.Delete(id)
+}
+
+// Sweep deletes the expired sessions saved through the store, disposing of
+// their exports, and returns the number deleted.
+func (t *TTLSessionStore) Sweep() int {
+	now := time.Now()
+	var expired []string
+	var disposed []*SessionData
+	t.mu.Lock()
+	for id, saved := range t.saved {
+		if now.After(saved.expiresAt) {
+			expired = append(expired, id)
+			disposed = append(disposed, saved.data)
+			delete(t.saved, id)
+		}
+	}
+	t.mu.Unlock()
+
+	for i, id := range expired {
+		disposed[i].disposeAll()
+		t.store.Delete(id)
+	}
+	return len(expired)
+}
+
+// resume restores the session saved under id into sessionData and removes
+// it from the store, so it cannot be resumed by two connections at once.
+// The session's exports move to sessionData rather than being disposed of.
+// It reports whether the session was resumed, and returns an error for a
+// session that cannot be, such as one whose capabilities were not kept.
+func (t *TTLSessionStore) resume(id string, sessionData *SessionData) (bool, error) {
+	// The session leaves saved first, so that Sweep does not dispose of
+	// its exports while it is resumed; they are disposed of here unless
+	// they move to sessionData
+	t.mu.Lock()
+	saved, tracked := t.saved[id]
+	delete(t.saved, id)
+	t.mu.Unlock()
+	if tracked {
+		defer saved.data.disposeAll()
+	}
+
+	data, err := t.store.Load(id)
+	if errors.Is(err, ErrSessionNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := t.store.Delete(id); err != nil {
+		return false, err
+	}
+	if data.expired() {
+		return false, nil
+	}
+
+	// Stores that encode sessions return a copy without the export table
+	if tracked && data != saved.data {
+		data.adoptExports(saved.data)
+		defer data.disposeAll()
+	}
+	if err := data.checkCapabilities(); err != nil {
+		return false, err
+	}
+	sessionData.restore(data)
+	return true, nil
+}
+
+// expired reports whether a stored session has expired.
+func (sd *SessionData) expired() bool {
+	return !sd.ExpiresAt.IsZero() && time.Now().After(sd.ExpiresAt)
+}
+
+// takeExports removes the export table from the session and returns it.
+func (sd *SessionData) takeExports() map[int]*exportEntry {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	exports := sd.exports
+	sd.setExports(nil)
+	return exports
+}
+
+// adoptExports moves the export table of from, a snapshot of the session,
+// to sd, a copy of it decoded by a SessionStore.
+func (sd *SessionData) adoptExports(from *SessionData) {
+	exports := from.takeExports()
+	sd.mu.Lock()
+	sd.setExports(exports)
+	sd.mu.Unlock()
+}
+
+// checkCapabilities returns an error if a stored session held capabilities
+// that were not kept with it.
+func (sd *SessionData) checkCapabilities() error {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+	for _, exportID := range sd.storedCapabilities {
+		if entry, exists := sd.exports[exportID]; !exists || entry.target == nil {
+			return fmt.Errorf("session %s held capability %d, which was not kept", sd.ID, exportID)
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of the session's state for a SessionStore. Request
+// headers are left out; a resumed session uses those of its new connection.
+// Session values are copied, but only stores that keep the copy in memory
+// keep them. The export table, with the capabilities returned by methods,
+// moves to the snapshot, so that its exports are not disposed of when the
+// session ends.
+func (sd *SessionData) snapshot() *SessionData {
+	saved := &SessionData{
+		ID:                sd.ID,
+		PendingResults:    make(map[int]interface{}),
+		PendingOperations: make(map[int]Operation),
+		Metadata:          make(map[string]string),
+	}
+
+	sd.resultsMu.Lock()
+	for exportID, result := range sd.PendingResults {
+		saved.PendingResults[exportID] = result
+	}
+	sd.resultsMu.Unlock()
+
+	sd.mu.Lock()
+	for exportID, operation := range sd.PendingOperations {
+		saved.PendingOperations[exportID] = operation
+	}
+	saved.NextExportID = sd.NextExportID
+	saved.lastCapabilityID = sd.lastCapabilityID
+	// The contexts of the session's calls end with its connection
+	for _, entry := range sd.exports {
+		entry.cancels = nil
+	}
+	saved.setExports(sd.exports)
+	sd.setExports(nil)
+	sd.mu.Unlock()
+
+	sd.metaMu.RLock()
+	for key, value := range sd.Metadata {
+		if !strings.HasPrefix(key, headerMetaPrefix) {
+			saved.Metadata[key] = value
+		}
+	}
+	for key, value := range sd.values {
+		if saved.values == nil {
+			saved.values = make(map[string]interface{}, len(sd.values))
+		}
+		saved.values[key] = value
+	}
+	sd.metaMu.RUnlock()
+
+	return saved
+}
+
+// restore replaces the session's identity and state with that of a stored
+// session, whose export table moves to the session. Metadata already set
+// on the session, such as its negotiated protocol, takes precedence over
+// the stored metadata, as do values.
+func (sd *SessionData) restore(saved *SessionData) {
+	sd.resetResults()
+	for exportID, result := range saved.PendingResults {
+		sd.storeResult(exportID, result)
+	}
+
+	exports := saved.takeExports()
+	sd.mu.Lock()
+	sd.ID = saved.ID
+	sd.PendingOperations = make(map[int]Operation, len(saved.PendingOperations))
+	for exportID, operation := range saved.PendingOperations {
+		sd.PendingOperations[exportID] = operation
+	}
+	sd.indexCalls()
+	if saved.NextExportID > 0 {
+		sd.NextExportID = saved.NextExportID
+	}
+	sd.lastCapabilityID = saved.lastCapabilityID
+	sd.setExports(exports)
+	if exports == nil {
+		// The client still holds a reference to every export it has not
+		// released
+		for exportID := range saved.PendingOperations {
+			sd.addExportRef(exportID)
+		}
+		for exportID := range saved.PendingResults {
+			if _, exists := sd.exports[exportID]; !exists {
+				sd.addExportRef(exportID)
+			}
+		}
+	}
+	sd.mu.Unlock()
+
+	for key, value := range saved.Metadata {
+		if _, exists := sd.GetMeta(key); !exists {
+			sd.SetMeta(key, value)
+		}
+	}
+	for key, value := range saved.values {
+		if _, exists := sd.Value(key); !exists {
+			sd.SetValue(key, value)
+		}
+	}
+}
+
+// storedSession is the encoding of a SessionData by stores such as
+// FileSessionStore. Results are kept as the expressions they are sent to
+// the client as, and capabilities by their export IDs alone.
+type storedSession struct {
+	ID                string                  `json:"id"`
+	PendingResults    map[int]json.RawMessage `json:"pendingResults"`
+	PendingOperations map[int]Operation       `json:"pendingOperations"`
+	NextExportID      int                     `json:"nextExportId"`
+	Metadata          map[string]string       `json:"metadata,omitempty"`
+	ExpiresAt         time.Time               `json:"expiresAt,omitempty"`
+	LastCapabilityID  int                     `json:"lastCapabilityId,omitempty"`
+	Capabilities      []int                   `json:"capabilities,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, encoding the state a SessionStore
+// keeps.
+func (sd *SessionData) MarshalJSON() ([]byte, error) {
+	stored := storedSession{
+		ID:                sd.ID,
+		PendingResults:    make(map[int]json.RawMessage),
+		PendingOperations: make(map[int]Operation),
+		ExpiresAt:         sd.ExpiresAt,
+	}
+
+	sd.resultsMu.Lock()
+	for exportID, result := range sd.PendingResults {
+		encoded, err := json.Marshal(wireValue(result))
+		if err != nil {
+			sd.resultsMu.Unlock()
+			return nil, fmt.Errorf("failed to encode result of export %d: %w", exportID, err)
+		}
+		stored.PendingResults[exportID] = encoded
+	}
+	sd.resultsMu.Unlock()
+
+	sd.mu.RLock()
+	for exportID, operation := range sd.PendingOperations {
+		stored.PendingOperations[exportID] = operation
+	}
+	stored.NextExportID = sd.NextExportID
+	stored.LastCapabilityID = sd.lastCapabilityID
+	for exportID, entry := range sd.exports {
+		if entry.target != nil {
+			stored.Capabilities = append(stored.Capabilities, exportID)
+		}
+	}
+	stored.Capabilities = append(stored.Capabilities, sd.storedCapabilities...)
+	sd.mu.RUnlock()
+	sort.Ints(stored.Capabilities)
+
+	sd.metaMu.RLock()
+	if len(sd.Metadata) > 0 {
+		stored.Metadata = make(map[string]string, len(sd.Metadata))
+		for key, value := range sd.Metadata {
+			stored.Metadata[key] = value
+		}
+	}
+	sd.metaMu.RUnlock()
+
+	return json.Marshal(stored)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding a session encoded by
+// MarshalJSON. The decoded session has no export table; the export IDs of
+// the capabilities it held are kept so that resuming it can be refused.
+func (sd *SessionData) UnmarshalJSON(data []byte) error {
+	var stored storedSession
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	results := make(map[int]interface{}, len(stored.PendingResults))
+	for exportID, encoded := range stored.PendingResults {
+		expr, err := decodeJSON(encoded)
+		if err != nil {
+			return fmt.Errorf("failed to decode result of export %d: %w", exportID, err)
+		}
+		results[exportID] = storedValue(expr)
+	}
+	if stored.PendingOperations == nil {
+		stored.PendingOperations = make(map[int]Operation)
+	}
+
+	sd.resetResults()
+	for exportID, result := range results {
+		sd.storeResult(exportID, result)
+	}
+	sd.mu.Lock()
+	sd.ID = stored.ID
+	sd.PendingOperations = stored.PendingOperations
+	sd.indexCalls()
+	sd.NextExportID = stored.NextExportID
+	sd.ExpiresAt = stored.ExpiresAt
+	sd.lastCapabilityID = stored.LastCapabilityID
+	sd.storedCapabilities = stored.Capabilities
+	sd.mu.Unlock()
+	sd.metaMu.Lock()
+	sd.Metadata = stored.Metadata
+	sd.metaMu.Unlock()
+	return nil
+}
+
+// storedValue reverses wireValue for a result read back from a stored
+// session: escaped arrays become arrays again and exports become stubs.
+// Other expressions, such as dates and errors, are kept as they are sent.
+func storedValue(expr interface{}) interface{} {
+	switch v := expr.(type) {
+	case []interface{}:
+		if len(v) == 1 {
+			if elems, ok := v[0].([]interface{}); ok {
+				values := make([]interface{}, len(elems))
+				for i, elem := range elems {
+					values[i] = storedValue(elem)
+				}
+				return values
+			}
+		}
+		if len(v) == 2 && v[0] == "export" {
+			if exportID, ok := v[1].(float64); ok {
+				return exportStub{id: int(exportID)}
+			}
+		}
+		return wireExpression(v)
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			fields[key] = storedValue(val)
+		}
+		return fields
+	default:
+		return expr
+	}
+}
+
+// operationJSON is the encoding of an Operation, which adds the fields a
+// stored operation needs to be dispatched as it would have been.
+type operationJSON struct {
+	operationFields
+	LiteralArgs  bool            `json:"literalArgs,omitempty"`
+	Error        json.RawMessage `json:"error,omitempty"`
+	ErrorMessage string          `json:"errorMessage,omitempty"`
+}
+
+// operationFields has the fields of Operation without its methods.
+type operationFields Operation
+
+// MarshalJSON implements json.Marshaler.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	encoded := operationJSON{operationFields: operationFields(o), LiteralArgs: o.literalArgs}
+	if o.Err != nil {
+		if rpcErr, ok := asRpcError(o.Err); ok {
+			expr, err := json.Marshal(Devaluator{}.DevaluateError(rpcErr, rpcErr.Code))
+			if err != nil {
+				return nil, err
+			}
+			encoded.Error = expr
+		} else {
+			encoded.ErrorMessage = o.Err.Error()
+		}
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var decoded operationJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*o = Operation(decoded.operationFields)
+	o.literalArgs = decoded.LiteralArgs
+	switch {
+	case decoded.Error != nil:
+		expr, err := decodeJSON(decoded.Error)
+		if err != nil {
+			return err
+		}
+		o.Err = Evaluator{}.EvaluateError(expr)
+	case decoded.ErrorMessage != "":
+		o.Err = errors.New(decoded.ErrorMessage)
+	}
+	return nil
+}
+
+// sessionFrame returns the ["session", id] frame that tells a client the
+// token with which it can resume its session.
+func sessionFrame(id string) string {
+	frame, _ := json.Marshal([]interface{}{"session", id})
+	return string(frame)
+}
+
+// parseResume returns the token of a ["resume", token] message.
+func parseResume(message []byte) (string, bool) {
+	var msg []interface{}
+	if err := json.Unmarshal(message, &msg); err != nil || len(msg) != 2 {
+		return "", false
+	}
+	if kind, ok := msg[0].(string); !ok || kind != "resume" {
+		return "", false
+	}
+	token, ok := msg[1].(string)
+	return token, ok
+}
@@ -0,0 +1,345 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// disposableCounter is a capability that counts the calls made on it and
+// the times it is disposed of.
+type disposableCounter struct {
+	*BaseRpcTarget
+	disposed *atomic.Int32
+}
+
+func (c disposableCounter) Dispose() {
+	c.disposed.Add(1)
+}
+
+// counterTarget returns testTarget with a "counter" method returning a
+// disposableCounter, whose disposals are counted in disposed.
+func counterTarget(disposed *atomic.Int32) *BaseRpcTarget {
+	target := testTarget()
+	target.Method("counter", func(json.RawMessage) (interface{}, error) {
+		counter := disposableCounter{BaseRpcTarget: NewBaseRpcTarget(), disposed: disposed}
+		var calls atomic.Int32
+		counter.Method("next", func(json.RawMessage) (interface{}, error) {
+			return calls.Add(1), nil
+		})
+		return counter, nil
+	})
+	return target
+}
+
+// resumeServer serves target's WebSocket endpoint with store and returns
+// its URL.
+func resumeServer(t *testing.T, target RpcTarget, store SessionStore) string {
+	t.Helper()
+	e := echo.New()
+	SetupRpcEndpoint(e, "/rpc", target,
+		WithSessionStore(store),
+		WithSessionOptions(WithLogger(log.New(io.Discard, "", 0))))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/rpc"
+}
+
+// dialSession opens a connection to url and returns it with the session
+// token the server sent.
+func dialSession(t *testing.T, url string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, sessionToken(t, readFrameWithPrefix(t, conn, `["session",`))
+}
+
+// sessionToken returns the token of a ["session", token] frame.
+func sessionToken(t *testing.T, frame string) string {
+	t.Helper()
+	var session []string
+	if err := json.Unmarshal([]byte(frame), &session); err != nil || len(session) != 2 {
+		t.Fatalf("invalid session frame %s", frame)
+	}
+	return session[1]
+}
+
+// sendMessages writes each message to conn.
+func sendMessages(t *testing.T, conn *websocket.Conn, messages ...string) {
+	t.Helper()
+	for _, message := range messages {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatalf("write %s: %v", message, err)
+		}
+	}
+}
+
+// readFrameWithPrefix reads frames from conn, skipping those that do not
+// start with prefix, and returns the first that does.
+func readFrameWithPrefix(t *testing.T, conn *websocket.Conn, prefix string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", prefix, err)
+		}
+		if strings.HasPrefix(string(frame), prefix) {
+			return string(frame)
+		}
+	}
+}
+
+// closeAndAwaitSave closes conn and waits for its session to be saved.
+func closeAndAwaitSave(t *testing.T, conn *websocket.Conn, store SessionStore, token string) {
+	t.Helper()
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.Load(token); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %s was not saved", token)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestResumeKeepsCapabilities(t *testing.T) {
+	stores := map[string]func(t *testing.T) SessionStore{
+		"memory": func(*testing.T) SessionStore { return NewMemorySessionStore() },
+		"file": func(t *testing.T) SessionStore {
+			store, err := NewFileSessionStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			var disposed atomic.Int32
+			store := NewTTLSessionStore(newStore(t), time.Minute)
+			url := resumeServer(t, counterTarget(&disposed), store)
+
+			conn, token := dialSession(t, url)
+			sendMessages(t, conn,
+				`["push",["pipeline",0,["counter"],[]]]`,
+				`["pull",1]`,
+				`["push",["pipeline",-1,["next"],[]]]`,
+				`["pull",2]`)
+			if got := readFrameWithPrefix(t, conn, `["resolve",2,`); got != `["resolve",2,1]` {
+				t.Fatalf("first call: got %s", got)
+			}
+			closeAndAwaitSave(t, conn, store, token)
+			if n := disposed.Load(); n != 0 {
+				t.Fatalf("capability disposed %d times when the connection closed", n)
+			}
+
+			conn, _ = dialSession(t, url)
+			sendMessages(t, conn, `["resume","`+token+`"]`)
+			if got := sessionToken(t, readFrameWithPrefix(t, conn, `["session",`)); got != token {
+				t.Fatalf("resumed session %s, want %s", got, token)
+			}
+			sendMessages(t, conn,
+				`["pull",1]`,
+				`["push",["pipeline",-1,["next"],[]]]`,
+				`["pull",3]`)
+			if got := readFrameWithPrefix(t, conn, `["resolve",1,`); got != `["resolve",1,["export",-1]]` {
+				t.Errorf("pull of the stored result: got %s", got)
+			}
+			if got := readFrameWithPrefix(t, conn, `["resolve",3,`); got != `["resolve",3,2]` {
+				t.Errorf("call on the resumed capability: got %s", got)
+			}
+			closeAndAwaitSave(t, conn, store, token)
+			if n := disposed.Load(); n != 0 {
+				t.Fatalf("capability disposed %d times when the resumed connection closed", n)
+			}
+
+			if err := store.Delete(token); err != nil {
+				t.Fatal(err)
+			}
+			if n := disposed.Load(); n != 1 {
+				t.Errorf("capability disposed %d times when the session was deleted, want 1", n)
+			}
+		})
+	}
+}
+
+func TestResumeAfterRestartRefusesLostCapabilities(t *testing.T) {
+	dir := t.TempDir()
+	newStore := func() *TTLSessionStore {
+		store, err := NewFileSessionStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewTTLSessionStore(store, time.Minute)
+	}
+	var disposed atomic.Int32
+	store := newStore()
+	conn, token := dialSession(t, resumeServer(t, counterTarget(&disposed), store))
+	sendMessages(t, conn, `["push",["pipeline",0,["counter"],[]]]`, `["pull",1]`)
+	readFrameWithPrefix(t, conn, `["resolve",1,`)
+	closeAndAwaitSave(t, conn, store, token)
+
+	// A new store over the same directory stands for a restarted server,
+	// which has lost the capability
+	restarted := newStore()
+	conn, _ = dialSession(t, resumeServer(t, counterTarget(&disposed), restarted))
+	sendMessages(t, conn, `["resume","`+token+`"]`)
+	if got := sessionToken(t, readFrameWithPrefix(t, conn, `["session",`)); got == token {
+		t.Fatal("session resumed without its capability")
+	}
+	if _, err := restarted.Load(token); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("refused session still stored: %v", err)
+	}
+}
+
+func TestResumeWithHello(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+	}{
+		{"resume then hello", []string{"resume", "hello"}},
+		{"hello then resume", []string{"hello", "resume"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemorySessionStore()
+			url := resumeServer(t, testTarget(), store)
+			conn, token := dialSession(t, url)
+			sendMessages(t, conn, `["push",["pipeline",0,["echo"],["Ada"]]]`)
+			closeAndAwaitSave(t, conn, store, token)
+
+			conn, _ = dialSession(t, url)
+			for _, step := range tt.order {
+				switch step {
+				case "hello":
+					sendMessages(t, conn, `["hello",{}]`)
+					readFrameWithPrefix(t, conn, `["hello-ack",`)
+				case "resume":
+					sendMessages(t, conn, `["resume","`+token+`"]`)
+					if got := sessionToken(t, readFrameWithPrefix(t, conn, `["session",`)); got != token {
+						t.Fatalf("resumed session %s, want %s", got, token)
+					}
+				}
+			}
+			sendMessages(t, conn, `["pull",1]`)
+			if got := readFrameWithPrefix(t, conn, `["resolve",1,`); got != `["resolve",1,"Ada"]` {
+				t.Errorf("got %s", got)
+			}
+		})
+	}
+}
+
+func TestResumeOnlyBeforeOtherMessages(t *testing.T) {
+	store := NewMemorySessionStore()
+	url := resumeServer(t, testTarget(), store)
+	conn, token := dialSession(t, url)
+	sendMessages(t, conn, `["push",["pipeline",0,["echo"],["Ada"]]]`)
+	closeAndAwaitSave(t, conn, store, token)
+
+	conn, _ = dialSession(t, url)
+	sendMessages(t, conn,
+		`["push",["pipeline",0,["echo"],["Grace"]]]`,
+		`["resume","`+token+`"]`,
+		`["pull",1]`)
+	if got := readFrameWithPrefix(t, conn, `["resolve",1,`); got != `["resolve",1,"Grace"]` {
+		t.Errorf("got %s, want the new session's result", got)
+	}
+}
+
+func TestTTLSessionStoreDisposesExpiredSessions(t *testing.T) {
+	var disposed atomic.Int32
+	target := counterTarget(&disposed)
+	session := newTestSession(target)
+	sessionData := NewSessionData(target)
+	for _, message := range []string{`["push",["pipeline",0,["counter"],[]]]`, `["pull",1]`} {
+		if _, err := session.HandleMessageFrames(sessionData, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewTTLSessionStore(NewMemorySessionStore(), time.Millisecond)
+	if err := store.Save(sessionData.ID, sessionData.snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	// The session ending leaves the stored exports alone
+	sessionData.disposeAll()
+	if n := disposed.Load(); n != 0 {
+		t.Fatalf("capability disposed %d times when the session ended", n)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if n := store.Sweep(); n != 1 {
+		t.Errorf("Sweep deleted %d sessions, want 1", n)
+	}
+	if n := disposed.Load(); n != 1 {
+		t.Errorf("capability disposed %d times when the session expired, want 1", n)
+	}
+}
+
+func TestFileSessionStoreRoundTrip(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := NewSessionData(nil)
+	saved.NextExportID = 7
+	saved.Metadata["tenant"] = "acme"
+	saved.PendingResults = map[int]interface{}{
+		1: []interface{}{"a", []interface{}{1.0}},
+		2: map[string]interface{}{"cap": exportStub{id: -1}, "list": []interface{}{}},
+		3: wireExpression{"date", 1.7e12},
+		4: []interface{}{"error", "QuotaExceeded", "slow down"},
+		5: RpcError{Code: "Conflict", Message: "taken", Data: map[string]interface{}{"field": "name"}},
+	}
+	saved.PendingOperations = map[int]Operation{
+		6: {Method: "echo", Args: json.RawMessage(`["Ada"]`), literalArgs: true},
+		7: {Err: RpcError{Code: "InvalidPush", Message: "bad push"}},
+		8: {Err: errors.New("invalid arguments")},
+	}
+	if err := store.Save(saved.ID, saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load(saved.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.ID != saved.ID || loaded.NextExportID != 7 || loaded.Metadata["tenant"] != "acme" {
+		t.Errorf("loaded session %s with next export %d and metadata %v", loaded.ID, loaded.NextExportID, loaded.Metadata)
+	}
+	for exportID, result := range saved.PendingResults {
+		want, _ := json.Marshal(resolveFrame(exportID, result))
+		got, _ := json.Marshal(resolveFrame(exportID, loaded.PendingResults[exportID]))
+		if string(got) != string(want) {
+			t.Errorf("result %d: got %s, want %s", exportID, got, want)
+		}
+	}
+	if _, ok := loaded.PendingResults[2].(map[string]interface{})["cap"].(exportStub); !ok {
+		t.Errorf("export in result 2 read back as %#v", loaded.PendingResults[2])
+	}
+	if op := loaded.PendingOperations[6]; op.Method != "echo" || string(op.Args) != `["Ada"]` || !op.literalArgs {
+		t.Errorf("operation 6 read back as %+v", op)
+	}
+	if err := loaded.PendingOperations[7].Err; !errors.Is(err, RpcError{Code: "InvalidPush"}) || err.Error() != saved.PendingOperations[7].Err.Error() {
+		t.Errorf("operation 7 error read back as %#v", err)
+	}
+	if err := loaded.PendingOperations[8].Err; err == nil || err.Error() != "invalid arguments" {
+		t.Errorf("operation 8 error read back as %#v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package gocapnweb
+
+// Session values let handlers keep state, such as the result of
+// authenticating the caller, a cursor or a rate counter, for the rest of a
+// session without keeping maps keyed by session ID of their own. Handlers
+// reach the session with SessionFromContext, or are passed it as
+// SessionTargets. Unlike Metadata, values may be of any type; they are
+// carried over when a session is resumed from a MemorySessionStore but are
+// not saved by stores that encode sessions, such as FileSessionStore.
+
+// Value returns the session value stored under key.
+func (sd *SessionData) Value(key string) (interface{}, bool) {
+	sd.metaMu.RLock()
+	defer sd.metaMu.RUnlock()
+	value, exists := sd.values[key]
+	return value, exists
+}
+
+// SetValue stores a session value under key.
+func (sd *SessionData) SetValue(key string, value interface{}) {
+	sd.metaMu.Lock()
+	defer sd.metaMu.Unlock()
+	if sd.values == nil {
+		sd.values = make(map[string]interface{})
+	}
+	sd.values[key] = value
+}
+
+// DeleteValue removes the session value stored under key.
+func (sd *SessionData) DeleteValue(key string) {
+	sd.metaMu.Lock()
+	defer sd.metaMu.Unlock()
+	delete(sd.values, key)
+}
+
+// UpdateValue replaces the session value stored under key with the one
+// update returns for it, atomically with respect to other calls made in the
+// session, and returns the new value. update is passed the current value
+// and whether there is one, and must not call the session's other methods.
+func (sd *SessionData) UpdateValue(key string, update func(value interface{}, exists bool) interface{}) interface{} {
+	sd.metaMu.Lock()
+	defer sd.metaMu.Unlock()
+	if sd.values == nil {
+		sd.values = make(map[string]interface{})
+	}
+	value, exists := sd.values[key]
+	value = update(value, exists)
+	sd.values[key] = value
+	return value
+}
+
+// SessionValue returns the session value stored under key if it is of type
+// T.
+func SessionValue[T any](sd *SessionData, key string) (T, bool) {
+	value, exists := sd.Value(key)
+	if !exists {
+		var zero T
+		return zero, false
+	}
+	typed, ok := value.(T)
+	return typed, ok
+}
@@ -0,0 +1,168 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// valuesTarget returns a target whose methods keep the caller's name and a
+// call count as session values.
+func valuesTarget() *BaseRpcTarget {
+	target := NewBaseRpcTarget()
+	target.MethodWithContext("login", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var names []string
+		if err := json.Unmarshal(args, &names); err != nil || len(names) != 1 {
+			return nil, NewRpcError("ArgumentError", "login takes a name")
+		}
+		sessionData, _ := SessionFromContext(ctx)
+		sessionData.SetValue("user", names[0])
+		return true, nil
+	})
+	target.MethodWithContext("whoami", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		sessionData, _ := SessionFromContext(ctx)
+		if user, ok := SessionValue[string](sessionData, "user"); ok {
+			return user, nil
+		}
+		return nil, NewRpcError("Unauthenticated", "not logged in")
+	})
+	target.MethodWithContext("logout", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		sessionData, _ := SessionFromContext(ctx)
+		sessionData.DeleteValue("user")
+		return true, nil
+	})
+	target.MethodWithContext("count", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		sessionData, _ := SessionFromContext(ctx)
+		return sessionData.UpdateValue("calls", func(value interface{}, exists bool) interface{} {
+			if !exists {
+				return 1
+			}
+			return value.(int) + 1
+		}), nil
+	})
+	return target
+}
+
+// sessionCaller calls methods of target in one session, returning the frame
+// each call's pull is answered with.
+type sessionCaller struct {
+	t           *testing.T
+	session     *RpcSession
+	sessionData *SessionData
+	nextID      int
+}
+
+func newSessionCaller(t *testing.T, target RpcTarget) *sessionCaller {
+	return &sessionCaller{t: t, session: newTestSession(target), sessionData: NewSessionData(target), nextID: 1}
+}
+
+func (c *sessionCaller) call(method string, args string) string {
+	c.t.Helper()
+	id := c.nextID
+	c.nextID++
+	var frames []string
+	for _, message := range []string{
+		fmt.Sprintf(`["push",["pipeline",0,[%q],%s]]`, method, args),
+		fmt.Sprintf(`["pull",%d]`, id),
+	} {
+		sent, err := c.session.HandleMessageFrames(c.sessionData, message)
+		if err != nil {
+			c.t.Fatalf("message %s: %v", message, err)
+		}
+		frames = append(frames, sent...)
+	}
+	if len(frames) != 1 {
+		c.t.Fatalf("call %s: got frames %v, want one", method, frames)
+	}
+	return frames[0]
+}
+
+func TestSessionValues(t *testing.T) {
+	target := valuesTarget()
+	caller := newSessionCaller(t, target)
+	steps := []struct {
+		method string
+		args   string
+		want   string
+	}{
+		{"whoami", `[]`, `["reject",1,["error","Unauthenticated","not logged in"]]`},
+		{"login", `["ada"]`, `["resolve",2,true]`},
+		{"whoami", `[]`, `["resolve",3,"ada"]`},
+		{"count", `[]`, `["resolve",4,1]`},
+		{"count", `[]`, `["resolve",5,2]`},
+		{"login", `["grace"]`, `["resolve",6,true]`},
+		{"whoami", `[]`, `["resolve",7,"grace"]`},
+		{"logout", `[]`, `["resolve",8,true]`},
+		{"whoami", `[]`, `["reject",9,["error","Unauthenticated","not logged in"]]`},
+		{"count", `[]`, `["resolve",10,3]`},
+	}
+	for _, step := range steps {
+		if got := caller.call(step.method, step.args); got != step.want {
+			t.Errorf("%s%s: got %s, want %s", step.method, step.args, got, step.want)
+		}
+	}
+	if calls, ok := SessionValue[int](caller.sessionData, "calls"); !ok || calls != 3 {
+		t.Errorf("SessionValue[int](calls) = %d, %v, want 3", calls, ok)
+	}
+	if _, ok := SessionValue[string](caller.sessionData, "calls"); ok {
+		t.Error("SessionValue of the wrong type reported a value")
+	}
+}
+
+func TestSessionValuesIsolation(t *testing.T) {
+	target := valuesTarget()
+	first := newSessionCaller(t, target)
+	second := newSessionCaller(t, target)
+
+	first.call("login", `["ada"]`)
+	first.call("count", `[]`)
+	if got, want := second.call("whoami", `[]`), `["reject",1,["error","Unauthenticated","not logged in"]]`; got != want {
+		t.Errorf("second session: got %s, want %s", got, want)
+	}
+	if got, want := second.call("count", `[]`), `["resolve",2,1]`; got != want {
+		t.Errorf("second session: got %s, want %s", got, want)
+	}
+	second.call("login", `["grace"]`)
+	if got, want := first.call("whoami", `[]`), `["resolve",3,"ada"]`; got != want {
+		t.Errorf("first session: got %s, want %s", got, want)
+	}
+
+	// Each WebSocket connection has a session of its own
+	server := endpointServer(t, target)
+	ada, grace := dialEndpoint(t, server, nil), dialEndpoint(t, server, nil)
+	sendMessages(t, ada, `["push",["pipeline",0,["login"],["ada"]]]`, `["pull",1]`)
+	readFrameWithPrefix(t, ada, `["resolve",1`)
+	sendMessages(t, grace, `["push",["pipeline",0,["login"],["grace"]]]`, `["pull",1]`)
+	readFrameWithPrefix(t, grace, `["resolve",1`)
+	sendMessages(t, ada, `["push",["pipeline",0,["whoami"],[]]]`, `["pull",2]`)
+	if got, want := readFrameWithPrefix(t, ada, `["resolve",2`), `["resolve",2,"ada"]`; got != want {
+		t.Errorf("first connection: got %s, want %s", got, want)
+	}
+}
+
+func TestUpdateValueConcurrent(t *testing.T) {
+	sessionData := NewSessionData(NewBaseRpcTarget())
+	const workers, increments = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				sessionData.UpdateValue("n", func(value interface{}, exists bool) interface{} {
+					if !exists {
+						return 1
+					}
+					return value.(int) + 1
+				})
+				sessionData.Value("n")
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := SessionValue[int](sessionData, "n"); n != workers*increments {
+		t.Errorf("n = %d, want %d", n, workers*increments)
+	}
+}
@@ -0,0 +1,77 @@
+package gocapnweb
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SetupOptions combines the options of the Echo server and RPC endpoint
+// created by SetupAll.
+type SetupOptions struct {
+	// RpcEndpointOptions configures the RPC endpoint.
+	RpcEndpointOptions
+
+	// EchoOptions configure the Echo server.
+	EchoOptions []EchoServerOption
+}
+
+// SetupOption configures SetupAll.
+type SetupOption func(*SetupOptions)
+
+// WithEchoOptions applies options to the Echo server created by SetupAll.
+func WithEchoOptions(opts ...EchoServerOption) SetupOption {
+	return func(o *SetupOptions) {
+		o.EchoOptions = append(o.EchoOptions, opts...)
+	}
+}
+
+// WithEndpointOptions applies options to the RPC endpoint created by
+// SetupAll.
+func WithEndpointOptions(opts ...RpcEndpointOption) SetupOption {
+	return func(o *SetupOptions) {
+		for _, opt := range opts {
+			opt(&o.RpcEndpointOptions)
+		}
+	}
+}
+
+// SetupAll creates an Echo server serving an RPC target and static files.
+// In order, it:
+//
+//  1. creates the server with SetupEchoServer and the Echo options,
+//  2. registers the WebSocket and HTTP batch RPC endpoints for target at
+//     rpcPath with SetupRpcEndpoint and the endpoint options, and
+//  3. serves the files under staticFSRoot at staticPath with
+//     SetupFileEndpoint.
+//
+// The server's address is set to port, so it can be started with
+// e.Start(port). An error is returned if port is not a valid listen address
+// or either path is empty.
+func SetupAll(port, rpcPath, staticPath, staticFSRoot string, target RpcTarget, opts ...SetupOption) (*echo.Echo, error) {
+	if _, _, err := net.SplitHostPort(port); err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", port, err)
+	}
+	if rpcPath == "" {
+		return nil, fmt.Errorf("rpc path must not be empty")
+	}
+	if staticPath == "" {
+		return nil, fmt.Errorf("static path must not be empty")
+	}
+
+	options := SetupOptions{RpcEndpointOptions: defaultRpcEndpointOptions()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	e := SetupEchoServer(options.EchoOptions...)
+	e.Server.Addr = port
+
+	SetupRpcEndpoint(e, rpcPath, target, func(o *RpcEndpointOptions) {
+		*o = options.RpcEndpointOptions
+	})
+	SetupFileEndpoint(e, staticPath, staticFSRoot)
+
+	return e, nil
+}
@@ -0,0 +1,92 @@
+package gocapnweb
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSetupAll(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>hello</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var configured bool
+	e, err := SetupAll(":9000", "/api", "/static", root, testTarget(),
+		WithEchoOptions(func(e *echo.Echo) { configured = true }),
+		WithEndpointOptions(
+			WithSessionOptions(WithLogger(log.New(io.Discard, "", 0)), WithMaxMessageBytes(1024)),
+		))
+	if err != nil {
+		t.Fatalf("SetupAll: %v", err)
+	}
+	if !configured {
+		t.Error("the Echo options were not applied")
+	}
+	if e.Server.Addr != ":9000" {
+		t.Errorf("server address = %q, want :9000", e.Server.Addr)
+	}
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// The RPC endpoint answers batches, within the endpoint options' limit
+	resp, err := http.Post(server.URL+"/api", ContentTypeText, strings.NewReader(`["push",["pipeline",0,["echo"],["hi"]]]`+"\n"+`["pull",1]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := strings.TrimSpace(string(body)); got != `["resolve",1,"hi"]` {
+		t.Errorf("RPC batch = %d %q", resp.StatusCode, got)
+	}
+	resp, err = http.Post(server.URL+"/api", ContentTypeText, strings.NewReader(`["push",["pipeline",0,["echo"],["`+strings.Repeat("x", 2048)+`"]]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("a batch over the endpoint's message limit was accepted")
+	}
+
+	// The static files are served
+	resp, err = http.Get(server.URL + "/static/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "<h1>hello</h1>" {
+		t.Errorf("static file = %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestSetupAllInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		port       string
+		rpcPath    string
+		staticPath string
+		wantErr    string
+	}{
+		{"bare port", "9000", "/api", "/static", `invalid port "9000": address 9000: missing port in address`},
+		{"empty port", "", "/api", "/static", `invalid port "": missing port in address`},
+		{"empty rpc path", ":9000", "", "/static", "rpc path must not be empty"},
+		{"empty static path", ":9000", "/api", "", "static path must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := SetupAll(tt.port, tt.rpcPath, tt.staticPath, t.TempDir(), testTarget())
+			if e != nil || err == nil || err.Error() != tt.wantErr {
+				t.Errorf("SetupAll = %v, %v; want error %q", e, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package gocapnweb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Server-Sent Events transport settings.
+const (
+	// SSEHeartbeatInterval is how often an idle event stream is sent a
+	// comment to keep it alive through proxies.
+	SSEHeartbeatInterval = 15 * time.Second
+
+	// SSESessionCookie names the cookie that identifies an event stream's
+	// session to the companion send endpoint.
+	SSESessionCookie = "capnweb_sse_session"
+
+	// SSESessionParam is the query parameter that may identify the session
+	// instead of the cookie.
+	SSESessionParam = "sessionID"
+)
+
+// errSSEClosed is returned when a frame is sent to a closed event stream.
+var errSSEClosed = errors.New("event stream closed")
+
+// sseSession is the state shared by an event stream and the sends made to it.
+type sseSession struct {
+	data   *SessionData
+	frames chan []byte
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// mu serializes the messages of concurrent sends.
+	mu sync.Mutex
+}
+
+// send queues a frame for the event stream.
+func (ss *sseSession) send(frame []byte) error {
+	select {
+	case ss.frames <- frame:
+		return nil
+	case <-ss.done:
+		return errSSEClosed
+	}
+}
+
+// sseSessionStore holds the open event streams, keyed by session ID.
+type sseSessionStore struct {
+	sessions map[string]*sseSession
+	mu       sync.RWMutex
+}
+
+func (st *sseSessionStore) add(ss *sseSession) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sessions[ss.data.ID] = ss
+}
+
+func (st *sseSessionStore) get(id string) (*sseSession, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	ss, exists := st.sessions[id]
+	return ss, exists
+}
+
+func (st *sseSessionStore) remove(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, id)
+}
+
+// SetupSSEEndpoint registers a Server-Sent Events transport, for clients
+// behind proxies that block WebSocket upgrades:
+//
+//	GET  path       opens the event stream for a new session
+//	POST path/send  sends newline-separated messages to the session
+//
+// The stream's first event, named "session", carries the session ID, which
+// is also set in the SSESessionCookie cookie. Sends identify the session by
+// that cookie or by the sessionID query parameter and are answered with 202
+// Accepted; the frames the messages produce, such as resolve and reject,
+// are delivered over the stream as "data: <json>" events. A ": ping" comment
+// is sent every SSEHeartbeatInterval. The session ends when the stream is
+// closed or the session is aborted.
+//
+// Of the endpoint options, the session options apply to every stream and
+// MaxConnections limits the number of open streams.
+func SetupSSEEndpoint(e *echo.Echo, path string, target RpcTarget, opts ...RpcEndpointOption) {
+	options := defaultRpcEndpointOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	session := newRpcSession(target, options.SessionOptions)
+	store := &sseSessionStore{sessions: make(map[string]*sseSession)}
+	var streams atomic.Int64
+
+	e.GET(path, func(c echo.Context) error {
+		if options.MaxConnections > 0 {
+			if streams.Add(1) > int64(options.MaxConnections) {
+				streams.Add(-1)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many connections")
+			}
+			defer streams.Add(-1)
+		}
+
+		// Calls made in the session are cancelled once the stream closes
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+
+		sessionData := NewSessionData(target)
+		sessionData.SetHeaders(c.Request().Header)
+		sessionData.SetContext(ctx)
+		if err := session.openSession(sessionData); err != nil {
+			return err
+		}
+
+		ss := &sseSession{
+			data:   sessionData,
+			frames: make(chan []byte, DefaultMessageQueueSize),
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		defer close(ss.done)
+		sessionData.SetFrameSender(ss.send)
+
+		store.add(ss)
+		defer store.remove(sessionData.ID)
+		defer session.endSession(sessionData)
+
+		c.SetCookie(&http.Cookie{
+			Name:     SSESessionCookie,
+			Value:    sessionData.ID,
+			Path:     path,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+		res.Header().Set(echo.HeaderConnection, "keep-alive")
+		// Stop nginx from buffering the stream
+		res.Header().Set("X-Accel-Buffering", "no")
+		res.WriteHeader(http.StatusOK)
+
+		if _, err := fmt.Fprintf(res, "event: session\ndata: %s\n\n", sessionData.ID); err != nil {
+			return nil
+		}
+		res.Flush()
+
+		heartbeat := time.NewTicker(SSEHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case frame := <-ss.frames:
+				if err := writeSSEData(res, frame); err != nil {
+					return nil
+				}
+			case <-heartbeat.C:
+				if _, err := res.Write([]byte(": ping\n\n")); err != nil {
+					return nil
+				}
+			case <-ctx.Done():
+				// Deliver what was queued before an abort closed the stream
+				drainSSEFrames(res, ss.frames)
+				return nil
+			}
+			res.Flush()
+		}
+	})
+
+	e.POST(strings.TrimSuffix(path, "/")+"/send", func(c echo.Context) error {
+		id := c.QueryParam(SSESessionParam)
+		if id == "" {
+			if cookie, err := c.Cookie(SSESessionCookie); err == nil {
+				id = cookie.Value
+			}
+		}
+		if id == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "session ID is required")
+		}
+		ss, exists := store.get(id)
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "session not found")
+		}
+
+		defer c.Request().Body.Close()
+		scanner := bufio.NewScanner(c.Request().Body)
+		if session.opts.MaxMessageBytes > 0 {
+			scanner.Buffer(nil, int(session.opts.MaxMessageBytes)+1)
+		}
+
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			frames, err := session.HandleMessageFrames(ss.data, line)
+			if err != nil {
+				session.logf("Error processing SSE message: %v", err)
+				session.reportError(ss.data, err)
+				continue
+			}
+			for _, frame := range frames {
+				if err := ss.send([]byte(frame)); err != nil {
+					return echo.NewHTTPError(http.StatusGone, "event stream closed")
+				}
+			}
+
+			// An abort ends the session and closes its stream
+			if ss.data.Abort() != nil {
+				ss.cancel()
+				break
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Message too large")
+			}
+			session.logf("Error reading SSE send body: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error reading request body")
+		}
+
+		setDeprecationHeaders(c.Response().Header(), ss.data.Deprecations())
+		return c.NoContent(http.StatusAccepted)
+	})
+}
+
+// writeSSEData writes frame as a single event. Frames are single-line JSON,
+// so each fits in one data field.
+func writeSSEData(w http.ResponseWriter, frame []byte) error {
+	_, err := fmt.Fprintf(w, "data: %s\n\n", frame)
+	return err
+}
+
+// drainSSEFrames writes the frames already queued on frames.
+func drainSSEFrames(res *echo.Response, frames <-chan []byte) {
+	for {
+		select {
+		case frame := <-frames:
+			if err := writeSSEData(res, frame); err != nil {
+				return
+			}
+		default:
+			res.Flush()
+			return
+		}
+	}
+}
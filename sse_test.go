@@ -0,0 +1,181 @@
+package gocapnweb
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// sseServer serves target's SSE endpoint at /sse, configured by opts.
+func sseServer(t *testing.T, target RpcTarget, opts ...RpcEndpointOption) *httptest.Server {
+	t.Helper()
+	e := echo.New()
+	opts = append([]RpcEndpointOption{WithSessionOptions(WithLogger(log.New(io.Discard, "", 0)))}, opts...)
+	SetupSSEEndpoint(e, "/sse", target, opts...)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sseStream is an open event stream.
+type sseStream struct {
+	resp   *http.Response
+	events chan sseEvent
+}
+
+// sseEvent is an event read from a stream.
+type sseEvent struct {
+	name string
+	data string
+}
+
+// openSSEStream opens server's event stream and reads its events in the
+// background.
+func openSSEStream(t *testing.T, server *httptest.Server) *sseStream {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /sse = %d", resp.StatusCode)
+	}
+
+	stream := &sseStream{resp: resp, events: make(chan sseEvent, 16)}
+	go func() {
+		defer close(stream.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.data != "" {
+					stream.events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return stream
+}
+
+// next returns the next event of the stream, or fails if the stream ends.
+func (s *sseStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			t.Fatal("event stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event on the stream")
+	}
+	return sseEvent{}
+}
+
+// sendSSE posts messages to the send endpoint of server with query and
+// returns the response status.
+func sendSSE(t *testing.T, server *httptest.Server, query string, cookie *http.Cookie, messages ...string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/sse/send"+query, strings.NewReader(strings.Join(messages, "\n")))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSSEEndpoint(t *testing.T) {
+	server := sseServer(t, streamTarget())
+	stream := openSSEStream(t, server)
+	if got := stream.resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	// The first event names the session, which the cookie also carries
+	session := stream.next(t)
+	if session.name != "session" || session.data == "" {
+		t.Fatalf("first event = %+v, want the session", session)
+	}
+	var cookie *http.Cookie
+	for _, c := range stream.resp.Cookies() {
+		if c.Name == SSESessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != session.data {
+		t.Fatalf("cookie = %v, want the session ID %s", cookie, session.data)
+	}
+
+	// Sends by query parameter and by cookie are answered on the stream
+	if status := sendSSE(t, server, "?sessionID="+session.data, nil, `["push",["pipeline",0,["echo"],["hi"]]]`, `["pull",1]`); status != http.StatusAccepted {
+		t.Fatalf("send = %d, want 202", status)
+	}
+	if got := stream.next(t).data; got != `["resolve",1,"hi"]` {
+		t.Errorf("got %s", got)
+	}
+	if status := sendSSE(t, server, "", cookie, `["push",["pipeline",0,["chunks"],[]]]`, `["pull",2]`); status != http.StatusAccepted {
+		t.Fatalf("send with the cookie = %d, want 202", status)
+	}
+	for _, want := range wantStreamFrames() {
+		// The chunks call is export 2 here
+		want = strings.Replace(want, `",1`, `",2`, 1)
+		if got := stream.next(t).data; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	// Sends must name an open session
+	if status := sendSSE(t, server, "", nil, `["pull",1]`); status != http.StatusBadRequest {
+		t.Errorf("send without a session = %d, want 400", status)
+	}
+	if status := sendSSE(t, server, "?sessionID=missing", nil, `["pull",1]`); status != http.StatusNotFound {
+		t.Errorf("send to an unknown session = %d, want 404", status)
+	}
+
+	// An abort ends the stream
+	sendSSE(t, server, "?sessionID="+session.data, nil, `["abort",["error","Error","bye"]]`)
+	for {
+		select {
+		case _, ok := <-stream.events:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream stayed open after an abort")
+		}
+	}
+}
+
+func TestSSEEndpointMaxConnections(t *testing.T) {
+	server := sseServer(t, testTarget(), WithMaxConnections(1))
+	stream := openSSEStream(t, server)
+	stream.next(t)
+
+	resp, err := http.Get(server.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second stream = %d, want 503", resp.StatusCode)
+	}
+}
@@ -0,0 +1,148 @@
+package gocapnweb
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStreamClosed is returned when writing to a StreamResult that has been
+// closed.
+var ErrStreamClosed = errors.New("stream closed")
+
+// StreamResult lets a method deliver its result in several parts rather
+// than buffering it all. A handler returns a *StreamResult and writes chunks
+// to it, typically from another goroutine, closing it when done:
+//
+//	stream := gocapnweb.NewStreamResult()
+//	go func() {
+//		defer stream.Close()
+//		for _, chunk := range chunks {
+//			if err := stream.Write(chunk); err != nil {
+//				return
+//			}
+//		}
+//	}()
+//	return stream, nil
+//
+// Pulling the call produces ["stream-start", id], one ["stream-chunk", id,
+// chunk] per chunk, and finally ["stream-end", id]. On WebSocket connections
+// each frame is sent as soon as its chunk is written.
+type StreamResult struct {
+	chunks    chan interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewStreamResult creates an open StreamResult.
+func NewStreamResult() *StreamResult {
+	return &StreamResult{
+		chunks: make(chan interface{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Write sends a chunk to the client. It blocks until the chunk has been
+// taken for delivery and fails with ErrStreamClosed once the stream is
+// closed.
+func (s *StreamResult) Write(chunk interface{}) error {
+	select {
+	case <-s.done:
+		return ErrStreamClosed
+	default:
+	}
+
+	select {
+	case s.chunks <- chunk:
+		return nil
+	case <-s.done:
+		return ErrStreamClosed
+	}
+}
+
+// Close ends the stream. It is safe to call more than once.
+func (s *StreamResult) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// next returns the next chunk, or false once the stream is closed.
+func (s *StreamResult) next() (interface{}, bool) {
+	select {
+	case chunk := <-s.chunks:
+		return chunk, true
+	case <-s.done:
+		return nil, false
+	}
+}
+
+// collect reads every chunk until the stream is closed.
+func (s *StreamResult) collect() []interface{} {
+	chunks := []interface{}{}
+	for {
+		chunk, ok := s.next()
+		if !ok {
+			return chunks
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+// pullStream emits the frames of a streaming result and returns the final
+// stream-end frame, or a reject if the stream cannot be delivered.
+func (s *RpcSession) pullStream(sessionData *SessionData, exportID int, stream *StreamResult) []interface{} {
+	if err := sessionData.emitFrame([]interface{}{"stream-start", exportID}); err != nil {
+		stream.Close()
+		return s.createErrorResponse(exportID, "StreamError", err.Error())
+	}
+
+	for {
+		chunk, ok := stream.next()
+		if !ok {
+			return []interface{}{"stream-end", exportID}
+		}
+
+		normalizedChunk, err := s.normalizeResult(sessionData, chunk)
+		if err != nil {
+			stream.Close()
+			return s.createErrorResponse(exportID, "SerializationError", err.Error())
+		}
+
+		if err := sessionData.emitFrame([]interface{}{"stream-chunk", exportID, wireValue(normalizedChunk)}); err != nil {
+			stream.Close()
+			return s.createErrorResponse(exportID, "StreamError", err.Error())
+		}
+	}
+}
+
+// subscriptionChannel returns the channel of a result that is a
+// subscription: a <-chan interface{}, or a chan interface{} the handler
+// also sends on.
+func subscriptionChannel(result interface{}) (<-chan interface{}, bool) {
+	switch ch := result.(type) {
+	case <-chan interface{}:
+		return ch, true
+	case chan interface{}:
+		return ch, true
+	}
+	return nil, false
+}
+
+// drainSubscription reads every value of a subscription until its channel
+// is closed or ctx is done, for sessions that receive it as one array.
+func drainSubscription(ctx context.Context, ch <-chan interface{}) []interface{} {
+	values := []interface{}{}
+	for {
+		select {
+		case value, ok := <-ch:
+			if !ok {
+				return values
+			}
+			values = append(values, value)
+		case <-ctx.Done():
+			return values
+		}
+	}
+}
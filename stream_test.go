@@ -0,0 +1,66 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// streamTarget returns the test target with a "chunks" method that streams
+// five chunks.
+func streamTarget() *BaseRpcTarget {
+	target := testTarget()
+	target.Method("chunks", func(json.RawMessage) (interface{}, error) {
+		stream := NewStreamResult()
+		go func() {
+			defer stream.Close()
+			for i := 1; i <= 5; i++ {
+				if err := stream.Write(map[string]interface{}{"part": i}); err != nil {
+					return
+				}
+			}
+		}()
+		return stream, nil
+	})
+	return target
+}
+
+// wantStreamFrames is what pulling export 1 of a "chunks" call sends.
+func wantStreamFrames() []string {
+	frames := []string{`["stream-start",1]`}
+	for i := 1; i <= 5; i++ {
+		frames = append(frames, fmt.Sprintf(`["stream-chunk",1,{"part":%d}]`, i))
+	}
+	return append(frames, `["stream-end",1]`)
+}
+
+func TestStreamResult(t *testing.T) {
+	target := streamTarget()
+	got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["chunks"],[]]]`, `["pull",1]`)
+	if want := wantStreamFrames(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+
+	stream := NewStreamResult()
+	stream.Close()
+	if err := stream.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := stream.Write("late"); err != ErrStreamClosed {
+		t.Errorf("Write after Close = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestStreamResultOverWebSocket(t *testing.T) {
+	server := endpointServer(t, streamTarget())
+	conn := dialEndpoint(t, server, nil)
+	sendMessages(t, conn, `["push",["pipeline",0,["chunks"],[]]]`, `["pull",1]`)
+
+	// Each chunk arrives as its own frame, in order
+	for _, want := range wantStreamFrames() {
+		if got := readFrameWithPrefix(t, conn, `["stream-`); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+}
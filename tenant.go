@@ -0,0 +1,85 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// TenantMetaKey is the session metadata key holding the tenant ID used by
+// TenantRouter.
+const TenantMetaKey = "tenantID"
+
+// ErrTenantNotFound is returned by TenantRouter for sessions whose tenant
+// has no registered target.
+var ErrTenantNotFound = RpcError{Code: "TenantNotFound"}
+
+// TenantRouter dispatches each call to the target registered for the
+// session's tenant, so one endpoint can serve several tenants with separate
+// method sets. The tenant ID is read from the session metadata under
+// TenantMetaKey, falling back to the request header named by HeaderName.
+type TenantRouter struct {
+	// HeaderName, if set, names a request header that supplies the tenant
+	// ID for sessions without tenant metadata.
+	HeaderName string
+
+	tenants map[string]RpcTarget
+	mu      sync.RWMutex
+}
+
+// NewTenantRouter creates a TenantRouter with no tenants.
+func NewTenantRouter() *TenantRouter {
+	return &TenantRouter{
+		tenants: make(map[string]RpcTarget),
+	}
+}
+
+// Register sets the target serving tenantID.
+func (r *TenantRouter) Register(tenantID string, target RpcTarget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants[tenantID] = target
+}
+
+// Unregister removes the target serving tenantID.
+func (r *TenantRouter) Unregister(tenantID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tenants, tenantID)
+}
+
+// Dispatch implements RpcTarget. Without a session there is no tenant, so
+// every call fails with ErrTenantNotFound.
+func (r *TenantRouter) Dispatch(method string, args json.RawMessage) (interface{}, error) {
+	return nil, RpcError{Code: ErrTenantNotFound.Code, Message: "no tenant for call to " + method}
+}
+
+// DispatchSession implements SessionTarget.
+func (r *TenantRouter) DispatchSession(sessionData *SessionData, method string, args json.RawMessage) (interface{}, error) {
+	return r.DispatchSessionContext(sessionData.Context(), sessionData, method, args)
+}
+
+// DispatchSessionContext implements SessionContextTarget.
+func (r *TenantRouter) DispatchSessionContext(ctx context.Context, sessionData *SessionData, method string, args json.RawMessage) (interface{}, error) {
+	tenantID, ok := sessionData.GetMeta(TenantMetaKey)
+	if !ok && r.HeaderName != "" {
+		tenantID, ok = sessionData.Header(r.HeaderName)
+	}
+	if !ok {
+		return nil, RpcError{Code: ErrTenantNotFound.Code, Message: "session has no tenant"}
+	}
+
+	r.mu.RLock()
+	target, exists := r.tenants[tenantID]
+	r.mu.RUnlock()
+
+	if !exists {
+		return nil, RpcError{
+			Code:    ErrTenantNotFound.Code,
+			Message: "unknown tenant: " + tenantID,
+			Details: map[string]interface{}{"tenantID": tenantID},
+		}
+	}
+
+	return dispatchTarget(ctx, sessionData, target, method, args)
+}
@@ -0,0 +1,107 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// tenantRouter returns a router serving the tenants acme and globex, each
+// with its own hello method.
+func tenantRouter() *TenantRouter {
+	router := NewTenantRouter()
+	for _, tenant := range []string{"acme", "globex"} {
+		greeting := "hello from " + tenant
+		target := NewBaseRpcTarget()
+		target.Method("hello", func(json.RawMessage) (interface{}, error) {
+			return greeting, nil
+		})
+		router.Register(tenant, target)
+	}
+	return router
+}
+
+func TestTenantRouter(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant string
+		header string
+		want   string
+	}{
+		{name: "first tenant", tenant: "acme", want: `["resolve",1,"hello from acme"]`},
+		{name: "second tenant", tenant: "globex", want: `["resolve",1,"hello from globex"]`},
+		{name: "header", header: "globex", want: `["resolve",1,"hello from globex"]`},
+		{name: "metadata over header", tenant: "acme", header: "globex", want: `["resolve",1,"hello from acme"]`},
+		{
+			name:   "unknown tenant",
+			tenant: "initech",
+			want:   `["reject",1,["error","TenantNotFound","unknown tenant: initech",null,{"tenantID":"initech"}]]`,
+		},
+		{name: "no tenant", want: `["reject",1,["error","TenantNotFound","session has no tenant"]]`},
+	}
+	router := tenantRouter()
+	router.HeaderName = "X-Tenant"
+	session := newTestSession(router)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionData := NewSessionData(router)
+			if tt.tenant != "" {
+				sessionData.SetMeta(TenantMetaKey, tt.tenant)
+			}
+			if tt.header != "" {
+				sessionData.SetHeaders(http.Header{"X-Tenant": {tt.header}})
+			}
+			var got []string
+			for _, message := range []string{`["push",["pipeline",0,["hello"],[]]]`, `["pull",1]`} {
+				frames, err := session.HandleMessageFrames(sessionData, message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, frames...)
+			}
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+		})
+	}
+
+	// An unregistered tenant is unknown
+	router.Unregister("acme")
+	sessionData := NewSessionData(router)
+	sessionData.SetMeta(TenantMetaKey, "acme")
+	if _, err := router.DispatchSession(sessionData, "hello", nil); err == nil || err.Error() != "TenantNotFound: unknown tenant: acme" {
+		t.Errorf("call for an unregistered tenant = %v, want TenantNotFound", err)
+	}
+}
+
+func TestTenantRouterOverHTTP(t *testing.T) {
+	router := tenantRouter()
+	router.HeaderName = "X-Tenant"
+	server := endpointServer(t, router)
+	batch := `["push",["pipeline",0,["hello"],[]]]` + "\n" + `["pull",1]`
+	for tenant, want := range map[string]string{
+		"acme":    `["resolve",1,"hello from acme"]`,
+		"globex":  `["resolve",1,"hello from globex"]`,
+		"initech": `["reject",1,["error","TenantNotFound","unknown tenant: initech",null,{"tenantID":"initech"}]]`,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/rpc", strings.NewReader(batch))
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body strings.Builder
+		_, _ = io.Copy(&body, resp.Body)
+		resp.Body.Close()
+		if got := strings.TrimSpace(body.String()); got != want {
+			t.Errorf("tenant %s got %s, want %s", tenant, got, want)
+		}
+	}
+
+	// Without a session there is no tenant
+	if _, err := router.Dispatch("hello", nil); err == nil || !strings.HasPrefix(err.Error(), "TenantNotFound") {
+		t.Errorf("Dispatch without a session = %v, want TenantNotFound", err)
+	}
+}
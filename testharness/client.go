@@ -0,0 +1,56 @@
+package testharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gocapnweb"
+)
+
+// InProcessClient drives an RpcSession directly, without a network
+// transport. It owns a single SessionData, so consecutive messages behave
+// like messages sent over one WebSocket connection.
+type InProcessClient struct {
+	session     *gocapnweb.RpcSession
+	sessionData *gocapnweb.SessionData
+	nextID      int
+	mu          sync.Mutex
+}
+
+// NewInProcessClient creates a client bound to a fresh session for target.
+func NewInProcessClient(session *gocapnweb.RpcSession, target gocapnweb.RpcTarget) *InProcessClient {
+	return &InProcessClient{
+		session:     session,
+		sessionData: gocapnweb.NewSessionData(target),
+		nextID:      1,
+	}
+}
+
+// SessionData returns the session state backing the client.
+func (c *InProcessClient) SessionData() *gocapnweb.SessionData {
+	return c.sessionData
+}
+
+// Send passes a raw protocol message to the session and returns its response.
+func (c *InProcessClient) Send(message string) (string, error) {
+	return c.session.HandleMessage(c.sessionData, message)
+}
+
+// SendValue marshals msg to JSON and sends it to the session.
+func (c *InProcessClient) SendValue(msg interface{}) (string, error) {
+	messageBytes, err := json.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return c.Send(string(messageBytes))
+}
+
+// allocateID returns the export ID the server will assign to the next push.
+func (c *InProcessClient) allocateID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextID
+	c.nextID++
+	return id
+}
@@ -0,0 +1,20 @@
+// Command conformance-golden regenerates the golden files of the protocol
+// conformance cases. Run it through go generate in the testharness package
+// when the wire format changes intentionally, and review the diff.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/gocapnweb/testharness"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: conformance-golden <dir>")
+	}
+	if err := testharness.UpdateConformanceGolden(os.Args[1]); err != nil {
+		log.Fatal(err)
+	}
+}
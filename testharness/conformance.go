@@ -0,0 +1,182 @@
+package testharness
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gocapnweb"
+)
+
+//go:generate go run ./cmd/conformance-golden testdata/conformance
+
+// Conformance cases are stored as pairs of files in a directory: NAME.in
+// holds one protocol message per line, sent to a fresh session in order, and
+// NAME.golden holds the frames the session is expected to send back, one per
+// line.
+const (
+	conformanceInputExt  = ".in"
+	conformanceGoldenExt = ".golden"
+)
+
+// ConformanceTarget returns the target the conformance cases are run
+// against. Its behaviour must stay fixed, since the golden files depend on it.
+func ConformanceTarget() *gocapnweb.BaseRpcTarget {
+	target := gocapnweb.NewBaseRpcTarget()
+
+	target.Method("echo", func(args json.RawMessage) (interface{}, error) {
+		var argArray []interface{}
+		if err := json.Unmarshal(args, &argArray); err != nil {
+			return nil, err
+		}
+		if len(argArray) == 0 {
+			return nil, nil
+		}
+		return argArray[0], nil
+	})
+
+	target.Method("list", func(args json.RawMessage) (interface{}, error) {
+		return []interface{}{"a", "b", "c"}, nil
+	})
+
+	target.Method("authenticate", func(args json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"id": "u_1", "name": "Ada Lovelace"}, nil
+	})
+
+	target.Method("getUserProfile", func(args json.RawMessage) (interface{}, error) {
+		var argArray []string
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, fmt.Errorf("expected user ID")
+		}
+		return map[string]interface{}{"id": argArray[0], "bio": "Mathematician"}, nil
+	})
+
+	target.Method("fail", func(args json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("intentional failure")
+	})
+
+	return target
+}
+
+// RunConformanceCase sends the messages of a case to a fresh session and
+// returns the frames produced, in order.
+func RunConformanceCase(input []string) ([]string, error) {
+	target := ConformanceTarget()
+	session := gocapnweb.NewRpcSession(target, gocapnweb.WithLogger(log.New(io.Discard, "", 0)))
+	sessionData := gocapnweb.NewSessionData(target)
+
+	var output []string
+	for _, message := range input {
+		frames, err := session.HandleMessageFrames(sessionData, message)
+		if err != nil {
+			return nil, fmt.Errorf("message %s: %w", message, err)
+		}
+		output = append(output, frames...)
+	}
+	return output, nil
+}
+
+// RunConformance runs every case in dir as a subtest and compares the frames
+// produced with the case's golden file.
+func RunConformance(t *testing.T, dir string) {
+	t.Helper()
+
+	cases, err := conformanceCases(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatalf("no conformance cases found in %s", dir)
+	}
+
+	for _, name := range cases {
+		t.Run(name, func(t *testing.T) {
+			input, err := readLines(filepath.Join(dir, name+conformanceInputExt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := readLines(filepath.Join(dir, name+conformanceGoldenExt))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := RunConformanceCase(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("output mismatch\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+// UpdateConformanceGolden rewrites the golden file of every case in dir from
+// the current implementation. Use it only when the wire format changes
+// intentionally.
+func UpdateConformanceGolden(dir string) error {
+	cases, err := conformanceCases(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range cases {
+		input, err := readLines(filepath.Join(dir, name+conformanceInputExt))
+		if err != nil {
+			return err
+		}
+		output, err := RunConformanceCase(input)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		content := strings.Join(output, "\n")
+		if content != "" {
+			content += "\n"
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+conformanceGoldenExt), []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conformanceCases returns the sorted names of the cases in dir.
+func conformanceCases(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+conformanceInputExt))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matches))
+	for _, match := range matches {
+		names = append(names, strings.TrimSuffix(filepath.Base(match), conformanceInputExt))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readLines returns the non-blank lines of a file.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
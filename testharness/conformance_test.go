@@ -0,0 +1,97 @@
+package testharness
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocapnweb"
+	"github.com/gorilla/websocket"
+)
+
+const conformanceDir = "testdata/conformance"
+
+// conformanceQuietPeriod is how long a WebSocket case waits for frames
+// beyond those its golden file expects.
+const conformanceQuietPeriod = 100 * time.Millisecond
+
+func TestConformance(t *testing.T) {
+	t.Run("session", func(t *testing.T) {
+		RunConformance(t, conformanceDir)
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		e := gocapnweb.SetupEchoServer()
+		gocapnweb.SetupRpcEndpoint(e, "/api", ConformanceTarget())
+		server := httptest.NewServer(e)
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api"
+
+		cases, err := conformanceCases(conformanceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range cases {
+			t.Run(name, func(t *testing.T) {
+				input, err := readLines(filepath.Join(conformanceDir, name+conformanceInputExt))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := readLines(filepath.Join(conformanceDir, name+conformanceGoldenExt))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := runWebSocketCase(t, url, input, len(want))
+				if strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("output mismatch\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+				}
+			})
+		}
+	})
+}
+
+// runWebSocketCase sends the messages of a case over a new WebSocket
+// connection to url and returns the frames received: the expected number,
+// and any more that arrive within conformanceQuietPeriod of them.
+func runWebSocketCase(t *testing.T, url string, input []string, expected int) []string {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, message := range input {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatalf("writing %s: %v", message, err)
+		}
+	}
+
+	var frames []string
+	for {
+		timeout := 5 * time.Second
+		if len(frames) >= expected {
+			timeout = conformanceQuietPeriod
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, frame, err := conn.ReadMessage()
+		var netErr net.Error
+		switch {
+		case err == nil:
+			frames = append(frames, string(frame))
+		case errors.As(err, &netErr) && netErr.Timeout() && len(frames) >= expected:
+			return frames
+		case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) ||
+			websocket.IsUnexpectedCloseError(err):
+			// An aborted session closes the connection
+			return frames
+		default:
+			t.Fatalf("reading frame %d: %v", len(frames)+1, err)
+		}
+	}
+}
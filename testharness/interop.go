@@ -0,0 +1,222 @@
+//go:build integration
+
+package testharness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gocapnweb"
+	"github.com/labstack/echo/v4"
+)
+
+// The interop harness runs the official TypeScript capnweb client, under
+// Node, against a gocapnweb server. It is built only with the integration
+// tag, and needs node on the PATH and the client's packages installed:
+//
+//	npm install --prefix testharness/interop
+//	go test -tags integration -run TestInterop ./testharness
+
+// InteropDirEnv names the environment variable that overrides the directory
+// holding the Node client, testharness/interop by default.
+const InteropDirEnv = "CAPNWEB_INTEROP_DIR"
+
+// InteropModes are the transports the Node client is run with.
+var InteropModes = []string{"batch", "websocket"}
+
+// interopExpected holds the JSON the Node client is expected to print for
+// each case, by mode. Escape types are printed as single-key objects and
+// errors as their name and message.
+var interopExpected = map[string]map[string]string{
+	"batch": {
+		"capability": `1`,
+	},
+	"websocket": {
+		"capability": `2`,
+	},
+	"": {
+		"hello":    `"Hello, World!"`,
+		"pipeline": `"Ada"`,
+		"list":     `[1, 2, 3]`,
+		"date":     `{"date": 0}`,
+		"bigint":   `{"bigint": "12345678901234567890"}`,
+		"bytes":    `{"bytes": [1, 2, 3]}`,
+		"error":    `{"error": {"name": "TypeError", "message": "boom"}}`,
+	},
+}
+
+// InteropTarget returns the target the Node client calls: hello returns a
+// greeting, getUser a user object, echo its first argument as sent, list an
+// array, fail rejects with a TypeError carrying its argument as the message,
+// and counter returns a new capability whose increment method counts its
+// calls.
+func InteropTarget() *gocapnweb.BaseRpcTarget {
+	target := gocapnweb.NewBaseRpcTarget()
+
+	target.Method("hello", func(args json.RawMessage) (interface{}, error) {
+		var argArray []string
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return "Hello, World!", nil
+		}
+		return "Hello, " + argArray[0] + "!", nil
+	})
+
+	target.Method("getUser", func(args json.RawMessage) (interface{}, error) {
+		var argArray []string
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, gocapnweb.NewRpcError("TypeError", "getUser expects an ID")
+		}
+		return map[string]interface{}{"id": argArray[0], "name": "Ada"}, nil
+	})
+
+	target.Method("echo", func(args json.RawMessage) (interface{}, error) {
+		var argArray []json.RawMessage
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, gocapnweb.NewRpcError("TypeError", "echo expects an argument")
+		}
+		return argArray[0], nil
+	})
+
+	target.Method("list", func(json.RawMessage) (interface{}, error) {
+		return []int{1, 2, 3}, nil
+	})
+
+	target.Method("fail", func(args json.RawMessage) (interface{}, error) {
+		var argArray []string
+		json.Unmarshal(args, &argArray)
+		message := "failed"
+		if len(argArray) > 0 {
+			message = argArray[0]
+		}
+		return nil, gocapnweb.NewRpcError("TypeError", message)
+	})
+
+	target.Method("counter", func(json.RawMessage) (interface{}, error) {
+		counter := gocapnweb.NewBaseRpcTarget(gocapnweb.WithoutIntrospection())
+		var mu sync.Mutex
+		count := 0
+		counter.Method("increment", func(json.RawMessage) (interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			count++
+			return count, nil
+		})
+		return counter, nil
+	})
+
+	return target
+}
+
+// RunInterop serves InteropTarget on an ephemeral port, runs the Node client
+// against it in the given mode and returns the mismatches between what the
+// client printed and what was expected, one per case, sorted by case.
+func RunInterop(mode string) ([]string, error) {
+	dir, err := interopDir()
+	if err != nil {
+		return nil, err
+	}
+
+	e := echo.New()
+	e.HideBanner = true
+	quiet := log.New(io.Discard, "", 0)
+	gocapnweb.SetupRpcEndpoint(e, "/rpc", InteropTarget(),
+		gocapnweb.WithSessionOptions(gocapnweb.WithLogger(quiet)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	url := server.URL + "/rpc"
+	if mode == "websocket" {
+		url = "ws" + strings.TrimPrefix(url, "http")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("node", "client.mjs", mode, url)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("node client (%s): %w\n%s", mode, err, stderr.String())
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		return nil, fmt.Errorf("node client (%s) printed invalid JSON: %w\n%s", mode, err, stdout.String())
+	}
+	return compareInterop(mode, got)
+}
+
+// RunInteropTests runs the Node client in every mode as subtests of t.
+func RunInteropTests(t *testing.T) {
+	for _, mode := range InteropModes {
+		t.Run(mode, func(t *testing.T) {
+			mismatches, err := RunInterop(mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, mismatch := range mismatches {
+				t.Error(mismatch)
+			}
+		})
+	}
+}
+
+// compareInterop compares the client's results with the cases expected in
+// mode.
+func compareInterop(mode string, got map[string]interface{}) ([]string, error) {
+	expected := make(map[string]string)
+	for name, want := range interopExpected[""] {
+		expected[name] = want
+	}
+	for name, want := range interopExpected[mode] {
+		expected[name] = want
+	}
+
+	var mismatches []string
+	for name, wantJSON := range expected {
+		var want interface{}
+		if err := json.Unmarshal([]byte(wantJSON), &want); err != nil {
+			return nil, fmt.Errorf("invalid expectation for %s: %w", name, err)
+		}
+		value, exists := got[name]
+		if !exists {
+			mismatches = append(mismatches, fmt.Sprintf("%s: no result", name))
+			continue
+		}
+		if !reflect.DeepEqual(value, want) {
+			encoded, _ := json.Marshal(value)
+			mismatches = append(mismatches, fmt.Sprintf("%s: got %s, want %s", name, encoded, wantJSON))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
+
+// interopDir returns the directory of the Node client, checking that its
+// packages have been installed.
+func interopDir() (string, error) {
+	dir := os.Getenv(InteropDirEnv)
+	if dir == "" {
+		_, file, _, ok := runtime.Caller(0)
+		if !ok {
+			return "", fmt.Errorf("cannot locate the interop client; set %s", InteropDirEnv)
+		}
+		dir = filepath.Join(filepath.Dir(file), "interop")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "node_modules", "capnweb")); err != nil {
+		return "", fmt.Errorf("capnweb is not installed in %s; run npm install --prefix %s", dir, dir)
+	}
+	return dir, nil
+}
@@ -0,0 +1,89 @@
+// Calls the server started by testharness.RunInterop with the official
+// capnweb client and prints the outcome of each case as one JSON object.
+//
+// Usage: node client.mjs <batch|websocket> <url>
+
+import { newHttpBatchRpcSession, newWebSocketRpcSession } from "capnweb";
+import WebSocket from "ws";
+
+const [mode, url] = process.argv.slice(2);
+
+// encode turns a result into JSON data the Go side can compare: escape
+// types become single-key objects and errors their name and message.
+function encode(value) {
+  if (value instanceof Error) {
+    return { error: { name: value.name, message: value.message } };
+  }
+  if (value instanceof Date) {
+    return { date: value.getTime() };
+  }
+  if (typeof value === "bigint") {
+    return { bigint: value.toString() };
+  }
+  if (value instanceof Uint8Array) {
+    return { bytes: Array.from(value) };
+  }
+  if (value === undefined) {
+    return { undefined: true };
+  }
+  if (Array.isArray(value)) {
+    return value.map(encode);
+  }
+  if (value !== null && typeof value === "object") {
+    return Object.fromEntries(Object.entries(value).map(([k, v]) => [k, encode(v)]));
+  }
+  return value;
+}
+
+async function settle(cases) {
+  const names = Object.keys(cases);
+  const outcomes = await Promise.allSettled(Object.values(cases));
+  const results = {};
+  outcomes.forEach((outcome, i) => {
+    results[names[i]] = encode(outcome.status === "fulfilled" ? outcome.value : outcome.reason);
+  });
+  return results;
+}
+
+// Every call of a batch session must be made before the batch is sent, so
+// the batch cases are started together and pipelined.
+async function runBatch() {
+  const api = newHttpBatchRpcSession(url);
+  const user = api.getUser("u_1");
+  return settle({
+    hello: api.hello("World"),
+    pipeline: api.echo(user.name),
+    list: api.list(),
+    date: api.echo(new Date(0)),
+    bigint: api.echo(12345678901234567890n),
+    bytes: api.echo(new Uint8Array([1, 2, 3])),
+    error: api.fail("boom"),
+    capability: api.counter().increment(),
+  });
+}
+
+async function runWebSocket() {
+  const api = newWebSocketRpcSession(new WebSocket(url));
+  const user = api.getUser("u_1");
+  const results = await settle({
+    hello: api.hello("World"),
+    pipeline: api.echo(user.name),
+    list: api.list(),
+    date: api.echo(new Date(0)),
+    bigint: api.echo(12345678901234567890n),
+    bytes: api.echo(new Uint8Array([1, 2, 3])),
+    error: api.fail("boom"),
+  });
+
+  // A capability held across calls keeps its state
+  const counter = await api.counter();
+  await counter.increment();
+  results.capability = encode(await counter.increment());
+
+  api[Symbol.dispose]();
+  return results;
+}
+
+const results = mode === "batch" ? await runBatch() : await runWebSocket();
+console.log(JSON.stringify(results));
+process.exit(0);
@@ -0,0 +1,15 @@
+//go:build integration
+
+package testharness
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestInterop(t *testing.T) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node is not on the PATH")
+	}
+	RunInteropTests(t)
+}
@@ -0,0 +1,179 @@
+package testharness
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// PipelineAssert builds a sequence of pushes against an InProcessClient and
+// asserts on the responses to the corresponding pulls. Export IDs are tracked
+// automatically, so tests only deal in method names and arguments.
+type PipelineAssert struct {
+	client   *InProcessClient
+	exportID int
+	err      error
+}
+
+// PullAssert holds the response to a pull so it can be checked.
+type PullAssert struct {
+	exportID int
+	response string
+	err      error
+}
+
+// NewPipelineAssert starts a pipeline against client.
+func NewPipelineAssert(client *InProcessClient) *PipelineAssert {
+	return &PipelineAssert{client: client}
+}
+
+// Push sends a pipelined call of method with args and returns a builder
+// representing its result. Arguments may contain references produced by Ref.
+func (p *PipelineAssert) Push(method string, args interface{}) *PipelineAssert {
+	if args == nil {
+		args = []interface{}{}
+	}
+
+	exportID := p.client.allocateID()
+	_, err := p.client.SendValue([]interface{}{
+		"push", []interface{}{"pipeline", 0, []interface{}{method}, args},
+	})
+	return &PipelineAssert{client: p.client, exportID: exportID, err: err}
+}
+
+// ExportID returns the export ID assigned to this push.
+func (p *PipelineAssert) ExportID() int {
+	return p.exportID
+}
+
+// Ref returns a pipeline reference to this push's result, optionally
+// traversing the given path, for use as an argument to later pushes.
+func (p *PipelineAssert) Ref(path ...interface{}) []interface{} {
+	if path == nil {
+		path = []interface{}{}
+	}
+	return []interface{}{"pipeline", p.exportID, path}
+}
+
+// Pull requests this push's result.
+func (p *PipelineAssert) Pull() *PullAssert {
+	if p.err != nil {
+		return &PullAssert{exportID: p.exportID, err: p.err}
+	}
+	response, err := p.client.SendValue([]interface{}{"pull", p.exportID})
+	return &PullAssert{exportID: p.exportID, response: response, err: err}
+}
+
+// Response returns the raw response to the pull.
+func (a *PullAssert) Response() string {
+	return a.response
+}
+
+// ExpectResolve asserts that the pull resolved to expected. Both values are
+// compared in their JSON form, so structs and maps with equivalent encodings
+// are considered equal. Arrays in the result, at any depth, are compared
+// unescaped; other expressions, such as ["date", ms], are compared as sent.
+func (a *PullAssert) ExpectResolve(t testing.TB, expected interface{}) {
+	t.Helper()
+
+	value, ok := a.expectFrame(t, "resolve")
+	if !ok {
+		return
+	}
+
+	value = unescapeArrays(value)
+
+	expectedBytes, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatalf("failed to marshal expected value: %v", err)
+	}
+	var want interface{}
+	if err := json.Unmarshal(expectedBytes, &want); err != nil {
+		t.Fatalf("failed to normalize expected value: %v", err)
+	}
+
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("export %d resolved to %s, want %s", a.exportID, mustMarshal(value), expectedBytes)
+	}
+}
+
+// ExpectReject asserts that the pull was rejected with the given error type.
+func (a *PullAssert) ExpectReject(t testing.TB, code string) {
+	t.Helper()
+
+	value, ok := a.expectFrame(t, "reject")
+	if !ok {
+		return
+	}
+
+	errArray, ok := value.([]interface{})
+	if !ok || len(errArray) < 2 || errArray[0] != "error" {
+		t.Errorf("export %d rejected with malformed error %s", a.exportID, mustMarshal(value))
+		return
+	}
+	if errArray[1] != code {
+		t.Errorf("export %d rejected with %v, want %s", a.exportID, errArray[1], code)
+	}
+}
+
+// expectFrame checks that the response is a frame of the given type for this
+// export and returns its payload.
+func (a *PullAssert) expectFrame(t testing.TB, frameType string) (interface{}, bool) {
+	t.Helper()
+
+	if a.err != nil {
+		t.Errorf("export %d: %v", a.exportID, a.err)
+		return nil, false
+	}
+
+	var frame []interface{}
+	if err := json.Unmarshal([]byte(a.response), &frame); err != nil {
+		t.Errorf("export %d: invalid response %q: %v", a.exportID, a.response, err)
+		return nil, false
+	}
+	if len(frame) < 3 {
+		t.Errorf("export %d: malformed response %s", a.exportID, a.response)
+		return nil, false
+	}
+	if frame[0] != frameType {
+		t.Errorf("export %d: got %s, want %s", a.exportID, a.response, frameType)
+		return nil, false
+	}
+	if id, ok := frame[1].(float64); !ok || int(id) != a.exportID {
+		t.Errorf("export %d: response for wrong export %s", a.exportID, a.response)
+		return nil, false
+	}
+	return frame[2], true
+}
+
+// unescapeArrays returns value with the arrays in it, which are escaped by
+// wrapping them in another array on the wire, unwrapped at any depth.
+func unescapeArrays(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 1 {
+			if inner, ok := v[0].([]interface{}); ok {
+				unescaped := make([]interface{}, len(inner))
+				for i, elem := range inner {
+					unescaped[i] = unescapeArrays(elem)
+				}
+				return unescaped
+			}
+		}
+	case map[string]interface{}:
+		unescaped := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			unescaped[key] = unescapeArrays(val)
+		}
+		return unescaped
+	}
+	return value
+}
+
+func mustMarshal(value interface{}) string {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err.Error()
+	}
+	return string(valueBytes)
+}
@@ -0,0 +1,35 @@
+package testharness
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gocapnweb"
+)
+
+func TestPipelineAssert(t *testing.T) {
+	target := gocapnweb.NewBaseRpcTarget()
+	target.Method("user", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"id": "u_1", "tags": []string{"a", "b"}, "groups": [][]int{{1, 2}, {3}}}, nil
+	})
+	target.Method("echo", func(args json.RawMessage) (interface{}, error) {
+		var argArray []interface{}
+		if err := json.Unmarshal(args, &argArray); err != nil || len(argArray) == 0 {
+			return nil, err
+		}
+		return argArray[0], nil
+	})
+	client := NewInProcessClient(NewRpcSessionForTest(t, target), target)
+	pipeline := NewPipelineAssert(client)
+
+	user := pipeline.Push("user", nil)
+	tags := pipeline.Push("echo", []interface{}{user.Ref("tags")})
+	if user.ExportID() != 1 || tags.ExportID() != 2 {
+		t.Errorf("export IDs %d and %d, want 1 and 2", user.ExportID(), tags.ExportID())
+	}
+
+	// Arrays nested in results are compared unescaped
+	user.Pull().ExpectResolve(t, map[string]interface{}{"id": "u_1", "tags": []string{"a", "b"}, "groups": [][]int{{1, 2}, {3}}})
+	tags.Pull().ExpectResolve(t, []string{"a", "b"})
+	pipeline.Push("missing", nil).Pull().ExpectReject(t, "MethodNotFound")
+}
@@ -0,0 +1,94 @@
+// Package testharness provides helpers for exercising gocapnweb RPC sessions
+// from Go tests.
+package testharness
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gocapnweb"
+)
+
+// goroutineSettleTimeout bounds how long the leak check waits for goroutines
+// started during a test to exit.
+const goroutineSettleTimeout = 2 * time.Second
+
+// testLogWriter adapts a test's log output to an io.Writer. Sessions may
+// log from goroutines that outlive the test, and logging to a test that has
+// completed panics, so output written once the test has cleaned up is
+// discarded.
+type testLogWriter struct {
+	t       testing.TB
+	stopped *atomic.Bool
+	// mu is held while writing, so the test cannot complete between a
+	// write seeing that logging has not stopped and logging.
+	mu *sync.RWMutex
+}
+
+// newTestLogWriter returns a testLogWriter that stops logging to t when t
+// cleans up.
+func newTestLogWriter(t testing.TB) testLogWriter {
+	w := testLogWriter{t: t, stopped: new(atomic.Bool), mu: new(sync.RWMutex)}
+	t.Cleanup(func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.stopped.Store(true)
+	})
+	return w
+}
+
+func (w testLogWriter) Write(p []byte) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.stopped.Load() {
+		w.t.Helper()
+		w.t.Log(string(p))
+	}
+	return len(p), nil
+}
+
+// NewRpcSessionForTest creates an RpcSession whose diagnostic output is routed
+// to the test log until the test has cleaned up. It records the number of
+// running goroutines before the session is created and registers a cleanup
+// that fails the test if any additional goroutines are still running once
+// the test has finished.
+func NewRpcSessionForTest(t testing.TB, target gocapnweb.RpcTarget, opts ...gocapnweb.RpcSessionOption) *gocapnweb.RpcSession {
+	t.Helper()
+
+	// Cleanups run last-registered first, so goroutines can still log
+	// while the leak check waits for them
+	logger := log.New(newTestLogWriter(t), "", 0)
+
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		checkGoroutineLeaks(t, before)
+	})
+
+	opts = append([]gocapnweb.RpcSessionOption{gocapnweb.WithLogger(logger)}, opts...)
+	return gocapnweb.NewRpcSession(target, opts...)
+}
+
+// checkGoroutineLeaks waits briefly for the goroutine count to return to the
+// baseline and reports a leak, with a dump of all stacks, if it does not.
+func checkGoroutineLeaks(t testing.TB, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(goroutineSettleTimeout)
+	for {
+		current := runtime.NumGoroutine()
+		if current <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Errorf("goroutine leak: %d goroutines running after test, %d before\n%s", current, baseline, buf[:n])
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,148 @@
+package testharness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocapnweb"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// recordingTB records what is logged to it and the cleanups registered on
+// it, which the test runs itself.
+type recordingTB struct {
+	testing.TB
+	mu       sync.Mutex
+	logged   []string
+	cleanups []func()
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Log(args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logged = append(r.logged, fmt.Sprint(args...))
+}
+
+func (r *recordingTB) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func TestTestLogWriterStopsAtCleanup(t *testing.T) {
+	tb := &recordingTB{TB: t}
+	logger := log.New(newTestLogWriter(tb), "", 0)
+
+	// Goroutines still logging as the test cleans up must not log to it
+	// afterwards
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					logger.Print("running")
+				}
+			}
+		}()
+	}
+	logger.Print("before cleanup")
+	for _, cleanup := range tb.cleanups {
+		cleanup()
+	}
+	tb.mu.Lock()
+	logged := len(tb.logged)
+	tb.mu.Unlock()
+
+	logger.Print("after cleanup")
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if len(tb.logged) != logged {
+		t.Errorf("%d messages logged after cleanup", len(tb.logged)-logged)
+	}
+	if logged == 0 || !strings.Contains(strings.Join(tb.logged, ""), "before cleanup") {
+		t.Errorf("messages before cleanup were not logged")
+	}
+}
+
+// tickTarget returns a target whose ticks method streams numbers until the
+// call's context is cancelled.
+func tickTarget() *gocapnweb.BaseRpcTarget {
+	target := gocapnweb.NewBaseRpcTarget()
+	target.MethodWithContext("ticks", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		ticks := make(chan interface{})
+		go func() {
+			defer close(ticks)
+			for i := 0; ; i++ {
+				select {
+				case ticks <- i:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return (<-chan interface{})(ticks), nil
+	})
+	return target
+}
+
+func TestSubscribeThenDisconnectDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		checkGoroutineLeaks(t, before)
+	})
+
+	e := echo.New()
+	e.HideBanner = true
+	gocapnweb.SetupRpcEndpoint(e, "/api", tickTarget(),
+		gocapnweb.WithSessionOptions(gocapnweb.WithLogger(log.New(newTestLogWriter(t), "", 0))))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(message string) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(`["push",["pipeline",0,["ticks"],[]]]`)
+	for i := 0; i < 3; i++ {
+		send(`["pull",1]`)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf(`["resolve",1,%d]`, i); string(frame) != want {
+			t.Fatalf("frame %d = %s, want %s", i, frame, want)
+		}
+	}
+
+	// Disconnecting cancels the subscription, whose producer must then
+	// exit along with the connection's goroutines
+	conn.Close()
+}
@@ -0,0 +1,82 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ErrTimeout rejects a call whose handler did not return within the
+// session's pull timeout. Its details name the method and the timeout in
+// milliseconds.
+var ErrTimeout = RpcError{Code: "TimeoutError"}
+
+// WithPullTimeout sets how long each handler called to resolve a pull may
+// run. A handler that has not returned in time has its context cancelled
+// with ErrTimeout, and its call is rejected with ErrTimeout without waiting
+// for it further. Zero or a negative value disables the timeout.
+func WithPullTimeout(d time.Duration) RpcSessionOption {
+	return func(o *SessionOptions) {
+		o.PullTimeout = d
+	}
+}
+
+// callTimedOut returns the error for a call to method that timed out.
+func callTimedOut(method string, timeout time.Duration) error {
+	return RpcError{
+		Code:    ErrTimeout.Code,
+		Message: fmt.Sprintf("method %s did not return within %s", method, timeout),
+		Details: map[string]interface{}{"method": method, "timeoutMs": timeout.Milliseconds()},
+	}
+}
+
+// callOutcome is what a handler run by dispatchWithTimeout returned, or the
+// value it panicked with.
+type callOutcome struct {
+	result   interface{}
+	err      error
+	panicked interface{}
+}
+
+// dispatchWithTimeout calls method on target, as dispatchTarget does with
+// ctx, and gives up on it once the session's pull timeout has passed. The
+// handler runs on its own goroutine, so one that never returns holds up
+// nothing but itself. A panic in the handler is raised again on the calling
+// goroutine.
+func (s *RpcSession) dispatchWithTimeout(ctx context.Context, sessionData *SessionData, target RpcTarget, method string, args json.RawMessage) (interface{}, error) {
+	timeout := s.opts.PullTimeout
+	if timeout <= 0 {
+		return dispatchTarget(ctx, sessionData, target, method, args)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timedOut := callTimedOut(method, timeout)
+
+	// Buffered so a handler that returns after the timeout does not block
+	outcome := make(chan callOutcome, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				outcome <- callOutcome{panicked: r}
+			}
+		}()
+		result, err := dispatchTarget(ctx, sessionData, target, method, args)
+		outcome <- callOutcome{result: result, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case out := <-outcome:
+		if out.panicked != nil {
+			panic(out.panicked)
+		}
+		return out.result, out.err
+	case <-timer.C:
+		cancel(timedOut)
+		s.logf("Call to %s timed out after %s", method, timeout)
+		return nil, timedOut
+	}
+}
@@ -0,0 +1,150 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hangTarget returns the test target with a hang method that blocks,
+// ignoring its context, until release is closed, a sleep method that
+// returns after its argument in milliseconds, and a wait method that
+// returns once its context is cancelled, sending the cause on causes.
+// running counts the hang handlers that have not returned.
+func hangTarget(release <-chan struct{}, running *int32, causes chan<- error) *BaseRpcTarget {
+	target := testTarget()
+	target.Method("hang", func(json.RawMessage) (interface{}, error) {
+		atomic.AddInt32(running, 1)
+		defer atomic.AddInt32(running, -1)
+		<-release
+		return "released", nil
+	})
+	target.Method("sleep", func(args json.RawMessage) (interface{}, error) {
+		var ms []int
+		if err := json.Unmarshal(args, &ms); err != nil || len(ms) != 1 {
+			return nil, fmt.Errorf("sleep takes a duration in milliseconds")
+		}
+		time.Sleep(time.Duration(ms[0]) * time.Millisecond)
+		return "done", nil
+	})
+	target.MethodWithContext("wait", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		causes <- context.Cause(ctx)
+		return nil, ctx.Err()
+	})
+	return target
+}
+
+func TestPullTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var running int32
+	causes := make(chan error, 1)
+	target := hangTarget(release, &running, causes)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		call    string
+		want    string
+	}{
+		{
+			"hung handler",
+			50 * time.Millisecond,
+			`["hang"],[]`,
+			`["reject",1,["error","TimeoutError","method hang did not return within 50ms",null,{"method":"hang","timeoutMs":50}]]`,
+		},
+		{
+			"handler watching its context",
+			50 * time.Millisecond,
+			`["wait"],[]`,
+			`["reject",1,["error","TimeoutError","method wait did not return within 50ms",null,{"method":"wait","timeoutMs":50}]]`,
+		},
+		{"handler returning in time", time.Second, `["sleep"],[10]`, `["resolve",1,"done"]`},
+		{"disabled", 0, `["sleep"],[60]`, `["resolve",1,"done"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			got := handleMessages(t, newTestSession(target, WithPullTimeout(tt.timeout)), target,
+				`["push",["pipeline",0,`+tt.call+`]]`, `["pull",1]`)
+			if strings.Join(got, "\n") != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+			if tt.timeout > 0 && time.Since(start) > tt.timeout+time.Second {
+				t.Errorf("pull took %s with a timeout of %s", time.Since(start), tt.timeout)
+			}
+		})
+	}
+
+	// The handler's context is cancelled with the timeout error
+	select {
+	case cause := <-causes:
+		if !errors.Is(cause, ErrTimeout) {
+			t.Errorf("context cause = %v, want ErrTimeout", cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("context of the timed-out handler was not cancelled")
+	}
+}
+
+// TestPullTimeoutLeak records the documented cost of the timeout: a handler
+// that ignores its context keeps its goroutine after the call is rejected,
+// until the handler itself returns.
+func TestPullTimeoutLeak(t *testing.T) {
+	release := make(chan struct{})
+	var running int32
+	target := hangTarget(release, &running, make(chan error, 1))
+	session := newTestSession(target, WithPullTimeout(10*time.Millisecond))
+
+	const calls = 5
+	for i := 0; i < calls; i++ {
+		got := handleMessages(t, session, target, `["push",["pipeline",0,["hang"],[]]]`, `["pull",1]`)
+		if len(got) != 1 || !strings.Contains(got[0], `"TimeoutError"`) {
+			t.Fatalf("call %d: got %v, want a TimeoutError reject", i, got)
+		}
+	}
+	if n := atomic.LoadInt32(&running); n != calls {
+		t.Errorf("%d hung handlers still running after their calls were rejected, want %d", n, calls)
+	}
+
+	// The goroutines end once the handlers return, and their late results
+	// are dropped
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&running) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d handlers still running after release", atomic.LoadInt32(&running))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPullTimeoutOverWebSocket(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var running int32
+	target := hangTarget(release, &running, make(chan error, 1))
+	server := endpointServer(t, target, WithSessionOptions(WithPullTimeout(50*time.Millisecond)))
+	conn := dialEndpoint(t, server, http.Header{})
+
+	// A hung handler no longer holds up the connection's later calls
+	sendMessages(t, conn,
+		`["push",["pipeline",0,["hang"],[]]]`,
+		`["pull",1]`,
+		`["push",["pipeline",0,["echo"],["after"]]]`,
+		`["pull",2]`,
+	)
+	if got := readFrameWithPrefix(t, conn, `["reject",1`); !strings.Contains(got, `"TimeoutError"`) {
+		t.Errorf("got %s, want a TimeoutError reject", got)
+	}
+	if got, want := readFrameWithPrefix(t, conn, `["resolve",2`), `["resolve",2,"after"]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
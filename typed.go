@@ -0,0 +1,236 @@
+package gocapnweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// TypedMethod registers fn as a method handler, decoding the positional
+// arguments of each call into fn's parameters and returning its result.
+// fn must have the form
+//
+//	func([ctx context.Context,] p1 T1, ..., pn Tn) (R, error)
+//
+// where the parameter and result types are JSON-serializable. A leading
+// context.Context parameter receives the context of the call, as for
+// MethodWithContext. A variadic final parameter collects any remaining
+// arguments, and pointer parameters receive nil for JSON null. Date
+// escapes bind to time.Time parameters and fields, as do RFC 3339 strings,
+// and parameters and fields that implement CapnWebUnmarshaler decode
+// themselves.
+// A function of one non-variadic parameter may also be called with the bare
+// argument rather than a one-element array.
+//
+// Calls with the wrong number or types of arguments are rejected with an
+// ArgumentError. TypedMethod returns an error if fn does not have the
+// required form.
+func (t *BaseRpcTarget) TypedMethod(name string, fn interface{}) error {
+	fnValue := reflect.ValueOf(fn)
+	fnType := fnValue.Type()
+	if err := checkTypedHandler(name, fnType); err != nil {
+		return err
+	}
+
+	hasContext := fnType.NumIn() > 0 && fnType.In(0) == contextType
+	params := make([]reflect.Type, 0, fnType.NumIn())
+	for i := 0; i < fnType.NumIn(); i++ {
+		if i == 0 && hasContext {
+			continue
+		}
+		params = append(params, fnType.In(i))
+	}
+
+	decoder := typedArgDecoder{method: name, params: params, variadic: fnType.IsVariadic()}
+
+	t.MethodWithContext(name, func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		in, err := decoder.decode(args)
+		if err != nil {
+			return nil, err
+		}
+		if hasContext {
+			in = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, in...)
+		}
+
+		out := fnValue.Call(in)
+		if errValue := out[1]; !errValue.IsNil() {
+			return nil, errValue.Interface().(error)
+		}
+		return out[0].Interface(), nil
+	})
+	return nil
+}
+
+// checkTypedHandler returns an error if fnType does not have the form of a
+// TypedMethod handler.
+func checkTypedHandler(name string, fnType reflect.Type) error {
+	if fnType.Kind() != reflect.Func {
+		return fmt.Errorf("typed method %s: handler must be a function, got %s", name, fnType)
+	}
+	if fnType.NumOut() != 2 || !fnType.Out(1).Implements(errorType) {
+		return fmt.Errorf("typed method %s: handler must return (result, error)", name)
+	}
+	return nil
+}
+
+// typedArgDecoder decodes a call's arguments into the parameters of a
+// TypedMethod handler. Errors name the method, if it is set, and the
+// parameters, if names are. The last len(defaults) parameters before any
+// variadic one are optional: omitted or undefined, they take their default.
+type typedArgDecoder struct {
+	method   string
+	params   []reflect.Type
+	names    []string
+	defaults []reflect.Value
+	variadic bool
+}
+
+// decode returns the argument values for a call with the given arguments.
+func (d typedArgDecoder) decode(args json.RawMessage) ([]reflect.Value, error) {
+	raw, err := d.positional(args)
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := len(d.params)
+	if d.variadic {
+		fixed--
+	}
+	required := fixed - len(d.defaults)
+	if len(raw) < required || (!d.variadic && len(raw) > fixed) {
+		return nil, RpcError{
+			Code:    "ArgumentError",
+			Message: fmt.Sprintf("%s %s, got %d", d.expects(), d.describeArity(fixed), len(raw)),
+		}
+	}
+
+	in := make([]reflect.Value, 0, max(len(raw), fixed))
+	for i, arg := range raw {
+		var paramType reflect.Type
+		if i < fixed {
+			paramType = d.params[i]
+		} else {
+			paramType = d.params[len(d.params)-1].Elem()
+		}
+		if i >= required && i < fixed && IsUndefined(arg) {
+			in = append(in, d.defaults[i-required])
+			continue
+		}
+
+		value := reflect.New(paramType)
+		if err := unmarshalArg(arg, value.Interface()); err != nil {
+			return nil, RpcError{
+				Code:    "ArgumentError",
+				Message: fmt.Sprintf("%s: expected %s: %v", d.describeArgument(i), paramType, err),
+				Details: d.argumentDetails(i),
+				Cause:   err,
+			}
+		}
+		in = append(in, value.Elem())
+	}
+	for i := len(raw); i < fixed; i++ {
+		in = append(in, d.defaults[i-required])
+	}
+	return in, nil
+}
+
+// positional splits args into its positional arguments.
+func (d typedArgDecoder) positional(args json.RawMessage) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(args)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil, nil
+	}
+
+	singleParam := len(d.params) == 1 && !d.variadic
+	if trimmed[0] != '[' {
+		if singleParam {
+			return []json.RawMessage{trimmed}, nil
+		}
+		return nil, RpcError{Code: "ArgumentError", Message: d.expects() + " an array of arguments"}
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(trimmed, &raw); err != nil {
+		return nil, RpcError{Code: "ArgumentError", Message: fmt.Sprintf("invalid arguments: %v", err), Cause: err}
+	}
+
+	// A sole slice parameter may be passed as the bare array, which is the
+	// case unless the array holds exactly one array or null
+	if singleParam {
+		if kind := d.params[0].Kind(); kind == reflect.Slice || kind == reflect.Array {
+			if len(raw) != 1 || !isArrayOrNull(raw[0]) {
+				return []json.RawMessage{trimmed}, nil
+			}
+		}
+	}
+	return raw, nil
+}
+
+// isArrayOrNull reports whether a JSON value is an array or null.
+func isArrayOrNull(value json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(value)
+	return len(trimmed) > 0 && (trimmed[0] == '[' || bytes.Equal(trimmed, []byte("null")))
+}
+
+func (d typedArgDecoder) describeArity(fixed int) string {
+	required := fixed - len(d.defaults)
+	var arity string
+	switch {
+	case d.variadic:
+		arity = fmt.Sprintf("at least %d argument%s", required, plural(required))
+	case required < fixed:
+		arity = fmt.Sprintf("%d to %d arguments", required, fixed)
+	default:
+		arity = fmt.Sprintf("%d argument%s", required, plural(required))
+	}
+	if len(d.names) > 0 {
+		arity += " (" + strings.Join(d.names, ", ") + ")"
+	}
+	return arity
+}
+
+// plural returns the suffix for n of a countable noun.
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// expects opens a message about the arguments the decoder expects.
+func (d typedArgDecoder) expects() string {
+	if d.method == "" {
+		return "expected"
+	}
+	return d.method + " expects"
+}
+
+// describeArgument names the argument at index i in messages.
+func (d typedArgDecoder) describeArgument(i int) string {
+	argument := fmt.Sprintf("argument %d", i+1)
+	if i < len(d.names) {
+		argument += " (" + d.names[i] + ")"
+	}
+	if d.method != "" {
+		argument += " of " + d.method
+	}
+	return argument
+}
+
+// argumentDetails returns the details of an error decoding the argument at
+// index i.
+func (d typedArgDecoder) argumentDetails(i int) map[string]interface{} {
+	details := map[string]interface{}{"argument": i + 1}
+	if i < len(d.names) {
+		details["parameter"] = d.names[i]
+	}
+	return details
+}
@@ -0,0 +1,146 @@
+package gocapnweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTypedMethod(t *testing.T) {
+	type profile struct {
+		Handle string `json:"handle"`
+		Limit  int    `json:"limit"`
+	}
+	target := NewBaseRpcTarget()
+	register := func(name string, fn interface{}) {
+		if err := target.TypedMethod(name, fn); err != nil {
+			t.Fatalf("TypedMethod(%s): %v", name, err)
+		}
+	}
+	register("add", func(a, b int) (int, error) { return a + b, nil })
+	register("greet", func(name string) (string, error) { return "Hello, " + name + "!", nil })
+	register("sum", func(prefix string, values ...float64) (string, error) {
+		total := 0.0
+		for _, v := range values {
+			total += v
+		}
+		return prefix + strings.Repeat("+", int(total)), nil
+	})
+	register("deref", func(p *profile) (string, error) {
+		if p == nil {
+			return "nil", nil
+		}
+		return p.Handle, nil
+	})
+	register("profile", func(p profile) (profile, error) { return p, nil })
+	register("lengths", func(items []string) (int, error) { return len(items), nil })
+	register("withContext", func(ctx context.Context, n int) (bool, error) {
+		return ctx != nil && n == 1, nil
+	})
+	register("fails", func() (interface{}, error) { return nil, ErrUnauthorized })
+
+	tests := []struct {
+		name    string
+		method  string
+		args    string
+		want    interface{}
+		wantErr string
+		details map[string]interface{}
+	}{
+		{name: "multiple arguments", method: "add", args: `[2,3]`, want: 5},
+		{name: "single bare argument", method: "greet", args: `"Ada"`, want: "Hello, Ada!"},
+		{name: "single argument in array", method: "greet", args: `["Ada"]`, want: "Hello, Ada!"},
+		{name: "variadic without tail", method: "sum", args: `["s"]`, want: "s"},
+		{name: "variadic with tail", method: "sum", args: `["s",1,2]`, want: "s+++"},
+		{name: "nil pointer", method: "deref", args: `[null]`, want: "nil"},
+		{name: "pointer", method: "deref", args: `[{"handle":"ada"}]`, want: "ada"},
+		{name: "struct", method: "profile", args: `[{"handle":"ada","limit":2}]`, want: profile{"ada", 2}},
+		{name: "sole slice as bare array", method: "lengths", args: `["a","b","c"]`, want: 3},
+		{name: "sole slice wrapped", method: "lengths", args: `[["a","b"]]`, want: 2},
+		{name: "context parameter", method: "withContext", args: `[1]`, want: true},
+		{name: "no arguments", method: "fails", args: ``, wantErr: "Unauthorized"},
+		{
+			name: "too few arguments", method: "add", args: `[1]`,
+			wantErr: "ArgumentError: add expects 2 arguments, got 1",
+		},
+		{
+			name: "too many arguments", method: "add", args: `[1,2,3]`,
+			wantErr: "ArgumentError: add expects 2 arguments, got 3",
+		},
+		{
+			name: "variadic too few", method: "sum", args: `[]`,
+			wantErr: "ArgumentError: sum expects at least 1 argument, got 0",
+		},
+		{
+			name: "wrong type", method: "add", args: `[1,"x"]`,
+			wantErr: "ArgumentError: argument 2 of add: expected int",
+			details: map[string]interface{}{"argument": 2},
+		},
+		{
+			name: "wrong variadic type", method: "sum", args: `["s",1,"x"]`,
+			wantErr: "ArgumentError: argument 3 of sum: expected float64",
+			details: map[string]interface{}{"argument": 3},
+		},
+		{
+			name: "not an array", method: "add", args: `{"a":1}`,
+			wantErr: "ArgumentError: add expects an array of arguments",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := target.Dispatch(tt.method, json.RawMessage(tt.args))
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %s", err, tt.wantErr)
+				}
+				var rpcErr RpcError
+				if tt.details != nil && (!errors.As(err, &rpcErr) || !reflect.DeepEqual(rpcErr.Details, tt.details)) {
+					t.Errorf("details = %v, want %v", rpcErr.Details, tt.details)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypedMethodCoexistsWithMethod(t *testing.T) {
+	target := NewBaseRpcTarget()
+	target.Method("raw", func(args json.RawMessage) (interface{}, error) { return string(args), nil })
+	if err := target.TypedMethod("typed", func(n int) (int, error) { return n * 2, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := target.Dispatch("raw", json.RawMessage(`[1]`)); err != nil || got != "[1]" {
+		t.Errorf("raw = %v, %v", got, err)
+	}
+	if got, err := target.Dispatch("typed", json.RawMessage(`[4]`)); err != nil || got != 8 {
+		t.Errorf("typed = %v, %v", got, err)
+	}
+}
+
+func TestTypedMethodRejectsInvalidHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler interface{}
+	}{
+		{"not a function", 42},
+		{"no results", func(int) {}},
+		{"one result", func(int) int { return 0 }},
+		{"second result not error", func(int) (int, int) { return 0, 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewBaseRpcTarget().TypedMethod("m", tt.handler); err == nil {
+				t.Error("TypedMethod succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ArgValidator checks the arguments of a call before its handler runs.
+// Returning an error rejects the call; return an RpcError to control the
+// error code reported to the client.
+type ArgValidator func(args json.RawMessage) error
+
+// MethodWithValidators registers a method handler that only runs once every
+// validator has accepted the arguments. Validators run in order and the first
+// error stops processing.
+func (t *BaseRpcTarget) MethodWithValidators(name string, validators []ArgValidator, handler func(json.RawMessage) (interface{}, error)) {
+	t.Method(name, func(args json.RawMessage) (interface{}, error) {
+		for _, validate := range validators {
+			if err := validate(args); err != nil {
+				return nil, err
+			}
+		}
+		return handler(args)
+	})
+}
+
+// LengthValidator requires the named argument field, if present, to be a
+// string or array whose length is between min and max inclusive. String
+// length is measured in characters.
+func LengthValidator(field string, min, max int) ArgValidator {
+	return func(args json.RawMessage) error {
+		value, exists, err := lookupArgField(args, field)
+		if err != nil || !exists {
+			return err
+		}
+
+		var length int
+		switch v := value.(type) {
+		case string:
+			length = utf8.RuneCountInString(v)
+		case []interface{}:
+			length = len(v)
+		default:
+			return newValidationError(field, fmt.Sprintf("%s must be a string or array", field))
+		}
+
+		if length < min || length > max {
+			return newValidationError(field, fmt.Sprintf("%s must have length between %d and %d", field, min, max))
+		}
+		return nil
+	}
+}
+
+// RangeValidator requires the named argument field, if present, to be a
+// number between min and max inclusive.
+func RangeValidator(field string, min, max float64) ArgValidator {
+	return func(args json.RawMessage) error {
+		value, exists, err := lookupArgField(args, field)
+		if err != nil || !exists {
+			return err
+		}
+
+		number, ok := value.(float64)
+		if !ok {
+			return newValidationError(field, fmt.Sprintf("%s must be a number", field))
+		}
+		if number < min || number > max {
+			return newValidationError(field, fmt.Sprintf("%s must be between %g and %g", field, min, max))
+		}
+		return nil
+	}
+}
+
+// lookupArgField finds a named field in call arguments, which may be an
+// object or a positional array whose first element is an object.
+func lookupArgField(args json.RawMessage, field string) (interface{}, bool, error) {
+	var decoded interface{}
+	if err := json.Unmarshal(args, &decoded); err != nil {
+		return nil, false, newValidationError(field, "arguments are not valid JSON")
+	}
+
+	if argArray, ok := decoded.([]interface{}); ok {
+		if len(argArray) == 0 {
+			return nil, false, nil
+		}
+		decoded = argArray[0]
+	}
+
+	obj, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	value, exists := obj[field]
+	return value, exists, nil
+}
+
+func newValidationError(field, message string) RpcError {
+	return RpcError{
+		Code:    "ValidationError",
+		Message: message,
+		Details: map[string]interface{}{"field": field},
+	}
+}
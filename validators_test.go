@@ -0,0 +1,111 @@
+package gocapnweb
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMethodWithValidators(t *testing.T) {
+	target := testTarget()
+	var ran []string
+	noSpaces := func(args json.RawMessage) error {
+		ran = append(ran, "noSpaces")
+		if strings.Contains(string(args), " ") {
+			return NewRpcError("InvalidHandle", "handle must not contain spaces")
+		}
+		return nil
+	}
+	target.MethodWithValidators("feed", []ArgValidator{
+		RangeValidator("limit", 1, 100),
+		LengthValidator("handle", 3, 20),
+		noSpaces,
+	}, func(args json.RawMessage) (interface{}, error) {
+		ran = append(ran, "handler")
+		return "feed", nil
+	})
+
+	tests := []struct {
+		name string
+		args string
+		want string
+		ran  []string
+	}{
+		{
+			name: "valid",
+			args: `[{"handle":"ada.bsky","limit":10}]`,
+			want: `["resolve",1,"feed"]`,
+			ran:  []string{"noSpaces", "handler"},
+		},
+		{
+			name: "below range",
+			args: `[{"handle":"ada.bsky","limit":0}]`,
+			want: `["reject",1,["error","ValidationError","limit must be between 1 and 100",null,{"field":"limit"}]]`,
+		},
+		{
+			name: "first error stops processing",
+			args: `[{"handle":"a b","limit":1000}]`,
+			want: `["reject",1,["error","ValidationError","limit must be between 1 and 100",null,{"field":"limit"}]]`,
+		},
+		{
+			name: "too short",
+			args: `[{"handle":"ab","limit":10}]`,
+			want: `["reject",1,["error","ValidationError","handle must have length between 3 and 20",null,{"field":"handle"}]]`,
+		},
+		{
+			name: "custom validator",
+			args: `[{"handle":"ada lovelace","limit":10}]`,
+			want: `["reject",1,["error","InvalidHandle","handle must not contain spaces"]]`,
+			ran:  []string{"noSpaces"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran = nil
+			got := handleMessages(t, newTestSession(target), target, `["push",["pipeline",0,["feed"],`+tt.args+`]]`, `["pull",1]`)
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got  %v\nwant %s", got, tt.want)
+			}
+			if strings.Join(ran, " ") != strings.Join(tt.ran, " ") {
+				t.Errorf("ran %v, want %v", ran, tt.ran)
+			}
+		})
+	}
+}
+
+func TestBuiltinValidators(t *testing.T) {
+	tests := []struct {
+		name      string
+		validator ArgValidator
+		args      string
+		want      string
+	}{
+		{"range in bounds", RangeValidator("limit", 1, 100), `{"limit":100}`, ""},
+		{"range above", RangeValidator("limit", 1, 100), `{"limit":100.5}`, "ValidationError: limit must be between 1 and 100"},
+		{"range not a number", RangeValidator("limit", 1, 100), `[{"limit":"5"}]`, "ValidationError: limit must be a number"},
+		{"range absent", RangeValidator("limit", 1, 100), `[{}]`, ""},
+		{"range no arguments", RangeValidator("limit", 1, 100), `[]`, ""},
+		{"length characters", LengthValidator("name", 1, 3), `{"name":"été"}`, ""},
+		{"length too long", LengthValidator("name", 1, 3), `{"name":"abcd"}`, "ValidationError: name must have length between 1 and 3"},
+		{"length array", LengthValidator("tags", 1, 2), `[{"tags":["a","b"]}]`, ""},
+		{"length empty array", LengthValidator("tags", 1, 2), `[{"tags":[]}]`, "ValidationError: tags must have length between 1 and 2"},
+		{"length not a string", LengthValidator("name", 1, 3), `{"name":7}`, "ValidationError: name must be a string or array"},
+		{"invalid JSON", LengthValidator("name", 1, 3), `{`, "ValidationError: arguments are not valid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validator(json.RawMessage(tt.args))
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("validator rejected %s: %v", tt.args, err)
+				}
+				return
+			}
+			var rpcErr RpcError
+			if err == nil || err.Error() != tt.want || !errors.As(err, &rpcErr) {
+				t.Errorf("validator error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package gocapnweb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the version of the Cap'n Web protocol implemented by
+// this package.
+const ProtocolVersion = "1.0.0"
+
+// ProtocolVersionMetaKey is the session metadata key holding the protocol
+// version negotiated with a hello message.
+const ProtocolVersionMetaKey = "protocolVersion"
+
+// ErrProtocolError aborts a session whose client breaks the protocol's
+// handshake: it sends a hello after other messages, or asks for a range of
+// versions the server does not speak. Pending and later calls are rejected
+// with it, and WebSocket connections are closed with 1002 (Protocol Error).
+var ErrProtocolError = RpcError{Code: "ProtocolError"}
+
+// semver is a parsed major.minor.patch version.
+type semver [3]int
+
+// parseSemver parses a version of the form major.minor.patch; missing
+// trailing components are treated as zero.
+func parseSemver(version string) (semver, error) {
+	var v semver
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v semver) compare(other semver) int {
+	for i := range v {
+		if v[i] != other[i] {
+			if v[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// negotiateVersion returns the highest of the supported versions within
+// [minVersion, maxVersion]. An empty bound is unbounded.
+func negotiateVersion(supported []string, minVersion, maxVersion string) (string, error) {
+	var lo, hi *semver
+	if minVersion != "" {
+		v, err := parseSemver(minVersion)
+		if err != nil {
+			return "", err
+		}
+		lo = &v
+	}
+	if maxVersion != "" {
+		v, err := parseSemver(maxVersion)
+		if err != nil {
+			return "", err
+		}
+		hi = &v
+	}
+
+	type candidate struct {
+		name    string
+		version semver
+	}
+	var candidates []candidate
+	for _, name := range supported {
+		v, err := parseSemver(name)
+		if err != nil {
+			continue
+		}
+		if lo != nil && v.compare(*lo) < 0 {
+			continue
+		}
+		if hi != nil && v.compare(*hi) > 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{name, v})
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no common protocol version: server supports %s", strings.Join(supported, ", "))
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].version.compare(candidates[j].version) > 0
+	})
+	return candidates[0].name, nil
+}
+
+// handleHello negotiates the protocol version requested by a hello message.
+// On success it acknowledges the chosen version and, unless the connection
+// negotiated the v1 subprotocol, announces the server's capabilities;
+// otherwise the session is aborted with ErrProtocolError.
+func (s *RpcSession) handleHello(sessionData *SessionData, helloData interface{}, first bool) [][]interface{} {
+	if !first {
+		s.abortProtocol(sessionData, "hello must be the first message")
+		return nil
+	}
+
+	var minVersion, maxVersion string
+	if params, ok := helloData.(map[string]interface{}); ok {
+		minVersion, _ = params["minVersion"].(string)
+		maxVersion, _ = params["maxVersion"].(string)
+	}
+
+	version, err := negotiateVersion(s.opts.ProtocolVersions, minVersion, maxVersion)
+	if err != nil {
+		s.logf("Version negotiation failed: %v", err)
+		s.abortProtocol(sessionData, err.Error())
+		return nil
+	}
+
+	sessionData.SetMeta(ProtocolVersionMetaKey, version)
+	frames := [][]interface{}{
+		{"hello-ack", map[string]interface{}{"version": version}},
+	}
+
+	// Capability announcements were introduced after v1
+	if !sessionData.isLegacyProtocol() {
+		frames = append(frames, []interface{}{"capabilities", map[string]interface{}{
+			"protocolVersion":   version,
+			"supportedVersions": s.opts.ProtocolVersions,
+		}})
+	}
+	return frames
+}
+
+// abortProtocol aborts a session whose client broke the protocol's
+// handshake, as if it had aborted with ErrProtocolError.
+func (s *RpcSession) abortProtocol(sessionData *SessionData, message string) {
+	s.abortSession(sessionData, AbortInfo{
+		CloseCode: websocket.CloseProtocolError,
+		Reason:    truncateUTF8(message, maxCloseReasonBytes),
+		Err:       RpcError{Code: ErrProtocolError.Code, Message: message},
+	})
+}
@@ -0,0 +1,136 @@
+package gocapnweb
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	supported := []string{"1.0.0", "1.2.0", "2.0.0"}
+	tests := []struct {
+		name       string
+		minVersion string
+		maxVersion string
+		want       string
+		wantErr    bool
+	}{
+		{"unbounded", "", "", "2.0.0", false},
+		{"range", "1.0.0", "1.9.0", "1.2.0", false},
+		{"short versions", "1", "1.1", "1.0.0", false},
+		{"v prefix", "v2.0.0", "", "2.0.0", false},
+		{"no common version", "3.0.0", "4.0.0", "", true},
+		{"invalid bound", "one", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateVersion(supported, tt.minVersion, tt.maxVersion)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("negotiateVersion(%q, %q) = %q, %v; want %q, error: %v", tt.minVersion, tt.maxVersion, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHello(t *testing.T) {
+	server := endpointServer(t, testTarget())
+	conn := dialEndpoint(t, server, nil)
+	sendMessages(t, conn, `["hello",{"minVersion":"1.0.0","maxVersion":"2.0.0"}]`)
+	if got, want := readFrameWithPrefix(t, conn, `["hello-ack",`), `["hello-ack",{"version":"1.0.0"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := readFrameWithPrefix(t, conn, `["capabilities",`), `["capabilities",{"protocolVersion":"1.0.0","supportedVersions":["1.0.0"]}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The session goes on after the handshake
+	sendMessages(t, conn, `["push",["pipeline",0,["echo"],["hi"]]]`, `["pull",1]`)
+	if got, want := readFrameWithPrefix(t, conn, `["resolve",`), `["resolve",1,"hi"]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHelloProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		reason   string
+	}{
+		{
+			name:     "no common version",
+			messages: []string{`["hello",{"minVersion":"2.0.0","maxVersion":"3.0.0"}]`},
+			reason:   "no common protocol version: server supports 1.0.0",
+		},
+		{
+			name: "repeated hello",
+			messages: []string{
+				`["hello",{"minVersion":"1.0.0"}]`,
+				`["hello",{"minVersion":"1.0.0"}]`,
+			},
+			reason: "hello must be the first message",
+		},
+		{
+			name: "hello after a call",
+			messages: []string{
+				`["push",["pipeline",0,["echo"],["hi"]]]`,
+				`["hello",{"minVersion":"1.0.0"}]`,
+			},
+			reason: "hello must be the first message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var reported []error
+			closed := make(chan struct{})
+			server := endpointServer(t, testTarget(), WithSessionOptions(
+				WithOnError(func(_ *SessionData, err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					reported = append(reported, err)
+				}),
+				WithOnClose(func(*SessionData) { close(closed) }),
+			))
+			conn := dialEndpoint(t, server, nil)
+			sendMessages(t, conn, tt.messages...)
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var err error
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseProtocolError || closeErr.Text != tt.reason {
+				t.Errorf("connection ended with %v, want close 1002 %q", err, tt.reason)
+			}
+
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnClose was not called")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(reported) != 1 || !errors.Is(reported[0], ErrProtocolError) || !strings.Contains(reported[0].Error(), tt.reason) {
+				t.Errorf("OnError got %v, want one ProtocolError", reported)
+			}
+		})
+	}
+}
+
+func TestPullAfterProtocolError(t *testing.T) {
+	target := testTarget()
+	got := handleMessages(t, newTestSession(target), target,
+		`["push",["pipeline",0,["echo"],["hi"]]]`,
+		`["hello",{"minVersion":"1.0.0"}]`,
+		`["pull",1]`,
+	)
+	want := `["reject",1,["error","ProtocolError","hello must be the first message"]]`
+	if strings.Join(got, "\n") != want {
+		t.Errorf("got  %v\nwant %s", got, want)
+	}
+}